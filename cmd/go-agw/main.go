@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"flag"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -11,12 +12,15 @@ import (
 	"time"
 
 	"github.com/kenelite/go-agw/internal/config"
+	"github.com/kenelite/go-agw/internal/consumer"
 	"github.com/kenelite/go-agw/internal/controlplane"
 	"github.com/kenelite/go-agw/internal/listener"
 	"github.com/kenelite/go-agw/internal/observability"
 	"github.com/kenelite/go-agw/internal/plugin"
+	"github.com/kenelite/go-agw/internal/ratelimiter"
 	"github.com/kenelite/go-agw/internal/router"
 	"github.com/kenelite/go-agw/internal/scheduler"
+	"github.com/kenelite/go-agw/internal/tlsutil"
 	"github.com/kenelite/go-agw/internal/upstream"
 )
 
@@ -47,27 +51,70 @@ func main() {
 	if err != nil {
 		logger.Fatalw("failed to init upstream manager", "err", err)
 	}
+	metrics.Register(upstreamMgr)
 
 	sched := scheduler.NewRoundRobin()
 
+	// Consumers (shared by key-auth and the admin API)
+	consumers, err := consumer.NewRegistry(cfg.Consumers)
+	if err != nil {
+		logger.Fatalw("failed to load consumers", "err", err)
+	}
+
 	// Plugins
 	pluginMgr := plugin.NewManager(logger)
+	pluginMgr.SetConsumers(consumers)
 	if err := pluginMgr.Init(cfg.Plugins); err != nil {
 		logger.Fatalw("failed to initialize plugins", "err", err)
 	}
+	if err := pluginMgr.InitRoutes(cfg.Routes); err != nil {
+		logger.Fatalw("failed to initialize route plugins", "err", err)
+	}
 
 	// Router
 	rtr, err := router.NewRouter(cfg.Routes, upstreamMgr, sched, pluginMgr, metrics, logger)
 	if err != nil {
 		logger.Fatalw("failed to init router", "err", err)
 	}
+	if err := rtr.UseServerConfig(cfg.Server); err != nil {
+		logger.Fatalw("failed to apply server config", "err", err)
+	}
+	if err := rtr.UseUpstreams(cfg.Upstreams); err != nil {
+		logger.Fatalw("failed to apply upstream limits", "err", err)
+	}
+	rlBackend, err := ratelimiter.NewBackend(cfg.RateLimitStore, logger)
+	if err != nil {
+		logger.Fatalw("failed to init rate limit store", "err", err)
+	}
+	if c, ok := rlBackend.(observability.Collector); ok {
+		metrics.Register(c)
+	}
+	rtr.UseRateLimitBackend(rlBackend)
+	// response cache outcomes and sizes
+	metrics.Register(pluginMgr)
 
 	// Data plane server
 	dataSrv := listener.NewServer(cfg.Server.HTTPAddr, rtr, logger)
+	if cfg.Server.TLS.CertFile != "" {
+		// routes with their own client_auth need the listener to at least request certificates
+		requestClientCert := false
+		for _, rt := range cfg.Routes {
+			if m := rt.ClientAuth.Mode; m != "" && m != "none" {
+				requestClientCert = true
+			}
+		}
+		tc, err := tlsutil.ServerConfig(cfg.Server.TLS, requestClientCert)
+		if err != nil {
+			logger.Fatalw("failed to init data plane tls", "err", err)
+		}
+		dataSrv.WithTLS(tc)
+	}
 
 	// Admin plane server
 	adminMux := http.NewServeMux()
 	controlplane.RegisterAdminHandlers(adminMux, metrics, cfg, logger)
+	controlplane.RegisterConsumerHandlers(adminMux, consumers, logger)
+	controlplane.RegisterCacheHandlers(adminMux, pluginMgr, logger)
 	adminSrv := &http.Server{Addr: cfg.Server.AdminAddr, Handler: adminMux, ReadHeaderTimeout: 5 * time.Second}
 
 	go func() {
@@ -83,6 +130,22 @@ func main() {
 		}
 	}()
 
+	// SIGHUP reloads hot-reloadable settings (upstreams and their TLS material)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			newCfg, err := config.Load(configPath)
+			if err != nil {
+				logger.Errorw("reload config failed", "err", err)
+				continue
+			}
+			if err := upstreamMgr.Reload(newCfg.Upstreams); err != nil {
+				logger.Errorw("reload upstreams failed", "err", err)
+			}
+		}
+	}()
+
 	// Graceful shutdown
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
@@ -93,4 +156,10 @@ func main() {
 	defer cancel()
 	_ = dataSrv.Shutdown(ctx)
 	_ = adminSrv.Shutdown(ctx)
+	// persists in-memory rate limit state
+	if c, ok := rlBackend.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			logger.Errorw("closing rate limit store failed", "err", err)
+		}
+	}
 }
@@ -0,0 +1,77 @@
+package admission
+
+import (
+	"math"
+	"time"
+)
+
+// Algorithm computes a new concurrency limit after each latency sample. Update is called
+// with the limiter's lock held, so implementations may keep unsynchronised state.
+type Algorithm interface {
+	Update(limit float64, rtt time.Duration, inflight int, dropped bool) float64
+}
+
+// AIMD grows the limit by one for every fast response while the limit is in use, and
+// multiplies it by Backoff when a response is slower than Threshold or dropped.
+type AIMD struct {
+	Threshold time.Duration // default 1s
+	Backoff   float64       // default 0.9
+}
+
+func (a *AIMD) Update(limit float64, rtt time.Duration, inflight int, dropped bool) float64 {
+	threshold, backoff := a.Threshold, a.Backoff
+	if threshold <= 0 {
+		threshold = time.Second
+	}
+	if backoff <= 0 || backoff >= 1 {
+		backoff = 0.9
+	}
+	if dropped || rtt > threshold {
+		return limit * backoff
+	}
+	// only probe upwards when the current limit is actually being used
+	if float64(inflight)*2 >= limit {
+		return limit + 1
+	}
+	return limit
+}
+
+// Gradient compares a short-term latency average with a long-term baseline: while latency
+// stays within Tolerance times the baseline the limit grows by about its square root,
+// and it shrinks in proportion as queueing inflates latency.
+type Gradient struct {
+	Tolerance float64 // accepted latency growth over the baseline, default 2
+	Smoothing float64 // weight of each new limit, default 0.2
+
+	short, long float64 // latency averages in seconds
+}
+
+func (g *Gradient) Update(limit float64, rtt time.Duration, inflight int, dropped bool) float64 {
+	tolerance, smoothing := g.Tolerance, g.Smoothing
+	if tolerance < 1 {
+		tolerance = 2
+	}
+	if smoothing <= 0 || smoothing > 1 {
+		smoothing = 0.2
+	}
+	sample := rtt.Seconds()
+	if g.long == 0 {
+		g.short, g.long = sample, sample
+	}
+	g.short += (sample - g.short) * 0.1
+	g.long += (sample - g.long) * 0.01
+	// let the baseline recover after a sustained shift to slower responses
+	if g.long/g.short > 2 {
+		g.long *= 0.95
+	}
+	gradient := math.Max(0.5, math.Min(1, tolerance*g.long/g.short))
+	if dropped {
+		gradient = 0.5
+	}
+	next := limit*gradient + math.Sqrt(limit)
+	// do not grow far beyond what is in use
+	if float64(inflight)*2 < limit && next > limit {
+		next = limit
+	}
+	return limit*(1-smoothing) + next*smoothing
+}
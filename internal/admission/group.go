@@ -0,0 +1,89 @@
+package admission
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/kenelite/go-agw/internal/config"
+)
+
+// FromConfig builds a Limiter, or returns nil when max_inflight is unset.
+func FromConfig(c config.ConcurrencyConfig) (*Limiter, error) {
+	if c.MaxInflight <= 0 {
+		return nil, nil
+	}
+	opts := Options{
+		MaxInflight:  c.MaxInflight,
+		MaxQueue:     c.MaxQueue,
+		QueueTimeout: time.Duration(c.QueueTimeout) * time.Millisecond,
+		MinInflight:  c.Adaptive.MinInflight,
+		Initial:      c.Adaptive.InitialInflight,
+	}
+	switch c.Adaptive.Algorithm {
+	case "":
+	case "aimd":
+		opts.Algorithm = &AIMD{Threshold: time.Duration(c.Adaptive.LatencyThreshold) * time.Millisecond, Backoff: c.Adaptive.Backoff}
+	case "gradient":
+		opts.Algorithm = &Gradient{Tolerance: c.Adaptive.Tolerance}
+	default:
+		return nil, fmt.Errorf("concurrency: unknown adaptive algorithm %q", c.Adaptive.Algorithm)
+	}
+	return New(opts), nil
+}
+
+// Group reports the state of several limiters in Prometheus text format.
+type Group struct {
+	mu      sync.Mutex
+	members []member
+}
+
+type member struct {
+	scope, name string
+	l           *Limiter
+}
+
+// Add registers l under a scope (route, upstream) and name.
+func (g *Group) Add(scope, name string, l *Limiter) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.members = append(g.members, member{scope: scope, name: name, l: l})
+}
+
+func (g *Group) WriteMetrics(w io.Writer) {
+	g.mu.Lock()
+	members := append([]member(nil), g.members...)
+	g.mu.Unlock()
+	if len(members) == 0 {
+		return
+	}
+	stats := make([]Stats, len(members))
+	for i, m := range members {
+		stats[i] = m.l.Stats()
+	}
+	series := []struct {
+		name, help, typ string
+		value           func(Stats) int64
+	}{
+		{"go_agw_concurrency_limit", "Current concurrency limit", "gauge", func(s Stats) int64 { return int64(s.Limit) }},
+		{"go_agw_concurrency_inflight", "Requests currently admitted", "gauge", func(s Stats) int64 { return int64(s.Inflight) }},
+		{"go_agw_concurrency_queued", "Requests waiting for admission", "gauge", func(s Stats) int64 { return int64(s.Queued) }},
+		{"go_agw_concurrency_admitted_total", "Requests admitted", "counter", func(s Stats) int64 { return s.Admitted }},
+	}
+	for _, sr := range series {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", sr.name, sr.help, sr.name, sr.typ)
+		for i, m := range members {
+			fmt.Fprintf(w, "%s{scope=%q,name=%q} %d\n", sr.name, m.scope, m.name, sr.value(stats[i]))
+		}
+	}
+	fmt.Fprintf(w, "# HELP go_agw_concurrency_shed_total Requests rejected by concurrency limits\n# TYPE go_agw_concurrency_shed_total counter\n")
+	for i, m := range members {
+		for c, cs := range stats[i].Classes {
+			class := Class(c).String()
+			fmt.Fprintf(w, "go_agw_concurrency_shed_total{scope=%q,name=%q,class=%q,reason=\"queue_full\"} %d\n", m.scope, m.name, class, cs.QueueFull)
+			fmt.Fprintf(w, "go_agw_concurrency_shed_total{scope=%q,name=%q,class=%q,reason=\"queue_timeout\"} %d\n", m.scope, m.name, class, cs.Timeouts)
+			fmt.Fprintf(w, "go_agw_concurrency_shed_total{scope=%q,name=%q,class=%q,reason=\"preempted\"} %d\n", m.scope, m.name, class, cs.Preempted)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+// Package admission caps concurrent requests, queueing or shedding the excess.
+package admission
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrQueueFull is returned when the limit is reached and no queue slot is free.
+	ErrQueueFull = errors.New("admission: queue full")
+	// ErrQueueTimeout is returned when a queued request was not admitted in time.
+	ErrQueueTimeout = errors.New("admission: queue timeout")
+	// ErrPreempted is returned when a queued request made room for a higher class.
+	ErrPreempted = errors.New("admission: preempted by higher priority")
+)
+
+// Options configures a Limiter.
+type Options struct {
+	MaxInflight  int           // upper bound of the limit
+	MinInflight  int           // lower bound for adaptive limits, default 1
+	Initial      int           // starting limit for adaptive limits, default MaxInflight
+	MaxQueue     int           // requests allowed to wait; 0 sheds immediately
+	QueueTimeout time.Duration // longest wait in the queue; 0 waits until the request is cancelled
+	// Algorithm adapts the limit from observed latency; nil keeps it at MaxInflight.
+	Algorithm Algorithm
+}
+
+// Limiter admits up to limit concurrent requests. Waiting requests are ordered by class,
+// then by arrival, and a full queue sheds its lowest class first. It is safe for
+// concurrent use.
+type Limiter struct {
+	opts Options
+
+	mu       sync.Mutex
+	limit    float64
+	inflight int
+	queue    []*waiter
+
+	admitted atomic.Int64
+	shed     [NumClasses][numReasons]atomic.Int64
+}
+
+// shed reasons
+const (
+	reasonQueueFull = iota
+	reasonTimeout
+	reasonPreempted
+	numReasons
+)
+
+type waiter struct {
+	class   Class
+	ready   chan struct{}
+	granted bool
+	err     error // set when preempted
+}
+
+// New returns a Limiter. MaxInflight must be positive.
+func New(opts Options) *Limiter {
+	if opts.MinInflight <= 0 {
+		opts.MinInflight = 1
+	}
+	if opts.MinInflight > opts.MaxInflight {
+		opts.MinInflight = opts.MaxInflight
+	}
+	limit := opts.MaxInflight
+	if opts.Algorithm != nil && opts.Initial > 0 {
+		limit = min(max(opts.Initial, opts.MinInflight), opts.MaxInflight)
+	}
+	return &Limiter{opts: opts, limit: float64(limit)}
+}
+
+// Ticket is held by an admitted request until Release.
+type Ticket struct {
+	l       *Limiter
+	start   time.Time
+	sampled bool
+	done    bool
+}
+
+// Acquire admits a request of the given class, waiting in the queue if allowed. It
+// returns ErrQueueFull, ErrQueueTimeout, ErrPreempted or the context's error when the
+// request is not admitted.
+func (l *Limiter) Acquire(ctx context.Context, class Class) (*Ticket, error) {
+	class = min(max(class, Critical), Low)
+	l.mu.Lock()
+	if l.inflight < l.current() && len(l.queue) == 0 {
+		l.inflight++
+		l.mu.Unlock()
+		l.admitted.Add(1)
+		return &Ticket{l: l, start: time.Now()}, nil
+	}
+	if len(l.queue) >= l.opts.MaxQueue {
+		// the tail holds the lowest class; make room if it ranks below this request
+		n := len(l.queue)
+		if n == 0 || l.queue[n-1].class <= class {
+			l.mu.Unlock()
+			l.shed[class][reasonQueueFull].Add(1)
+			return nil, ErrQueueFull
+		}
+		victim := l.queue[n-1]
+		l.queue[n-1] = nil
+		l.queue = l.queue[:n-1]
+		victim.err = ErrPreempted
+		close(victim.ready)
+	}
+	w := &waiter{class: class, ready: make(chan struct{})}
+	l.enqueue(w)
+	l.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if l.opts.QueueTimeout > 0 {
+		t := time.NewTimer(l.opts.QueueTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	var err error
+	select {
+	case <-w.ready:
+		if w.err != nil {
+			l.shed[class][reasonPreempted].Add(1)
+			return nil, w.err
+		}
+	case <-timeout:
+		err = ErrQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		l.mu.Lock()
+		if w.err != nil {
+			err = w.err
+		}
+		if !w.granted {
+			l.removeWaiter(w)
+			l.mu.Unlock()
+			switch err {
+			case ErrQueueTimeout:
+				l.shed[class][reasonTimeout].Add(1)
+			case ErrPreempted:
+				l.shed[class][reasonPreempted].Add(1)
+			}
+			return nil, err
+		}
+		// admitted while giving up: keep the slot
+		l.mu.Unlock()
+	}
+	l.admitted.Add(1)
+	return &Ticket{l: l, start: time.Now()}, nil
+}
+
+// Sample feeds the time since admission to the adaptive algorithm; call it once the
+// upstream has answered. dropped marks failures caused by overload (timeouts, 503).
+func (t *Ticket) Sample(dropped bool) {
+	if t == nil || t.sampled || t.l.opts.Algorithm == nil {
+		return
+	}
+	t.sampled = true
+	rtt := time.Since(t.start)
+	l := t.l
+	l.mu.Lock()
+	next := l.opts.Algorithm.Update(l.limit, rtt, l.inflight, dropped)
+	l.limit = math.Min(math.Max(next, float64(l.opts.MinInflight)), float64(l.opts.MaxInflight))
+	l.dispatch()
+	l.mu.Unlock()
+}
+
+// Release frees the request's slot and admits the next queued request, if any.
+func (t *Ticket) Release() {
+	if t == nil || t.done {
+		return
+	}
+	t.done = true
+	l := t.l
+	l.mu.Lock()
+	l.inflight--
+	l.dispatch()
+	l.mu.Unlock()
+}
+
+// dispatch admits queued requests while there is room. Callers hold mu.
+func (l *Limiter) dispatch() {
+	for len(l.queue) > 0 && l.inflight < l.current() {
+		w := l.queue[0]
+		l.queue[0] = nil
+		l.queue = l.queue[1:]
+		w.granted = true
+		l.inflight++
+		close(w.ready)
+	}
+}
+
+// enqueue inserts w after every waiter of the same or a higher class. Callers hold mu.
+func (l *Limiter) enqueue(w *waiter) {
+	i := len(l.queue)
+	for i > 0 && l.queue[i-1].class > w.class {
+		i--
+	}
+	l.queue = append(l.queue, nil)
+	copy(l.queue[i+1:], l.queue[i:])
+	l.queue[i] = w
+}
+
+func (l *Limiter) removeWaiter(w *waiter) {
+	for i, q := range l.queue {
+		if q == w {
+			l.queue = append(l.queue[:i], l.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+func (l *Limiter) current() int { return int(l.limit) }
+
+// Stats is a point-in-time view of a Limiter. QueueFull, Timeouts and Preempted total
+// the per-class counts in Classes.
+type Stats struct {
+	Limit, Inflight, Queued                  int
+	Admitted, QueueFull, Timeouts, Preempted int64
+	Classes                                  [NumClasses]ClassStats
+}
+
+// ClassStats counts the requests of one class that were shed, by reason.
+type ClassStats struct {
+	QueueFull, Timeouts, Preempted int64
+}
+
+func (l *Limiter) Stats() Stats {
+	l.mu.Lock()
+	s := Stats{Limit: l.current(), Inflight: l.inflight, Queued: len(l.queue)}
+	l.mu.Unlock()
+	s.Admitted = l.admitted.Load()
+	for c := range s.Classes {
+		cs := &s.Classes[c]
+		cs.QueueFull = l.shed[c][reasonQueueFull].Load()
+		cs.Timeouts = l.shed[c][reasonTimeout].Load()
+		cs.Preempted = l.shed[c][reasonPreempted].Load()
+		s.QueueFull += cs.QueueFull
+		s.Timeouts += cs.Timeouts
+		s.Preempted += cs.Preempted
+	}
+	return s
+}
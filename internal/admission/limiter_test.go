@@ -0,0 +1,184 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimiterQueueAndShed(t *testing.T) {
+	l := New(Options{MaxInflight: 1, MaxQueue: 1})
+	first, err := l.Acquire(context.Background(), Normal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan error, 1)
+	go func() {
+		tk, err := l.Acquire(context.Background(), Normal)
+		if err == nil {
+			tk.Release()
+		}
+		got <- err
+	}()
+	for l.Stats().Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := l.Acquire(context.Background(), Normal); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("third request: %v, want ErrQueueFull", err)
+	}
+	first.Release()
+	if err := <-got; err != nil {
+		t.Fatalf("queued request: %v", err)
+	}
+	s := l.Stats()
+	if s.Inflight != 0 || s.Queued != 0 || s.Admitted != 2 || s.QueueFull != 1 {
+		t.Fatalf("stats: %+v", s)
+	}
+}
+
+func TestLimiterQueueTimeout(t *testing.T) {
+	l := New(Options{MaxInflight: 1, MaxQueue: 4, QueueTimeout: 20 * time.Millisecond})
+	tk, _ := l.Acquire(context.Background(), Normal)
+	defer tk.Release()
+	if _, err := l.Acquire(context.Background(), Normal); !errors.Is(err, ErrQueueTimeout) {
+		t.Fatalf("got %v, want ErrQueueTimeout", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.Acquire(ctx, Normal); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if s := l.Stats(); s.Queued != 0 || s.Timeouts != 1 {
+		t.Fatalf("stats: %+v", s)
+	}
+}
+
+func TestAIMD(t *testing.T) {
+	l := New(Options{MaxInflight: 10, MinInflight: 2, Initial: 4, Algorithm: &AIMD{Threshold: time.Second, Backoff: 0.5}})
+	var held []*Ticket
+	for i := 0; i < 4; i++ {
+		tk, err := l.Acquire(context.Background(), Normal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		held = append(held, tk)
+	}
+	held[0].Sample(false)
+	if got := l.Stats().Limit; got != 5 {
+		t.Fatalf("fast response under load should grow the limit to 5, got %d", got)
+	}
+	held[1].Sample(true)
+	if got := l.Stats().Limit; got != 2 {
+		t.Fatalf("dropped response should halve the limit to 2, got %d", got)
+	}
+	held[2].Sample(true)
+	if got := l.Stats().Limit; got != 2 {
+		t.Fatalf("limit should stay at the minimum, got %d", got)
+	}
+	for _, tk := range held {
+		tk.Release()
+	}
+}
+
+func TestGradientShrinksOnLatency(t *testing.T) {
+	g := &Gradient{}
+	limit := 20.0
+	for i := 0; i < 50; i++ {
+		limit = g.Update(limit, 10*time.Millisecond, int(limit), false)
+	}
+	steady := limit
+	for i := 0; i < 50; i++ {
+		limit = g.Update(limit, 200*time.Millisecond, int(limit), false)
+	}
+	if limit >= steady {
+		t.Fatalf("limit %v should fall below %v once latency rises", limit, steady)
+	}
+}
+
+func TestGroupMetrics(t *testing.T) {
+	l := New(Options{MaxInflight: 1})
+	tk, _ := l.Acquire(context.Background(), Normal)
+	_, _ = l.Acquire(context.Background(), Normal)
+	tk.Release()
+	g := &Group{}
+	g.Add("route", "/api", l)
+	var sb strings.Builder
+	g.WriteMetrics(&sb)
+	for _, want := range []string{
+		`go_agw_concurrency_limit{scope="route",name="/api"} 1`,
+		`go_agw_concurrency_admitted_total{scope="route",name="/api"} 1`,
+		`go_agw_concurrency_shed_total{scope="route",name="/api",class="normal",reason="queue_full"} 1`,
+	} {
+		if !strings.Contains(sb.String(), want+"\n") {
+			t.Fatalf("missing %q in:\n%s", want, sb.String())
+		}
+	}
+}
+
+func TestLimiterShedsLowerClassesFirst(t *testing.T) {
+	l := New(Options{MaxInflight: 1, MaxQueue: 2})
+	holder, _ := l.Acquire(context.Background(), Normal)
+
+	type result struct {
+		class Class
+		err   error
+	}
+	results := make(chan result, 4)
+	var order []Class
+	wait := func(c Class) {
+		go func() {
+			tk, err := l.Acquire(context.Background(), c)
+			if err == nil {
+				order = append(order, c) // admitted one at a time, under the single slot
+				tk.Release()
+			}
+			results <- result{c, err}
+		}()
+	}
+	queued := func(n int) {
+		for l.Stats().Queued != n {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	wait(Low)
+	queued(1)
+	wait(Normal)
+	queued(2)
+	// a full queue makes room for higher classes by dropping its lowest one
+	wait(High)
+	if r := <-results; r.class != Low || !errors.Is(r.err, ErrPreempted) {
+		t.Fatalf("low request: %+v, want ErrPreempted", r)
+	}
+	queued(2)
+	// but does not drop an equal class
+	if _, err := l.Acquire(context.Background(), Normal); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("normal request with a full queue: %v", err)
+	}
+	holder.Release()
+	for i := 0; i < 2; i++ {
+		if r := <-results; r.err != nil {
+			t.Fatalf("%v: %v", r.class, r.err)
+		}
+	}
+	if len(order) != 2 || order[0] != High || order[1] != Normal {
+		t.Fatalf("admission order %v, want [high normal]", order)
+	}
+	s := l.Stats()
+	if s.Classes[Low].Preempted != 1 || s.Classes[Normal].QueueFull != 1 || s.Preempted != 1 || s.QueueFull != 1 {
+		t.Fatalf("stats: %+v", s)
+	}
+}
+
+func TestParseClass(t *testing.T) {
+	for _, name := range []string{"critical", "high", "normal", "low"} {
+		c, ok := ParseClass(name)
+		if !ok || c.String() != name {
+			t.Fatalf("%s: got %v %v", name, c, ok)
+		}
+	}
+	if _, ok := ParseClass("urgent"); ok {
+		t.Fatal("unknown class should not parse")
+	}
+}
@@ -0,0 +1,32 @@
+package admission
+
+// Class is a request's priority. Lower values are admitted first and shed last.
+type Class int
+
+const (
+	Critical Class = iota // health checks, control traffic
+	High                  // paid tiers, interactive users
+	Normal
+	Low // batch jobs, crawlers
+
+	NumClasses = int(Low) + 1
+)
+
+var classNames = [NumClasses]string{"critical", "high", "normal", "low"}
+
+func (c Class) String() string {
+	if c < 0 || int(c) >= NumClasses {
+		return "unknown"
+	}
+	return classNames[c]
+}
+
+// ParseClass maps a class name to its Class.
+func ParseClass(s string) (Class, bool) {
+	for i, n := range classNames {
+		if n == s {
+			return Class(i), true
+		}
+	}
+	return Normal, false
+}
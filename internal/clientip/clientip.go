@@ -0,0 +1,136 @@
+package clientip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type ctxKey struct{}
+
+// NewContext stores the resolved client IP for later middleware and plugins.
+func NewContext(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, ip)
+}
+
+func FromContext(ctx context.Context) (string, bool) {
+	ip, ok := ctx.Value(ctxKey{}).(string)
+	return ip, ok && ip != ""
+}
+
+// Resolver determines the real client IP from the peer address and, when the peer is
+// a trusted proxy, from X-Forwarded-For or Forwarded. A nil Resolver trusts nobody.
+type Resolver struct {
+	trusted []*net.IPNet
+}
+
+// NewResolver parses trusted proxy CIDRs; bare IPs are treated as single-host networks.
+func NewResolver(cidrs []string) (*Resolver, error) {
+	r := &Resolver{}
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", c)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			r.trusted = append(r.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", c, err)
+		}
+		r.trusted = append(r.trusted, n)
+	}
+	return r, nil
+}
+
+// Trusted reports whether ip belongs to a trusted proxy network.
+func (r *Resolver) Trusted(ip string) bool {
+	if r == nil {
+		return false
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range r.trusted {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve walks the forwarding chain right to left and returns the first address that
+// is not a trusted proxy. Forwarding headers are ignored unless the peer is trusted.
+func (r *Resolver) Resolve(req *http.Request) string {
+	peer := Host(req.RemoteAddr)
+	if !r.Trusted(peer) {
+		return peer
+	}
+	chain := ForwardedFor(req.Header)
+	if len(chain) == 0 {
+		chain = splitList(req.Header.Values("X-Forwarded-For"))
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		if !r.Trusted(chain[i]) {
+			return chain[i]
+		}
+	}
+	if len(chain) > 0 {
+		return chain[0]
+	}
+	return peer
+}
+
+// Host strips the port from a host:port address.
+func Host(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	return host
+}
+
+// ForwardedFor returns the for= addresses of an RFC 7239 Forwarded header, in order.
+func ForwardedFor(h http.Header) []string {
+	var out []string
+	for _, elem := range splitList(h.Values("Forwarded")) {
+		for _, pair := range strings.Split(elem, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || !strings.EqualFold(k, "for") {
+				continue
+			}
+			v = strings.Trim(v, `"`)
+			if strings.HasPrefix(v, "[") {
+				// "[2001:db8::1]:4711"
+				if end := strings.Index(v, "]"); end > 0 {
+					v = v[1:end]
+				}
+			} else if host, _, err := net.SplitHostPort(v); err == nil {
+				v = host
+			}
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func splitList(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				out = append(out, p)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,88 @@
+package clientip
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	r, err := NewResolver([]string{"10.0.0.0/8", "192.168.1.1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatalf("new resolver: %v", err)
+	}
+	cases := []struct {
+		name, remote, xff, fwd, want string
+	}{
+		{"untrusted peer ignores headers", "1.2.3.4:1000", "9.9.9.9", "", "1.2.3.4"},
+		{"trusted peer uses xff", "10.1.2.3:1000", "5.6.7.8", "", "5.6.7.8"},
+		{"skips trusted hops right to left", "10.1.2.3:1000", "6.6.6.6, 5.6.7.8, 192.168.1.1", "", "5.6.7.8"},
+		{"all trusted falls back to leftmost", "10.1.2.3:1000", "10.0.0.9, 10.0.0.8", "", "10.0.0.9"},
+		{"forwarded header", "[2001:db8::1]:443", "", `for="[2001:db8:cafe::17]:4711", for=10.0.0.2`, "2001:db8:cafe::17"},
+		{"trusted peer without headers", "10.1.2.3:1000", "", "", "10.1.2.3"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "http://agw/", nil)
+		req.RemoteAddr = c.remote
+		if c.xff != "" {
+			req.Header.Set("X-Forwarded-For", c.xff)
+		}
+		if c.fwd != "" {
+			req.Header.Set("Forwarded", c.fwd)
+		}
+		if got := r.Resolve(req); got != c.want {
+			t.Errorf("%s: got %q want %q", c.name, got, c.want)
+		}
+	}
+
+	var nilResolver *Resolver
+	req := httptest.NewRequest("GET", "http://agw/", nil)
+	req.RemoteAddr = "10.1.2.3:1000"
+	req.Header.Set("X-Forwarded-For", "5.6.7.8")
+	if got := nilResolver.Resolve(req); got != "10.1.2.3" {
+		t.Errorf("nil resolver should use the peer address, got %q", got)
+	}
+	if _, err := NewResolver([]string{"not-an-ip"}); err == nil {
+		t.Error("expected error for invalid trusted proxy")
+	}
+}
+
+func TestTrieLongestPrefix(t *testing.T) {
+	tr := NewTrie[string]()
+	for cidr, v := range map[string]string{
+		"10.0.0.0/8":         "deny",
+		"10.1.0.0/16":        "allow",
+		"10.1.2.3":           "deny",
+		"2001:db8::/32":      "deny",
+		"::ffff:1.2.3.0/120": "mapped",
+		"0.0.0.0/0":          "default",
+	} {
+		p, err := ParsePrefix(cidr)
+		if err != nil {
+			t.Fatalf("parse %s: %v", cidr, err)
+		}
+		tr.Insert(p, v)
+	}
+	cases := map[string]string{
+		"10.9.9.9":        "deny",
+		"10.1.9.9":        "allow",
+		"10.1.2.3":        "deny",
+		"::ffff:10.1.9.9": "allow",
+		"1.2.3.4":         "mapped",
+		"8.8.8.8":         "default",
+		"2001:db8::1":     "deny",
+		"2001:db9::1":     "",
+	}
+	for ip, want := range cases {
+		got, ok := tr.Lookup(netip.MustParseAddr(ip))
+		if got != want || ok != (want != "") {
+			t.Errorf("%s: got %q (%v), want %q", ip, got, ok, want)
+		}
+	}
+	if tr.Len() != 6 {
+		t.Fatalf("len = %d", tr.Len())
+	}
+	if _, err := ParsePrefix("10.0.0.0/33"); err == nil {
+		t.Fatal("invalid prefix accepted")
+	}
+}
@@ -0,0 +1,110 @@
+package clientip
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Trie is a binary prefix trie mapping IPv4 and IPv6 networks to values. Lookups return
+// the value of the longest matching prefix. IPv4-mapped IPv6 addresses are treated as IPv4.
+// A Trie is not safe for concurrent mutation; build it once and then share it read-only.
+type Trie[V any] struct {
+	v4, v6 *trieNode[V]
+	n      int
+}
+
+type trieNode[V any] struct {
+	child [2]*trieNode[V]
+	set   bool
+	val   V
+}
+
+func NewTrie[V any]() *Trie[V] {
+	return &Trie[V]{v4: &trieNode[V]{}, v6: &trieNode[V]{}}
+}
+
+// ParsePrefix accepts a CIDR or a bare address (a single-host prefix).
+func ParsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		a, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid address %q", s)
+		}
+		a = a.Unmap()
+		return netip.PrefixFrom(a, a.BitLen()), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR %q", s)
+	}
+	if p.Addr().Is4In6() && p.Bits() >= 96 {
+		p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+	return p.Masked(), nil
+}
+
+// Insert stores v for the prefix, replacing any value stored for exactly that prefix.
+// Prefixes should come from ParsePrefix so that IPv4-mapped networks are normalised.
+func (t *Trie[V]) Insert(p netip.Prefix, v V) {
+	n := t.root(p.Addr())
+	a := p.Addr().AsSlice()
+	for i := 0; i < p.Bits(); i++ {
+		b := a[i/8] >> (7 - i%8) & 1
+		if n.child[b] == nil {
+			n.child[b] = &trieNode[V]{}
+		}
+		n = n.child[b]
+	}
+	if !n.set {
+		t.n++
+	}
+	n.set, n.val = true, v
+}
+
+// Get returns the value stored for exactly the prefix.
+func (t *Trie[V]) Get(p netip.Prefix) (V, bool) {
+	n := t.root(p.Addr())
+	a := p.Addr().AsSlice()
+	for i := 0; i < p.Bits() && n != nil; i++ {
+		n = n.child[a[i/8]>>(7-i%8)&1]
+	}
+	if n == nil || !n.set {
+		var zero V
+		return zero, false
+	}
+	return n.val, true
+}
+
+// Lookup returns the value of the longest prefix containing addr.
+func (t *Trie[V]) Lookup(addr netip.Addr) (V, bool) {
+	var best V
+	found := false
+	if !addr.IsValid() {
+		return best, false
+	}
+	addr = addr.Unmap()
+	n := t.root(addr)
+	a := addr.AsSlice()
+	for i := 0; n != nil; i++ {
+		if n.set {
+			best, found = n.val, true
+		}
+		if i == len(a)*8 {
+			break
+		}
+		n = n.child[a[i/8]>>(7-i%8)&1]
+	}
+	return best, found
+}
+
+// Len returns the number of stored prefixes.
+func (t *Trie[V]) Len() int { return t.n }
+
+func (t *Trie[V]) root(a netip.Addr) *trieNode[V] {
+	if a.Is4() {
+		return t.v4
+	}
+	return t.v6
+}
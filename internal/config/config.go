@@ -8,27 +8,260 @@ import (
 )
 
 type ServerConfig struct {
-	HTTPAddr  string `yaml:"http_addr"`
-	AdminAddr string `yaml:"admin_addr"`
+	HTTPAddr  string    `yaml:"http_addr"`
+	AdminAddr string    `yaml:"admin_addr"`
+	TLS       TLSConfig `yaml:"tls"`
+	// TrustedProxies lists CIDRs (or IPs) whose X-Forwarded-For/Forwarded headers are believed.
+	TrustedProxies   []string               `yaml:"trusted_proxies"`
+	ForwardedHeaders ForwardedHeadersConfig `yaml:"forwarded_headers"`
+}
+
+// ForwardedHeadersConfig controls X-Forwarded-* and Forwarded headers sent upstream.
+type ForwardedHeadersConfig struct {
+	// Policy is one of: append (default; extends the chain from trusted proxies, replaces it otherwise),
+	// replace (always start a new chain), preserve (forward client headers untouched).
+	Policy string `yaml:"policy"`
+	// RFC7239 also emits the standard Forwarded header.
+	RFC7239 bool `yaml:"rfc7239"`
+}
+
+// TLSConfig enables TLS on the data-plane listener when cert_file and key_file are set.
+type TLSConfig struct {
+	CertFile   string           `yaml:"cert_file"`
+	KeyFile    string           `yaml:"key_file"`
+	ClientAuth ClientAuthConfig `yaml:"client_auth"`
+}
+
+// ClientAuthConfig controls client certificate (mTLS) verification.
+// It can be set on the listener (server.tls.client_auth) or per route.
+type ClientAuthConfig struct {
+	// Mode is one of: "" / none, optional (verify if presented), require.
+	Mode     string   `yaml:"mode"`
+	CAFiles  []string `yaml:"ca_files"`
+	CRLFiles []string `yaml:"crl_files"`
+	// AllowedSPIFFEIDs restricts accepted clients by SPIFFE ID; a trailing "*" matches a prefix.
+	AllowedSPIFFEIDs []string `yaml:"allowed_spiffe_ids"`
+	// ForwardClientCert controls X-Forwarded-Client-Cert: sanitize (default), set, append.
+	ForwardClientCert string `yaml:"forward_client_cert"`
 }
 
 type UpstreamConfig struct {
-	Name    string   `yaml:"name"`
-	Targets []string `yaml:"targets"`
-	Timeout int      `yaml:"timeout_ms"`
+	Name        string            `yaml:"name"`
+	Targets     []string          `yaml:"targets"`
+	Timeout     int               `yaml:"timeout_ms"`
+	TLS         UpstreamTLSConfig `yaml:"tls"`
+	Transport   TransportConfig   `yaml:"transport"`
+	HostRewrite HostRewriteConfig `yaml:"host_rewrite"`
+	// Concurrency caps in-flight requests to this upstream across all routes.
+	Concurrency ConcurrencyConfig `yaml:"concurrency"`
+}
+
+// HostRewriteConfig selects the Host header (and TLS SNI) sent upstream.
+// Policy is one of: preserve (client host, default), target (target URL host),
+// fixed (Value as-is) or template (Value with ${host}, ${hostname}, ${target_host}, ${upstream}).
+type HostRewriteConfig struct {
+	Policy string `yaml:"policy"`
+	Value  string `yaml:"value"`
+}
+
+// TransportConfig tunes the connection pool used for an upstream. Zero values keep net/http defaults.
+type TransportConfig struct {
+	ConnectTimeout        int  `yaml:"connect_timeout_ms"`
+	TLSHandshakeTimeout   int  `yaml:"tls_handshake_timeout_ms"`
+	ResponseHeaderTimeout int  `yaml:"response_header_timeout_ms"`
+	IdleConnTimeout       int  `yaml:"idle_conn_timeout_ms"`
+	MaxIdleConns          int  `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost   int  `yaml:"max_idle_conns_per_host"`
+	MaxConnsPerHost       int  `yaml:"max_conns_per_host"`
+	KeepAlive             int  `yaml:"keep_alive_ms"` // TCP keep-alive period; negative disables
+	DisableKeepAlives     bool `yaml:"disable_keep_alives"`
+	// HTTP/2 health checks: send a PING after this much read inactivity and
+	// close the connection if no reply arrives within http2_ping_timeout_ms.
+	HTTP2ReadIdleTimeout int `yaml:"http2_read_idle_timeout_ms"`
+	HTTP2PingTimeout     int `yaml:"http2_ping_timeout_ms"`
+}
+
+// UpstreamTLSConfig controls how go-agw connects to https:// targets.
+type UpstreamTLSConfig struct {
+	CAFile   string `yaml:"ca_file"`
+	CertFile string `yaml:"cert_file"` // client certificate presented to the upstream
+	KeyFile  string `yaml:"key_file"`
+	// ServerName overrides the SNI and the name verified in the upstream certificate.
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"` // development only
+	MinVersion         string `yaml:"min_version"`          // "1.0" to "1.3", default "1.2"
+	// PinnedSHA256 lists base64 SHA-256 hashes of accepted upstream public keys (SPKI).
+	PinnedSHA256 []string `yaml:"pinned_sha256"`
 }
 
 type RouteConfig struct {
-	Path        string          `yaml:"path"`
-	Methods     []string        `yaml:"methods"`
-	UpstreamRef string          `yaml:"upstream"`
-	RateLimit   RateLimitConfig `yaml:"rate_limit"`
-	Plugins     []PluginRef     `yaml:"plugins"`
+	Path        string           `yaml:"path"`
+	Methods     []string         `yaml:"methods"`
+	UpstreamRef string           `yaml:"upstream"`
+	RateLimit   RateLimitConfig  `yaml:"rate_limit"`
+	Plugins     []PluginRef      `yaml:"plugins"`
+	ClientAuth  ClientAuthConfig `yaml:"client_auth"`
+	// HostRewrite overrides the upstream's host_rewrite for this route.
+	HostRewrite HostRewriteConfig `yaml:"host_rewrite"`
+	Upgrade     UpgradeConfig     `yaml:"upgrade"`
+	// Streaming relays responses as they arrive (SSE, long polling) instead of buffering them.
+	// text/event-stream and application/x-ndjson responses are always streamed.
+	Streaming bool `yaml:"streaming"`
+	// IdleTimeout replaces the upstream timeout_ms for streamed responses: the stream is cut
+	// when no data arrives for this long (defaults to the upstream timeout_ms).
+	IdleTimeout int `yaml:"idle_timeout_ms"`
+	// Concurrency caps in-flight requests on this route.
+	Concurrency ConcurrencyConfig `yaml:"concurrency"`
+	// Priority assigns requests a class that decides who is shed first under load.
+	Priority PriorityConfig `yaml:"priority"`
+	// Coalesce collapses concurrent identical requests into one upstream call.
+	Coalesce CoalesceConfig `yaml:"coalesce"`
+	// MaxRequestBodyBytes rejects larger request bodies with 413; 0 means unlimited.
+	MaxRequestBodyBytes int64 `yaml:"max_request_body_bytes"`
+	// RequestBuffering reads the whole request body before contacting the upstream.
+	RequestBuffering RequestBufferingConfig `yaml:"request_buffering"`
+	// Timeouts bound the request and each upstream attempt; they replace the upstream's
+	// timeout_ms for this route.
+	Timeouts TimeoutConfig `yaml:"timeouts"`
+	// Hedge sends a second request to another target when the first one is slow.
+	Hedge HedgeConfig `yaml:"hedge"`
+}
+
+// HedgeConfig sends a duplicate of a slow request to a different target; the first response
+// wins and the other request is cancelled. Only enable it for idempotent routes.
+type HedgeConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Delay is how long the first attempt may run before the hedge is sent. With Percentile
+	// set it is used until enough latencies have been observed. Default 50.
+	Delay int `yaml:"delay_ms"`
+	// Percentile derives the delay from the route's observed latency instead, e.g. 95.
+	Percentile float64 `yaml:"percentile"`
+	// BudgetPercent caps hedges at this share of the route's requests. Default 10.
+	BudgetPercent float64  `yaml:"budget_percent"`
+	Methods       []string `yaml:"methods"` // default GET, HEAD, OPTIONS
+}
+
+// TimeoutConfig sets per-route deadlines. A deadline sent by the client (grpc-timeout, or
+// deadline_header for HTTP) shortens them, and the remaining time is passed upstream.
+type TimeoutConfig struct {
+	Request int `yaml:"request_ms"` // from arrival at the gateway to the full response
+	PerTry  int `yaml:"per_try_ms"` // each upstream attempt; default the upstream timeout_ms
+	// Idle cuts an upstream response, buffered or streamed, after no bytes arrived for this
+	// long. Streams are bounded by it alone once their headers arrive.
+	Idle int `yaml:"idle_ms"`
+	// DeadlineHeader carries the remaining time in milliseconds on HTTP requests, read from
+	// the client and set on the upstream request, e.g. X-Request-Timeout.
+	DeadlineHeader string `yaml:"deadline_header"`
+}
+
+// RequestBufferingConfig makes the gateway receive the full request body first, so that
+// slow uploads do not hold upstream connections and the body can be replayed.
+type RequestBufferingConfig struct {
+	Enabled     bool  `yaml:"enabled"`
+	MemoryBytes int64 `yaml:"memory_bytes"` // default 1 MiB; larger bodies spill to a temp file
+	// TempDir holds spilled bodies (default: the system temp directory).
+	TempDir string `yaml:"temp_dir"`
+	// ReadTimeout bounds receiving the body; slower clients get 408. 0 disables.
+	ReadTimeout int `yaml:"read_timeout_ms"`
+}
+
+// CoalesceConfig shares one upstream response between concurrent requests with the same
+// key. Followers wait up to timeout_ms for the leader and then call the upstream themselves.
+type CoalesceConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Key is a key expression as in rate_limit.limits, e.g. "method+host+path+query+consumer".
+	// Default: method+host+path+query+header:Authorization+header:Cookie.
+	Key     string   `yaml:"key"`
+	Timeout int      `yaml:"timeout_ms"` // default 1000
+	Methods []string `yaml:"methods"`    // default GET, HEAD
+}
+
+// PriorityConfig picks a request's priority class: critical, high, normal or low. The
+// consumer's "priority" metadata wins, then the header, then the route's class.
+type PriorityConfig struct {
+	Class  string `yaml:"class"`  // default normal
+	Header string `yaml:"header"` // e.g. X-Priority; only set it behind a trusted edge
+}
+
+// ConcurrencyConfig caps in-flight requests. Requests beyond the limit wait in a bounded
+// queue for up to queue_timeout_ms and are otherwise shed with 503 and Retry-After.
+type ConcurrencyConfig struct {
+	MaxInflight  int `yaml:"max_inflight"` // 0 disables the limit
+	MaxQueue     int `yaml:"max_queue"`    // 0 sheds as soon as the limit is reached
+	QueueTimeout int `yaml:"queue_timeout_ms"`
+	RetryAfter   int `yaml:"retry_after_ms"` // default 1000
+	// Adaptive moves the limit between min_inflight and max_inflight from observed latency.
+	Adaptive AdaptiveConcurrencyConfig `yaml:"adaptive"`
+}
+
+// AdaptiveConcurrencyConfig selects an algorithm that adjusts the concurrency limit.
+type AdaptiveConcurrencyConfig struct {
+	Algorithm       string `yaml:"algorithm"` // "" (fixed limit), aimd or gradient
+	MinInflight     int    `yaml:"min_inflight"`
+	InitialInflight int    `yaml:"initial_inflight"` // default max_inflight
+	// aimd: responses slower than latency_threshold_ms (default 1000) or failing with
+	// 503/504/timeouts multiply the limit by backoff (default 0.9); others add one.
+	LatencyThreshold int     `yaml:"latency_threshold_ms"`
+	Backoff          float64 `yaml:"backoff"`
+	// gradient: latency may grow to tolerance (default 2) times its long-term average
+	// before the limit shrinks.
+	Tolerance float64 `yaml:"tolerance"`
+}
+
+// UpgradeConfig controls tunnelled HTTP Upgrade (e.g. WebSocket) connections on a route.
+type UpgradeConfig struct {
+	Disabled bool `yaml:"disabled"`
+	// IdleTimeout closes a tunnel after no bytes flowed in either direction; 0 disables.
+	IdleTimeout    int `yaml:"idle_timeout_ms"`
+	MaxConnections int `yaml:"max_connections"` // open tunnels on this route; 0 = unlimited
 }
 
 type RateLimitConfig struct {
+	// RequestsPerSecond and Burst form a per-second limit keyed by client (consumer or IP) and path.
 	RequestsPerSecond int `yaml:"rps"`
 	Burst             int `yaml:"burst"`
+	// Limits are enforced together with rps: a request must fit every one of them.
+	Limits []RateLimitRule `yaml:"limits"`
+	// HideHeaders omits the RateLimit-Limit/Remaining/Reset response headers.
+	HideHeaders bool `yaml:"hide_headers"`
+}
+
+// RateLimitRule allows Requests per Window for each distinct value of Key. Key joins terms
+// with "+": ip, consumer, client (consumer, else IP), header:<name>, claim:<name>, route,
+// path, template:/users/{id} (paths matching the template share a bucket). Default: client.
+type RateLimitRule struct {
+	Name     string `yaml:"name"`
+	Key      string `yaml:"key"`
+	Requests int    `yaml:"requests"`
+	Window   int    `yaml:"window_ms"` // default 1000
+	Burst    int    `yaml:"burst"`     // default requests; token_bucket only
+	// Algorithm is token_bucket (default), fixed_window, sliding_window or sliding_log.
+	Algorithm string `yaml:"algorithm"`
+	// Period replaces window_ms: second, minute, hour, day, week or month. Fixed month
+	// windows follow the calendar (UTC); other algorithms treat a month as 30 days.
+	Period string `yaml:"period"`
+}
+
+// RateLimitStoreConfig selects where rate limit state lives. With type redis, state is shared
+// between gateway replicas through a Redis-compatible server; while it is unreachable each
+// replica falls back to limiting on its own and retries the store every retry_interval_ms.
+type RateLimitStoreConfig struct {
+	Type          string `yaml:"type"` // memory (default) | redis
+	Addr          string `yaml:"addr"`
+	Password      string `yaml:"password"`
+	DB            int    `yaml:"db"`
+	Timeout       int    `yaml:"timeout_ms"` // dial and command deadline, default 100
+	KeyPrefix     string `yaml:"key_prefix"` // default "agw:rl:"
+	PoolSize      int    `yaml:"pool_size"`
+	RetryInterval int    `yaml:"retry_interval_ms"` // default 1000
+	// PersistFile keeps in-memory state across restarts (type memory only); it is saved
+	// every persist_interval_ms (default 10000) and on shutdown.
+	PersistFile     string `yaml:"persist_file"`
+	PersistInterval int    `yaml:"persist_interval_ms"`
+	// MaxKeys caps the keys tracked in process (memory store and the redis fallback); the
+	// least recently used key is evicted beyond it. Idle keys are swept every sweep_interval_ms.
+	MaxKeys       int `yaml:"max_keys"`          // default 1048576
+	SweepInterval int `yaml:"sweep_interval_ms"` // default 60000
 }
 
 type PluginRef struct {
@@ -44,12 +277,26 @@ type PluginsConfig struct {
 	Available []PluginRef `yaml:"available"`
 }
 
+// ConsumerConfig declares a named API client and its credentials.
+type ConsumerConfig struct {
+	Name     string            `yaml:"name"`
+	Groups   []string          `yaml:"groups"`
+	Metadata map[string]string `yaml:"metadata"`
+	// APIKeyHashes are "sha256:<hex>" digests of the consumer's API keys.
+	APIKeyHashes []string `yaml:"api_key_hashes"`
+	// APIKeys are plaintext keys, hashed on load; prefer api_key_hashes.
+	APIKeys []string `yaml:"api_keys" json:"-"`
+}
+
 type Config struct {
 	Server        ServerConfig        `yaml:"server"`
 	Upstreams     []UpstreamConfig    `yaml:"upstreams"`
 	Routes        []RouteConfig       `yaml:"routes"`
 	Observability ObservabilityConfig `yaml:"observability"`
 	Plugins       PluginsConfig       `yaml:"plugins"`
+	Consumers     []ConsumerConfig    `yaml:"consumers"`
+	// RateLimitStore selects where rate limit buckets live (default: in process).
+	RateLimitStore RateLimitStoreConfig `yaml:"rate_limit_store"`
 }
 
 func Load(path string) (*Config, error) {
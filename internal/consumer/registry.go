@@ -0,0 +1,190 @@
+package consumer
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kenelite/go-agw/internal/config"
+)
+
+// Consumer is a named API client. Values returned by the registry are snapshots
+// and must not be modified.
+type Consumer struct {
+	Name      string            `json:"name"`
+	Groups    []string          `json:"groups,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	KeyHashes []string          `json:"api_key_hashes,omitempty"`
+}
+
+// InGroup reports whether the consumer belongs to any of the groups.
+func (c *Consumer) InGroup(groups ...string) bool {
+	for _, g := range c.Groups {
+		for _, want := range groups {
+			if g == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var ErrNotFound = errors.New("consumer not found")
+
+const hashPrefix = "sha256:"
+
+// HashKey returns the at-rest form of an API key.
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hashPrefix + hex.EncodeToString(sum[:])
+}
+
+// GenerateKey returns a new random API key.
+func GenerateKey() (string, error) {
+	var b [24]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// Registry holds consumers and resolves API keys to them. Only key hashes are stored.
+type Registry struct {
+	mu        sync.RWMutex
+	consumers map[string]*Consumer
+	keys      map[string]string // key hash -> consumer name
+}
+
+func NewRegistry(cfgs []config.ConsumerConfig) (*Registry, error) {
+	r := &Registry{consumers: map[string]*Consumer{}, keys: map[string]string{}}
+	for _, cc := range cfgs {
+		hashes := append([]string(nil), cc.APIKeyHashes...)
+		for _, k := range cc.APIKeys {
+			hashes = append(hashes, HashKey(k))
+		}
+		if err := r.Put(Consumer{Name: cc.Name, Groups: cc.Groups, Metadata: cc.Metadata, KeyHashes: hashes}); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Put creates or replaces a consumer together with its key hashes.
+func (r *Registry) Put(c Consumer) error {
+	if c.Name == "" {
+		return errors.New("consumer name required")
+	}
+	c.KeyHashes = append([]string(nil), c.KeyHashes...)
+	for i, h := range c.KeyHashes {
+		h = strings.ToLower(h)
+		if !strings.HasPrefix(h, hashPrefix) || len(h) != len(hashPrefix)+64 {
+			return fmt.Errorf("consumer %s: invalid key hash %q", c.Name, h)
+		}
+		c.KeyHashes[i] = h
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, h := range c.KeyHashes {
+		if owner, ok := r.keys[h]; ok && owner != c.Name {
+			return fmt.Errorf("consumer %s: api key already assigned to %s", c.Name, owner)
+		}
+	}
+	r.removeLocked(c.Name)
+	r.consumers[c.Name] = &c
+	for _, h := range c.KeyHashes {
+		r.keys[h] = c.Name
+	}
+	return nil
+}
+
+// AddKey generates a new API key for an existing consumer and returns it in plaintext;
+// only its hash is kept.
+func (r *Registry) AddKey(name string) (string, error) {
+	key, err := GenerateKey()
+	if err != nil {
+		return "", err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.consumers[name]
+	if !ok {
+		return "", ErrNotFound
+	}
+	next := *c
+	next.KeyHashes = append(append([]string(nil), c.KeyHashes...), HashKey(key))
+	r.consumers[name] = &next
+	r.keys[HashKey(key)] = name
+	return key, nil
+}
+
+func (r *Registry) Delete(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.consumers[name]; !ok {
+		return ErrNotFound
+	}
+	r.removeLocked(name)
+	return nil
+}
+
+func (r *Registry) removeLocked(name string) {
+	if old, ok := r.consumers[name]; ok {
+		for _, h := range old.KeyHashes {
+			delete(r.keys, h)
+		}
+		delete(r.consumers, name)
+	}
+}
+
+func (r *Registry) Get(name string) (*Consumer, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c, ok := r.consumers[name]
+	return c, ok
+}
+
+// List returns all consumers sorted by name.
+func (r *Registry) List() []*Consumer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make([]*Consumer, 0, len(r.consumers))
+	for _, c := range r.consumers {
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Lookup resolves a plaintext API key to its consumer.
+func (r *Registry) Lookup(apiKey string) (*Consumer, bool) {
+	if apiKey == "" {
+		return nil, false
+	}
+	h := HashKey(apiKey)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	name, ok := r.keys[h]
+	if !ok {
+		return nil, false
+	}
+	c, ok := r.consumers[name]
+	return c, ok
+}
+
+type ctxKey struct{}
+
+// NewContext attaches the authenticated consumer to a request context.
+func NewContext(ctx context.Context, c *Consumer) context.Context {
+	return context.WithValue(ctx, ctxKey{}, c)
+}
+
+func FromContext(ctx context.Context) (*Consumer, bool) {
+	c, ok := ctx.Value(ctxKey{}).(*Consumer)
+	return c, ok && c != nil
+}
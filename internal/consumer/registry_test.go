@@ -0,0 +1,71 @@
+package consumer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kenelite/go-agw/internal/config"
+)
+
+func TestRegistryLookup(t *testing.T) {
+	reg, err := NewRegistry([]config.ConsumerConfig{
+		{Name: "alice", Groups: []string{"paid"}, APIKeys: []string{"k-alice"}},
+		{Name: "bob", APIKeyHashes: []string{HashKey("k-bob")}},
+	})
+	if err != nil {
+		t.Fatalf("new registry: %v", err)
+	}
+	if c, ok := reg.Lookup("k-alice"); !ok || c.Name != "alice" || !c.InGroup("paid") {
+		t.Fatalf("lookup alice: %v %v", c, ok)
+	}
+	if c, ok := reg.Lookup("k-bob"); !ok || c.Name != "bob" {
+		t.Fatalf("lookup bob: %v %v", c, ok)
+	}
+	if _, ok := reg.Lookup("nope"); ok {
+		t.Fatal("unknown key resolved")
+	}
+	for _, c := range reg.List() {
+		for _, h := range c.KeyHashes {
+			if h == "k-alice" || h == "k-bob" {
+				t.Fatal("plaintext key stored")
+			}
+		}
+	}
+
+	key, err := reg.AddKey("bob")
+	if err != nil {
+		t.Fatalf("add key: %v", err)
+	}
+	if c, ok := reg.Lookup(key); !ok || c.Name != "bob" {
+		t.Fatal("generated key not resolvable")
+	}
+	if _, err := reg.AddKey("carol"); err != ErrNotFound {
+		t.Fatalf("add key to unknown consumer: %v", err)
+	}
+
+	// replacing a consumer drops its old keys; a key can belong to one consumer only
+	if err := reg.Put(Consumer{Name: "bob", KeyHashes: []string{HashKey("k-bob2")}}); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if _, ok := reg.Lookup("k-bob"); ok {
+		t.Fatal("old key still valid after replace")
+	}
+	if err := reg.Put(Consumer{Name: "eve", KeyHashes: []string{HashKey("k-alice")}}); err == nil {
+		t.Fatal("duplicate key accepted")
+	}
+	if err := reg.Put(Consumer{Name: "eve", KeyHashes: []string{"plain"}}); err == nil {
+		t.Fatal("malformed hash accepted")
+	}
+
+	if err := reg.Delete("alice"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, ok := reg.Lookup("k-alice"); ok {
+		t.Fatal("deleted consumer still resolvable")
+	}
+
+	ctx := NewContext(context.Background(), &Consumer{Name: "x"})
+	if c, ok := FromContext(ctx); !ok || c.Name != "x" {
+		t.Fatal("context round trip failed")
+	}
+}
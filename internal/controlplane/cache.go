@@ -0,0 +1,73 @@
+package controlplane
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/kenelite/go-agw/internal/observability"
+	"github.com/kenelite/go-agw/internal/plugin"
+)
+
+// purgeRequest is the body accepted by POST /cache/purge; exactly one field is set.
+type purgeRequest struct {
+	Key    string `json:"key"`
+	Prefix string `json:"prefix"`
+	Tag    string `json:"tag"`
+	Zone   string `json:"zone"` // optional: limit the purge to one cache
+}
+
+// RegisterCacheHandlers exposes the response caches:
+//
+//	GET  /cache        entries, size and outcome counts per cache zone
+//	POST /cache/purge  remove entries by {"key": "GET example.com/items?id=1"},
+//	                   {"prefix": "GET example.com/items"} or {"tag": "product:42"}
+func RegisterCacheHandlers(mux *http.ServeMux, pm *plugin.Manager, logger *observability.Logger) {
+	mux.Handle("/cache", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		stats := []plugin.CacheStats{}
+		for _, c := range pm.Caches() {
+			stats = append(stats, c.Stats())
+		}
+		writeJSON(w, http.StatusOK, stats)
+	}))
+	mux.Handle("/cache/purge", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var body purgeRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil {
+			http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		var kind, value string
+		set := 0
+		for _, f := range []struct{ kind, value string }{{"key", body.Key}, {"prefix", body.Prefix}, {"tag", body.Tag}} {
+			if f.value != "" {
+				kind, value = f.kind, f.value
+				set++
+			}
+		}
+		if set != 1 {
+			http.Error(w, "exactly one of key, prefix or tag is required", http.StatusBadRequest)
+			return
+		}
+		purged := map[string]int{}
+		for _, c := range pm.Caches() {
+			if body.Zone != "" && c.Zone() != body.Zone {
+				continue
+			}
+			n, err := c.Purge(kind, value)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			purged[c.Zone()] += n
+		}
+		logger.Infow("cache purged", kind, value, "zone", body.Zone)
+		writeJSON(w, http.StatusOK, map[string]any{"purged": purged})
+	}))
+}
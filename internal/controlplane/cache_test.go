@@ -0,0 +1,58 @@
+package controlplane
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kenelite/go-agw/internal/config"
+	"github.com/kenelite/go-agw/internal/observability"
+	"github.com/kenelite/go-agw/internal/plugin"
+)
+
+func TestCacheHandlers(t *testing.T) {
+	logger := observability.NewLogger(nil)
+	pm := plugin.NewManager(logger)
+	_ = pm.Init(config.PluginsConfig{Available: []config.PluginRef{{Name: "cache", Config: map[string]any{"zone": "edge"}}}})
+	if len(pm.Caches()) != 1 {
+		t.Fatal("cache plugin not loaded")
+	}
+	// fill the cache through the plugin
+	cache := pm.Caches()[0]
+	for _, path := range []string{"/a", "/b"} {
+		req := httptest.NewRequest(http.MethodGet, "http://api"+path, nil)
+		prc := &plugin.RequestContext{Context: req.Context(), Writer: httptest.NewRecorder(), Request: req}
+		_, _ = cache.BeforeDispatch(prc)
+		prc.Response = &plugin.Response{StatusCode: http.StatusOK, Header: http.Header{"Cache-Control": {"max-age=60"}, "Cache-Tag": {"t" + path[1:]}}}
+		cache.AfterDispatch(prc)
+	}
+
+	mux := http.NewServeMux()
+	RegisterCacheHandlers(mux, pm, logger)
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, "http://admin"+path, strings.NewReader(body)))
+		return rec
+	}
+	var stats []plugin.CacheStats
+	if rec := do(http.MethodGet, "/cache", ""); json.Unmarshal(rec.Body.Bytes(), &stats) != nil || len(stats) != 1 || stats[0].Entries != 2 {
+		t.Fatalf("stats: %s", rec.Body)
+	}
+	var out struct{ Purged map[string]int }
+	rec := do(http.MethodPost, "/cache/purge", `{"tag":"ta"}`)
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &out) != nil || out.Purged["edge"] != 1 {
+		t.Fatalf("purge by tag: %d %s", rec.Code, rec.Body)
+	}
+	rec = do(http.MethodPost, "/cache/purge", `{"key":"GET api/b"}`)
+	if json.Unmarshal(rec.Body.Bytes(), &out) != nil || out.Purged["edge"] != 1 {
+		t.Fatalf("purge by key: %s", rec.Body)
+	}
+	if rec := do(http.MethodPost, "/cache/purge", `{"key":"x","tag":"y"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("ambiguous purge: %d", rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/cache/purge", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("method: %d", rec.Code)
+	}
+}
@@ -0,0 +1,105 @@
+package controlplane
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/kenelite/go-agw/internal/consumer"
+	"github.com/kenelite/go-agw/internal/observability"
+)
+
+// consumerRequest is the body accepted by PUT /consumers/{name}. Plaintext api_keys are
+// hashed before they are stored.
+type consumerRequest struct {
+	Groups       []string          `json:"groups"`
+	Metadata     map[string]string `json:"metadata"`
+	APIKeys      []string          `json:"api_keys"`
+	APIKeyHashes []string          `json:"api_key_hashes"`
+}
+
+// RegisterConsumerHandlers exposes consumer management:
+//
+//	GET    /consumers              list consumers
+//	GET    /consumers/{name}       show one consumer
+//	PUT    /consumers/{name}       create or replace a consumer
+//	DELETE /consumers/{name}       remove a consumer
+//	POST   /consumers/{name}/keys  issue a new API key (returned once, stored hashed)
+func RegisterConsumerHandlers(mux *http.ServeMux, reg *consumer.Registry, logger *observability.Logger) {
+	mux.Handle("/consumers", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, reg.List())
+	}))
+	mux.Handle("/consumers/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.TrimPrefix(r.URL.Path, "/consumers/")
+		name, sub, _ := strings.Cut(rest, "/")
+		if name == "" {
+			http.NotFound(w, r)
+			return
+		}
+		switch {
+		case sub == "keys" && r.Method == http.MethodPost:
+			key, err := reg.AddKey(name)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			logger.Infow("consumer api key issued", "consumer", name)
+			writeJSON(w, http.StatusCreated, map[string]string{"api_key": key, "api_key_hash": consumer.HashKey(key)})
+		case sub != "":
+			http.NotFound(w, r)
+		case r.Method == http.MethodGet:
+			c, ok := reg.Get(name)
+			if !ok {
+				writeError(w, consumer.ErrNotFound)
+				return
+			}
+			writeJSON(w, http.StatusOK, c)
+		case r.Method == http.MethodPut:
+			var body consumerRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil {
+				http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			hashes := body.APIKeyHashes
+			for _, k := range body.APIKeys {
+				hashes = append(hashes, consumer.HashKey(k))
+			}
+			c := consumer.Consumer{Name: name, Groups: body.Groups, Metadata: body.Metadata, KeyHashes: hashes}
+			if err := reg.Put(c); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logger.Infow("consumer updated", "consumer", name)
+			stored, _ := reg.Get(name)
+			writeJSON(w, http.StatusOK, stored)
+		case r.Method == http.MethodDelete:
+			if err := reg.Delete(name); err != nil {
+				writeError(w, err)
+				return
+			}
+			logger.Infow("consumer deleted", "consumer", name)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, consumer.ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,58 @@
+package controlplane
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kenelite/go-agw/internal/consumer"
+	"github.com/kenelite/go-agw/internal/observability"
+)
+
+func TestConsumerHandlers(t *testing.T) {
+	reg, _ := consumer.NewRegistry(nil)
+	mux := http.NewServeMux()
+	RegisterConsumerHandlers(mux, reg, observability.NewLogger(nil))
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, "http://admin"+path, strings.NewReader(body)))
+		return rec
+	}
+
+	if rec := do(http.MethodPut, "/consumers/alice", `{"groups":["paid"],"api_keys":["k-alice"]}`); rec.Code != http.StatusOK {
+		t.Fatalf("put: %d %s", rec.Code, rec.Body)
+	} else if strings.Contains(rec.Body.String(), "k-alice") {
+		t.Fatal("plaintext key echoed back")
+	}
+	if c, ok := reg.Lookup("k-alice"); !ok || c.Name != "alice" {
+		t.Fatal("consumer not stored")
+	}
+
+	rec := do(http.MethodPost, "/consumers/alice/keys", "")
+	var issued map[string]string
+	if rec.Code != http.StatusCreated || json.Unmarshal(rec.Body.Bytes(), &issued) != nil {
+		t.Fatalf("issue key: %d %s", rec.Code, rec.Body)
+	}
+	if _, ok := reg.Lookup(issued["api_key"]); !ok {
+		t.Fatal("issued key not usable")
+	}
+
+	var list []consumer.Consumer
+	if rec := do(http.MethodGet, "/consumers", ""); json.Unmarshal(rec.Body.Bytes(), &list) != nil || len(list) != 1 || len(list[0].KeyHashes) != 2 {
+		t.Fatalf("list: %s", rec.Body)
+	}
+	if rec := do(http.MethodGet, "/consumers/bob", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("get unknown: %d", rec.Code)
+	}
+	if rec := do(http.MethodPut, "/consumers/bob", `{"api_key_hashes":["bogus"]}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("bad hash: %d", rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/consumers/alice", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d", rec.Code)
+	}
+	if _, ok := reg.Lookup("k-alice"); ok {
+		t.Fatal("deleted consumer still resolvable")
+	}
+}
@@ -0,0 +1,311 @@
+// Package geoip reads MaxMind DB (.mmdb) files such as GeoLite2-Country.
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+)
+
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// DB is an opened MaxMind database held in memory. It is safe for concurrent use.
+type DB struct {
+	buf        []byte
+	data       []byte // data section
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint
+	// DatabaseType is the metadata database_type, e.g. "GeoLite2-Country".
+	DatabaseType string
+}
+
+// Open reads and validates a database file.
+func Open(path string) (*DB, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return New(buf)
+}
+
+// New parses a database from memory.
+func New(buf []byte) (*DB, error) {
+	i := bytes.LastIndex(buf, metadataMarker)
+	if i < 0 {
+		return nil, errors.New("mmdb: metadata marker not found")
+	}
+	d := &decoder{buf: buf[i+len(metadataMarker):]}
+	v, _, err := d.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("mmdb: metadata: %w", err)
+	}
+	meta, ok := v.(map[string]any)
+	if !ok {
+		return nil, errors.New("mmdb: metadata is not a map")
+	}
+	db := &DB{buf: buf}
+	db.nodeCount = uintOf(meta["node_count"])
+	db.recordSize = uintOf(meta["record_size"])
+	db.ipVersion = uintOf(meta["ip_version"])
+	db.DatabaseType, _ = meta["database_type"].(string)
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("mmdb: unsupported record size %d", db.recordSize)
+	}
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, errors.New("mmdb: search tree exceeds file size")
+	}
+	db.data = buf[treeSize+16 : i]
+	if db.ipVersion == 6 {
+		// IPv4 addresses live under ::/96
+		node := uint(0)
+		for j := 0; j < 96 && node < db.nodeCount; j++ {
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+// Lookup returns the data record for addr, or nil when the address is not in the database.
+func (db *DB) Lookup(addr netip.Addr) (any, error) {
+	addr = addr.Unmap()
+	node := uint(0)
+	bits := addr.AsSlice()
+	if addr.Is4() && db.ipVersion == 6 {
+		node = db.ipv4Start
+	} else if !addr.Is4() && db.ipVersion == 4 {
+		return nil, nil
+	}
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, uint(bits[i/8]>>(7-i%8)&1))
+	}
+	switch {
+	case node == db.nodeCount:
+		return nil, nil
+	case node < db.nodeCount:
+		return nil, errors.New("mmdb: invalid search tree")
+	}
+	off := node - db.nodeCount - 16
+	if off >= uint(len(db.data)) {
+		return nil, errors.New("mmdb: invalid data pointer")
+	}
+	d := &decoder{buf: db.data}
+	v, _, err := d.decode(off)
+	return v, err
+}
+
+// Country returns the ISO 3166 country code for addr, falling back to the registered country.
+func (db *DB) Country(addr netip.Addr) (string, bool) {
+	v, err := db.Lookup(addr)
+	if err != nil || v == nil {
+		return "", false
+	}
+	rec, _ := v.(map[string]any)
+	for _, key := range []string{"country", "registered_country"} {
+		if c, ok := rec[key].(map[string]any); ok {
+			if iso, ok := c["iso_code"].(string); ok && iso != "" {
+				return iso, true
+			}
+		}
+	}
+	return "", false
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a search tree node.
+func (db *DB) record(node, bit uint) uint {
+	switch db.recordSize {
+	case 24:
+		o := node*6 + bit*3
+		b := db.buf[o : o+3]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		o := node * 7
+		b := db.buf[o : o+7]
+		if bit == 0 {
+			return uint(b[3]>>4)<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		o := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(db.buf[o : o+4]))
+	}
+}
+
+// decoder reads the MaxMind data section format.
+type decoder struct{ buf []byte }
+
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+var errTruncated = errors.New("mmdb: truncated data")
+
+// decode returns the value at off and the offset just past it.
+func (d *decoder) decode(off uint) (any, uint, error) {
+	return d.decodeDepth(off, 0)
+}
+
+func (d *decoder) decodeDepth(off uint, depth int) (any, uint, error) {
+	if depth > 32 {
+		return nil, 0, errors.New("mmdb: data nested too deeply")
+	}
+	if off >= uint(len(d.buf)) {
+		return nil, 0, errTruncated
+	}
+	ctrl := d.buf[off]
+	off++
+	typ := int(ctrl >> 5)
+	if typ == typePointer {
+		ptr, next, err := d.pointer(ctrl, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decodeDepth(ptr, depth+1)
+		return v, next, err
+	}
+	if typ == typeExtended {
+		if off >= uint(len(d.buf)) {
+			return nil, 0, errTruncated
+		}
+		typ = 7 + int(d.buf[off])
+		off++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 && typ != typeBool {
+		n := size - 28
+		if off+n > uint(len(d.buf)) {
+			return nil, 0, errTruncated
+		}
+		v := uint(0)
+		for _, b := range d.buf[off : off+n] {
+			v = v<<8 | uint(b)
+		}
+		off += n
+		switch size {
+		case 29:
+			size = 29 + v
+		case 30:
+			size = 285 + v
+		default:
+			size = 65821 + v
+		}
+	}
+	switch typ {
+	case typeMap:
+		m := make(map[string]any, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decodeDepth(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			v, next, err := d.decodeDepth(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, _ := k.(string)
+			m[key] = v
+			off = next
+		}
+		return m, off, nil
+	case typeArray:
+		a := make([]any, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decodeDepth(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			off = next
+		}
+		return a, off, nil
+	case typeBool:
+		return size != 0, off, nil
+	}
+	if off+size > uint(len(d.buf)) {
+		return nil, 0, errTruncated
+	}
+	b := d.buf[off : off+size]
+	off += size
+	switch typ {
+	case typeString:
+		return string(b), off, nil
+	case typeBytes:
+		return append([]byte(nil), b...), off, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errors.New("mmdb: bad double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errors.New("mmdb: bad float")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), off, nil
+	case typeUint16, typeUint32, typeUint64:
+		v := uint64(0)
+		for _, x := range b {
+			v = v<<8 | uint64(x)
+		}
+		return v, off, nil
+	case typeInt32:
+		v := uint32(0)
+		for _, x := range b {
+			v = v<<8 | uint32(x)
+		}
+		return int64(int32(v)), off, nil
+	case typeUint128:
+		// not needed for lookups; keep the raw bytes
+		return append([]byte(nil), b...), off, nil
+	}
+	return nil, 0, fmt.Errorf("mmdb: unsupported data type %d", typ)
+}
+
+func (d *decoder) pointer(ctrl byte, off uint) (uint, uint, error) {
+	size := uint(ctrl>>3) & 3
+	n := size + 1
+	if off+n > uint(len(d.buf)) {
+		return 0, 0, errTruncated
+	}
+	b := d.buf[off : off+n]
+	var v uint
+	switch size {
+	case 0:
+		v = uint(ctrl&7)<<8 | uint(b[0])
+	case 1:
+		v = (uint(ctrl&7)<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+	case 2:
+		v = (uint(ctrl&7)<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+	default:
+		v = uint(binary.BigEndian.Uint32(b))
+	}
+	return v, off + n, nil
+}
+
+func uintOf(v any) uint {
+	if n, ok := v.(uint64); ok {
+		return uint(n)
+	}
+	return 0
+}
@@ -0,0 +1,143 @@
+package geoip
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mmdbWriter builds tiny IPv6 databases (24-bit records) for tests.
+type mmdbWriter struct {
+	root *wnode
+	data []byte
+}
+
+type wnode struct {
+	child [2]*wnode
+	data  int // data offset + 1 for leaves
+}
+
+func encString(s string) []byte { return append([]byte{2<<5 | byte(len(s))}, s...) }
+
+func encMap(kv ...[]byte) []byte {
+	out := []byte{7<<5 | byte(len(kv)/2)}
+	for _, b := range kv {
+		out = append(out, b...)
+	}
+	return out
+}
+
+func encUint(typ byte, v uint32) []byte {
+	b := binary.BigEndian.AppendUint32(nil, v)
+	return append([]byte{typ<<5 | 4}, b...)
+}
+
+// add stores an encoded data record for prefix and returns its offset in the data section.
+func (w *mmdbWriter) add(prefix string, data []byte) int {
+	p := netip.MustParsePrefix(prefix)
+	a, bits := p.Addr().As16(), p.Bits()
+	if p.Addr().Is4() {
+		// IPv4 lives under ::/96, not ::ffff:0:0/96
+		a = [16]byte{}
+		v4 := p.Addr().As4()
+		copy(a[12:], v4[:])
+		bits += 96
+	}
+	if w.root == nil {
+		w.root = &wnode{}
+	}
+	n := w.root
+	for i := 0; i < bits; i++ {
+		b := a[i/8] >> (7 - i%8) & 1
+		if n.child[b] == nil {
+			n.child[b] = &wnode{}
+		}
+		n = n.child[b]
+	}
+	off := len(w.data)
+	w.data = append(w.data, data...)
+	n.data = off + 1
+	return off
+}
+
+func (w *mmdbWriter) bytes() []byte {
+	var nodes []*wnode
+	var walk func(n *wnode)
+	walk = func(n *wnode) {
+		if n == nil || n.data != 0 {
+			return
+		}
+		nodes = append(nodes, n)
+		walk(n.child[0])
+		walk(n.child[1])
+	}
+	walk(w.root)
+	index := map[*wnode]int{}
+	for i, n := range nodes {
+		index[n] = i
+	}
+	count := len(nodes)
+	var out []byte
+	for _, n := range nodes {
+		for _, c := range n.child {
+			v := count
+			switch {
+			case c == nil:
+			case c.data != 0:
+				v = count + 16 + c.data - 1
+			default:
+				v = index[c]
+			}
+			out = append(out, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	out = append(out, make([]byte, 16)...)
+	out = append(out, w.data...)
+	out = append(out, metadataMarker...)
+	return append(out, encMap(
+		encString("node_count"), encUint(6, uint32(count)),
+		encString("record_size"), encUint(5, 24),
+		encString("ip_version"), encUint(5, 6),
+		encString("database_type"), encString("Test-Country"),
+	)...)
+}
+
+func TestDBCountry(t *testing.T) {
+	w := &mmdbWriter{}
+	us := w.add("8.8.8.0/24", encMap(encString("country"), encMap(encString("iso_code"), encString("US"))))
+	// pointer to the US record's country map (type 1, 11-bit offset)
+	ptr := us + 1 + len(encString("country"))
+	w.add("9.9.0.0/16", encMap(encString("registered_country"), []byte{1 << 5, byte(ptr)}))
+	w.add("2001:db8::/32", encMap(encString("country"), encMap(encString("iso_code"), encString("DE"))))
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, w.bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if db.DatabaseType != "Test-Country" {
+		t.Fatalf("database type %q", db.DatabaseType)
+	}
+	cases := map[string]string{
+		"8.8.8.8":          "US",
+		"::ffff:8.8.8.200": "US",
+		"9.9.1.1":          "US",
+		"2001:db8::1":      "DE",
+		"8.8.9.1":          "",
+		"2001:db9::1":      "",
+	}
+	for ip, want := range cases {
+		got, ok := db.Country(netip.MustParseAddr(ip))
+		if got != want || ok != (want != "") {
+			t.Errorf("%s: got %q (%v), want %q", ip, got, ok, want)
+		}
+	}
+	if _, err := New([]byte("not a database")); err == nil {
+		t.Fatal("garbage accepted")
+	}
+}
@@ -2,6 +2,7 @@ package listener
 
 import (
 	"context"
+	"crypto/tls"
 	"net/http"
 	"time"
 
@@ -29,7 +30,17 @@ func NewServer(addr string, handler http.Handler, logger *observability.Logger)
 	}
 }
 
+// WithTLS serves the data plane over TLS using the given config (certificates must be set).
+func (s *Server) WithTLS(tc *tls.Config) *Server {
+	s.srv.TLSConfig = tc
+	return s
+}
+
 func (s *Server) Start() error {
+	if s.srv.TLSConfig != nil {
+		s.logger.Infow("listening (tls)", "addr", s.addr)
+		return s.srv.ListenAndServeTLS("", "")
+	}
 	s.logger.Infow("listening", "addr", s.addr)
 	return s.srv.ListenAndServe()
 }
@@ -1,13 +1,24 @@
 package observability
 
 import (
+    "io"
     "net/http"
+    "sync"
     "sync/atomic"
 )
 
 type Metrics struct {
     totalRequests  atomic.Int64
     totalFailures  atomic.Int64
+    openTunnels    atomic.Int64
+    totalTunnels   atomic.Int64
+    mu             sync.RWMutex
+    collectors     []Collector
+}
+
+// Collector contributes extra samples, in Prometheus text format, to each /metrics scrape.
+type Collector interface {
+    WriteMetrics(w io.Writer)
 }
 
 func NewMetrics() *Metrics { return &Metrics{} }
@@ -15,6 +26,17 @@ func NewMetrics() *Metrics { return &Metrics{} }
 func (m *Metrics) IncRequests() { m.totalRequests.Add(1) }
 func (m *Metrics) IncFailures() { m.totalFailures.Add(1) }
 
+// TunnelOpened and TunnelClosed track upgraded (e.g. WebSocket) connections.
+func (m *Metrics) TunnelOpened() { m.openTunnels.Add(1); m.totalTunnels.Add(1) }
+func (m *Metrics) TunnelClosed() { m.openTunnels.Add(-1) }
+func (m *Metrics) OpenTunnels() int64 { return m.openTunnels.Load() }
+
+// Register adds a collector to the /metrics output.
+func (m *Metrics) Register(c Collector) {
+    m.mu.Lock(); defer m.mu.Unlock()
+    m.collectors = append(m.collectors, c)
+}
+
 func (m *Metrics) Handler() http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
         _, _ = w.Write([]byte(
@@ -23,8 +45,16 @@ func (m *Metrics) Handler() http.Handler {
                 "go_agw_total_requests " + itoa(m.totalRequests.Load()) + "\n" +
                 "# HELP go_agw_total_failures Total failed requests\n" +
                 "# TYPE go_agw_total_failures counter\n" +
-                "go_agw_total_failures " + itoa(m.totalFailures.Load()) + "\n",
+                "go_agw_total_failures " + itoa(m.totalFailures.Load()) + "\n" +
+                "# HELP go_agw_open_tunnels Upgraded connections currently open\n" +
+                "# TYPE go_agw_open_tunnels gauge\n" +
+                "go_agw_open_tunnels " + itoa(m.openTunnels.Load()) + "\n" +
+                "# HELP go_agw_tunnels_total Upgraded connections established\n" +
+                "# TYPE go_agw_tunnels_total counter\n" +
+                "go_agw_tunnels_total " + itoa(m.totalTunnels.Load()) + "\n",
         ))
+        m.mu.RLock(); defer m.mu.RUnlock()
+        for _, c := range m.collectors { c.WriteMetrics(w) }
     })
 }
 
@@ -42,4 +72,3 @@ func itoa(v int64) string {
     if neg { buf = append([]byte{'-'}, buf...) }
     return string(buf)
 }
-
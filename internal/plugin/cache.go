@@ -0,0 +1,375 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CachePlugin stores cacheable upstream responses and answers later requests from them.
+// Config:
+//
+//	zone: "default"                    // name in metrics and purge results
+//	store: memory                      // memory | disk
+//	dir: /var/cache/go-agw             // disk store directory, one per cache instance
+//	max_bytes: 67108864                // total size; least recently used entries go first
+//	max_entry_bytes: 1048576           // larger responses are not stored
+//	default_ttl_ms: 0                  // freshness when the upstream gives none
+//	query_params: ["id", "page"]       // query parameters in the key; default all
+//	stale_while_revalidate_ms: 0       // defaults for responses without the directives
+//	stale_if_error_ms: 0
+//	tag_header: Cache-Tag              // response header listing purge tags
+//
+// Freshness follows Cache-Control (s-maxage, max-age, no-cache, no-store, private,
+// must-revalidate) and Expires. Stale entries with an ETag or Last-Modified are
+// revalidated with a conditional request; within stale-while-revalidate the stale
+// response is served at once and refreshed in the background; within stale-if-error it
+// replaces 5xx responses and failed upstream calls. Place the plugin after authentication
+// plugins so that hits are only served to authorised requests.
+type CachePlugin struct {
+	zone          string
+	store         cacheStore
+	maxEntryBytes int
+	defaultTTL    time.Duration
+	queryParams   []string
+	swr, sie      time.Duration
+	tagHeader     string
+
+	dispatcher http.Handler
+	refreshing sync.Map // keys being revalidated in the background
+
+	results [numCacheResults]atomic.Int64
+}
+
+// cache outcomes, reported in X-Cache and metrics
+const (
+	cacheHit = iota
+	cacheMiss
+	cacheStale
+	cacheRevalidated
+	cacheBypass
+	numCacheResults
+)
+
+var cacheResultNames = [numCacheResults]string{"HIT", "MISS", "STALE", "REVALIDATED", "BYPASS"}
+
+// cacheState travels with a request from BeforeDispatch to AfterDispatch.
+type cacheState struct {
+	key   string
+	entry *cacheEntry // stale entry being revalidated, if any
+	// conditional is set when the plugin added If-None-Match/If-Modified-Since itself
+	conditional bool
+}
+
+const cacheStateKey ctxKey = "plugin.cache.state"
+const cacheRefreshKey ctxKey = "plugin.cache.refresh"
+
+func (p *CachePlugin) Name() string { return "cache" }
+
+func (p *CachePlugin) Init(cfg map[string]any) error {
+	p.zone = getStringOr(cfg, "zone", "default")
+	maxBytes := int64(getIntOr(cfg, "max_bytes", 64<<20))
+	switch kind := getStringOr(cfg, "store", "memory"); kind {
+	case "memory":
+		p.store = newMemoryStore(maxBytes)
+	case "disk":
+		dir := getStringOr(cfg, "dir", "")
+		if dir == "" {
+			return fmt.Errorf("cache: disk store needs dir")
+		}
+		s, err := openDiskStore(dir, maxBytes)
+		if err != nil {
+			return fmt.Errorf("cache: %w", err)
+		}
+		p.store = s
+	default:
+		return fmt.Errorf("cache: unknown store %q", kind)
+	}
+	p.maxEntryBytes = getIntOr(cfg, "max_entry_bytes", 1<<20)
+	p.defaultTTL = time.Duration(getIntOr(cfg, "default_ttl_ms", 0)) * time.Millisecond
+	p.queryParams = getStrings(cfg, "query_params")
+	p.swr = time.Duration(getIntOr(cfg, "stale_while_revalidate_ms", 0)) * time.Millisecond
+	p.sie = time.Duration(getIntOr(cfg, "stale_if_error_ms", 0)) * time.Millisecond
+	p.tagHeader = getStringOr(cfg, "tag_header", "Cache-Tag")
+	return nil
+}
+
+// UseDispatcher receives the handler used for background revalidation.
+func (p *CachePlugin) UseDispatcher(h http.Handler) { p.dispatcher = h }
+
+func (p *CachePlugin) BeforeDispatch(ctx *RequestContext) (bool, error) {
+	req := ctx.Request
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false, nil
+	}
+	reqCC := parseCacheControl(req.Header)
+	if reqCC.has("no-store") {
+		p.results[cacheBypass].Add(1)
+		return false, nil
+	}
+	now := time.Now()
+	key, e := p.lookup(req)
+	st := &cacheState{key: key}
+	refresh := req.Context().Value(cacheRefreshKey) != nil
+	if e != nil && !refresh {
+		if e.fresh(now) && acceptable(e, reqCC, req.Header, now) {
+			p.serve(ctx.Writer, req, e, now, cacheHit)
+			return true, nil
+		}
+		if e.staleFor(now, e.StaleWhileRevalidate) && !reqCC.has("no-cache") && !reqCC.has("max-age") {
+			p.serve(ctx.Writer, req, e, now, cacheStale)
+			p.refresh(ctx)
+			return true, nil
+		}
+	}
+	if e != nil {
+		st.entry = e
+		// revalidate on the client's behalf unless it sent validators of its own
+		if e.validators() && req.Header.Get("If-None-Match") == "" && req.Header.Get("If-Modified-Since") == "" {
+			if etag := e.Header.Get("ETag"); etag != "" {
+				req.Header.Set("If-None-Match", etag)
+			}
+			if lm := e.Header.Get("Last-Modified"); lm != "" {
+				req.Header.Set("If-Modified-Since", lm)
+			}
+			st.conditional = true
+		}
+	}
+	ctx.Request = req.WithContext(context.WithValue(req.Context(), cacheStateKey, st))
+	return false, nil
+}
+
+func (p *CachePlugin) AfterDispatch(ctx *RequestContext) {
+	st, ok := ctx.Request.Context().Value(cacheStateKey).(*cacheState)
+	if !ok || ctx.Response == nil || ctx.Response.Streaming {
+		return
+	}
+	resp, req, now := ctx.Response, ctx.Request, time.Now()
+	if st.conditional {
+		// the validators were ours: never pass them on to the client
+		req.Header.Del("If-None-Match")
+		req.Header.Del("If-Modified-Since")
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotModified && st.conditional:
+		e := p.revalidated(st.entry, resp.Header, now)
+		p.store.set(e)
+		p.replace(ctx, e, now, cacheRevalidated)
+	case resp.StatusCode >= 500 && st.entry != nil && st.entry.staleFor(now, st.entry.StaleIfError):
+		p.replace(ctx, st.entry, now, cacheStale)
+	default:
+		cc := parseCacheControl(resp.Header)
+		if p.storable(req, resp, cc, ctx.Consumer != nil || ctx.Claims != nil) {
+			if e := p.entry(st.key, req, resp, cc, now); e.Fresh > 0 || e.validators() {
+				p.put(req, e)
+			}
+		}
+		p.results[cacheMiss].Add(1)
+		resp.Header.Set("X-Cache", cacheResultNames[cacheMiss])
+	}
+}
+
+// UpstreamError serves a stale entry within stale-if-error when the upstream call failed.
+func (p *CachePlugin) UpstreamError(ctx *RequestContext, _ error) bool {
+	st, ok := ctx.Request.Context().Value(cacheStateKey).(*cacheState)
+	if !ok || st.entry == nil || !st.entry.staleFor(time.Now(), st.entry.StaleIfError) {
+		return false
+	}
+	if st.conditional {
+		ctx.Request.Header.Del("If-None-Match")
+		ctx.Request.Header.Del("If-Modified-Since")
+	}
+	p.serve(ctx.Writer, ctx.Request, st.entry, time.Now(), cacheStale)
+	return true
+}
+
+// lookup returns the primary key of req and the entry stored for it, following Vary.
+func (p *CachePlugin) lookup(req *http.Request) (string, *cacheEntry) {
+	key := p.primaryKey(req)
+	e, ok := p.store.get(key)
+	if !ok {
+		return key, nil
+	}
+	if e.Status == 0 {
+		if e, ok = p.store.get(variantKey(key, e.Vary, req)); !ok {
+			return key, nil
+		}
+	}
+	return key, e
+}
+
+// acceptable applies the request's own freshness limits (no-cache, max-age) to an entry.
+func acceptable(e *cacheEntry, cc cacheControl, h http.Header, now time.Time) bool {
+	if cc.has("no-cache") || (len(cc) == 0 && h.Get("Pragma") == "no-cache") {
+		return false
+	}
+	if d, ok := cc.seconds("max-age"); ok && e.age(now) > d {
+		return false
+	}
+	return true
+}
+
+func (p *CachePlugin) entry(key string, req *http.Request, resp *Response, cc cacheControl, now time.Time) *cacheEntry {
+	h := resp.Header.Clone()
+	for _, k := range []string{"Connection", "Keep-Alive", "Transfer-Encoding", "Trailer", "Upgrade", "Content-Length", "X-Cache"} {
+		h.Del(k)
+	}
+	e := &cacheEntry{
+		Key:            key,
+		Status:         resp.StatusCode,
+		Header:         h,
+		Body:           resp.Body,
+		Tags:           cacheTags(resp.Header.Values(p.tagHeader)),
+		Stored:         now,
+		MustRevalidate: cc.has("must-revalidate") || cc.has("proxy-revalidate"),
+	}
+	p.setLifetimes(e, cc, now)
+	if vary := varyFields(resp.Header); len(vary) > 0 {
+		e.Vary = vary
+	}
+	return e
+}
+
+// setLifetimes reads the freshness, stale-while-revalidate and stale-if-error windows and
+// the upstream's Age from the entry's headers.
+func (p *CachePlugin) setLifetimes(e *cacheEntry, cc cacheControl, now time.Time) {
+	e.Fresh = p.freshness(e.Header, cc, now)
+	e.StaleWhileRevalidate, e.StaleIfError = p.swr, p.sie
+	if d, ok := cc.seconds("stale-while-revalidate"); ok {
+		e.StaleWhileRevalidate = d
+	}
+	if d, ok := cc.seconds("stale-if-error"); ok {
+		e.StaleIfError = d
+	}
+	e.Age = 0
+	if n, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && n > 0 {
+		e.Age = time.Duration(n) * time.Second
+	}
+}
+
+// put stores e; responses with Vary go under a variant key with a marker at the primary.
+func (p *CachePlugin) put(req *http.Request, e *cacheEntry) {
+	if len(e.Vary) > 0 {
+		p.store.set(&cacheEntry{Key: e.Key, Vary: e.Vary, Stored: e.Stored})
+		e.Key = variantKey(e.Key, e.Vary, req)
+	}
+	p.store.set(e)
+}
+
+// revalidated returns a copy of e refreshed by the headers of a 304 response.
+func (p *CachePlugin) revalidated(e *cacheEntry, h http.Header, now time.Time) *cacheEntry {
+	n := *e
+	n.Header = e.Header.Clone()
+	for k, vv := range h {
+		if k == "Content-Length" || k == "X-Cache" {
+			continue
+		}
+		n.Header[k] = append([]string(nil), vv...)
+	}
+	n.Stored = now
+	cc := parseCacheControl(n.Header)
+	n.MustRevalidate = cc.has("must-revalidate") || cc.has("proxy-revalidate")
+	p.setLifetimes(&n, cc, now)
+	return &n
+}
+
+// replace swaps the upstream response for a cached entry.
+func (p *CachePlugin) replace(ctx *RequestContext, e *cacheEntry, now time.Time, result int) {
+	p.results[result].Add(1)
+	h := e.Header.Clone()
+	h.Set("Age", strconv.FormatInt(int64(e.age(now)/time.Second), 10))
+	h.Set("X-Cache", cacheResultNames[result])
+	ctx.Response.StatusCode, ctx.Response.Header, ctx.Response.Body = e.Status, h, e.Body
+	if notModified(ctx.Request, e) {
+		ctx.Response.StatusCode, ctx.Response.Body = http.StatusNotModified, nil
+	}
+}
+
+// serve writes a cached entry, or 304 when the client's validators still match.
+func (p *CachePlugin) serve(w http.ResponseWriter, req *http.Request, e *cacheEntry, now time.Time, result int) {
+	p.results[result].Add(1)
+	h := w.Header()
+	for k, vv := range e.Header {
+		h[k] = append([]string(nil), vv...)
+	}
+	h.Set("Age", strconv.FormatInt(int64(e.age(now)/time.Second), 10))
+	h.Set("X-Cache", cacheResultNames[result])
+	if notModified(req, e) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Length", strconv.Itoa(len(e.Body)))
+	w.WriteHeader(e.Status)
+	if req.Method != http.MethodHead {
+		_, _ = w.Write(e.Body)
+	}
+}
+
+// refresh revalidates the entry of the request in the background, once per key at a
+// time. The request is replayed as the client sent it, since earlier plugins may have
+// stripped its credentials.
+func (p *CachePlugin) refresh(ctx *RequestContext) {
+	if p.dispatcher == nil {
+		return
+	}
+	key := p.primaryKey(ctx.Request)
+	if _, busy := p.refreshing.LoadOrStore(key, struct{}{}); busy {
+		return
+	}
+	req := ctx.Request
+	if ctx.Original != nil {
+		req = ctx.Original
+	}
+	bg := req.Clone(context.WithValue(context.WithoutCancel(req.Context()), cacheRefreshKey, true))
+	bg.Method = http.MethodGet
+	for _, k := range []string{"If-None-Match", "If-Modified-Since", "Cache-Control", "Pragma"} {
+		bg.Header.Del(k)
+	}
+	go func() {
+		defer p.refreshing.Delete(key)
+		p.dispatcher.ServeHTTP(discardResponseWriter{header: http.Header{}}, bg)
+	}()
+}
+
+// Purge removes entries by "key" (including its Vary variants), "prefix" or "tag".
+func (p *CachePlugin) Purge(kind, value string) (int, error) {
+	match := purgeMatcher(kind, value)
+	if match == nil || value == "" {
+		return 0, fmt.Errorf("cache: purge needs a key, prefix or tag")
+	}
+	return p.store.purge(match), nil
+}
+
+// Zone names the cache in metrics and admin responses.
+func (p *CachePlugin) Zone() string { return p.zone }
+
+// CacheStats is a point-in-time view of a cache.
+type CacheStats struct {
+	Zone    string           `json:"zone"`
+	Entries int              `json:"entries"`
+	Bytes   int64            `json:"bytes"`
+	Results map[string]int64 `json:"results"`
+}
+
+func (p *CachePlugin) Stats() CacheStats {
+	s := CacheStats{Zone: p.zone, Results: map[string]int64{}}
+	s.Entries, s.Bytes = p.store.stats()
+	for i, name := range cacheResultNames {
+		s.Results[name] = p.results[i].Load()
+	}
+	return s
+}
+
+// discardResponseWriter absorbs the response of a background revalidation, which only
+// matters for what AfterDispatch stores.
+type discardResponseWriter struct{ header http.Header }
+
+func (d discardResponseWriter) Header() http.Header         { return d.header }
+func (d discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (d discardResponseWriter) WriteHeader(int)             {}
+
+func init() { Register("cache", func() Plugin { return &CachePlugin{} }) }
@@ -0,0 +1,182 @@
+package plugin
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// varySep separates a cache key from the Vary part of its variants, so that purging a
+// key or a prefix also removes every variant.
+const varySep = "|vary:"
+
+// cacheableStatus lists the statuses a shared cache may store (RFC 9111 heuristically
+// cacheable codes). Partial content is left to the upstream.
+var cacheableStatus = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// primaryKey identifies a resource: method, host, path and the selected query parameters
+// (all of them, sorted, when none are selected). HEAD shares the GET entry.
+func (p *CachePlugin) primaryKey(req *http.Request) string {
+	method := req.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	q := req.URL.Query()
+	if len(p.queryParams) > 0 {
+		sel := url.Values{}
+		for _, k := range p.queryParams {
+			if v, ok := q[k]; ok {
+				sel[k] = v
+			}
+		}
+		q = sel
+	}
+	key := method + " " + strings.ToLower(req.Host) + req.URL.Path
+	if enc := q.Encode(); enc != "" { // Encode sorts by key
+		key += "?" + enc
+	}
+	return key
+}
+
+// variantKey extends key with the request's values of the Vary headers.
+func variantKey(key string, vary []string, req *http.Request) string {
+	parts := make([]string, len(vary))
+	for i, h := range vary {
+		parts[i] = h + "=" + strings.Join(req.Header.Values(h), ",")
+	}
+	return key + varySep + strings.Join(parts, "&")
+}
+
+// varyFields returns the canonical, sorted header names of a Vary header.
+func varyFields(h http.Header) []string {
+	var out []string
+	for _, v := range splitHeaderList(h.Values("Vary")) {
+		out = append(out, http.CanonicalHeaderKey(v))
+	}
+	sort.Strings(out)
+	return out
+}
+
+// cacheControl holds parsed Cache-Control directives, lower-cased, with unquoted values.
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, d := range splitHeaderList(h.Values("Cache-Control")) {
+		name, val, _ := strings.Cut(d, "=")
+		cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(val), `"`)
+	}
+	return cc
+}
+
+func (cc cacheControl) has(d string) bool {
+	_, ok := cc[d]
+	return ok
+}
+
+// seconds returns a delta-seconds directive, or false when it is absent or malformed.
+func (cc cacheControl) seconds(d string) (time.Duration, bool) {
+	v, ok := cc[d]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// freshness computes how long a response stays fresh: s-maxage, max-age, Expires minus
+// Date, then the configured default. no-cache responses are stored stale.
+func (p *CachePlugin) freshness(h http.Header, cc cacheControl, now time.Time) time.Duration {
+	if cc.has("no-cache") {
+		return 0
+	}
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+	if exp := h.Get("Expires"); exp != "" {
+		t, err := http.ParseTime(exp)
+		if err != nil {
+			return 0 // invalid Expires means already expired
+		}
+		date := now
+		if d, err := http.ParseTime(h.Get("Date")); err == nil {
+			date = d
+		}
+		return max(t.Sub(date), 0)
+	}
+	return p.defaultTTL
+}
+
+// storable reports whether a response to req may be kept by a shared cache. identified
+// is set when a plugin authenticated the caller as a consumer or by token claims.
+func (p *CachePlugin) storable(req *http.Request, resp *Response, cc cacheControl, identified bool) bool {
+	if req.Method != http.MethodGet || !cacheableStatus[resp.StatusCode] {
+		return false
+	}
+	if cc.has("no-store") || cc.has("private") || len(resp.Header.Values("Set-Cookie")) > 0 {
+		return false
+	}
+	if parseCacheControl(req.Header).has("no-store") {
+		return false
+	}
+	for _, v := range resp.Header.Values("Vary") {
+		if strings.TrimSpace(v) == "*" {
+			return false
+		}
+	}
+	// responses to authenticated requests are only shared when the upstream says so
+	if req.Header.Get("Authorization") != "" && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return false
+	}
+	// plugins may have removed the credentials (API key, session cookie) from the request
+	if identified && !cc.has("public") && !cc.has("s-maxage") {
+		return false
+	}
+	return len(resp.Body) <= p.maxEntryBytes
+}
+
+// notModified evaluates the client's conditional headers against a cached entry.
+func notModified(req *http.Request, e *cacheEntry) bool {
+	if e.Status != http.StatusOK {
+		return false
+	}
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := e.Header.Get("ETag")
+		if etag == "" {
+			return false
+		}
+		for _, t := range splitHeaderList([]string{inm}) {
+			if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
+
+// cacheTags splits a tag header such as "Cache-Tag: product:42, catalog" into tags.
+func cacheTags(values []string) []string {
+	var tags []string
+	for _, v := range values {
+		tags = append(tags, strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' })...)
+	}
+	return tags
+}
@@ -0,0 +1,308 @@
+package plugin
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheEntry is a stored response. Entries with Vary set and no Status only record which
+// request headers select the variants stored under the same key.
+type cacheEntry struct {
+	Key    string        `json:"key"`
+	Status int           `json:"status,omitempty"`
+	Header http.Header   `json:"header,omitempty"`
+	Body   []byte        `json:"body,omitempty"`
+	Tags   []string      `json:"tags,omitempty"`
+	Vary   []string      `json:"vary,omitempty"`
+	Stored time.Time     `json:"stored"`
+	Age    time.Duration `json:"age,omitempty"` // Age reported by the upstream when stored
+	Fresh  time.Duration `json:"fresh,omitempty"`
+	// how long past freshness the entry may still be served
+	StaleWhileRevalidate time.Duration `json:"swr,omitempty"`
+	StaleIfError         time.Duration `json:"sie,omitempty"`
+	MustRevalidate       bool          `json:"must_revalidate,omitempty"`
+}
+
+func (e *cacheEntry) age(now time.Time) time.Duration { return e.Age + now.Sub(e.Stored) }
+
+func (e *cacheEntry) fresh(now time.Time) bool { return e.age(now) < e.Fresh }
+
+// staleFor reports whether the entry is stale by no more than d and may still be served.
+func (e *cacheEntry) staleFor(now time.Time, d time.Duration) bool {
+	return !e.MustRevalidate && e.age(now) < e.Fresh+d
+}
+
+func (e *cacheEntry) validators() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// size approximates the memory an entry takes.
+func (e *cacheEntry) size() int64 {
+	n := len(e.Key) + len(e.Body)
+	for k, vv := range e.Header {
+		n += len(k)
+		for _, v := range vv {
+			n += len(v)
+		}
+	}
+	return int64(n)
+}
+
+// cacheStore keeps entries up to a total size, evicting the least recently used.
+type cacheStore interface {
+	get(key string) (*cacheEntry, bool)
+	set(e *cacheEntry)
+	// purge removes the entries match selects and returns how many it removed.
+	purge(match func(key string, tags []string) bool) int
+	stats() (entries int, bytes int64)
+}
+
+// lruIndex tracks keys by recency and size; stores hold their mutex around it.
+type lruIndex struct {
+	ll    *list.List
+	items map[string]*list.Element
+	bytes int64
+	max   int64
+}
+
+type lruItem struct {
+	key   string
+	size  int64
+	tags  []string
+	entry *cacheEntry // memory store only
+}
+
+func newLRUIndex(max int64) lruIndex {
+	return lruIndex{ll: list.New(), items: map[string]*list.Element{}, max: max}
+}
+
+func (x *lruIndex) touch(key string) (*lruItem, bool) {
+	el, ok := x.items[key]
+	if !ok {
+		return nil, false
+	}
+	x.ll.MoveToFront(el)
+	return el.Value.(*lruItem), true
+}
+
+// add inserts or replaces an item and returns the keys evicted to stay within max.
+func (x *lruIndex) add(it *lruItem) []string {
+	x.remove(it.key)
+	x.items[it.key] = x.ll.PushFront(it)
+	x.bytes += it.size
+	var evicted []string
+	for x.bytes > x.max && x.ll.Len() > 1 {
+		old := x.ll.Back().Value.(*lruItem)
+		x.remove(old.key)
+		evicted = append(evicted, old.key)
+	}
+	return evicted
+}
+
+func (x *lruIndex) remove(key string) bool {
+	el, ok := x.items[key]
+	if !ok {
+		return false
+	}
+	x.bytes -= el.Value.(*lruItem).size
+	x.ll.Remove(el)
+	delete(x.items, key)
+	return true
+}
+
+func (x *lruIndex) matching(match func(key string, tags []string) bool) []string {
+	var keys []string
+	for k, el := range x.items {
+		if match(k, el.Value.(*lruItem).tags) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// memoryStore keeps entries in process memory.
+type memoryStore struct {
+	mu  sync.Mutex
+	idx lruIndex
+}
+
+func newMemoryStore(maxBytes int64) *memoryStore {
+	return &memoryStore{idx: newLRUIndex(maxBytes)}
+}
+
+func (s *memoryStore) get(key string) (*cacheEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it, ok := s.idx.touch(key)
+	if !ok {
+		return nil, false
+	}
+	return it.entry, true
+}
+
+func (s *memoryStore) set(e *cacheEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.idx.add(&lruItem{key: e.Key, size: e.size(), tags: e.Tags, entry: e})
+}
+
+func (s *memoryStore) purge(match func(string, []string) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := s.idx.matching(match)
+	for _, k := range keys {
+		s.idx.remove(k)
+	}
+	return len(keys)
+}
+
+func (s *memoryStore) stats() (int, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.idx.items), s.idx.bytes
+}
+
+// diskStore keeps one JSON file per entry in dir and an in-memory index of them, rebuilt
+// from the directory on start so a restart keeps the cache warm.
+type diskStore struct {
+	dir string
+	mu  sync.Mutex
+	idx lruIndex
+}
+
+func openDiskStore(dir string, maxBytes int64) (*diskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &diskStore{dir: dir, idx: newLRUIndex(maxBytes)}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var entries []*cacheEntry
+	for _, f := range files {
+		e, err := readEntry(f)
+		if err != nil || s.path(e.Key) != f {
+			_ = os.Remove(f)
+			continue
+		}
+		e.Body = nil // only the index is kept in memory
+		entries = append(entries, e)
+	}
+	// oldest first, so that the most recently stored end up at the front
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Stored.Before(entries[j].Stored) })
+	for _, e := range entries {
+		s.evict(s.idx.add(&lruItem{key: e.Key, size: fileSize(s.path(e.Key)), tags: e.Tags}))
+	}
+	return s, nil
+}
+
+func (s *diskStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (s *diskStore) get(key string) (*cacheEntry, bool) {
+	s.mu.Lock()
+	_, ok := s.idx.touch(key)
+	s.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	e, err := readEntry(s.path(key))
+	if err != nil {
+		s.mu.Lock()
+		s.idx.remove(key)
+		s.mu.Unlock()
+		return nil, false
+	}
+	return e, true
+}
+
+func (s *diskStore) set(e *cacheEntry) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(s.dir, ".entry*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, werr := tmp.Write(data)
+	if cerr := tmp.Close(); werr != nil || cerr != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if os.Rename(tmp.Name(), s.path(e.Key)) != nil {
+		return
+	}
+	s.evict(s.idx.add(&lruItem{key: e.Key, size: int64(len(data)), tags: e.Tags}))
+}
+
+func (s *diskStore) purge(match func(string, []string) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := s.idx.matching(match)
+	for _, k := range keys {
+		s.idx.remove(k)
+	}
+	s.evict(keys)
+	return len(keys)
+}
+
+// evict removes the files of keys already dropped from the index. Callers hold mu.
+func (s *diskStore) evict(keys []string) {
+	for _, k := range keys {
+		_ = os.Remove(s.path(k))
+	}
+}
+
+func (s *diskStore) stats() (int, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.idx.items), s.idx.bytes
+}
+
+func readEntry(path string) (*cacheEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var e cacheEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func fileSize(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// purgeMatcher selects entries by exact key (with its variants), key prefix or tag.
+func purgeMatcher(kind, value string) func(string, []string) bool {
+	switch kind {
+	case "key":
+		return func(k string, _ []string) bool { return k == value || strings.HasPrefix(k, value+varySep) }
+	case "prefix":
+		return func(k string, _ []string) bool { return strings.HasPrefix(k, value) }
+	case "tag":
+		return func(_ string, tags []string) bool { return containsString(tags, value) }
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package plugin
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// cacheHarness runs requests through a cache plugin the way the router does: BeforeDispatch,
+// the upstream unless the plugin answered, AfterDispatch, then the buffered response.
+type cacheHarness struct {
+	t        *testing.T
+	p        *CachePlugin
+	upstream http.HandlerFunc
+	calls    atomic.Int32
+	fail     error // returned instead of calling upstream
+}
+
+func newCacheHarness(t *testing.T, cfg map[string]any, upstream http.HandlerFunc) *cacheHarness {
+	t.Helper()
+	h := &cacheHarness{t: t, p: &CachePlugin{}, upstream: upstream}
+	if err := h.p.Init(cfg); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	return h
+}
+
+func (h *cacheHarness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx := &RequestContext{Context: req.Context(), Writer: w, Request: req}
+	if handled, _ := h.p.BeforeDispatch(ctx); handled {
+		return
+	}
+	if h.fail != nil {
+		if !h.p.UpstreamError(ctx, h.fail) {
+			http.Error(w, h.fail.Error(), http.StatusBadGateway)
+		}
+		return
+	}
+	h.calls.Add(1)
+	up := httptest.NewRecorder()
+	h.upstream(up, ctx.Request)
+	ctx.Response = &Response{StatusCode: up.Code, Header: up.Header().Clone(), Body: up.Body.Bytes()}
+	h.p.AfterDispatch(ctx)
+	copyHeaders(w.Header(), ctx.Response.Header)
+	w.WriteHeader(ctx.Response.StatusCode)
+	_, _ = w.Write(ctx.Response.Body)
+}
+
+func copyHeaders(dst, src http.Header) {
+	for k, vv := range src {
+		dst[k] = append([]string(nil), vv...)
+	}
+}
+
+func (h *cacheHarness) get(path string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "http://api.example.com"+path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCacheFreshHit(t *testing.T) {
+	h := newCacheHarness(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("v1 " + r.URL.RawQuery))
+	})
+	if rec := h.get("/items?b=2&a=1"); rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("first request: %v", rec.Header())
+	}
+	rec := h.get("/items?a=1&b=2")
+	if rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "v1 b=2&a=1" || rec.Header().Get("Age") != "0" {
+		t.Fatalf("reordered query should hit: %v %q", rec.Header(), rec.Body)
+	}
+	if h.get("/items?a=1&b=3").Header().Get("X-Cache") != "MISS" {
+		t.Fatal("different query should miss")
+	}
+	if rec := h.get("/items?a=1&b=2", "Cache-Control", "no-cache"); rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("request no-cache must go upstream: %v", rec.Header())
+	}
+	if h.calls.Load() != 3 {
+		t.Fatalf("upstream calls: %d", h.calls.Load())
+	}
+	if rec := h.get("/items?a=1&b=2", "If-None-Match", `"x"`); rec.Code != http.StatusOK {
+		t.Fatalf("non-matching validator: %d", rec.Code)
+	}
+	if rec := h.get("/items?a=1&b=2", "If-None-Match", `W/"v1"`); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Fatalf("matching validator should be answered from cache: %d %q", rec.Code, rec.Body)
+	}
+}
+
+func TestCacheQueryParamsAndNotStored(t *testing.T) {
+	h := newCacheHarness(t, map[string]any{"query_params": []any{"id"}}, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/cookie":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Set-Cookie", "s=1")
+		case "/nostore":
+			w.Header().Set("Cache-Control", "no-store")
+		default:
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+	})
+	h.get("/item?id=1&utm=a")
+	if h.get("/item?utm=b&id=1").Header().Get("X-Cache") != "HIT" {
+		t.Fatal("unselected query parameters should not split the key")
+	}
+	for _, path := range []string{"/private", "/cookie", "/nostore"} {
+		h.get(path)
+		if h.get(path).Header().Get("X-Cache") != "MISS" {
+			t.Fatalf("%s should not be stored", path)
+		}
+	}
+	h.get("/auth", "Authorization", "Bearer x")
+	if h.get("/auth", "Authorization", "Bearer x").Header().Get("X-Cache") != "MISS" {
+		t.Fatal("authorised responses need public or s-maxage to be shared")
+	}
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	var conditional atomic.Value
+	h := newCacheHarness(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("ETag", `"v1"`)
+		conditional.Store(r.Header.Get("If-None-Match"))
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write([]byte("body"))
+	})
+	h.get("/doc")
+	rec := h.get("/doc")
+	if conditional.Load() != `"v1"` {
+		t.Fatal("stale entry should be revalidated with If-None-Match")
+	}
+	if rec.Code != http.StatusOK || rec.Body.String() != "body" || rec.Header().Get("X-Cache") != "REVALIDATED" {
+		t.Fatalf("revalidated response: %d %v %q", rec.Code, rec.Header(), rec.Body)
+	}
+	// the client's own validators go upstream untouched, and so does the 304
+	rec = h.get("/doc", "If-None-Match", `"v1"`)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Fatalf("client conditional: %d %q", rec.Code, rec.Body)
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	h := newCacheHarness(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		_, _ = w.Write([]byte(r.Header.Get("Accept-Language")))
+	})
+	h.get("/greeting", "Accept-Language", "en")
+	h.get("/greeting", "Accept-Language", "fr")
+	for _, lang := range []string{"en", "fr"} {
+		rec := h.get("/greeting", "Accept-Language", lang)
+		if rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != lang {
+			t.Fatalf("%s: %v %q", lang, rec.Header(), rec.Body)
+		}
+	}
+	n, _ := h.p.Purge("key", "GET api.example.com/greeting")
+	if n != 3 {
+		t.Fatalf("purging the key should drop the marker and both variants, got %d", n)
+	}
+}
+
+func TestCacheStaleIfError(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	h := newCacheHarness(t, nil, func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0, stale-if-error=60")
+		w.Header().Set("ETag", `"v1"`)
+		w.WriteHeader(int(status.Load()))
+		_, _ = w.Write([]byte("good"))
+	})
+	h.get("/feed")
+	status.Store(http.StatusServiceUnavailable)
+	rec := h.get("/feed")
+	if rec.Code != http.StatusOK || rec.Body.String() != "good" || rec.Header().Get("X-Cache") != "STALE" {
+		t.Fatalf("5xx should be replaced by the stale entry: %d %v", rec.Code, rec.Header())
+	}
+	h.fail = errors.New("connection refused")
+	if rec := h.get("/feed"); rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "STALE" {
+		t.Fatalf("failed upstream call should be answered from cache: %d", rec.Code)
+	}
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	var version atomic.Int32
+	h := newCacheHarness(t, map[string]any{"stale_while_revalidate_ms": 60000}, func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		_, _ = w.Write([]byte{byte('0' + version.Add(1))})
+	})
+	refreshed := make(chan struct{})
+	var once sync.Once
+	h.p.UseDispatcher(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r)
+		once.Do(func() { close(refreshed) })
+	}))
+	h.get("/news")
+	rec := h.get("/news")
+	if rec.Header().Get("X-Cache") != "STALE" || rec.Body.String() != "1" {
+		t.Fatalf("stale entry should be served at once: %v %q", rec.Header(), rec.Body)
+	}
+	select {
+	case <-refreshed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no background revalidation")
+	}
+	if rec := h.get("/news"); rec.Body.String() != "2" {
+		t.Fatalf("background refresh should have replaced the entry: %q", rec.Body)
+	}
+}
+
+func TestCachePurgeByTagAndPrefix(t *testing.T) {
+	h := newCacheHarness(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Cache-Tag", "catalog, product:"+r.URL.Query().Get("id"))
+	})
+	for _, id := range []string{"1", "2", "3"} {
+		h.get("/products?id=" + id)
+	}
+	h.get("/orders")
+	if n, _ := h.p.Purge("tag", "product:2"); n != 1 {
+		t.Fatalf("tag purge removed %d", n)
+	}
+	if n, _ := h.p.Purge("prefix", "GET api.example.com/products"); n != 2 {
+		t.Fatalf("prefix purge removed %d", n)
+	}
+	if s := h.p.Stats(); s.Entries != 1 {
+		t.Fatalf("entries left: %+v", s)
+	}
+	if _, err := h.p.Purge("regex", "x"); err == nil {
+		t.Fatal("unknown purge kind should fail")
+	}
+}
+
+func TestCacheMemoryLimit(t *testing.T) {
+	h := newCacheHarness(t, map[string]any{"max_bytes": 2500, "max_entry_bytes": 1500}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		n := 1000
+		if r.URL.Path == "/huge" {
+			n = 2000
+		}
+		_, _ = w.Write([]byte(strings.Repeat("x", n)))
+	})
+	h.get("/a")
+	h.get("/b")
+	h.get("/a") // a becomes most recently used
+	h.get("/c") // evicts b
+	if h.get("/a").Header().Get("X-Cache") != "HIT" || h.get("/b").Header().Get("X-Cache") != "MISS" {
+		t.Fatal("least recently used entry should be evicted first")
+	}
+	h.get("/huge")
+	if h.get("/huge").Header().Get("X-Cache") != "MISS" {
+		t.Fatal("entries above max_entry_bytes should not be stored")
+	}
+}
+
+func TestCacheDiskStore(t *testing.T) {
+	dir := t.TempDir()
+	upstream := func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Cache-Tag", "docs")
+		_, _ = w.Write([]byte("on disk"))
+	}
+	h := newCacheHarness(t, map[string]any{"store": "disk", "dir": dir}, upstream)
+	h.get("/guide")
+
+	// a new instance over the same directory starts warm
+	h = newCacheHarness(t, map[string]any{"store": "disk", "dir": dir}, upstream)
+	rec := h.get("/guide")
+	if rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "on disk" {
+		t.Fatalf("disk entry not reloaded: %v %q", rec.Header(), rec.Body)
+	}
+	if n, _ := h.p.Purge("tag", "docs"); n != 1 {
+		t.Fatalf("tag purge on disk removed %d", n)
+	}
+	if h.get("/guide").Header().Get("X-Cache") != "MISS" {
+		t.Fatal("purged entry still served")
+	}
+	if err := (&CachePlugin{}).Init(map[string]any{"store": "disk"}); err == nil {
+		t.Fatal("disk store without dir should fail")
+	}
+}
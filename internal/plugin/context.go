@@ -9,6 +9,7 @@ type ctxKey string
 
 const upstreamOverrideKey ctxKey = "plugin.rewrite.upstream_override"
 const startTimeKey ctxKey = "plugin.obs.start_time"
+const claimsKey ctxKey = "plugin.jwt.claims"
 
 func withUpstreamOverride(ctx context.Context, name string) context.Context {
     return context.WithValue(ctx, upstreamOverrideKey, name)
@@ -28,3 +29,13 @@ func startTimeFrom(ctx context.Context) time.Time {
     return time.Time{}
 }
 
+
+func withClaims(ctx context.Context, claims map[string]any) context.Context {
+    return context.WithValue(ctx, claimsKey, claims)
+}
+
+// ClaimsFrom returns verified token claims stored by an authentication plugin.
+func ClaimsFrom(ctx context.Context) (map[string]any, bool) {
+    c, ok := ctx.Value(claimsKey).(map[string]any)
+    return c, ok
+}
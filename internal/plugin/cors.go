@@ -0,0 +1,238 @@
+package plugin
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// CORSPlugin answers preflight requests and adds CORS headers to responses.
+// Config:
+//
+//	allow_origins: ["https://app.example.com", "https://*.example.com"]  // "*" allows any origin
+//	allow_origin_regex: ["^https://[a-z0-9-]+\\.preview\\.example\\.com$"]
+//	allow_methods: ["GET", "POST"]     // default: GET, HEAD, POST, PUT, PATCH, DELETE
+//	allow_headers: ["Content-Type"]    // default: whatever the preflight asks for
+//	expose_headers: ["X-Request-ID"]
+//	allow_credentials: false
+//	max_age_ms: 600000
+//
+// Preflights never reach the upstream. CORS headers set by the upstream are replaced so
+// that every backend answers consistently. Put cors before authentication plugins so their
+// rejections carry CORS headers too.
+type CORSPlugin struct {
+	anyOrigin   bool
+	origins     map[string]struct{}
+	wildcards   [][2]string // prefix, suffix around "*"
+	patterns    []*regexp.Regexp
+	methods     []string
+	headers     []string
+	expose      string
+	credentials bool
+	maxAge      string
+}
+
+var defaultCORSMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+// wildcardLabel is what "*" may stand for in an origin pattern: one or more host labels.
+var wildcardLabel = regexp.MustCompile(`^[a-z0-9-]+(\.[a-z0-9-]+)*$`)
+
+func (p *CORSPlugin) Name() string { return "cors" }
+
+func (p *CORSPlugin) Init(cfg map[string]any) error {
+	p.origins = map[string]struct{}{}
+	for _, o := range getStrings(cfg, "allow_origins") {
+		o = strings.ToLower(strings.TrimSuffix(o, "/"))
+		switch strings.Count(o, "*") {
+		case 0:
+			p.origins[o] = struct{}{}
+		case 1:
+			if o == "*" {
+				p.anyOrigin = true
+				continue
+			}
+			pre, suf, _ := strings.Cut(o, "*")
+			p.wildcards = append(p.wildcards, [2]string{pre, suf})
+		default:
+			return fmt.Errorf("cors: origin pattern %q may contain one *", o)
+		}
+	}
+	for _, expr := range getStrings(cfg, "allow_origin_regex") {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("cors: allow_origin_regex %q: %w", expr, err)
+		}
+		p.patterns = append(p.patterns, re)
+	}
+	p.methods = upperAll(getStrings(cfg, "allow_methods"))
+	if len(p.methods) == 0 {
+		p.methods = defaultCORSMethods
+	}
+	p.headers = getStrings(cfg, "allow_headers")
+	p.expose = strings.Join(getStrings(cfg, "expose_headers"), ", ")
+	p.credentials = getBoolOr(cfg, "allow_credentials", false)
+	if ms := getIntOr(cfg, "max_age_ms", 600000); ms > 0 {
+		p.maxAge = strconv.Itoa(ms / 1000)
+	}
+	return nil
+}
+
+func (p *CORSPlugin) BeforeDispatch(ctx *RequestContext) (bool, error) {
+	req := ctx.Request
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return false, nil
+	}
+	if IsPreflight(req) {
+		p.preflight(ctx.Writer, req, origin)
+		return true, nil
+	}
+	// pre-set headers so rejections written by later plugins are readable by the browser;
+	// AfterDispatch moves them onto the upstream response
+	p.setHeaders(ctx.Writer.Header(), origin)
+	return false, nil
+}
+
+func (p *CORSPlugin) AfterDispatch(ctx *RequestContext) {
+	origin := ctx.Request.Header.Get("Origin")
+	if origin == "" || ctx.Response == nil {
+		return
+	}
+	clearCORSHeaders(ctx.Writer.Header())
+	p.setHeaders(ctx.Response.Header, origin)
+	if !p.anyOrigin || p.credentials {
+		addVary(ctx.Response.Header, "Origin")
+	}
+}
+
+// IsPreflight reports whether req is a CORS preflight (OPTIONS with Origin and
+// Access-Control-Request-Method).
+func IsPreflight(req *http.Request) bool {
+	return req.Method == http.MethodOptions && req.Header.Get("Origin") != "" && req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+func (p *CORSPlugin) preflight(w http.ResponseWriter, req *http.Request, origin string) {
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	if !p.originAllowed(origin) {
+		http.Error(w, "CORS origin not allowed", http.StatusForbidden)
+		return
+	}
+	method := strings.ToUpper(req.Header.Get("Access-Control-Request-Method"))
+	if !containsString(p.methods, method) {
+		http.Error(w, "CORS method not allowed", http.StatusForbidden)
+		return
+	}
+	requested := splitHeaderList(req.Header.Values("Access-Control-Request-Headers"))
+	allowHeaders := strings.Join(requested, ", ")
+	if len(p.headers) > 0 {
+		for _, rh := range requested {
+			if !containsFold(p.headers, rh) {
+				http.Error(w, "CORS header not allowed: "+rh, http.StatusForbidden)
+				return
+			}
+		}
+		allowHeaders = strings.Join(p.headers, ", ")
+	}
+	h.Set("Access-Control-Allow-Origin", p.allowOriginValue(origin))
+	h.Set("Access-Control-Allow-Methods", strings.Join(p.methods, ", "))
+	if allowHeaders != "" {
+		h.Set("Access-Control-Allow-Headers", allowHeaders)
+	}
+	if p.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if p.maxAge != "" {
+		h.Set("Access-Control-Max-Age", p.maxAge)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setHeaders replaces any CORS headers in h with ours for an allowed origin.
+func (p *CORSPlugin) setHeaders(h http.Header, origin string) {
+	clearCORSHeaders(h)
+	if !p.originAllowed(origin) {
+		return
+	}
+	h.Set("Access-Control-Allow-Origin", p.allowOriginValue(origin))
+	if p.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if p.expose != "" {
+		h.Set("Access-Control-Expose-Headers", p.expose)
+	}
+}
+
+func (p *CORSPlugin) originAllowed(origin string) bool {
+	if p.anyOrigin {
+		return true
+	}
+	o := strings.ToLower(origin)
+	if _, ok := p.origins[o]; ok {
+		return true
+	}
+	for _, w := range p.wildcards {
+		if len(o) > len(w[0])+len(w[1]) && strings.HasPrefix(o, w[0]) && strings.HasSuffix(o, w[1]) &&
+			wildcardLabel.MatchString(o[len(w[0]):len(o)-len(w[1])]) {
+			return true
+		}
+	}
+	for _, re := range p.patterns {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowOriginValue echoes the origin unless any origin is allowed without credentials
+// (browsers reject "*" on credentialed requests).
+func (p *CORSPlugin) allowOriginValue(origin string) string {
+	if p.anyOrigin && !p.credentials {
+		return "*"
+	}
+	return origin
+}
+
+func clearCORSHeaders(h http.Header) {
+	for _, k := range []string{"Access-Control-Allow-Origin", "Access-Control-Allow-Credentials", "Access-Control-Expose-Headers",
+		"Access-Control-Allow-Methods", "Access-Control-Allow-Headers", "Access-Control-Max-Age"} {
+		h.Del(k)
+	}
+}
+
+func addVary(h http.Header, field string) {
+	for _, v := range splitHeaderList(h.Values("Vary")) {
+		if strings.EqualFold(v, field) || v == "*" {
+			return
+		}
+	}
+	h.Add("Vary", field)
+}
+
+func splitHeaderList(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				out = append(out, item)
+			}
+		}
+	}
+	return out
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func init() { Register("cors", func() Plugin { return &CORSPlugin{} }) }
@@ -0,0 +1,82 @@
+package plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSPlugin(t *testing.T) {
+	p := &CORSPlugin{}
+	if err := p.Init(map[string]any{
+		"allow_origins":      []any{"https://app.example.com", "https://*.example.org"},
+		"allow_origin_regex": []any{`^https://pr-\d+\.preview\.example\.net$`},
+		"allow_methods":      []any{"GET", "POST"},
+		"allow_headers":      []any{"Content-Type", "Authorization"},
+		"expose_headers":     []any{"X-Request-ID"},
+		"allow_credentials":  true,
+		"max_age_ms":         120000,
+	}); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	for origin, want := range map[string]bool{
+		"https://app.example.com":           true,
+		"https://APP.example.com":           true,
+		"https://a.b.example.org":           true,
+		"https://example.org":               false,
+		"https://evil.com/.example.org":     false,
+		"https://pr-42.preview.example.net": true,
+		"https://pr-x.preview.example.net":  false,
+		"http://app.example.com":            false,
+	} {
+		if got := p.originAllowed(origin); got != want {
+			t.Errorf("%s: allowed=%v, want %v", origin, got, want)
+		}
+	}
+
+	preflight := func(origin, method, headers string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, "http://agw/orders", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", method)
+		if headers != "" {
+			req.Header.Set("Access-Control-Request-Headers", headers)
+		}
+		rec := httptest.NewRecorder()
+		if handled, _ := p.BeforeDispatch(&RequestContext{Context: req.Context(), Writer: rec, Request: req}); !handled {
+			t.Fatal("preflight was not answered by the plugin")
+		}
+		return rec
+	}
+	rec := preflight("https://app.example.com", "POST", "content-type, authorization")
+	h := rec.Header()
+	if rec.Code != http.StatusNoContent || h.Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		h.Get("Access-Control-Allow-Methods") != "GET, POST" || h.Get("Access-Control-Allow-Credentials") != "true" ||
+		h.Get("Access-Control-Max-Age") != "120" {
+		t.Fatalf("preflight: %d %v", rec.Code, h)
+	}
+	if rec := preflight("https://evil.com", "POST", ""); rec.Code != http.StatusForbidden || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("disallowed origin: %d", rec.Code)
+	}
+	if rec := preflight("https://app.example.com", "DELETE", ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("disallowed method: %d", rec.Code)
+	}
+	if rec := preflight("https://app.example.com", "GET", "X-Secret"); rec.Code != http.StatusForbidden {
+		t.Fatalf("disallowed header: %d", rec.Code)
+	}
+
+	// actual request: upstream CORS headers are replaced
+	req := httptest.NewRequest(http.MethodGet, "http://agw/orders", nil)
+	req.Header.Set("Origin", "https://a.example.org")
+	w := httptest.NewRecorder()
+	ctx := &RequestContext{Context: req.Context(), Writer: w, Request: req}
+	if handled, _ := p.BeforeDispatch(ctx); handled {
+		t.Fatal("simple request intercepted")
+	}
+	ctx.Response = &Response{StatusCode: 200, Header: http.Header{"Access-Control-Allow-Origin": {"*"}, "Vary": {"Accept-Encoding"}}}
+	p.AfterDispatch(ctx)
+	rh := ctx.Response.Header
+	if rh.Get("Access-Control-Allow-Origin") != "https://a.example.org" || rh.Get("Access-Control-Expose-Headers") != "X-Request-ID" ||
+		len(rh.Values("Vary")) != 2 || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("response headers: %v / writer %v", rh, w.Header())
+	}
+}
@@ -0,0 +1,275 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ExtAuthzPlugin asks an external authorization service whether a request may proceed.
+// Config:
+//
+//	mode: "http"                            // "http" or "grpc" (envoy.service.auth.v3.Authorization/Check)
+//	url: "http://authz:9000/check"          // http: the request path is appended; grpc: http (h2c) or https base URL
+//	timeout_ms: 200
+//	failure_mode_allow: false               // on timeout, transport error or 5xx: let the request through
+//	status_on_error: 403                    // status returned when the service fails and failure_mode_allow is false
+//	include_body: false                     // send up to max_body_bytes of the request body
+//	max_body_bytes: 8192
+//	allowed_headers: ["Authorization"]      // request headers sent to the service (default: all)
+//	upstream_headers: ["X-User-ID"]         // http: service response headers copied onto the allowed request
+//	client_headers: ["WWW-Authenticate"]    // http: service response headers copied onto a denial
+//	context_extensions: { tenant: "acme" }  // grpc: passed as AttributeContext.context_extensions
+//
+// In grpc mode the service's OkHttpResponse headers are applied to the upstream request and
+// DeniedHttpResponse status, headers and body are returned to the client.
+type ExtAuthzPlugin struct {
+	checker        authzChecker
+	timeout        time.Duration
+	failOpen       bool
+	statusOnError  int
+	includeBody    bool
+	maxBody        int
+	allowedHeaders map[string]struct{}
+}
+
+// authzRequest is the request metadata sent to the authorization service.
+type authzRequest struct {
+	Method    string
+	Scheme    string
+	Host      string
+	Path      string // escaped path
+	Query     string // raw query
+	Protocol  string
+	Header    http.Header
+	Body      []byte
+	Size      int64
+	ClientIP  string
+	Principal string
+}
+
+// authzResult is the service's decision.
+type authzResult struct {
+	Allowed bool
+	// Allowed: headers to set (or add, see Append) on the upstream request; denied: headers for the client
+	Header http.Header
+	Append map[string]bool
+	Remove []string
+	// Denied only
+	Status int
+	Body   []byte
+}
+
+type authzChecker interface {
+	check(ctx context.Context, req *authzRequest) (*authzResult, error)
+}
+
+var defaultClientHeaders = []string{"WWW-Authenticate", "Location", "Content-Type"}
+
+func (p *ExtAuthzPlugin) Name() string { return "ext-authz" }
+
+func (p *ExtAuthzPlugin) Init(cfg map[string]any) error {
+	raw := getStringOr(cfg, "url", "")
+	if raw == "" {
+		return errors.New("ext-authz: url required")
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("ext-authz: invalid url %q", raw)
+	}
+	p.timeout = time.Duration(getIntOr(cfg, "timeout_ms", 200)) * time.Millisecond
+	p.failOpen = getBoolOr(cfg, "failure_mode_allow", false)
+	p.statusOnError = getIntOr(cfg, "status_on_error", http.StatusForbidden)
+	p.includeBody = getBoolOr(cfg, "include_body", false)
+	p.maxBody = getIntOr(cfg, "max_body_bytes", 8192)
+	if hs := getStrings(cfg, "allowed_headers"); len(hs) > 0 {
+		p.allowedHeaders = map[string]struct{}{}
+		for _, h := range hs {
+			p.allowedHeaders[http.CanonicalHeaderKey(h)] = struct{}{}
+		}
+	}
+	clientHeaders := getStrings(cfg, "client_headers")
+	if len(clientHeaders) == 0 {
+		clientHeaders = defaultClientHeaders
+	}
+	switch mode := getStringOr(cfg, "mode", "http"); mode {
+	case "http":
+		p.checker = &httpAuthz{
+			base: u,
+			client: &http.Client{
+				// the decision is the service's response, not wherever it redirects to
+				CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+			},
+			upstreamHeaders: getStrings(cfg, "upstream_headers"),
+			clientHeaders:   clientHeaders,
+		}
+	case "grpc":
+		p.checker = newGRPCAuthz(u, getStringMap(cfg, "context_extensions"))
+	default:
+		return fmt.Errorf("ext-authz: unknown mode %q", mode)
+	}
+	return nil
+}
+
+func (p *ExtAuthzPlugin) BeforeDispatch(ctx *RequestContext) (bool, error) {
+	areq, err := p.buildRequest(ctx)
+	if err != nil {
+		http.Error(ctx.Writer, "bad request", http.StatusBadRequest)
+		return true, nil
+	}
+	cctx, cancel := context.WithTimeout(ctx.Request.Context(), p.timeout)
+	defer cancel()
+	res, err := p.checker.check(cctx, areq)
+	if err != nil {
+		if ctx.Logger != nil {
+			ctx.Logger.Warnw("ext-authz check failed", "err", err, "fail_open", p.failOpen)
+		}
+		if p.failOpen {
+			return false, nil
+		}
+		http.Error(ctx.Writer, http.StatusText(p.statusOnError), p.statusOnError)
+		return true, nil
+	}
+	if !res.Allowed {
+		h := ctx.Writer.Header()
+		for k, vv := range res.Header {
+			for _, v := range vv {
+				h.Add(k, v)
+			}
+		}
+		status := res.Status
+		if status == 0 {
+			status = http.StatusForbidden
+		}
+		ctx.Writer.WriteHeader(status)
+		_, _ = ctx.Writer.Write(res.Body)
+		return true, nil
+	}
+	for _, k := range res.Remove {
+		ctx.Request.Header.Del(k)
+	}
+	for k, vv := range res.Header {
+		if !res.Append[k] {
+			ctx.Request.Header.Del(k)
+		}
+		for _, v := range vv {
+			ctx.Request.Header.Add(k, v)
+		}
+	}
+	return false, nil
+}
+
+func (p *ExtAuthzPlugin) AfterDispatch(ctx *RequestContext) {}
+
+func (p *ExtAuthzPlugin) buildRequest(ctx *RequestContext) (*authzRequest, error) {
+	req := ctx.Request
+	areq := &authzRequest{
+		Method:   req.Method,
+		Scheme:   "http",
+		Host:     req.Host,
+		Path:     req.URL.EscapedPath(),
+		Query:    req.URL.RawQuery,
+		Protocol: req.Proto,
+		Header:   http.Header{},
+		Size:     req.ContentLength,
+		ClientIP: ctx.ClientIP,
+	}
+	if req.TLS != nil {
+		areq.Scheme = "https"
+	}
+	if ctx.ClientCert != nil {
+		areq.Principal = ctx.ClientCert.SPIFFEID
+		if areq.Principal == "" {
+			areq.Principal = ctx.ClientCert.Subject
+		}
+	}
+	for k, vv := range req.Header {
+		if p.allowedHeaders != nil {
+			if _, ok := p.allowedHeaders[k]; !ok {
+				continue
+			}
+		}
+		areq.Header[k] = vv
+	}
+	if p.includeBody && req.Body != nil && req.Body != http.NoBody {
+		buf, err := io.ReadAll(io.LimitReader(req.Body, int64(p.maxBody)))
+		if err != nil {
+			return nil, err
+		}
+		areq.Body = buf
+		// hand the consumed prefix back to the upstream request
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+	}
+	return areq, nil
+}
+
+// httpAuthz sends the original method, path and headers to the service; 2xx allows.
+type httpAuthz struct {
+	base            *url.URL
+	client          *http.Client
+	upstreamHeaders []string
+	clientHeaders   []string
+}
+
+func (c *httpAuthz) check(ctx context.Context, areq *authzRequest) (*authzResult, error) {
+	path, err := url.PathUnescape(areq.Path)
+	if err != nil {
+		return nil, err
+	}
+	u := *c.base
+	u.Path = strings.TrimSuffix(c.base.Path, "/") + path
+	u.RawPath = strings.TrimSuffix(c.base.EscapedPath(), "/") + areq.Path
+	u.RawQuery = areq.Query
+	req, err := http.NewRequestWithContext(ctx, areq.Method, u.String(), bytes.NewReader(areq.Body))
+	if err != nil {
+		return nil, err
+	}
+	for k, vv := range areq.Header {
+		if k == "Content-Length" || k == "Connection" || k == "Te" || k == "Upgrade" || k == "Transfer-Encoding" {
+			continue
+		}
+		req.Header[k] = vv
+	}
+	req.Host = areq.Host
+	if areq.ClientIP != "" {
+		req.Header.Set("X-Forwarded-For", areq.ClientIP)
+	}
+	req.Header.Set("X-Forwarded-Proto", areq.Scheme)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return nil, fmt.Errorf("authorization service returned %d", resp.StatusCode)
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return &authzResult{Allowed: true, Header: pickHeaders(resp.Header, c.upstreamHeaders)}, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	return &authzResult{Status: resp.StatusCode, Header: pickHeaders(resp.Header, c.clientHeaders), Body: body}, nil
+}
+
+func pickHeaders(src http.Header, names []string) http.Header {
+	out := http.Header{}
+	for _, n := range names {
+		if vv := src.Values(n); len(vv) > 0 {
+			out[http.CanonicalHeaderKey(n)] = vv
+		}
+	}
+	return out
+}
+
+func init() { Register("ext-authz", func() Plugin { return &ExtAuthzPlugin{} }) }
@@ -0,0 +1,318 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http2"
+)
+
+// authzCheckMethod is the Envoy external authorization service method.
+const authzCheckMethod = "/envoy.service.auth.v3.Authorization/Check"
+
+// grpcAuthz calls an Envoy-compatible Authorization/Check service. The few messages
+// involved are encoded by hand to avoid pulling in the gRPC and protobuf runtimes.
+type grpcAuthz struct {
+	url        string
+	client     *http.Client
+	extensions map[string]string
+}
+
+func newGRPCAuthz(base *url.URL, extensions map[string]string) *grpcAuthz {
+	tr := &http2.Transport{}
+	if base.Scheme == "http" {
+		// cleartext HTTP/2 (h2c)
+		tr.AllowHTTP = true
+		tr.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		}
+	}
+	return &grpcAuthz{
+		url:        strings.TrimSuffix(base.String(), "/") + authzCheckMethod,
+		client:     &http.Client{Transport: tr},
+		extensions: extensions,
+	}
+}
+
+func (c *grpcAuthz) check(ctx context.Context, areq *authzRequest) (*authzResult, error) {
+	msg := encodeCheckRequest(areq, c.extensions)
+	frame := make([]byte, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(msg)))
+	copy(frame[5:], msg)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(frame))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("authorization service returned http %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	// trailers-only responses carry grpc-status in the headers
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+	}
+	if status != "0" {
+		return nil, fmt.Errorf("authorization service grpc-status %s: %s", status, resp.Trailer.Get("Grpc-Message"))
+	}
+	if len(data) < 5 || data[0] != 0 || int(binary.BigEndian.Uint32(data[1:5])) != len(data)-5 {
+		return nil, errors.New("malformed grpc response frame")
+	}
+	return decodeCheckResponse(data[5:])
+}
+
+// encodeCheckRequest builds envoy.service.auth.v3.CheckRequest{attributes: AttributeContext}.
+func encodeCheckRequest(areq *authzRequest, extensions map[string]string) []byte {
+	var attrs pbEncoder
+	if areq.ClientIP != "" || areq.Principal != "" {
+		attrs.message(1, func(peer *pbEncoder) { // source: Peer
+			if areq.ClientIP != "" {
+				peer.message(1, func(addr *pbEncoder) { // address: Address
+					addr.message(1, func(sa *pbEncoder) { // socket_address: SocketAddress
+						sa.string(2, areq.ClientIP)
+					})
+				})
+			}
+			peer.string(4, areq.Principal)
+		})
+	}
+	attrs.message(4, func(r *pbEncoder) { // request: AttributeContext.Request
+		r.message(2, func(h *pbEncoder) { // http: HttpRequest
+			h.string(2, areq.Method)
+			headers := map[string]string{}
+			for k, vv := range areq.Header {
+				headers[strings.ToLower(k)] = strings.Join(vv, ",")
+			}
+			headers[":authority"] = areq.Host
+			headers[":method"] = areq.Method
+			path := areq.Path
+			if areq.Query != "" {
+				path += "?" + areq.Query
+			}
+			headers[":path"] = path
+			h.stringMap(3, headers)
+			h.string(4, path)
+			h.string(5, areq.Host)
+			h.string(6, areq.Scheme)
+			h.string(7, areq.Query)
+			if areq.Size > 0 {
+				h.varint(9, uint64(areq.Size))
+			}
+			h.string(10, areq.Protocol)
+			h.bytes(12, areq.Body) // raw_body
+		})
+	})
+	attrs.stringMap(10, extensions)
+
+	var req pbEncoder
+	req.message(1, func(e *pbEncoder) { e.buf = append(e.buf, attrs.buf...) })
+	return req.buf
+}
+
+// decodeCheckResponse reads envoy.service.auth.v3.CheckResponse: status (google.rpc.Status),
+// denied_response (DeniedHttpResponse) and ok_response (OkHttpResponse).
+func decodeCheckResponse(b []byte) (*authzResult, error) {
+	res := &authzResult{Header: http.Header{}, Append: map[string]bool{}}
+	code := uint64(0)
+	err := pbFields(b, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1: // status
+			return pbFields(data, func(f int, v uint64, _ []byte) error {
+				if f == 1 {
+					code = v
+				}
+				return nil
+			})
+		case 2: // denied_response
+			return pbFields(data, func(f int, v uint64, d []byte) error {
+				switch f {
+				case 1: // status: HttpStatus{code}
+					return pbFields(d, func(f int, v uint64, _ []byte) error {
+						if f == 1 {
+							res.Status = int(v)
+						}
+						return nil
+					})
+				case 2:
+					return decodeHeaderOption(d, res)
+				case 3:
+					res.Body = append([]byte(nil), d...)
+				}
+				return nil
+			})
+		case 3: // ok_response
+			return pbFields(data, func(f int, v uint64, d []byte) error {
+				switch f {
+				case 2:
+					return decodeHeaderOption(d, res)
+				case 5: // headers_to_remove
+					res.Remove = append(res.Remove, string(d))
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	res.Allowed = code == 0
+	if !res.Allowed && res.Status == 0 {
+		res.Status = http.StatusForbidden
+	}
+	return res, nil
+}
+
+// decodeHeaderOption reads config.core.v3.HeaderValueOption{header: {key, value}, append}.
+func decodeHeaderOption(b []byte, res *authzResult) error {
+	var key, value string
+	appendValue := false
+	err := pbFields(b, func(f int, _ uint64, d []byte) error {
+		switch f {
+		case 1:
+			return pbFields(d, func(f int, _ uint64, d []byte) error {
+				switch f {
+				case 1:
+					key = string(d)
+				case 2:
+					value = string(d)
+				}
+				return nil
+			})
+		case 2: // google.protobuf.BoolValue
+			return pbFields(d, func(f int, v uint64, _ []byte) error {
+				if f == 1 {
+					appendValue = v != 0
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil || key == "" {
+		return err
+	}
+	k := http.CanonicalHeaderKey(key)
+	res.Header.Add(k, value)
+	if appendValue {
+		res.Append[k] = true
+	}
+	return nil
+}
+
+// pbEncoder appends protobuf wire-format fields.
+type pbEncoder struct{ buf []byte }
+
+func (e *pbEncoder) tag(field, wire int) {
+	e.buf = binary.AppendUvarint(e.buf, uint64(field)<<3|uint64(wire))
+}
+
+func (e *pbEncoder) varint(field int, v uint64) {
+	e.tag(field, 0)
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+func (e *pbEncoder) bytes(field int, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	e.tag(field, 2)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *pbEncoder) string(field int, s string) { e.bytes(field, []byte(s)) }
+
+func (e *pbEncoder) message(field int, fn func(*pbEncoder)) {
+	var sub pbEncoder
+	fn(&sub)
+	e.tag(field, 2)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(sub.buf)))
+	e.buf = append(e.buf, sub.buf...)
+}
+
+// stringMap encodes map<string, string> in key order.
+func (e *pbEncoder) stringMap(field int, m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := m[k]
+		e.message(field, func(entry *pbEncoder) {
+			entry.string(1, k)
+			entry.string(2, v)
+		})
+	}
+}
+
+// pbFields walks the fields of a protobuf message. Varint fields are passed in v and
+// length-delimited fields in data; fixed-width fields are skipped.
+func pbFields(b []byte, fn func(field int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("protobuf: bad tag")
+		}
+		b = b[n:]
+		field, wire := int(key>>3), int(key&7)
+		var v uint64
+		var data []byte
+		switch wire {
+		case 0:
+			v, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errors.New("protobuf: bad varint")
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return errors.New("protobuf: truncated fixed64")
+			}
+			b = b[8:]
+			continue
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errors.New("protobuf: truncated field")
+			}
+			data = b[n : n+int(l)]
+			b = b[n+int(l):]
+		case 5:
+			if len(b) < 4 {
+				return errors.New("protobuf: truncated fixed32")
+			}
+			b = b[4:]
+			continue
+		default:
+			return errors.New("protobuf: unsupported wire type " + strconv.Itoa(wire))
+		}
+		if err := fn(field, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package plugin
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func runExtAuthz(t *testing.T, p *ExtAuthzPlugin, method, target, body string) (*RequestContext, *httptest.ResponseRecorder, bool) {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer ok")
+	req.Header.Set("X-User-ID", "spoofed")
+	rec := httptest.NewRecorder()
+	ctx := &RequestContext{Context: req.Context(), Writer: rec, Request: req, ClientIP: "203.0.113.7"}
+	handled, err := p.BeforeDispatch(ctx)
+	if err != nil {
+		t.Fatalf("before dispatch: %v", err)
+	}
+	return ctx, rec, handled
+}
+
+func TestExtAuthzHTTP(t *testing.T) {
+	// the slow check outlives the plugin's timeout, so captures are guarded
+	var mu sync.Mutex
+	var gotPath, gotBody, gotXFF string
+	authz := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		gotPath, gotXFF, gotBody = r.URL.RequestURI(), r.Header.Get("X-Forwarded-For"), string(b)
+		mu.Unlock()
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/check/slow"):
+			time.Sleep(200 * time.Millisecond)
+		case strings.HasPrefix(r.URL.Path, "/check/broken"):
+			w.WriteHeader(http.StatusInternalServerError)
+		case r.Header.Get("Authorization") == "Bearer ok" && !strings.HasPrefix(r.URL.Path, "/check/admin"):
+			w.Header().Set("X-User-ID", "alice")
+			w.Header().Set("X-Internal", "secret")
+		default:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="authz"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte("denied by policy"))
+		}
+	}))
+	defer authz.Close()
+
+	p := &ExtAuthzPlugin{}
+	if err := p.Init(map[string]any{
+		"url":              authz.URL + "/check",
+		"timeout_ms":       50,
+		"include_body":     true,
+		"max_body_bytes":   4,
+		"upstream_headers": []any{"X-User-ID"},
+	}); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+
+	ctx, _, handled := runExtAuthz(t, p, http.MethodPost, "http://agw/orders?id=1", "payload")
+	if handled {
+		t.Fatal("allowed request was short-circuited")
+	}
+	mu.Lock()
+	path, body, xff := gotPath, gotBody, gotXFF
+	mu.Unlock()
+	if path != "/check/orders?id=1" || body != "payl" || xff != "203.0.113.7" {
+		t.Fatalf("authz saw path=%q body=%q xff=%q", path, body, xff)
+	}
+	if ctx.Request.Header.Get("X-User-ID") != "alice" || ctx.Request.Header.Get("X-Internal") != "" {
+		t.Fatalf("unexpected injected headers: %v", ctx.Request.Header)
+	}
+	if b, _ := io.ReadAll(ctx.Request.Body); string(b) != "payload" {
+		t.Fatalf("request body not restored: %q", b)
+	}
+
+	_, rec, handled := runExtAuthz(t, p, http.MethodGet, "http://agw/admin", "")
+	if !handled || rec.Code != http.StatusUnauthorized || rec.Body.String() != "denied by policy" || rec.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("denial not relayed: handled=%v code=%d body=%q", handled, rec.Code, rec.Body)
+	}
+
+	for _, path := range []string{"/slow", "/broken"} {
+		if _, rec, handled := runExtAuthz(t, p, http.MethodGet, "http://agw"+path, ""); !handled || rec.Code != http.StatusForbidden {
+			t.Fatalf("%s fail-closed: handled=%v code=%d", path, handled, rec.Code)
+		}
+	}
+	p.failOpen = true
+	if _, _, handled := runExtAuthz(t, p, http.MethodGet, "http://agw/slow", ""); handled {
+		t.Fatal("fail-open request was rejected")
+	}
+}
+
+func TestExtAuthzGRPC(t *testing.T) {
+	var gotPath, gotTenant, gotSource string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != authzCheckMethod || r.Header.Get("Content-Type") != "application/grpc" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		_ = pbFields(data[5:], func(f int, _ uint64, attrs []byte) error {
+			return pbFields(attrs, func(f int, _ uint64, d []byte) error {
+				switch f {
+				case 1:
+					gotSource = string(d)
+				case 4:
+					_ = pbFields(d, func(f int, _ uint64, httpReq []byte) error {
+						return pbFields(httpReq, func(f int, _ uint64, d []byte) error {
+							if f == 4 {
+								gotPath = string(d)
+							}
+							return nil
+						})
+					})
+				case 10:
+					_ = pbFields(d, func(f int, _ uint64, d []byte) error {
+						if f == 2 {
+							gotTenant = string(d)
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+		})
+
+		header := func(e *pbEncoder, k, v string) {
+			e.message(1, func(h *pbEncoder) { h.string(1, k); h.string(2, v) })
+		}
+		var resp pbEncoder
+		if strings.HasPrefix(gotPath, "/public") {
+			resp.message(1, func(s *pbEncoder) {})
+			resp.message(3, func(ok *pbEncoder) {
+				ok.message(2, func(o *pbEncoder) { header(o, "x-user-id", "svc") })
+				ok.string(5, "authorization")
+			})
+		} else {
+			resp.message(1, func(s *pbEncoder) { s.varint(1, 7) })
+			resp.message(2, func(d *pbEncoder) {
+				d.message(1, func(s *pbEncoder) { s.varint(1, 401) })
+				d.message(2, func(o *pbEncoder) { header(o, "www-authenticate", "Basic") })
+				d.string(3, "nope")
+			})
+		}
+		frame := make([]byte, 5, 5+len(resp.buf))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(resp.buf)))
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		_, _ = w.Write(append(frame, resp.buf...))
+		w.Header().Set("Grpc-Status", "0")
+	})
+	srv := httptest.NewServer(h2c.NewHandler(h, &http2.Server{}))
+	defer srv.Close()
+
+	p := &ExtAuthzPlugin{}
+	if err := p.Init(map[string]any{
+		"mode":               "grpc",
+		"url":                srv.URL,
+		"timeout_ms":         1000,
+		"context_extensions": map[string]any{"tenant": "acme"},
+	}); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+
+	ctx, rec, handled := runExtAuthz(t, p, http.MethodGet, "http://agw/public/x?y=1", "")
+	if handled {
+		t.Fatalf("allowed request rejected: %d %s", rec.Code, rec.Body)
+	}
+	if gotPath != "/public/x?y=1" || gotTenant != "acme" || !strings.Contains(gotSource, "203.0.113.7") {
+		t.Fatalf("check request: path=%q tenant=%q source=%q", gotPath, gotTenant, gotSource)
+	}
+	if ctx.Request.Header.Get("X-User-ID") != "svc" || ctx.Request.Header.Get("Authorization") != "" {
+		t.Fatalf("ok_response not applied: %v", ctx.Request.Header)
+	}
+
+	_, rec, handled = runExtAuthz(t, p, http.MethodGet, "http://agw/private", "")
+	if !handled || rec.Code != http.StatusUnauthorized || rec.Body.String() != "nope" || rec.Header().Get("WWW-Authenticate") != "Basic" {
+		t.Fatalf("denied_response not relayed: handled=%v code=%d body=%q", handled, rec.Code, rec.Body)
+	}
+}
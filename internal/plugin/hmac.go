@@ -0,0 +1,338 @@
+package plugin
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HMACPlugin verifies HMAC-SHA256 request signatures.
+// Config:
+//
+//	format: "canonical"                 // canonical | github | stripe | slack | rfc9421
+//	secret: "..."                       // single shared secret, or
+//	secrets: { partner-a: "...", partner-b: "..." }  // by key id (all are tried when no key id is sent)
+//	clock_skew_ms: 300000               // accepted timestamp drift
+//	nonce_ttl_ms: 600000                // how long nonces/signatures are remembered (default 2x skew)
+//	max_body_bytes: 1048576
+//
+//	# canonical format: HMAC over the components joined by "\n"
+//	signature_header: "X-Signature"     // hex or base64
+//	key_id_header: "X-Key-Id"
+//	timestamp_header: "X-Timestamp"     // unix seconds; "" disables freshness checks
+//	nonce_header: "X-Nonce"
+//	components: ["method", "path", "query", "timestamp", "nonce", "header:content-type", "body-sha256"]
+//
+//	# rfc9421 format
+//	signature_label: "sig1"             // default: first signature in Signature-Input
+//	required_components: ["@method", "@authority", "@path"]
+//
+// Rejections are 401 (413 for oversized bodies) with a JSON body {"error", "reason", "message"}.
+type HMACPlugin struct {
+	format      string
+	secrets     map[string][]byte
+	skew        time.Duration
+	maxBody     int64
+	sigHeader   string
+	keyIDHeader string
+	tsHeader    string
+	nonceHeader string
+	components  []string
+	label       string
+	required    []string
+	nonces      *nonceCache
+	now         func() time.Time
+}
+
+// sigError is a structured verification failure.
+type sigError struct {
+	status  int
+	reason  string
+	message string
+}
+
+func (e *sigError) Error() string { return e.reason + ": " + e.message }
+
+func sigFail(reason, format string, args ...any) *sigError {
+	return &sigError{status: http.StatusUnauthorized, reason: reason, message: fmt.Sprintf(format, args...)}
+}
+
+var defaultCanonicalComponents = []string{"method", "path", "query", "timestamp", "nonce", "body-sha256"}
+
+func (p *HMACPlugin) Name() string { return "hmac-auth" }
+
+func (p *HMACPlugin) Init(cfg map[string]any) error {
+	p.format = getStringOr(cfg, "format", "canonical")
+	switch p.format {
+	case "canonical", "github", "stripe", "slack", "rfc9421":
+	default:
+		return fmt.Errorf("hmac-auth: unknown format %q", p.format)
+	}
+	p.secrets = map[string][]byte{}
+	if s := getStringOr(cfg, "secret", ""); s != "" {
+		p.secrets[""] = []byte(s)
+	}
+	for id, s := range getStringMap(cfg, "secrets") {
+		p.secrets[id] = []byte(s)
+	}
+	if len(p.secrets) == 0 {
+		return errors.New("hmac-auth: secret or secrets required")
+	}
+	p.skew = time.Duration(getIntOr(cfg, "clock_skew_ms", 300000)) * time.Millisecond
+	p.maxBody = int64(getIntOr(cfg, "max_body_bytes", 1<<20))
+	p.sigHeader = getStringOr(cfg, "signature_header", "X-Signature")
+	p.keyIDHeader = getStringOr(cfg, "key_id_header", "X-Key-Id")
+	p.tsHeader = "X-Timestamp"
+	if v, ok := cfg["timestamp_header"].(string); ok {
+		p.tsHeader = v
+	}
+	p.nonceHeader = getStringOr(cfg, "nonce_header", "X-Nonce")
+	p.components = getStrings(cfg, "components")
+	if len(p.components) == 0 {
+		p.components = defaultCanonicalComponents
+	}
+	for _, c := range p.components {
+		switch {
+		case c == "method", c == "path", c == "query", c == "timestamp", c == "nonce", c == "body-sha256", strings.HasPrefix(c, "header:"):
+		default:
+			return fmt.Errorf("hmac-auth: unknown component %q", c)
+		}
+	}
+	p.label = getStringOr(cfg, "signature_label", "")
+	p.required = getStrings(cfg, "required_components")
+	if len(p.required) == 0 {
+		p.required = []string{"@method", "@authority", "@path"}
+	}
+	ttl := time.Duration(getIntOr(cfg, "nonce_ttl_ms", int(2*p.skew/time.Millisecond))) * time.Millisecond
+	p.nonces = newNonceCache(ttl)
+	p.now = time.Now
+	return nil
+}
+
+func (p *HMACPlugin) BeforeDispatch(ctx *RequestContext) (bool, error) {
+	var err *sigError
+	switch p.format {
+	case "canonical":
+		err = p.verifyCanonical(ctx.Request)
+	case "github":
+		err = p.verifyGitHub(ctx.Request)
+	case "stripe":
+		err = p.verifyStripe(ctx.Request)
+	case "slack":
+		err = p.verifySlack(ctx.Request)
+	case "rfc9421":
+		err = p.verifyRFC9421(ctx.Request)
+	}
+	if err != nil {
+		if ctx.Logger != nil {
+			ctx.Logger.Infow("request signature rejected", "format", p.format, "reason", err.reason, "err", err.message)
+		}
+		ctx.Writer.Header().Set("Content-Type", "application/json")
+		ctx.Writer.WriteHeader(err.status)
+		_ = json.NewEncoder(ctx.Writer).Encode(map[string]string{"error": "invalid_signature", "reason": err.reason, "message": err.message})
+		return true, nil
+	}
+	return false, nil
+}
+
+func (p *HMACPlugin) AfterDispatch(ctx *RequestContext) {}
+
+func (p *HMACPlugin) verifyCanonical(req *http.Request) *sigError {
+	sig := req.Header.Get(p.sigHeader)
+	if sig == "" {
+		return sigFail("missing_signature", "%s header required", p.sigHeader)
+	}
+	mac, ok := decodeSignature(sig)
+	if !ok {
+		return sigFail("malformed_signature", "signature is neither hex nor base64")
+	}
+	keys, serr := p.keysFor(req.Header.Get(p.keyIDHeader))
+	if serr != nil {
+		return serr
+	}
+	ts := ""
+	if p.tsHeader != "" {
+		ts = req.Header.Get(p.tsHeader)
+		if serr := p.checkUnixTimestamp(ts); serr != nil {
+			return serr
+		}
+	}
+	nonce := req.Header.Get(p.nonceHeader)
+	parts := make([]string, 0, len(p.components))
+	for _, c := range p.components {
+		switch {
+		case c == "method":
+			parts = append(parts, req.Method)
+		case c == "path":
+			parts = append(parts, req.URL.EscapedPath())
+		case c == "query":
+			parts = append(parts, req.URL.RawQuery)
+		case c == "timestamp":
+			parts = append(parts, ts)
+		case c == "nonce":
+			parts = append(parts, nonce)
+		case c == "body-sha256":
+			body, serr := p.readBody(req)
+			if serr != nil {
+				return serr
+			}
+			sum := sha256.Sum256(body)
+			parts = append(parts, hex.EncodeToString(sum[:]))
+		case strings.HasPrefix(c, "header:"):
+			name := strings.TrimPrefix(c, "header:")
+			if strings.EqualFold(name, "host") {
+				parts = append(parts, req.Host)
+			} else {
+				parts = append(parts, strings.Join(req.Header.Values(name), ","))
+			}
+		}
+	}
+	if !macMatches(keys, []byte(strings.Join(parts, "\n")), mac) {
+		return sigFail("signature_mismatch", "signature does not match the canonical request")
+	}
+	replayKey := nonce
+	if replayKey == "" {
+		replayKey = sig
+	}
+	return p.checkReplay(req.Header.Get(p.keyIDHeader) + "|" + replayKey)
+}
+
+// keysFor returns the secret for a key id, or every secret when no id was sent.
+func (p *HMACPlugin) keysFor(keyID string) ([][]byte, *sigError) {
+	if keyID != "" {
+		k, ok := p.secrets[keyID]
+		if !ok {
+			return nil, sigFail("unknown_key", "key id %q is not configured", keyID)
+		}
+		return [][]byte{k}, nil
+	}
+	ids := make([]string, 0, len(p.secrets))
+	for id := range p.secrets {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	keys := make([][]byte, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, p.secrets[id])
+	}
+	return keys, nil
+}
+
+func (p *HMACPlugin) checkUnixTimestamp(ts string) *sigError {
+	if ts == "" {
+		return sigFail("missing_timestamp", "timestamp required")
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return sigFail("malformed_timestamp", "timestamp %q is not unix seconds", ts)
+	}
+	return p.checkFreshness(time.Unix(sec, 0))
+}
+
+func (p *HMACPlugin) checkFreshness(t time.Time) *sigError {
+	if d := p.now().Sub(t); math.Abs(float64(d)) > float64(p.skew) {
+		return sigFail("timestamp_expired", "timestamp is %s away from gateway time", d.Round(time.Second))
+	}
+	return nil
+}
+
+func (p *HMACPlugin) checkReplay(key string) *sigError {
+	if !p.nonces.add(key, p.now()) {
+		return sigFail("replayed_request", "nonce or signature was already used")
+	}
+	return nil
+}
+
+// readBody buffers the request body for hashing and hands an identical copy to the upstream.
+func (p *HMACPlugin) readBody(req *http.Request) ([]byte, *sigError) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, p.maxBody+1))
+	_ = req.Body.Close()
+	if err != nil {
+		return nil, sigFail("unreadable_body", "%v", err)
+	}
+	if int64(len(body)) > p.maxBody {
+		return nil, &sigError{status: http.StatusRequestEntityTooLarge, reason: "body_too_large", message: fmt.Sprintf("body exceeds %d bytes", p.maxBody)}
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	return body, nil
+}
+
+func hmacSHA256(key, msg []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write(msg)
+	return m.Sum(nil)
+}
+
+func macMatches(keys [][]byte, msg, mac []byte) bool {
+	for _, k := range keys {
+		if hmac.Equal(hmacSHA256(k, msg), mac) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeSignature accepts a hex or (URL-safe) base64 HMAC-SHA256 value.
+func decodeSignature(s string) ([]byte, bool) {
+	if len(s) == 2*sha256.Size {
+		if b, err := hex.DecodeString(s); err == nil {
+			return b, true
+		}
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		if b, err := enc.DecodeString(s); err == nil && len(b) == sha256.Size {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+// nonceCache remembers values for a fixed TTL to detect replays.
+type nonceCache struct {
+	ttl       time.Duration
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	nextSweep time.Time
+}
+
+func newNonceCache(ttl time.Duration) *nonceCache {
+	return &nonceCache{ttl: ttl, seen: map[string]time.Time{}}
+}
+
+// add records key and reports whether it was unseen.
+func (c *nonceCache) add(key string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.After(c.nextSweep) {
+		for k, exp := range c.seen {
+			if now.After(exp) {
+				delete(c.seen, k)
+			}
+		}
+		c.nextSweep = now.Add(c.ttl / 2)
+	}
+	if exp, ok := c.seen[key]; ok && !now.After(exp) {
+		return false
+	}
+	c.seen[key] = now.Add(c.ttl)
+	return true
+}
+
+func init() { Register("hmac-auth", func() Plugin { return &HMACPlugin{} }) }
@@ -0,0 +1,316 @@
+package plugin
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// verifyGitHub checks X-Hub-Signature-256: sha256=<hex HMAC of the body>. GitHub sends no
+// timestamp, so replays are detected by the X-GitHub-Delivery id.
+func (p *HMACPlugin) verifyGitHub(req *http.Request) *sigError {
+	v := req.Header.Get("X-Hub-Signature-256")
+	if v == "" {
+		return sigFail("missing_signature", "X-Hub-Signature-256 header required")
+	}
+	mac, err := hex.DecodeString(strings.TrimPrefix(v, "sha256="))
+	if err != nil || !strings.HasPrefix(v, "sha256=") {
+		return sigFail("malformed_signature", "expected sha256=<hex>")
+	}
+	body, serr := p.readBody(req)
+	if serr != nil {
+		return serr
+	}
+	keys, _ := p.keysFor("")
+	if !macMatches(keys, body, mac) {
+		return sigFail("signature_mismatch", "signature does not match the payload")
+	}
+	if id := req.Header.Get("X-GitHub-Delivery"); id != "" {
+		return p.checkReplay("github|" + id)
+	}
+	return nil
+}
+
+// verifyStripe checks Stripe-Signature: t=<unix>,v1=<hex HMAC of "t.body">[,v1=...].
+func (p *HMACPlugin) verifyStripe(req *http.Request) *sigError {
+	v := req.Header.Get("Stripe-Signature")
+	if v == "" {
+		return sigFail("missing_signature", "Stripe-Signature header required")
+	}
+	var ts string
+	var macs [][]byte
+	for _, item := range strings.Split(v, ",") {
+		k, val, _ := strings.Cut(strings.TrimSpace(item), "=")
+		switch k {
+		case "t":
+			ts = val
+		case "v1":
+			if b, err := hex.DecodeString(val); err == nil {
+				macs = append(macs, b)
+			}
+		}
+	}
+	if len(macs) == 0 {
+		return sigFail("malformed_signature", "no v1 signature in Stripe-Signature")
+	}
+	if serr := p.checkUnixTimestamp(ts); serr != nil {
+		return serr
+	}
+	body, serr := p.readBody(req)
+	if serr != nil {
+		return serr
+	}
+	keys, _ := p.keysFor("")
+	msg := append([]byte(ts+"."), body...)
+	for _, mac := range macs {
+		if macMatches(keys, msg, mac) {
+			return p.checkReplay("stripe|" + hex.EncodeToString(mac))
+		}
+	}
+	return sigFail("signature_mismatch", "signature does not match the payload")
+}
+
+// verifySlack checks X-Slack-Signature: v0=<hex HMAC of "v0:ts:body"> with X-Slack-Request-Timestamp.
+func (p *HMACPlugin) verifySlack(req *http.Request) *sigError {
+	v := req.Header.Get("X-Slack-Signature")
+	if v == "" {
+		return sigFail("missing_signature", "X-Slack-Signature header required")
+	}
+	mac, err := hex.DecodeString(strings.TrimPrefix(v, "v0="))
+	if err != nil || !strings.HasPrefix(v, "v0=") {
+		return sigFail("malformed_signature", "expected v0=<hex>")
+	}
+	ts := req.Header.Get("X-Slack-Request-Timestamp")
+	if serr := p.checkUnixTimestamp(ts); serr != nil {
+		return serr
+	}
+	body, serr := p.readBody(req)
+	if serr != nil {
+		return serr
+	}
+	keys, _ := p.keysFor("")
+	if !macMatches(keys, append([]byte("v0:"+ts+":"), body...), mac) {
+		return sigFail("signature_mismatch", "signature does not match the payload")
+	}
+	return p.checkReplay("slack|" + hex.EncodeToString(mac))
+}
+
+// verifyRFC9421 checks an HTTP Message Signature (RFC 9421) using alg="hmac-sha256".
+func (p *HMACPlugin) verifyRFC9421(req *http.Request) *sigError {
+	inputs := req.Header.Get("Signature-Input")
+	sigs := req.Header.Get("Signature")
+	if inputs == "" || sigs == "" {
+		return sigFail("missing_signature", "Signature and Signature-Input headers required")
+	}
+	label, params, ok := pickSignatureInput(inputs, p.label)
+	if !ok {
+		return sigFail("malformed_signature", "no usable entry in Signature-Input")
+	}
+	mac, ok := signatureFor(sigs, label)
+	if !ok {
+		return sigFail("malformed_signature", "no signature labelled %q", label)
+	}
+	components, attrs, ok := parseSignatureParams(params)
+	if !ok {
+		return sigFail("malformed_signature", "cannot parse signature parameters")
+	}
+	for _, r := range p.required {
+		if !containsString(components, r) {
+			return sigFail("missing_component", "signature must cover %s", r)
+		}
+	}
+	if alg := attrs["alg"]; alg != "" && alg != "hmac-sha256" {
+		return sigFail("unsupported_algorithm", "algorithm %q not supported", alg)
+	}
+	created, err := strconv.ParseInt(attrs["created"], 10, 64)
+	if err != nil {
+		return sigFail("missing_timestamp", "created parameter required")
+	}
+	if serr := p.checkFreshness(time.Unix(created, 0)); serr != nil {
+		return serr
+	}
+	if exp, err := strconv.ParseInt(attrs["expires"], 10, 64); err == nil && !p.now().Before(time.Unix(exp, 0)) {
+		return sigFail("timestamp_expired", "signature expired")
+	}
+	keys, serr := p.keysFor(attrs["keyid"])
+	if serr != nil {
+		return serr
+	}
+	if req.Header.Get("Content-Digest") != "" {
+		if serr := p.checkContentDigest(req); serr != nil {
+			return serr
+		}
+	}
+
+	var base strings.Builder
+	for _, c := range components {
+		v, ok := signatureComponent(req, c)
+		if !ok {
+			return sigFail("missing_component", "request has no %s", c)
+		}
+		base.WriteString(strconv.Quote(c) + ": " + v + "\n")
+	}
+	base.WriteString(`"@signature-params": ` + params)
+	if !macMatches(keys, []byte(base.String()), mac) {
+		return sigFail("signature_mismatch", "signature does not match the signature base")
+	}
+	replay := attrs["nonce"]
+	if replay == "" {
+		replay = base64.StdEncoding.EncodeToString(mac)
+	}
+	return p.checkReplay("rfc9421|" + attrs["keyid"] + "|" + replay)
+}
+
+// checkContentDigest verifies an RFC 9530 Content-Digest (sha-256 or sha-512) against the body.
+func (p *HMACPlugin) checkContentDigest(req *http.Request) *sigError {
+	body, serr := p.readBody(req)
+	if serr != nil {
+		return serr
+	}
+	for _, item := range splitTopLevel(req.Header.Get("Content-Digest")) {
+		alg, val, _ := strings.Cut(strings.TrimSpace(item), "=")
+		want, err := base64.StdEncoding.DecodeString(strings.Trim(val, ":"))
+		if err != nil {
+			continue
+		}
+		var got []byte
+		switch alg {
+		case "sha-256":
+			s := sha256.Sum256(body)
+			got = s[:]
+		case "sha-512":
+			s := sha512.Sum512(body)
+			got = s[:]
+		default:
+			continue
+		}
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			return sigFail("digest_mismatch", "Content-Digest %s does not match the body", alg)
+		}
+		return nil
+	}
+	return sigFail("digest_mismatch", "Content-Digest has no supported algorithm")
+}
+
+// signatureComponent renders one covered component value (RFC 9421 section 2).
+func signatureComponent(req *http.Request, name string) (string, bool) {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	switch name {
+	case "@method":
+		return req.Method, true
+	case "@authority":
+		return strings.ToLower(req.Host), true
+	case "@scheme":
+		return scheme, true
+	case "@target-uri":
+		return scheme + "://" + strings.ToLower(req.Host) + req.URL.RequestURI(), true
+	case "@request-target":
+		return req.URL.RequestURI(), true
+	case "@path":
+		return req.URL.EscapedPath(), true
+	case "@query":
+		return "?" + req.URL.RawQuery, true
+	}
+	if strings.HasPrefix(name, "@") {
+		return "", false
+	}
+	vv := req.Header.Values(name)
+	if strings.EqualFold(name, "host") && len(vv) == 0 && req.Host != "" {
+		vv = []string{req.Host}
+	}
+	if len(vv) == 0 {
+		return "", false
+	}
+	for i, v := range vv {
+		vv[i] = strings.TrimSpace(v)
+	}
+	return strings.Join(vv, ", "), true
+}
+
+// pickSignatureInput returns the label and raw parameters ("(...);created=...") of the
+// wanted signature, or of the first one when label is empty.
+func pickSignatureInput(header, label string) (string, string, bool) {
+	for _, member := range splitTopLevel(header) {
+		name, params, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok || !strings.HasPrefix(params, "(") {
+			continue
+		}
+		if label == "" || name == label {
+			return name, params, true
+		}
+	}
+	return "", "", false
+}
+
+func signatureFor(header, label string) ([]byte, bool) {
+	for _, member := range splitTopLevel(header) {
+		name, val, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok || name != label || len(val) < 2 || val[0] != ':' || val[len(val)-1] != ':' {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(val[1 : len(val)-1])
+		return b, err == nil
+	}
+	return nil, false
+}
+
+// parseSignatureParams splits `("@method" "content-digest");created=1;keyid="k"` into
+// the component names and parameters.
+func parseSignatureParams(s string) ([]string, map[string]string, bool) {
+	end := strings.IndexByte(s, ')')
+	if !strings.HasPrefix(s, "(") || end < 0 {
+		return nil, nil, false
+	}
+	var components []string
+	for _, item := range strings.Fields(s[1:end]) {
+		name, err := strconv.Unquote(item)
+		if err != nil || name == "" {
+			// component parameters (;sf, ;key, ...) are not supported
+			return nil, nil, false
+		}
+		components = append(components, strings.ToLower(name))
+	}
+	attrs := map[string]string{}
+	for _, kv := range strings.Split(s[end+1:], ";") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			continue
+		}
+		if uq, err := strconv.Unquote(v); err == nil {
+			v = uq
+		}
+		attrs[k] = v
+	}
+	return components, attrs, true
+}
+
+// splitTopLevel splits a structured-field list or dictionary on commas outside
+// parentheses and quoted strings.
+func splitTopLevel(s string) []string {
+	var out []string
+	depth, quoted, start := 0, false, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' && (i == 0 || s[i-1] != '\\'):
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			out = append(out, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(out, s[start:])
+}
@@ -0,0 +1,173 @@
+package plugin
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func hexMAC(key, msg string) string { return hex.EncodeToString(hmacSHA256([]byte(key), []byte(msg))) }
+
+func runSigned(p Plugin, req *http.Request) (*httptest.ResponseRecorder, bool, string) {
+	rec := httptest.NewRecorder()
+	ctx := &RequestContext{Context: req.Context(), Writer: rec, Request: req}
+	handled, _ := p.BeforeDispatch(ctx)
+	var body struct{ Reason string }
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	return rec, handled, body.Reason
+}
+
+func TestHMACCanonical(t *testing.T) {
+	p := &HMACPlugin{}
+	if err := p.Init(map[string]any{"secrets": map[string]any{"partner-a": "key-a", "partner-b": "key-b"}}); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	now := time.Now()
+	sign := func(keyID, key, nonce string, ts time.Time, body string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "http://agw/orders?id=1", strings.NewReader(body))
+		stamp := strconv.FormatInt(ts.Unix(), 10)
+		sum := sha256.Sum256([]byte(body))
+		canonical := strings.Join([]string{"POST", "/orders", "id=1", stamp, nonce, hex.EncodeToString(sum[:])}, "\n")
+		req.Header.Set("X-Key-Id", keyID)
+		req.Header.Set("X-Timestamp", stamp)
+		req.Header.Set("X-Nonce", nonce)
+		req.Header.Set("X-Signature", hexMAC(key, canonical))
+		return req
+	}
+
+	req := sign("partner-a", "key-a", "n1", now, `{"qty":1}`)
+	if rec, handled, reason := runSigned(p, req); handled {
+		t.Fatalf("valid signature rejected: %d %s", rec.Code, reason)
+	}
+	if b, _ := io.ReadAll(req.Body); string(b) != `{"qty":1}` {
+		t.Fatalf("body not restored: %q", b)
+	}
+
+	cases := map[string]struct {
+		req    *http.Request
+		reason string
+	}{
+		"replay":      {sign("partner-a", "key-a", "n1", now, `{"qty":1}`), "replayed_request"},
+		"wrong key":   {sign("partner-b", "key-a", "n2", now, `{"qty":1}`), "signature_mismatch"},
+		"unknown key": {sign("partner-c", "key-a", "n3", now, `{"qty":1}`), "unknown_key"},
+		"stale":       {sign("partner-a", "key-a", "n4", now.Add(-time.Hour), `{"qty":1}`), "timestamp_expired"},
+		"missing":     {httptest.NewRequest(http.MethodGet, "http://agw/", nil), "missing_signature"},
+	}
+	tampered := sign("partner-a", "key-a", "n5", now, `{"qty":1}`)
+	tampered.Body = io.NopCloser(strings.NewReader(`{"qty":9}`))
+	cases["tampered body"] = struct {
+		req    *http.Request
+		reason string
+	}{tampered, "signature_mismatch"}
+
+	for name, tc := range cases {
+		rec, handled, reason := runSigned(p, tc.req)
+		if !handled || rec.Code != http.StatusUnauthorized || reason != tc.reason {
+			t.Errorf("%s: handled=%v code=%d reason=%q, want %q", name, handled, rec.Code, reason, tc.reason)
+		}
+	}
+}
+
+func TestHMACProviderFormats(t *testing.T) {
+	now := time.Now()
+	ts := strconv.FormatInt(now.Unix(), 10)
+	body := `{"event":"ping"}`
+	newPlugin := func(format string) *HMACPlugin {
+		p := &HMACPlugin{}
+		if err := p.Init(map[string]any{"format": format, "secret": "whsec"}); err != nil {
+			t.Fatalf("init %s: %v", format, err)
+		}
+		return p
+	}
+	post := func(h map[string]string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "http://agw/hooks", strings.NewReader(body))
+		for k, v := range h {
+			req.Header.Set(k, v)
+		}
+		return req
+	}
+
+	tests := []struct {
+		format string
+		good   map[string]string
+		bad    map[string]string
+	}{
+		{"github",
+			map[string]string{"X-Hub-Signature-256": "sha256=" + hexMAC("whsec", body), "X-GitHub-Delivery": "d1"},
+			map[string]string{"X-Hub-Signature-256": "sha256=" + hexMAC("other", body)}},
+		{"stripe",
+			map[string]string{"Stripe-Signature": "t=" + ts + ",v1=" + hexMAC("old", ts+"."+body) + ",v1=" + hexMAC("whsec", ts+"."+body)},
+			map[string]string{"Stripe-Signature": "t=" + ts + ",v1=" + hexMAC("whsec", body)}},
+		{"slack",
+			map[string]string{"X-Slack-Signature": "v0=" + hexMAC("whsec", "v0:"+ts+":"+body), "X-Slack-Request-Timestamp": ts},
+			map[string]string{"X-Slack-Signature": "v0=" + hexMAC("whsec", "v0:"+ts+":"+body), "X-Slack-Request-Timestamp": "1"}},
+	}
+	for _, tc := range tests {
+		p := newPlugin(tc.format)
+		if rec, handled, reason := runSigned(p, post(tc.good)); handled {
+			t.Errorf("%s: valid signature rejected: %d %s", tc.format, rec.Code, reason)
+		}
+		if _, handled, reason := runSigned(p, post(tc.good)); !handled || reason != "replayed_request" {
+			t.Errorf("%s: replay not detected (%q)", tc.format, reason)
+		}
+		if _, handled, _ := runSigned(p, post(tc.bad)); !handled {
+			t.Errorf("%s: bad signature accepted", tc.format)
+		}
+	}
+}
+
+func TestHMACRFC9421(t *testing.T) {
+	p := &HMACPlugin{}
+	if err := p.Init(map[string]any{
+		"format":              "rfc9421",
+		"secrets":             map[string]any{"test-shared-secret": "s3cret"},
+		"required_components": []any{"@method", "@authority", "@path", "content-digest"},
+	}); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	body := `{"hello": "world"}`
+	sum := sha256.Sum256([]byte(body))
+	digest := "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+	created := strconv.FormatInt(time.Now().Unix(), 10)
+	params := `("@method" "@authority" "@path" "content-digest" "content-type");created=` + created + `;keyid="test-shared-secret";alg="hmac-sha256";nonce="abc"`
+	base := strings.Join([]string{
+		`"@method": POST`,
+		`"@authority": example.com`,
+		`"@path": /foo`,
+		`"content-digest": ` + digest,
+		`"content-type": application/json`,
+		`"@signature-params": ` + params,
+	}, "\n")
+	sig := base64.StdEncoding.EncodeToString(hmacSHA256([]byte("s3cret"), []byte(base)))
+
+	build := func(payload, digest string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "http://example.com/foo", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Digest", digest)
+		req.Header.Set("Signature-Input", "sig1="+params)
+		req.Header.Set("Signature", "sig1=:"+sig+":")
+		return req
+	}
+	if rec, handled, reason := runSigned(p, build(body, digest)); handled {
+		t.Fatalf("valid message signature rejected: %d %s", rec.Code, reason)
+	}
+	if _, _, reason := runSigned(p, build(body, digest)); reason != "replayed_request" {
+		t.Fatalf("nonce replay: %q", reason)
+	}
+	if _, _, reason := runSigned(p, build(`{"hello": "mallory"}`, digest)); reason != "digest_mismatch" {
+		t.Fatalf("body swap: %q", reason)
+	}
+	req := build(body, digest)
+	req.Header.Set("Signature-Input", `sig1=("@method");created=`+created+`;keyid="test-shared-secret"`)
+	if _, _, reason := runSigned(p, req); reason != "missing_component" {
+		t.Fatalf("uncovered components: %q", reason)
+	}
+}
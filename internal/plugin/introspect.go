@@ -0,0 +1,240 @@
+package plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IntrospectPlugin validates opaque bearer tokens against an RFC 7662 introspection endpoint.
+// Active results are cached by token until their exp (capped by cache_ttl_ms).
+// Config:
+//
+//	introspection_url: "https://idp.example.com/oauth2/introspect"
+//	client_id: "gateway"
+//	client_secret: "..."
+//	header: "Authorization"
+//	timeout_ms: 2000
+//	cache_ttl_ms: 300000           // upper bound for cached active tokens; 0 disables caching
+//	max_cache_entries: 10000
+//	required_scopes: ["orders:read"]
+//	claims_to_headers: { sub: X-User-ID }
+//	realm: "go-agw"
+type IntrospectPlugin struct {
+	endpoint     string
+	clientID     string
+	clientSecret string
+	header       string
+	realm        string
+	scopes       []string
+	claimHeaders map[string]string
+	client       *http.Client
+	cacheTTL     time.Duration
+	maxEntries   int
+	now          func() time.Time
+
+	mu    sync.Mutex
+	cache map[[32]byte]introspectEntry
+}
+
+type introspectEntry struct {
+	claims  map[string]any
+	expires time.Time
+}
+
+func (p *IntrospectPlugin) Name() string { return "oauth2-introspect" }
+
+func (p *IntrospectPlugin) Init(cfg map[string]any) error {
+	p.endpoint = getStringOr(cfg, "introspection_url", "")
+	if p.endpoint == "" {
+		return errors.New("oauth2-introspect: introspection_url required")
+	}
+	p.clientID = getStringOr(cfg, "client_id", "")
+	p.clientSecret = getStringOr(cfg, "client_secret", "")
+	p.header = getStringOr(cfg, "header", "Authorization")
+	p.realm = getStringOr(cfg, "realm", "go-agw")
+	p.scopes = getStrings(cfg, "required_scopes")
+	p.claimHeaders = getStringMap(cfg, "claims_to_headers")
+	p.client = &http.Client{Timeout: time.Duration(getIntOr(cfg, "timeout_ms", 2000)) * time.Millisecond}
+	p.cacheTTL = time.Duration(getIntOr(cfg, "cache_ttl_ms", 300000)) * time.Millisecond
+	p.maxEntries = getIntOr(cfg, "max_cache_entries", 10000)
+	p.now = time.Now
+	p.cache = map[[32]byte]introspectEntry{}
+	return nil
+}
+
+func (p *IntrospectPlugin) BeforeDispatch(ctx *RequestContext) (bool, error) {
+	token, ok := bearerToken(ctx.Request.Header.Get(p.header))
+	if !ok {
+		p.reject(ctx.Writer, "")
+		return true, nil
+	}
+	claims, err := p.introspect(ctx.Request.Context(), token)
+	if err != nil {
+		if ctx.Logger != nil {
+			ctx.Logger.Warnw("token introspection failed", "err", err)
+		}
+		http.Error(ctx.Writer, "authorization server unavailable", http.StatusServiceUnavailable)
+		return true, nil
+	}
+	if claims == nil {
+		p.reject(ctx.Writer, "token inactive")
+		return true, nil
+	}
+	if missing := missingScope(claims["scope"], p.scopes); missing != "" {
+		ctx.Writer.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q, error=\"insufficient_scope\", scope=%q", p.realm, missing))
+		http.Error(ctx.Writer, "forbidden", http.StatusForbidden)
+		return true, nil
+	}
+	applyClaims(ctx, claims, p.claimHeaders)
+	return false, nil
+}
+
+func (p *IntrospectPlugin) AfterDispatch(ctx *RequestContext) {}
+
+func (p *IntrospectPlugin) reject(w http.ResponseWriter, reason string) {
+	(&JWTPlugin{realm: p.realm}).reject(w, reason)
+}
+
+// introspect returns the token's claims, or nil when the token is not active.
+func (p *IntrospectPlugin) introspect(ctx context.Context, token string) (map[string]any, error) {
+	key := sha256.Sum256([]byte(token))
+	now := p.now()
+	p.mu.Lock()
+	if e, ok := p.cache[key]; ok {
+		if now.Before(e.expires) {
+			p.mu.Unlock()
+			return e.claims, nil
+		}
+		delete(p.cache, key)
+	}
+	p.mu.Unlock()
+
+	var claims map[string]any
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	if err := postForm(ctx, p.client, p.endpoint, p.clientID, p.clientSecret, form, &claims); err != nil {
+		return nil, err
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return nil, nil
+	}
+	if exp, ok := numericClaim(claims, "exp"); ok && !now.Before(exp) {
+		return nil, nil
+	}
+	p.store(key, claims, now)
+	return claims, nil
+}
+
+func (p *IntrospectPlugin) store(key [32]byte, claims map[string]any, now time.Time) {
+	if p.cacheTTL <= 0 || p.maxEntries <= 0 {
+		return
+	}
+	expires := now.Add(p.cacheTTL)
+	if exp, ok := numericClaim(claims, "exp"); ok && exp.Before(expires) {
+		expires = exp
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.cache) >= p.maxEntries {
+		for k, e := range p.cache {
+			if !now.Before(e.expires) {
+				delete(p.cache, k)
+			}
+		}
+		// still full: drop arbitrary entries rather than grow without bound
+		for k := range p.cache {
+			if len(p.cache) < p.maxEntries {
+				break
+			}
+			delete(p.cache, k)
+		}
+	}
+	p.cache[key] = introspectEntry{claims: claims, expires: expires}
+}
+
+// applyClaims exposes verified claims to later plugins and, via claims_to_headers, to the upstream.
+func applyClaims(ctx *RequestContext, claims map[string]any, claimHeaders map[string]string) {
+	// never trust claim headers sent by the client
+	for _, h := range claimHeaders {
+		ctx.Request.Header.Del(h)
+	}
+	for claim, h := range claimHeaders {
+		if v, ok := claims[claim]; ok {
+			ctx.Request.Header.Set(h, claimString(v))
+		}
+	}
+	ctx.Claims = claims
+	ctx.Request = ctx.Request.WithContext(withClaims(ctx.Request.Context(), claims))
+}
+
+// missingScope returns the first required scope absent from a space-delimited scope claim.
+func missingScope(scope any, required []string) string {
+	s, _ := scope.(string)
+	granted := strings.Fields(s)
+	for _, r := range required {
+		if !containsString(granted, r) {
+			return r
+		}
+	}
+	return ""
+}
+
+// postForm POSTs an OAuth2 form request with client_secret_basic authentication and decodes
+// the JSON reply into out.
+func postForm(ctx context.Context, client *http.Client, endpoint, clientID, clientSecret string, form url.Values, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if clientID != "" {
+		req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var oerr struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		if json.Unmarshal(data, &oerr) == nil && oerr.Error != "" {
+			return &oauthError{Code: oerr.Error, Description: oerr.Description, Status: resp.StatusCode}
+		}
+		return fmt.Errorf("%s: status %d", endpoint, resp.StatusCode)
+	}
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.UseNumber()
+	return dec.Decode(out)
+}
+
+// oauthError is an RFC 6749 error response.
+type oauthError struct {
+	Code        string
+	Description string
+	Status      int
+}
+
+func (e *oauthError) Error() string {
+	if e.Description != "" {
+		return e.Code + ": " + e.Description
+	}
+	return e.Code
+}
+
+func init() { Register("oauth2-introspect", func() Plugin { return &IntrospectPlugin{} }) }
@@ -0,0 +1,253 @@
+package plugin
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kenelite/go-agw/internal/clientip"
+	"github.com/kenelite/go-agw/internal/geoip"
+	"github.com/kenelite/go-agw/internal/observability"
+)
+
+// IPRestrictionPlugin allows or denies requests by real client IP and, optionally, country.
+// Config:
+//
+//	allow: ["10.0.0.0/8", "2001:db8::/32"]
+//	deny: ["10.0.13.0/24"]
+//	allow_files: ["/etc/agw/allow.txt"]   // one IP or CIDR per line, "#" comments
+//	deny_files: ["/etc/agw/deny.txt"]
+//	reload_interval_ms: 5000              // files (and the GeoIP database) are re-read when they change
+//	geoip_db: "/var/lib/GeoLite2-Country.mmdb"
+//	allow_countries: ["DE", "FR"]
+//	deny_countries: ["KP"]
+//	status: 403
+//	message: "forbidden"
+//
+// CIDR rules are matched by longest prefix, so a specific allow entry can carve an
+// exception out of a broader deny (an identical prefix in both lists denies). Addresses
+// no CIDR matches fall through to the country rules. When any allow rule exists,
+// requests matched by none of them are denied.
+type IPRestrictionPlugin struct {
+	allow, deny           []string
+	allowFiles, denyFiles []string
+	geoipPath             string
+	allowCountries        []string
+	denyCountries         []string
+	status                int
+	message               string
+	interval              time.Duration
+
+	rules     atomic.Pointer[ipRules]
+	nextCheck atomic.Int64
+	reloadMu  sync.Mutex
+	stamps    map[string]fileStamp
+}
+
+// countryLookup resolves addresses to ISO country codes (geoip.DB).
+type countryLookup interface {
+	Country(netip.Addr) (string, bool)
+}
+
+// ipRules is an immutable snapshot of the compiled rules.
+type ipRules struct {
+	prefixes *clientip.Trie[bool] // true: allow, false: deny
+	hasAllow bool
+	geo      countryLookup
+}
+
+type fileStamp struct {
+	mod  time.Time
+	size int64
+}
+
+func (p *IPRestrictionPlugin) Name() string { return "ip-restriction" }
+
+func (p *IPRestrictionPlugin) Init(cfg map[string]any) error {
+	p.allow = getStrings(cfg, "allow")
+	p.deny = getStrings(cfg, "deny")
+	p.allowFiles = getStrings(cfg, "allow_files")
+	p.denyFiles = getStrings(cfg, "deny_files")
+	p.geoipPath = getStringOr(cfg, "geoip_db", "")
+	p.allowCountries = upperAll(getStrings(cfg, "allow_countries"))
+	p.denyCountries = upperAll(getStrings(cfg, "deny_countries"))
+	if (len(p.allowCountries) > 0 || len(p.denyCountries) > 0) && p.geoipPath == "" {
+		return errors.New("ip-restriction: country rules need geoip_db")
+	}
+	p.status = getIntOr(cfg, "status", http.StatusForbidden)
+	p.message = getStringOr(cfg, "message", "forbidden")
+	p.interval = time.Duration(getIntOr(cfg, "reload_interval_ms", 5000)) * time.Millisecond
+	p.stamps = p.statFiles()
+	rules, err := p.load()
+	if err != nil {
+		return fmt.Errorf("ip-restriction: %w", err)
+	}
+	p.rules.Store(rules)
+	p.nextCheck.Store(time.Now().Add(p.interval).UnixNano())
+	return nil
+}
+
+func (p *IPRestrictionPlugin) BeforeDispatch(ctx *RequestContext) (bool, error) {
+	p.maybeReload(ctx.Logger)
+	ip := ctx.ClientIP
+	if ip == "" {
+		ip = clientip.Host(ctx.Request.RemoteAddr)
+	}
+	addr, _ := netip.ParseAddr(ip)
+	if !p.rules.Load().allowed(addr.Unmap(), p.allowCountries, p.denyCountries) {
+		http.Error(ctx.Writer, p.message, p.status)
+		return true, nil
+	}
+	return false, nil
+}
+
+func (p *IPRestrictionPlugin) AfterDispatch(ctx *RequestContext) {}
+
+func (r *ipRules) allowed(addr netip.Addr, allowCountries, denyCountries []string) bool {
+	if !addr.IsValid() {
+		return !r.hasAllow
+	}
+	if allow, ok := r.prefixes.Lookup(addr); ok {
+		return allow
+	}
+	if r.geo != nil {
+		if country, ok := r.geo.Country(addr); ok {
+			if containsString(denyCountries, country) {
+				return false
+			}
+			if containsString(allowCountries, country) {
+				return true
+			}
+		}
+	}
+	return !r.hasAllow
+}
+
+// load compiles inline lists, list files and the GeoIP database into a new snapshot.
+func (p *IPRestrictionPlugin) load() (*ipRules, error) {
+	r := &ipRules{prefixes: clientip.NewTrie[bool](), hasAllow: len(p.allowCountries) > 0}
+	// allow first: an identical deny prefix overwrites it
+	for _, list := range []struct {
+		inline []string
+		files  []string
+		allow  bool
+	}{{p.allow, p.allowFiles, true}, {p.deny, p.denyFiles, false}} {
+		entries := append([]string(nil), list.inline...)
+		for _, f := range list.files {
+			lines, err := readListFile(f)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, lines...)
+		}
+		for _, e := range entries {
+			prefix, err := clientip.ParsePrefix(e)
+			if err != nil {
+				return nil, err
+			}
+			r.prefixes.Insert(prefix, list.allow)
+		}
+		if list.allow && len(entries) > 0 {
+			r.hasAllow = true
+		}
+	}
+	if p.geoipPath != "" {
+		db, err := geoip.Open(p.geoipPath)
+		if err != nil {
+			return nil, err
+		}
+		r.geo = db
+	}
+	return r, nil
+}
+
+func readListFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			out = append(out, line)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return out, nil
+}
+
+// maybeReload re-reads the source files in the background at most once per interval
+// when any of them changed. A broken file keeps the previous rules in place.
+func (p *IPRestrictionPlugin) maybeReload(logger *observability.Logger) {
+	next := p.nextCheck.Load()
+	if p.interval <= 0 || time.Now().UnixNano() < next {
+		return
+	}
+	if !p.nextCheck.CompareAndSwap(next, time.Now().Add(p.interval).UnixNano()) {
+		return
+	}
+	go func() {
+		if err := p.reloadIfChanged(); err != nil && logger != nil {
+			logger.Warnw("ip-restriction reload failed, keeping previous rules", "err", err)
+		}
+	}()
+}
+
+func (p *IPRestrictionPlugin) reloadIfChanged() error {
+	p.reloadMu.Lock()
+	defer p.reloadMu.Unlock()
+	stamps := p.statFiles()
+	changed := false
+	for path, st := range stamps {
+		if p.stamps[path] != st {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	rules, err := p.load()
+	if err != nil {
+		return err
+	}
+	p.rules.Store(rules)
+	p.stamps = stamps
+	return nil
+}
+
+func (p *IPRestrictionPlugin) statFiles() map[string]fileStamp {
+	out := map[string]fileStamp{}
+	paths := append(append([]string(nil), p.allowFiles...), p.denyFiles...)
+	if p.geoipPath != "" {
+		paths = append(paths, p.geoipPath)
+	}
+	for _, path := range paths {
+		if fi, err := os.Stat(path); err == nil {
+			out[path] = fileStamp{mod: fi.ModTime(), size: fi.Size()}
+		} else {
+			out[path] = fileStamp{}
+		}
+	}
+	return out
+}
+
+func upperAll(in []string) []string {
+	for i, s := range in {
+		in[i] = strings.ToUpper(s)
+	}
+	return in
+}
+
+func init() { Register("ip-restriction", func() Plugin { return &IPRestrictionPlugin{} }) }
@@ -0,0 +1,140 @@
+package plugin
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kenelite/go-agw/internal/config"
+)
+
+type stubCountries map[string]string
+
+func (s stubCountries) Country(a netip.Addr) (string, bool) {
+	c, ok := s[a.String()]
+	return c, ok
+}
+
+func ipAllowed(p Plugin, ip string) bool {
+	req := httptest.NewRequest(http.MethodGet, "http://agw/", nil)
+	rec := httptest.NewRecorder()
+	handled, _ := p.BeforeDispatch(&RequestContext{Context: req.Context(), Writer: rec, Request: req, ClientIP: ip})
+	return !handled && rec.Code == http.StatusOK
+}
+
+func TestIPRestriction(t *testing.T) {
+	dir := t.TempDir()
+	denyFile := filepath.Join(dir, "deny.txt")
+	// a large deny list, as loaded from threat feeds
+	var list strings.Builder
+	list.WriteString("# feed\n")
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&list, "100.%d.%d.0/24\n", i/256, i%256)
+	}
+	list.WriteString("2001:db8:bad::/48 # v6 range\n")
+	if err := os.WriteFile(denyFile, []byte(list.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p := &IPRestrictionPlugin{}
+	if err := p.Init(map[string]any{
+		"deny":       []any{"10.0.0.0/8"},
+		"allow":      []any{"10.1.2.0/24"},
+		"deny_files": []any{denyFile},
+	}); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	cases := map[string]bool{
+		"10.9.9.9":         false,
+		"10.1.2.3":         true, // more specific allow wins
+		"100.78.31.7":      false,
+		"::ffff:100.0.0.1": false,
+		"2001:db8:bad::1":  false,
+		"2001:db8:900d::1": false, // allow list present: unmatched addresses are denied
+		"":                 false,
+	}
+	for ip, want := range cases {
+		if got := ipAllowed(p, ip); got != want {
+			t.Errorf("%q: allowed=%v, want %v", ip, got, want)
+		}
+	}
+
+	// changed files are picked up; a broken file keeps the previous rules
+	if err := os.WriteFile(denyFile, []byte("10.1.2.3\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Chtimes(denyFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if err := p.reloadIfChanged(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if ipAllowed(p, "10.1.2.3") || !ipAllowed(p, "10.1.2.4") {
+		t.Fatal("reloaded deny list not applied")
+	}
+	_ = os.WriteFile(denyFile, []byte("not-an-ip\n"), 0o644)
+	_ = os.Chtimes(denyFile, time.Now().Add(2*time.Minute), time.Now().Add(2*time.Minute))
+	if err := p.reloadIfChanged(); err == nil {
+		t.Fatal("broken list accepted")
+	}
+	if ipAllowed(p, "10.1.2.3") {
+		t.Fatal("previous rules dropped after a failed reload")
+	}
+}
+
+func TestIPRestrictionCountries(t *testing.T) {
+	p := &IPRestrictionPlugin{}
+	if err := p.Init(map[string]any{"deny": []any{"192.0.2.66"}}); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	p.allowCountries, p.denyCountries = []string{"DE", "FR"}, []string{"KP"}
+	rules, _ := p.load()
+	rules.geo = stubCountries{"192.0.2.1": "DE", "192.0.2.66": "DE", "198.51.100.1": "KP", "203.0.113.1": "US"}
+	p.rules.Store(rules)
+	for ip, want := range map[string]bool{"192.0.2.1": true, "192.0.2.66": false, "198.51.100.1": false, "203.0.113.1": false, "203.0.113.9": false} {
+		if got := ipAllowed(p, ip); got != want {
+			t.Errorf("%s: allowed=%v, want %v", ip, got, want)
+		}
+	}
+	if err := (&IPRestrictionPlugin{}).Init(map[string]any{"allow_countries": []any{"DE"}}); err == nil {
+		t.Fatal("country rules without geoip_db accepted")
+	}
+}
+
+func TestManagerRouteChains(t *testing.T) {
+	m := NewManager(nil)
+	_ = m.Init(config.PluginsConfig{Available: []config.PluginRef{
+		{Name: "ip-restriction", Config: map[string]any{"deny": []any{"192.0.2.0/24"}}},
+	}})
+	_ = m.InitRoutes([]config.RouteConfig{
+		{Path: "/public"},
+		{Path: "/admin", Plugins: []config.PluginRef{
+			{Name: "ip-restriction", Config: map[string]any{"allow": []any{"10.0.0.0/8"}}},
+			{Name: "observability", Config: map[string]any{}},
+		}},
+	})
+	if len(m.ChainFor(0)) != 1 || len(m.ChainFor(5)) != 1 {
+		t.Fatal("routes without plugins should use the global chain")
+	}
+	admin := m.ChainFor(1)
+	if len(admin) != 2 || admin[0].Name() != "ip-restriction" || admin[1].Name() != "observability" {
+		t.Fatalf("unexpected admin chain: %v", admin)
+	}
+	if !ipAllowed(admin[0], "10.1.1.1") || ipAllowed(admin[0], "203.0.113.1") || ipAllowed(m.ChainFor(0)[0], "192.0.2.1") {
+		t.Fatal("route plugin did not replace the global instance")
+	}
+}
+
+func TestManagerInitFailure(t *testing.T) {
+	bad := config.PluginRef{Name: "ip-restriction", Config: map[string]any{"allow": []any{"not-a-cidr"}}}
+	m := NewManager(nil)
+	if err := m.Init(config.PluginsConfig{Available: []config.PluginRef{bad}}); err == nil {
+		t.Fatal("a plugin that fails to initialise must fail Init")
+	}
+	if err := m.InitRoutes([]config.RouteConfig{{Path: "/admin", Plugins: []config.PluginRef{bad}}}); err == nil || !strings.Contains(err.Error(), "/admin") {
+		t.Fatalf("route plugin failure not reported: %v", err)
+	}
+}
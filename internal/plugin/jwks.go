@@ -0,0 +1,267 @@
+package plugin
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// jwk is a verification key: *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey or []byte (HMAC).
+type jwk struct {
+	kid string
+	alg string // optional restriction
+	key any
+}
+
+// compatible reports whether the key can verify tokens signed with alg.
+func (k jwk) compatible(alg string) bool {
+	if k.alg != "" && k.alg != alg {
+		return false
+	}
+	switch key := k.key.(type) {
+	case *rsa.PublicKey:
+		return alg == "RS256"
+	case *ecdsa.PublicKey:
+		return alg == "ES256" && key.Curve == elliptic.P256()
+	case ed25519.PublicKey:
+		return alg == "EdDSA"
+	case []byte:
+		return alg == "HS256"
+	}
+	return false
+}
+
+// parsePublicKeyPEM accepts a PKIX public key or a certificate.
+func parsePublicKeyPEM(data string) (any, error) {
+	blk, _ := pem.Decode([]byte(data))
+	if blk == nil {
+		return nil, errors.New("invalid PEM public key")
+	}
+	if blk.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(blk.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return x509.ParsePKIXPublicKey(blk.Bytes)
+}
+
+type jwkJSON struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// parseJWKS decodes a JSON Web Key Set, skipping keys of unsupported types.
+func parseJWKS(data []byte) ([]jwk, error) {
+	var set struct {
+		Keys []jwkJSON `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("parse jwks: %w", err)
+	}
+	var out []jwk
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		out = append(out, jwk{kid: k.Kid, alg: k.Alg, key: key})
+	}
+	return out, nil
+}
+
+func (k jwkJSON) publicKey() (any, error) {
+	b64 := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := b64(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := b64(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := b64(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	case "oct":
+		return b64(k.K)
+	}
+	return nil, fmt.Errorf("unsupported kty %s", k.Kty)
+}
+
+// jwksMissRefresh limits refetches triggered by tokens with an unknown kid.
+const jwksMissRefresh = 10 * time.Second
+
+// remoteRetryBackoff holds back fetches of a remote document after one failed.
+const remoteRetryBackoff = 10 * time.Second
+
+// fetchGate runs at most one fetch of a remote document at a time: concurrent callers
+// join the running fetch, and after a failure further fetches wait out a backoff, so
+// an identity provider that is down or slow does not serialize or flood requests.
+type fetchGate struct {
+	mu       sync.Mutex
+	inflight chan struct{}
+	failedAt time.Time
+	err      error
+}
+
+// start runs fn in the background unless a fetch is already running, and returns a
+// channel closed when it ends. Within the backoff after a failure it returns that
+// failure instead.
+func (g *fetchGate) start(fn func() error) (<-chan struct{}, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.inflight != nil {
+		return g.inflight, nil
+	}
+	if g.err != nil && time.Since(g.failedAt) < remoteRetryBackoff {
+		return nil, g.err
+	}
+	done := make(chan struct{})
+	g.inflight = done
+	go func() {
+		err := fn()
+		g.mu.Lock()
+		g.err, g.inflight = err, nil
+		if err != nil {
+			g.failedAt = time.Now()
+		}
+		g.mu.Unlock()
+		close(done)
+	}()
+	return done, nil
+}
+
+// wait runs fn through start and returns the outcome of the fetch it waited for.
+func (g *fetchGate) wait(fn func() error) error {
+	done, err := g.start(fn)
+	if err != nil {
+		return err
+	}
+	<-done
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.err
+}
+
+// jwksCache fetches a remote key set and refreshes it periodically or when an unknown kid shows up.
+type jwksCache struct {
+	url      string
+	client   *http.Client
+	refresh  time.Duration
+	gate     fetchGate
+	mu       sync.Mutex
+	keys     []jwk
+	fetched  time.Time
+	lastMiss time.Time
+}
+
+// get returns the key set. A due refresh runs in the background while the current set
+// keeps being served; only the first fetch and an unknown kid make the caller wait.
+func (c *jwksCache) get(kid string) ([]jwk, error) {
+	c.mu.Lock()
+	keys := c.keys
+	stale := c.fetched.IsZero() || time.Since(c.fetched) > c.refresh
+	miss := !stale && kid != "" && !hasKid(keys, kid) && time.Since(c.lastMiss) > jwksMissRefresh
+	if miss {
+		c.lastMiss = time.Now()
+	}
+	c.mu.Unlock()
+	if !stale && !miss {
+		return keys, nil
+	}
+	if keys != nil && !miss {
+		_, _ = c.gate.start(c.update)
+		return keys, nil
+	}
+	err := c.gate.wait(c.update)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.keys == nil {
+		return nil, err
+	}
+	// keep serving the last good set if the refetch failed
+	return c.keys, nil
+}
+
+func (c *jwksCache) update() error {
+	keys, err := c.fetch()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.keys, c.fetched = keys, time.Now()
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *jwksCache) fetch() ([]jwk, error) {
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		return nil, fmt.Errorf("fetch jwks: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch jwks: status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(data)
+}
+
+func hasKid(keys []jwk, kid string) bool {
+	for _, k := range keys {
+		if k.kid == kid {
+			return true
+		}
+	}
+	return false
+}
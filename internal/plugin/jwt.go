@@ -0,0 +1,308 @@
+package plugin
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JWTPlugin authenticates bearer tokens (RS256, ES256, EdDSA, HS256).
+// Config:
+//
+//	header: "Authorization"            // token is read from "Bearer <token>"
+//	algorithms: ["RS256", "ES256"]     // default: all supported
+//	keys:                              // static keys
+//	  - kid: "k1"
+//	    secret: "..."                  // HS256
+//	  - kid: "k2"
+//	    public_key: "-----BEGIN PUBLIC KEY-----..."
+//	jwks_url: "https://idp.example.com/.well-known/jwks.json"
+//	jwks_refresh_ms: 300000
+//	issuer: "https://idp.example.com/"
+//	audiences: ["orders-api"]
+//	clock_skew_ms: 60000
+//	require_exp: true                  // default; tokens without exp never expire
+//	required_claims: ["sub", "scope"]
+//	claims_to_headers: { sub: X-User-ID }
+//	realm: "go-agw"
+type JWTPlugin struct {
+	header       string
+	algorithms   map[string]struct{}
+	keys         []jwk
+	jwks         *jwksCache
+	issuer       string
+	audiences    []string
+	skew         time.Duration
+	requireExp   bool
+	required     []string
+	claimHeaders map[string]string
+	realm        string
+	now          func() time.Time
+}
+
+var jwtAlgorithms = []string{"RS256", "ES256", "EdDSA", "HS256"}
+
+func (p *JWTPlugin) Name() string { return "jwt" }
+
+func (p *JWTPlugin) Init(cfg map[string]any) error {
+	p.header = getStringOr(cfg, "header", "Authorization")
+	p.realm = getStringOr(cfg, "realm", "go-agw")
+	p.issuer = getStringOr(cfg, "issuer", "")
+	p.audiences = getStrings(cfg, "audiences")
+	p.required = getStrings(cfg, "required_claims")
+	p.claimHeaders = getStringMap(cfg, "claims_to_headers")
+	p.skew = time.Duration(getIntOr(cfg, "clock_skew_ms", 60000)) * time.Millisecond
+	p.requireExp = getBoolOr(cfg, "require_exp", true)
+	p.now = time.Now
+	algs := getStrings(cfg, "algorithms")
+	if len(algs) == 0 {
+		algs = jwtAlgorithms
+	}
+	p.algorithms = map[string]struct{}{}
+	for _, a := range algs {
+		if !containsString(jwtAlgorithms, a) {
+			return fmt.Errorf("jwt: unsupported algorithm %q", a)
+		}
+		p.algorithms[a] = struct{}{}
+	}
+	if arr, ok := cfg["keys"].([]any); ok {
+		for _, ki := range arr {
+			km, ok := ki.(map[string]any)
+			if !ok {
+				continue
+			}
+			k := jwk{kid: getStringOr(km, "kid", ""), alg: getStringOr(km, "alg", "")}
+			if secret := getStringOr(km, "secret", ""); secret != "" {
+				k.key = []byte(secret)
+			} else {
+				pub, err := parsePublicKeyPEM(getStringOr(km, "public_key", ""))
+				if err != nil {
+					return fmt.Errorf("jwt: key %q: %w", k.kid, err)
+				}
+				k.key = pub
+			}
+			p.keys = append(p.keys, k)
+		}
+	}
+	if u := getStringOr(cfg, "jwks_url", ""); u != "" {
+		p.jwks = &jwksCache{
+			url:     u,
+			client:  &http.Client{Timeout: 5 * time.Second},
+			refresh: time.Duration(getIntOr(cfg, "jwks_refresh_ms", 300000)) * time.Millisecond,
+		}
+	}
+	if len(p.keys) == 0 && p.jwks == nil {
+		return errors.New("jwt: keys or jwks_url required")
+	}
+	return nil
+}
+
+func (p *JWTPlugin) BeforeDispatch(ctx *RequestContext) (bool, error) {
+	token, ok := bearerToken(ctx.Request.Header.Get(p.header))
+	if !ok {
+		p.reject(ctx.Writer, "")
+		return true, nil
+	}
+	claims, err := p.verify(token)
+	if err != nil {
+		p.reject(ctx.Writer, err.Error())
+		return true, nil
+	}
+	applyClaims(ctx, claims, p.claimHeaders)
+	return false, nil
+}
+
+func (p *JWTPlugin) AfterDispatch(ctx *RequestContext) {}
+
+// reject answers 401 with an RFC 6750 challenge; an empty reason means no token was sent.
+func (p *JWTPlugin) reject(w http.ResponseWriter, reason string) {
+	challenge := fmt.Sprintf("Bearer realm=%q", p.realm)
+	if reason != "" {
+		challenge += fmt.Sprintf(", error=\"invalid_token\", error_description=%q", reason)
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
+
+func bearerToken(v string) (string, bool) {
+	scheme, token, ok := strings.Cut(strings.TrimSpace(v), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+func (p *JWTPlugin) verify(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var hdr struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &hdr); err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	if _, ok := p.algorithms[hdr.Alg]; !ok {
+		return nil, fmt.Errorf("algorithm %q not allowed", hdr.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	keys := p.keys
+	if p.jwks != nil {
+		remote, err := p.jwks.get(hdr.Kid)
+		if err != nil && len(keys) == 0 {
+			return nil, errors.New("signing keys unavailable")
+		}
+		keys = append(append([]jwk(nil), keys...), remote...)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range keys {
+		if hdr.Kid != "" && k.kid != "" && k.kid != hdr.Kid || !k.compatible(hdr.Alg) {
+			continue
+		}
+		if verifyJWS(hdr.Alg, k.key, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid signature")
+	}
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	return claims, p.validateClaims(claims)
+}
+
+func (p *JWTPlugin) validateClaims(claims map[string]any) error {
+	now := p.now()
+	exp, ok := numericClaim(claims, "exp")
+	if !ok && p.requireExp {
+		return errors.New("token has no expiry")
+	}
+	if ok && now.After(exp.Add(p.skew)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now.Add(p.skew).Before(nbf) {
+		return errors.New("token not yet valid")
+	}
+	if p.issuer != "" && claims["iss"] != p.issuer {
+		return errors.New("unexpected issuer")
+	}
+	if len(p.audiences) > 0 && !audienceMatches(claims["aud"], p.audiences) {
+		return errors.New("unexpected audience")
+	}
+	for _, c := range p.required {
+		if _, ok := claims[c]; !ok {
+			return fmt.Errorf("missing claim %q", c)
+		}
+	}
+	return nil
+}
+
+func verifyJWS(alg string, key any, signed, sig []byte) bool {
+	sum := sha256.Sum256(signed)
+	switch alg {
+	case "RS256":
+		return rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, sum[:], sig) == nil
+	case "ES256":
+		if len(sig) != 64 {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(key.(*ecdsa.PublicKey), sum[:], r, s)
+	case "EdDSA":
+		return ed25519.Verify(key.(ed25519.PublicKey), signed, sig)
+	case "HS256":
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), sig)
+	}
+	return false
+}
+
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+func numericClaim(claims map[string]any, name string) (time.Time, bool) {
+	n, ok := claims[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+func audienceMatches(aud any, allowed []string) bool {
+	switch v := aud.(type) {
+	case string:
+		return containsString(allowed, v)
+	case []any:
+		for _, a := range v {
+			if s, ok := a.(string); ok && containsString(allowed, s) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimString renders a claim for use as a header value.
+func claimString(v any) string {
+	switch c := v.(type) {
+	case string:
+		return c
+	case json.Number:
+		return c.String()
+	case bool:
+		return strconv.FormatBool(c)
+	case []any:
+		parts := make([]string, 0, len(c))
+		for _, e := range c {
+			parts = append(parts, claimString(e))
+		}
+		return strings.Join(parts, ",")
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func init() { Register("jwt", func() Plugin { return &JWTPlugin{} }) }
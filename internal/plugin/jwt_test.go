@@ -0,0 +1,221 @@
+package plugin
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func signJWT(t *testing.T, alg, kid string, key any, claims map[string]any) string {
+	t.Helper()
+	enc := base64.RawURLEncoding
+	hdr, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	body, _ := json.Marshal(claims)
+	signed := enc.EncodeToString(hdr) + "." + enc.EncodeToString(body)
+	sum := sha256.Sum256([]byte(signed))
+	var sig []byte
+	var err error
+	switch alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, sum[:])
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), sum[:])
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case "EdDSA":
+		sig = ed25519.Sign(key.(ed25519.PrivateKey), []byte(signed))
+	}
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return signed + "." + enc.EncodeToString(sig)
+}
+
+func runBefore(p Plugin, token string) (*RequestContext, *httptest.ResponseRecorder, bool) {
+	req := httptest.NewRequest(http.MethodGet, "http://agw/orders", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("X-User-ID", "spoofed")
+	rec := httptest.NewRecorder()
+	ctx := &RequestContext{Context: req.Context(), Writer: rec, Request: req}
+	handled, _ := p.BeforeDispatch(ctx)
+	return ctx, rec, handled
+}
+
+func TestJWTPluginStaticKeys(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	der, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	p := &JWTPlugin{}
+	err := p.Init(map[string]any{
+		"keys": []any{
+			map[string]any{"kid": "hs", "secret": "s3cret"},
+			map[string]any{"kid": "rs", "public_key": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))},
+		},
+		"issuer":            "https://idp.example.com/",
+		"audiences":         []any{"orders"},
+		"required_claims":   []any{"sub"},
+		"claims_to_headers": map[string]any{"sub": "X-User-ID"},
+	})
+	if err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	now := time.Now().Unix()
+	good := map[string]any{"sub": "alice", "iss": "https://idp.example.com/", "aud": []string{"orders"}, "exp": now + 60}
+
+	for _, tok := range []string{signJWT(t, "HS256", "hs", []byte("s3cret"), good), signJWT(t, "RS256", "rs", rsaKey, good)} {
+		ctx, _, handled := runBefore(p, tok)
+		if handled {
+			t.Fatal("valid token rejected")
+		}
+		if ctx.Claims["sub"] != "alice" || ctx.Request.Header.Get("X-User-ID") != "alice" {
+			t.Fatalf("claims not propagated: %v %v", ctx.Claims, ctx.Request.Header)
+		}
+		if c, ok := ClaimsFrom(ctx.Request.Context()); !ok || c["sub"] != "alice" {
+			t.Fatal("claims missing from request context")
+		}
+	}
+
+	_, rec, handled := runBefore(p, "")
+	if !handled || rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") != `Bearer realm="go-agw"` {
+		t.Fatalf("missing token: handled=%v code=%d challenge=%q", handled, rec.Code, rec.Header().Get("WWW-Authenticate"))
+	}
+
+	bad := map[string]map[string]any{
+		"expired":  {"sub": "alice", "iss": "https://idp.example.com/", "aud": "orders", "exp": now - 3600},
+		"not yet":  {"sub": "alice", "iss": "https://idp.example.com/", "aud": "orders", "nbf": now + 3600},
+		"issuer":   {"sub": "alice", "iss": "https://evil.example/", "aud": "orders"},
+		"audience": {"sub": "alice", "iss": "https://idp.example.com/", "aud": "billing"},
+		"no sub":   {"iss": "https://idp.example.com/", "aud": "orders", "exp": now + 60},
+		"no exp":   {"sub": "alice", "iss": "https://idp.example.com/", "aud": "orders"},
+	}
+	for name, claims := range bad {
+		_, rec, handled := runBefore(p, signJWT(t, "HS256", "hs", []byte("s3cret"), claims))
+		if !handled || rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Header().Get("WWW-Authenticate"), `error="invalid_token"`) {
+			t.Errorf("%s: expected 401 invalid_token, got handled=%v code=%d", name, handled, rec.Code)
+		}
+	}
+	if _, _, handled := runBefore(p, signJWT(t, "HS256", "hs", []byte("wrong"), good)); !handled {
+		t.Error("token with bad signature accepted")
+	}
+	parts := strings.Split(signJWT(t, "HS256", "hs", []byte("s3cret"), good), ".")
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + "."
+	if _, _, handled := runBefore(p, unsigned); !handled {
+		t.Error("unsigned token accepted")
+	}
+
+	lax := &JWTPlugin{}
+	if err := lax.Init(map[string]any{
+		"keys":        []any{map[string]any{"kid": "hs", "secret": "s3cret"}},
+		"require_exp": false,
+	}); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	if _, _, handled := runBefore(lax, signJWT(t, "HS256", "hs", []byte("s3cret"), map[string]any{"sub": "svc"})); handled {
+		t.Error("require_exp: false should accept a token without exp")
+	}
+}
+
+func TestJWTPluginJWKS(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPub, edPriv, _ := ed25519.GenerateKey(rand.Reader)
+	enc := base64.RawURLEncoding
+	fetches := 0
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fetches++
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": enc.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))), "y": enc.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32)))},
+			{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": enc.EncodeToString(edPub)},
+		}})
+	}))
+	defer jwks.Close()
+
+	p := &JWTPlugin{}
+	if err := p.Init(map[string]any{"jwks_url": jwks.URL, "algorithms": []any{"ES256", "EdDSA"}}); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	claims := map[string]any{"sub": "svc", "exp": time.Now().Unix() + 60}
+	if _, _, handled := runBefore(p, signJWT(t, "ES256", "ec", ecKey, claims)); handled {
+		t.Fatal("ES256 token rejected")
+	}
+	if _, _, handled := runBefore(p, signJWT(t, "EdDSA", "ed", edPriv, claims)); handled {
+		t.Fatal("EdDSA token rejected")
+	}
+	if fetches != 1 {
+		t.Fatalf("expected cached key set, fetched %d times", fetches)
+	}
+	if _, _, handled := runBefore(p, signJWT(t, "HS256", "ec", []byte("x"), claims)); !handled {
+		t.Fatal("disallowed algorithm accepted")
+	}
+}
+
+func TestJWKSCacheOutage(t *testing.T) {
+	var fetches atomic.Int32
+	var mode atomic.Value // "fail", "ok" or "slow"
+	mode.Store("fail")
+	release := make(chan struct{})
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fetches.Add(1)
+		switch mode.Load() {
+		case "fail":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		case "slow":
+			<-release
+		}
+		_, _ = w.Write([]byte(`{"keys":[{"kty":"oct","kid":"k","k":"c2VjcmV0"}]}`))
+	}))
+	defer jwks.Close()
+	defer close(release)
+	c := &jwksCache{url: jwks.URL, client: jwks.Client(), refresh: time.Hour}
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.get("k"); err == nil {
+			t.Fatal("failed fetch should surface without keys")
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("failed fetch retried without backoff: %d fetches", n)
+	}
+
+	mode.Store("ok")
+	c.gate.err = nil // skip the backoff
+	if keys, err := c.get("k"); err != nil || len(keys) != 1 {
+		t.Fatalf("get: %v %v", keys, err)
+	}
+
+	// a due refresh against a hanging provider must not block requests
+	mode.Store("slow")
+	c.mu.Lock()
+	c.fetched = time.Now().Add(-2 * time.Hour)
+	c.mu.Unlock()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if keys, err := c.get("k"); err != nil || len(keys) != 1 {
+			t.Fatalf("stale set not served during refresh: %v %v", keys, err)
+		}
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("requests waited %v on the refresh", d)
+	}
+}
@@ -0,0 +1,85 @@
+package plugin
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/kenelite/go-agw/internal/consumer"
+)
+
+// KeyAuthPlugin resolves API keys to consumers from the shared consumer registry.
+// Config:
+//
+//	header: "X-API-Key"        // request header carrying the key
+//	query: "api_key"           // optional query parameter carrying the key
+//	hide_credentials: true     // strip the key before forwarding upstream
+//	allow_groups: ["paid"]     // optional: only consumers in these groups pass (403 otherwise)
+//
+// The consumer's name and groups are forwarded as X-Consumer-Name / X-Consumer-Groups.
+type KeyAuthPlugin struct {
+	header          string
+	query           string
+	hideCredentials bool
+	allowGroups     []string
+	consumers       *consumer.Registry
+}
+
+func (p *KeyAuthPlugin) Name() string { return "key-auth" }
+
+// UseConsumers is called by the Manager before Init.
+func (p *KeyAuthPlugin) UseConsumers(reg *consumer.Registry) { p.consumers = reg }
+
+func (p *KeyAuthPlugin) Init(cfg map[string]any) error {
+	p.header = getStringOr(cfg, "header", "X-API-Key")
+	p.query = getStringOr(cfg, "query", "")
+	p.hideCredentials = getBoolOr(cfg, "hide_credentials", true)
+	p.allowGroups = getStrings(cfg, "allow_groups")
+	if p.consumers == nil {
+		return errors.New("key-auth: consumer registry not configured")
+	}
+	return nil
+}
+
+func (p *KeyAuthPlugin) BeforeDispatch(ctx *RequestContext) (bool, error) {
+	req := ctx.Request
+	key := req.Header.Get(p.header)
+	if key == "" && p.query != "" {
+		key = req.URL.Query().Get(p.query)
+	}
+	if key == "" {
+		http.Error(ctx.Writer, "missing api key", http.StatusUnauthorized)
+		return true, nil
+	}
+	c, ok := p.consumers.Lookup(key)
+	if !ok {
+		http.Error(ctx.Writer, "invalid api key", http.StatusUnauthorized)
+		return true, nil
+	}
+	if len(p.allowGroups) > 0 && !c.InGroup(p.allowGroups...) {
+		http.Error(ctx.Writer, "consumer not allowed", http.StatusForbidden)
+		return true, nil
+	}
+	if p.hideCredentials {
+		req.Header.Del(p.header)
+		if p.query != "" {
+			q := req.URL.Query()
+			if q.Has(p.query) {
+				q.Del(p.query)
+				req.URL.RawQuery = q.Encode()
+			}
+		}
+	}
+	req.Header.Set("X-Consumer-Name", c.Name)
+	req.Header.Del("X-Consumer-Groups")
+	if len(c.Groups) > 0 {
+		req.Header.Set("X-Consumer-Groups", strings.Join(c.Groups, ","))
+	}
+	ctx.Consumer = c
+	ctx.Request = req.WithContext(consumer.NewContext(req.Context(), c))
+	return false, nil
+}
+
+func (p *KeyAuthPlugin) AfterDispatch(ctx *RequestContext) {}
+
+func init() { Register("key-auth", func() Plugin { return &KeyAuthPlugin{} }) }
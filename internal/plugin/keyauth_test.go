@@ -0,0 +1,66 @@
+package plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kenelite/go-agw/internal/config"
+	"github.com/kenelite/go-agw/internal/consumer"
+)
+
+func TestKeyAuthPlugin(t *testing.T) {
+	reg, err := consumer.NewRegistry([]config.ConsumerConfig{
+		{Name: "alice", Groups: []string{"paid"}, APIKeys: []string{"k-alice"}},
+		{Name: "bob", APIKeys: []string{"k-bob"}},
+	})
+	if err != nil {
+		t.Fatalf("registry: %v", err)
+	}
+	p := &KeyAuthPlugin{}
+	if err := p.Init(nil); err == nil {
+		t.Fatal("init without registry should fail")
+	}
+	p.UseConsumers(reg)
+	if err := p.Init(map[string]any{"query": "api_key", "allow_groups": []any{"paid"}}); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+
+	run := func(target, key string) (*RequestContext, *httptest.ResponseRecorder, bool) {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		req.Header.Set("X-Consumer-Groups", "admin")
+		rec := httptest.NewRecorder()
+		ctx := &RequestContext{Context: req.Context(), Writer: rec, Request: req}
+		handled, _ := p.BeforeDispatch(ctx)
+		return ctx, rec, handled
+	}
+
+	ctx, _, handled := run("http://agw/orders", "k-alice")
+	if handled {
+		t.Fatal("valid key rejected")
+	}
+	h := ctx.Request.Header
+	if h.Get("X-API-Key") != "" || h.Get("X-Consumer-Name") != "alice" || h.Get("X-Consumer-Groups") != "paid" {
+		t.Fatalf("unexpected upstream headers: %v", h)
+	}
+	if c, ok := consumer.FromContext(ctx.Request.Context()); !ok || c.Name != "alice" || ctx.Consumer != c {
+		t.Fatal("consumer not attached to request")
+	}
+
+	ctx, _, handled = run("http://agw/orders?api_key=k-alice&x=1", "")
+	if handled || ctx.Request.URL.RawQuery != "x=1" {
+		t.Fatalf("query key: handled=%v query=%q", handled, ctx.Request.URL.RawQuery)
+	}
+	if _, rec, handled := run("http://agw/orders", ""); !handled || rec.Code != http.StatusUnauthorized {
+		t.Fatalf("missing key: %d", rec.Code)
+	}
+	if _, rec, handled := run("http://agw/orders", "k-wrong"); !handled || rec.Code != http.StatusUnauthorized {
+		t.Fatalf("unknown key: %d", rec.Code)
+	}
+	if _, rec, handled := run("http://agw/orders", "k-bob"); !handled || rec.Code != http.StatusForbidden {
+		t.Fatalf("group mismatch: %d", rec.Code)
+	}
+}
@@ -50,10 +50,14 @@ func (p *ObservabilityPlugin) AfterDispatch(ctx *RequestContext) {
     if ctx.Logger == nil || ctx.Metrics == nil || ctx.Response == nil { return }
     dur := time.Since(startTimeFrom(ctx.Request.Context()))
     // basic structured log
+    consumerName := ""
+    if ctx.Consumer != nil { consumerName = ctx.Consumer.Name }
     if p.enableLog {
         ctx.Logger.Infow("request",
             "method", ctx.Request.Method,
             "path", ctx.Request.URL.Path,
+            "client_ip", ctx.ClientIP,
+            "consumer", consumerName,
             "status", ctx.Response.StatusCode,
             "duration_ms", dur.Milliseconds(),
             "upstream", ctx.UpstreamName,
@@ -5,3 +5,42 @@ func getStringOr(m map[string]any, key, def string) string {
     return def
 }
 
+func getIntOr(m map[string]any, key string, def int) int {
+    switch v := m[key].(type) {
+    case int:
+        return v
+    case int64:
+        return int(v)
+    case float64:
+        return int(v)
+    }
+    return def
+}
+
+func getBoolOr(m map[string]any, key string, def bool) bool {
+    if v, ok := m[key].(bool); ok { return v }
+    return def
+}
+
+// getStrings accepts a YAML list of strings or a single string.
+func getStrings(m map[string]any, key string) []string {
+    switch v := m[key].(type) {
+    case string:
+        return []string{v}
+    case []string:
+        return v
+    case []any:
+        out := make([]string, 0, len(v))
+        for _, e := range v { if s, ok := e.(string); ok { out = append(out, s) } }
+        return out
+    }
+    return nil
+}
+
+func getStringMap(m map[string]any, key string) map[string]string {
+    src, ok := m[key].(map[string]any)
+    if !ok { return nil }
+    out := make(map[string]string, len(src))
+    for k, vi := range src { if s, ok := vi.(string); ok { out[k] = s } }
+    return out
+}
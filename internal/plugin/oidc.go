@@ -0,0 +1,577 @@
+package plugin
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDCPlugin logs browser users in with the OpenID Connect authorization code flow (PKCE).
+// Sessions live in an AES-GCM encrypted cookie; access tokens are refreshed when they expire.
+// Config:
+//
+//	issuer: "https://idp.example.com"      // discovery: {issuer}/.well-known/openid-configuration
+//	client_id: "web"
+//	client_secret: "..."
+//	redirect_path: "/oauth2/callback"
+//	redirect_url: "https://app.example.com/oauth2/callback" // behind TLS-terminating proxies; default built from the request
+//	logout_path: "/oauth2/logout"
+//	post_logout_redirect: "/"
+//	scopes: ["openid", "profile", "email"]
+//	cookie_name: "agw_session"
+//	cookie_secret: "..."                   // required; hashed into the AES-256 key
+//	cookie_secure: true                    // default true for an https redirect_url, else when served over TLS
+//	session_ttl_ms: 86400000
+//	unauthenticated: "redirect"            // or "deny" (401) for API callers
+//	pass_access_token: false               // forward "Authorization: Bearer <access token>"
+//	claims_to_headers: { email: X-User-Email }
+type OIDCPlugin struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectPath string
+	redirectURL  string
+	logoutPath   string
+	postLogout   string
+	scopes       []string
+	cookieName   string
+	secure       bool
+	aead         cipher.AEAD
+	sessionTTL   time.Duration
+	deny         bool
+	passToken    bool
+	claimHeaders map[string]string
+	client       *http.Client
+	now          func() time.Time
+
+	gate      fetchGate
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	idTokens  *JWTPlugin
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+// oidcSession is the encrypted session cookie payload.
+type oidcSession struct {
+	Claims       map[string]any `json:"c"`
+	AccessToken  string         `json:"at,omitempty"`
+	RefreshToken string         `json:"rt,omitempty"`
+	IDToken      string         `json:"it,omitempty"`
+	AccessExpiry int64          `json:"ae,omitempty"`
+	Expiry       int64          `json:"e"`
+}
+
+// oidcLogin is the encrypted state cookie carried across the redirect to the provider.
+type oidcLogin struct {
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Verifier string `json:"v"`
+	Return   string `json:"r"`
+}
+
+type oidcTokens struct {
+	AccessToken  string      `json:"access_token"`
+	RefreshToken string      `json:"refresh_token"`
+	IDToken      string      `json:"id_token"`
+	ExpiresIn    json.Number `json:"expires_in"`
+}
+
+const oidcLoginTTL = 10 * time.Minute
+
+// Sealed cookies larger than oidcCookieChunk are split into name, name.1, name.2, ...
+const (
+	oidcCookieChunk     = 3800
+	oidcMaxCookieChunks = 8
+)
+
+func (p *OIDCPlugin) Name() string { return "oidc" }
+
+func (p *OIDCPlugin) Init(cfg map[string]any) error {
+	p.issuer = strings.TrimSuffix(getStringOr(cfg, "issuer", ""), "/")
+	p.clientID = getStringOr(cfg, "client_id", "")
+	if p.issuer == "" || p.clientID == "" {
+		return errors.New("oidc: issuer and client_id required")
+	}
+	secret := getStringOr(cfg, "cookie_secret", "")
+	if len(secret) < 16 {
+		return errors.New("oidc: cookie_secret of at least 16 characters required")
+	}
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return err
+	}
+	if p.aead, err = cipher.NewGCM(block); err != nil {
+		return err
+	}
+	p.clientSecret = getStringOr(cfg, "client_secret", "")
+	callbackPath := "/oauth2/callback"
+	if p.redirectURL = getStringOr(cfg, "redirect_url", ""); p.redirectURL != "" {
+		u, err := url.Parse(p.redirectURL)
+		if err != nil || !u.IsAbs() {
+			return fmt.Errorf("oidc: redirect_url %q must be an absolute URL", p.redirectURL)
+		}
+		callbackPath = u.Path
+	}
+	p.redirectPath = getStringOr(cfg, "redirect_path", callbackPath)
+	p.secure = getBoolOr(cfg, "cookie_secure", strings.HasPrefix(p.redirectURL, "https://"))
+	p.logoutPath = getStringOr(cfg, "logout_path", "/oauth2/logout")
+	p.postLogout = getStringOr(cfg, "post_logout_redirect", "/")
+	p.scopes = getStrings(cfg, "scopes")
+	if len(p.scopes) == 0 {
+		p.scopes = []string{"openid", "profile", "email"}
+	}
+	p.cookieName = getStringOr(cfg, "cookie_name", "agw_session")
+	p.sessionTTL = time.Duration(getIntOr(cfg, "session_ttl_ms", 86400000)) * time.Millisecond
+	switch mode := getStringOr(cfg, "unauthenticated", "redirect"); mode {
+	case "redirect":
+	case "deny":
+		p.deny = true
+	default:
+		return fmt.Errorf("oidc: unknown unauthenticated action %q", mode)
+	}
+	p.passToken = getBoolOr(cfg, "pass_access_token", false)
+	p.claimHeaders = getStringMap(cfg, "claims_to_headers")
+	p.client = &http.Client{Timeout: 5 * time.Second}
+	p.now = time.Now
+	return nil
+}
+
+func (p *OIDCPlugin) BeforeDispatch(ctx *RequestContext) (bool, error) {
+	req := ctx.Request
+	switch req.URL.Path {
+	case p.redirectPath:
+		p.callback(ctx)
+		return true, nil
+	case p.logoutPath:
+		p.logout(ctx)
+		return true, nil
+	}
+	disc, err := p.provider()
+	if err != nil {
+		p.fail(ctx, "oidc discovery failed", err)
+		return true, nil
+	}
+	sess, ok := p.readSession(req)
+	if ok && sess.AccessExpiry != 0 && p.now().Unix() >= sess.AccessExpiry {
+		ok = sess.RefreshToken != "" && p.refresh(ctx, disc, sess)
+	}
+	if !ok {
+		p.login(ctx, disc)
+		return true, nil
+	}
+	// keep the session cookies away from the upstream
+	stripCookies(req, p.cookieName, p.cookieName+"_login")
+	if p.passToken && sess.AccessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+sess.AccessToken)
+	}
+	applyClaims(ctx, sess.Claims, p.claimHeaders)
+	return false, nil
+}
+
+func (p *OIDCPlugin) AfterDispatch(ctx *RequestContext) {}
+
+// provider returns the discovery document, fetching it on first use. Concurrent requests
+// share one fetch, and a failed fetch is not retried before the backoff has passed.
+func (p *OIDCPlugin) provider() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	disc := p.discovery
+	p.mu.Unlock()
+	if disc != nil {
+		return disc, nil
+	}
+	if err := p.gate.wait(p.discover); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.discovery, nil
+}
+
+func (p *OIDCPlugin) discover() error {
+	resp, err := p.client.Get(p.issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("discovery: status %d", resp.StatusCode)
+	}
+	var d oidcDiscovery
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&d); err != nil {
+		return fmt.Errorf("discovery: %w", err)
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != p.issuer || d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return errors.New("discovery: incomplete or mismatched provider metadata")
+	}
+	verifier := &JWTPlugin{}
+	if err := verifier.Init(map[string]any{
+		"jwks_url":   d.JWKSURI,
+		"issuer":     d.Issuer,
+		"audiences":  []string{p.clientID},
+		"algorithms": []string{"RS256", "ES256", "EdDSA"},
+	}); err != nil {
+		return err
+	}
+	verifier.now = p.now
+	p.mu.Lock()
+	p.discovery, p.idTokens = &d, verifier
+	p.mu.Unlock()
+	return nil
+}
+
+// login starts the authorization code flow, or answers 401 in deny mode.
+func (p *OIDCPlugin) login(ctx *RequestContext, disc *oidcDiscovery) {
+	if p.deny {
+		http.Error(ctx.Writer, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	st := oidcLogin{State: randomToken(), Nonce: randomToken(), Verifier: randomToken() + randomToken(), Return: ctx.Request.URL.RequestURI()}
+	if ctx.Request.Method != http.MethodGet {
+		st.Return = "/"
+	}
+	if err := p.setCookie(ctx.Writer, ctx.Request, p.cookieName+"_login", st, oidcLoginTTL); err != nil {
+		p.fail(ctx, "oidc login failed", err)
+		return
+	}
+	challenge := sha256.Sum256([]byte(st.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.clientID},
+		"redirect_uri":          {p.redirectURI(ctx.Request)},
+		"scope":                 {strings.Join(p.scopes, " ")},
+		"state":                 {st.State},
+		"nonce":                 {st.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(disc.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(ctx.Writer, ctx.Request, disc.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// callback completes the flow: it checks state, redeems the code and verifies the ID token.
+func (p *OIDCPlugin) callback(ctx *RequestContext) {
+	req := ctx.Request
+	var st oidcLogin
+	if !p.readCookie(req, p.cookieName+"_login", &st) || st.State == "" || req.URL.Query().Get("state") != st.State {
+		http.Error(ctx.Writer, "invalid login state", http.StatusBadRequest)
+		return
+	}
+	p.clearCookie(ctx.Writer, req, p.cookieName+"_login")
+	if e := req.URL.Query().Get("error"); e != "" {
+		http.Error(ctx.Writer, "login failed: "+e, http.StatusUnauthorized)
+		return
+	}
+	disc, err := p.provider()
+	if err != nil {
+		p.fail(ctx, "oidc discovery failed", err)
+		return
+	}
+	var tok oidcTokens
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {req.URL.Query().Get("code")},
+		"redirect_uri":  {p.redirectURI(req)},
+		"code_verifier": {st.Verifier},
+	}
+	if p.clientSecret == "" {
+		form.Set("client_id", p.clientID)
+	}
+	if err := postForm(req.Context(), p.client, disc.TokenEndpoint, p.clientIDForAuth(), p.clientSecret, form, &tok); err != nil {
+		p.fail(ctx, "oidc code exchange failed", err)
+		return
+	}
+	claims, err := p.verifyIDToken(tok.IDToken, st.Nonce)
+	if err != nil {
+		if ctx.Logger != nil {
+			ctx.Logger.Warnw("oidc id token rejected", "err", err)
+		}
+		http.Error(ctx.Writer, "invalid id token", http.StatusUnauthorized)
+		return
+	}
+	sess := p.newSession(disc, claims, &tok)
+	if err := p.setCookie(ctx.Writer, req, p.cookieName, sess, p.sessionTTL); err != nil {
+		p.fail(ctx, "oidc session failed", err)
+		return
+	}
+	ret := st.Return
+	if !strings.HasPrefix(ret, "/") || strings.HasPrefix(ret, "//") {
+		ret = "/"
+	}
+	http.Redirect(ctx.Writer, req, ret, http.StatusFound)
+}
+
+// refresh renews the access token in place; it reports false when the session must restart.
+func (p *OIDCPlugin) refresh(ctx *RequestContext, disc *oidcDiscovery, sess *oidcSession) bool {
+	var tok oidcTokens
+	form := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {sess.RefreshToken}}
+	if p.clientSecret == "" {
+		form.Set("client_id", p.clientID)
+	}
+	if err := postForm(ctx.Request.Context(), p.client, disc.TokenEndpoint, p.clientIDForAuth(), p.clientSecret, form, &tok); err != nil {
+		if ctx.Logger != nil {
+			ctx.Logger.Infow("oidc token refresh failed", "err", err)
+		}
+		return false
+	}
+	claims := sess.Claims
+	if tok.IDToken != "" {
+		c, err := p.verifyIDToken(tok.IDToken, "")
+		if err != nil || claimString(c["sub"]) != claimString(claims["sub"]) {
+			return false
+		}
+		claims = c
+	}
+	next := p.newSession(disc, claims, &tok)
+	next.Expiry = sess.Expiry
+	if next.RefreshToken == "" {
+		next.RefreshToken = sess.RefreshToken
+	}
+	if next.IDToken == "" {
+		next.IDToken = sess.IDToken
+	}
+	if err := p.setCookie(ctx.Writer, ctx.Request, p.cookieName, next, time.Until(time.Unix(next.Expiry, 0))); err != nil {
+		return false
+	}
+	*sess = *next
+	return true
+}
+
+func (p *OIDCPlugin) logout(ctx *RequestContext) {
+	sess, _ := p.readSession(ctx.Request)
+	p.clearCookie(ctx.Writer, ctx.Request, p.cookieName)
+	target := p.postLogout
+	p.mu.Lock()
+	disc := p.discovery
+	p.mu.Unlock()
+	if disc != nil && disc.EndSessionEndpoint != "" {
+		q := url.Values{"client_id": {p.clientID}}
+		if sess != nil && sess.IDToken != "" {
+			q.Set("id_token_hint", sess.IDToken)
+		}
+		if strings.HasPrefix(p.postLogout, "http") {
+			q.Set("post_logout_redirect_uri", p.postLogout)
+		}
+		target = disc.EndSessionEndpoint + "?" + q.Encode()
+	}
+	http.Redirect(ctx.Writer, ctx.Request, target, http.StatusFound)
+}
+
+func (p *OIDCPlugin) verifyIDToken(idToken, nonce string) (map[string]any, error) {
+	if idToken == "" {
+		return nil, errors.New("no id_token in token response")
+	}
+	p.mu.Lock()
+	verifier := p.idTokens
+	p.mu.Unlock()
+	claims, err := verifier.verify(idToken)
+	if err != nil {
+		return nil, err
+	}
+	if nonce != "" && claims["nonce"] != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+	if _, ok := numericClaim(claims, "exp"); !ok {
+		return nil, errors.New("id token without exp")
+	}
+	return claims, nil
+}
+
+// newSession builds the session payload. The ID token is only kept as the logout hint
+// for providers with an end_session_endpoint.
+func (p *OIDCPlugin) newSession(disc *oidcDiscovery, claims map[string]any, tok *oidcTokens) *oidcSession {
+	now := p.now()
+	sess := &oidcSession{
+		Claims:       claims,
+		AccessToken:  tok.AccessToken,
+		RefreshToken: tok.RefreshToken,
+		IDToken:      tok.IDToken,
+		Expiry:       now.Add(p.sessionTTL).Unix(),
+	}
+	if disc.EndSessionEndpoint == "" {
+		sess.IDToken = ""
+	}
+	if n, err := tok.ExpiresIn.Int64(); err == nil && n > 0 {
+		sess.AccessExpiry = now.Unix() + n
+	}
+	return sess
+}
+
+func (p *OIDCPlugin) readSession(req *http.Request) (*oidcSession, bool) {
+	var sess oidcSession
+	if !p.readCookie(req, p.cookieName, &sess) || p.now().Unix() >= sess.Expiry {
+		return nil, false
+	}
+	return &sess, true
+}
+
+// clientIDForAuth returns the client id for HTTP Basic authentication; public clients
+// (no secret) send it in the form instead.
+func (p *OIDCPlugin) clientIDForAuth() string {
+	if p.clientSecret == "" {
+		return ""
+	}
+	return p.clientID
+}
+
+func (p *OIDCPlugin) redirectURI(req *http.Request) string {
+	if p.redirectURL != "" {
+		return p.redirectURL
+	}
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host + p.redirectPath
+}
+
+func (p *OIDCPlugin) fail(ctx *RequestContext, msg string, err error) {
+	if ctx.Logger != nil {
+		ctx.Logger.Errorw(msg, "err", err)
+	}
+	http.Error(ctx.Writer, "authentication unavailable", http.StatusBadGateway)
+}
+
+// setCookie seals v with AES-GCM; the cookie name is bound as additional data. Values too
+// large for one cookie are split into chunks, and chunks left over from a larger value
+// are expired.
+func (p *OIDCPlugin) setCookie(w http.ResponseWriter, req *http.Request, name string, v any, ttl time.Duration) error {
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, p.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := p.aead.Seal(nonce, nonce, plain, []byte(name))
+	value := base64.RawURLEncoding.EncodeToString(sealed)
+	if len(value) > oidcCookieChunk*oidcMaxCookieChunks {
+		return fmt.Errorf("cookie %s too large (%d bytes)", name, len(value))
+	}
+	n := 0
+	for ; n == 0 || len(value) > 0; n++ {
+		chunk := value[:min(len(value), oidcCookieChunk)]
+		value = value[len(chunk):]
+		http.SetCookie(w, p.cookie(req, cookieChunkName(name, n), chunk, int(ttl/time.Second)))
+	}
+	for _, c := range req.Cookies() {
+		if i, ok := cookieChunkIndex(name, c.Name); ok && i >= n {
+			http.SetCookie(w, p.cookie(req, c.Name, "", -1))
+		}
+	}
+	return nil
+}
+
+func (p *OIDCPlugin) cookie(req *http.Request, name, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   p.secure || req.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// cookieChunkName names chunk i of cookie name: name itself, then name.1, name.2, ...
+func cookieChunkName(name string, i int) string {
+	if i == 0 {
+		return name
+	}
+	return name + "." + strconv.Itoa(i)
+}
+
+// cookieChunkIndex reports whether cookie is a chunk of name, and which.
+func cookieChunkIndex(name, cookie string) (int, bool) {
+	if cookie == name {
+		return 0, true
+	}
+	rest, ok := strings.CutPrefix(cookie, name+".")
+	if !ok {
+		return 0, false
+	}
+	i, err := strconv.Atoi(rest)
+	return i, err == nil && i > 0
+}
+
+func (p *OIDCPlugin) readCookie(req *http.Request, name string, v any) bool {
+	var value strings.Builder
+	for i := 0; i < oidcMaxCookieChunks; i++ {
+		c, err := req.Cookie(cookieChunkName(name, i))
+		if err != nil {
+			break
+		}
+		value.WriteString(c.Value)
+	}
+	if value.Len() == 0 {
+		return false
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(value.String())
+	if err != nil || len(sealed) < p.aead.NonceSize() {
+		return false
+	}
+	ns := p.aead.NonceSize()
+	plain, err := p.aead.Open(nil, sealed[:ns], sealed[ns:], []byte(name))
+	if err != nil {
+		return false
+	}
+	dec := json.NewDecoder(strings.NewReader(string(plain)))
+	dec.UseNumber()
+	return dec.Decode(v) == nil
+}
+
+func (p *OIDCPlugin) clearCookie(w http.ResponseWriter, req *http.Request, name string) {
+	http.SetCookie(w, p.cookie(req, name, "", -1))
+	for _, c := range req.Cookies() {
+		if i, ok := cookieChunkIndex(name, c.Name); ok && i > 0 {
+			http.SetCookie(w, p.cookie(req, c.Name, "", -1))
+		}
+	}
+}
+
+// stripCookies removes the named cookies, and their chunks, from the request's Cookie header.
+func stripCookies(req *http.Request, names ...string) {
+	cookies := req.Cookies()
+	req.Header.Del("Cookie")
+next:
+	for _, c := range cookies {
+		for _, name := range names {
+			if _, ok := cookieChunkIndex(name, c.Name); ok {
+				continue next
+			}
+		}
+		req.AddCookie(c)
+	}
+}
+
+func randomToken() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return base64.RawURLEncoding.EncodeToString(b[:])
+}
+
+func init() { Register("oidc", func() Plugin { return &OIDCPlugin{} }) }
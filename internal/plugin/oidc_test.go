@@ -0,0 +1,359 @@
+package plugin
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mockProvider is a minimal OpenID provider: discovery, JWKS, token and introspection endpoints.
+type mockProvider struct {
+	t   *testing.T
+	srv *httptest.Server
+	key *rsa.PrivateKey
+
+	mu             sync.Mutex
+	codes          map[string][2]string // code -> {code_challenge, nonce}
+	refreshes      int
+	introspections int
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	m := &mockProvider{t: t, key: key, codes: map[string][2]string{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.srv.URL,
+			"authorization_endpoint": m.srv.URL + "/authorize",
+			"token_endpoint":         m.srv.URL + "/token",
+			"jwks_uri":               m.srv.URL + "/jwks",
+			"end_session_endpoint":   m.srv.URL + "/logout",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, _ *http.Request) {
+		enc := base64.RawURLEncoding
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "k1", "n": enc.EncodeToString(key.N.Bytes()), "e": enc.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", m.token)
+	mux.HandleFunc("/introspect", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		m.introspections++
+		m.mu.Unlock()
+		if id, secret, _ := r.BasicAuth(); id != "gateway" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = r.ParseForm()
+		switch r.PostForm.Get("token") {
+		case "opaque-good":
+			_ = json.NewEncoder(w).Encode(map[string]any{"active": true, "sub": "alice", "scope": "orders:read profile", "exp": time.Now().Unix() + 60})
+		case "opaque-narrow":
+			_ = json.NewEncoder(w).Encode(map[string]any{"active": true, "sub": "bob", "scope": "profile"})
+		default:
+			_ = json.NewEncoder(w).Encode(map[string]any{"active": false})
+		}
+	})
+	m.srv = httptest.NewServer(mux)
+	t.Cleanup(m.srv.Close)
+	return m
+}
+
+func (m *mockProvider) token(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	if id, secret, _ := r.BasicAuth(); id != "web" || secret != "web-secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"error":"invalid_client"}`))
+		return
+	}
+	idToken := func(nonce string) string {
+		claims := map[string]any{"iss": m.srv.URL, "aud": "web", "sub": "alice", "email": "alice@example.com", "exp": time.Now().Unix() + 300}
+		if nonce != "" {
+			claims["nonce"] = nonce
+		}
+		return signJWT(m.t, "RS256", "k1", m.key, claims)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		c, ok := m.codes[r.PostForm.Get("code")]
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != c[0] {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		delete(m.codes, r.PostForm.Get("code"))
+		_ = json.NewEncoder(w).Encode(map[string]any{"access_token": "at-1", "refresh_token": "rt-1", "id_token": idToken(c[1]), "expires_in": 60})
+	case "refresh_token":
+		if r.PostForm.Get("refresh_token") != "rt-1" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		m.refreshes++
+		_ = json.NewEncoder(w).Encode(map[string]any{"access_token": "at-2", "expires_in": 60})
+	}
+}
+
+// authorize plays the provider's login page: it accepts the authorization request and
+// returns the callback URL with a fresh code.
+func (m *mockProvider) authorize(t *testing.T, location string) string {
+	u, err := url.Parse(location)
+	if err != nil || !strings.HasPrefix(location, m.srv.URL+"/authorize") {
+		t.Fatalf("unexpected login redirect %q", location)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("client_id") != "web" || q.Get("response_type") != "code" {
+		t.Fatalf("bad authorization request: %v", q)
+	}
+	m.mu.Lock()
+	m.codes["code-1"] = [2]string{q.Get("code_challenge"), q.Get("nonce")}
+	m.mu.Unlock()
+	return q.Get("redirect_uri") + "?code=code-1&state=" + url.QueryEscape(q.Get("state"))
+}
+
+func runWithCookies(p Plugin, target string, cookies []*http.Cookie) (*RequestContext, *httptest.ResponseRecorder, bool) {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	ctx := &RequestContext{Context: req.Context(), Writer: rec, Request: req}
+	handled, _ := p.BeforeDispatch(ctx)
+	return ctx, rec, handled
+}
+
+func TestOIDCPluginLoginFlow(t *testing.T) {
+	idp := newMockProvider(t)
+	p := &OIDCPlugin{}
+	if err := p.Init(map[string]any{
+		"issuer":            idp.srv.URL,
+		"client_id":         "web",
+		"client_secret":     "web-secret",
+		"cookie_secret":     "0123456789abcdef0123456789abcdef",
+		"pass_access_token": true,
+		"claims_to_headers": map[string]any{"email": "X-User-Email"},
+	}); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+
+	// 1. anonymous request is redirected to the provider
+	_, rec, handled := runWithCookies(p, "http://app.example/orders?page=2", nil)
+	if !handled || rec.Code != http.StatusFound {
+		t.Fatalf("expected login redirect, got %d", rec.Code)
+	}
+	callback := idp.authorize(t, rec.Header().Get("Location"))
+	loginCookies := rec.Result().Cookies()
+
+	// 2. a forged state is refused
+	if _, rec, _ := runWithCookies(p, strings.Replace(callback, "state=", "state=x", 1), loginCookies); rec.Code != http.StatusBadRequest {
+		t.Fatalf("forged state: %d", rec.Code)
+	}
+
+	// 3. the callback redeems the code and sets the session
+	_, rec, handled = runWithCookies(p, callback, loginCookies)
+	if !handled || rec.Code != http.StatusFound || rec.Header().Get("Location") != "/orders?page=2" {
+		t.Fatalf("callback: code=%d location=%q body=%s", rec.Code, rec.Header().Get("Location"), rec.Body)
+	}
+	var session *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "agw_session" && c.Value != "" {
+			session = c
+		}
+	}
+	if session == nil || !session.HttpOnly || strings.Contains(session.Value, "alice") {
+		t.Fatalf("session cookie missing or readable: %+v", session)
+	}
+
+	// 4. authenticated requests carry claims and the access token upstream
+	ctx, _, handled := runWithCookies(p, "http://app.example/orders", []*http.Cookie{session, {Name: "theme", Value: "dark"}})
+	if handled {
+		t.Fatal("authenticated request was intercepted")
+	}
+	h := ctx.Request.Header
+	if h.Get("X-User-Email") != "alice@example.com" || h.Get("Authorization") != "Bearer at-1" || ctx.Claims["sub"] != "alice" {
+		t.Fatalf("claims not forwarded: %v", h)
+	}
+	if strings.Contains(h.Get("Cookie"), "agw_session") || !strings.Contains(h.Get("Cookie"), "theme=dark") {
+		t.Fatalf("session cookie leaked upstream: %q", h.Get("Cookie"))
+	}
+
+	// 5. once the access token expires it is refreshed transparently
+	p.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	ctx, rec, handled = runWithCookies(p, "http://app.example/orders", []*http.Cookie{session})
+	if handled || ctx.Request.Header.Get("Authorization") != "Bearer at-2" || idp.refreshes != 1 {
+		t.Fatalf("refresh: handled=%v auth=%q refreshes=%d", handled, ctx.Request.Header.Get("Authorization"), idp.refreshes)
+	}
+	if len(rec.Result().Cookies()) == 0 {
+		t.Fatal("refreshed session not re-issued")
+	}
+
+	// 6. tampered cookies are ignored
+	bad := *session
+	bad.Value = session.Value[:len(session.Value)-2] + "AA"
+	if _, rec, handled := runWithCookies(p, "http://app.example/orders", []*http.Cookie{&bad}); !handled || rec.Code != http.StatusFound {
+		t.Fatalf("tampered session accepted: %d", rec.Code)
+	}
+
+	// 7. logout clears the session and goes to the provider's end_session_endpoint
+	_, rec, _ = runWithCookies(p, "http://app.example/oauth2/logout", []*http.Cookie{session})
+	if !strings.HasPrefix(rec.Header().Get("Location"), idp.srv.URL+"/logout?") || rec.Result().Cookies()[0].MaxAge >= 0 {
+		t.Fatalf("logout: %q %v", rec.Header().Get("Location"), rec.Result().Cookies())
+	}
+}
+
+func TestIntrospectPlugin(t *testing.T) {
+	idp := newMockProvider(t)
+	p := &IntrospectPlugin{}
+	if err := p.Init(map[string]any{
+		"introspection_url": idp.srv.URL + "/introspect",
+		"client_id":         "gateway",
+		"client_secret":     "s3cret",
+		"required_scopes":   []any{"orders:read"},
+		"claims_to_headers": map[string]any{"sub": "X-User-ID"},
+	}); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		ctx, rec, handled := runBefore(p, "opaque-good")
+		if handled || ctx.Request.Header.Get("X-User-ID") != "alice" {
+			t.Fatalf("active token rejected: %d", rec.Code)
+		}
+	}
+	if idp.introspections != 1 {
+		t.Fatalf("expected cached introspection, got %d calls", idp.introspections)
+	}
+	// cached entries expire with the token; the provider's answer is then past exp as well
+	p.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if _, _, handled := runBefore(p, "opaque-good"); !handled || idp.introspections != 2 {
+		t.Fatalf("expired cache entry reused: calls=%d", idp.introspections)
+	}
+	p.now = time.Now
+
+	if _, rec, handled := runBefore(p, "opaque-revoked"); !handled || rec.Code != http.StatusUnauthorized {
+		t.Fatalf("inactive token: %d", rec.Code)
+	}
+	if _, rec, handled := runBefore(p, "opaque-narrow"); !handled || rec.Code != http.StatusForbidden || !strings.Contains(rec.Header().Get("WWW-Authenticate"), "insufficient_scope") {
+		t.Fatalf("insufficient scope: %d", rec.Code)
+	}
+	if _, rec, handled := runBefore(p, ""); !handled || rec.Code != http.StatusUnauthorized {
+		t.Fatalf("missing token: %d", rec.Code)
+	}
+}
+
+func TestOIDCPluginBehindProxy(t *testing.T) {
+	idp := newMockProvider(t)
+	p := &OIDCPlugin{}
+	if err := p.Init(map[string]any{
+		"issuer":        idp.srv.URL,
+		"client_id":     "web",
+		"client_secret": "web-secret",
+		"cookie_secret": "0123456789abcdef0123456789abcdef",
+		"redirect_url":  "https://app.example.com/auth/callback",
+	}); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	if p.redirectPath != "/auth/callback" {
+		t.Fatalf("redirect_path should follow redirect_url, got %q", p.redirectPath)
+	}
+
+	// TLS ends at the proxy: the request arrives over plain HTTP with an internal host
+	_, rec, _ := runWithCookies(p, "http://10.0.0.7:8080/orders", nil)
+	u, _ := url.Parse(rec.Header().Get("Location"))
+	if got := u.Query().Get("redirect_uri"); got != "https://app.example.com/auth/callback" {
+		t.Fatalf("redirect_uri = %q", got)
+	}
+	for _, c := range rec.Result().Cookies() {
+		if !c.Secure {
+			t.Fatalf("cookie %s not marked Secure", c.Name)
+		}
+	}
+}
+
+func TestOIDCCookieChunks(t *testing.T) {
+	p := &OIDCPlugin{}
+	if err := p.Init(map[string]any{"issuer": "http://idp.example", "client_id": "web", "cookie_secret": "0123456789abcdef0123456789abcdef"}); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	big := &oidcSession{AccessToken: strings.Repeat("a", 9000), Claims: map[string]any{"sub": "alice"}}
+	req := httptest.NewRequest(http.MethodGet, "http://app.example/", nil)
+	rec := httptest.NewRecorder()
+	if err := p.setCookie(rec, req, "agw_session", big, time.Hour); err != nil {
+		t.Fatalf("large session: %v", err)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) < 3 || cookies[1].Name != "agw_session.1" {
+		t.Fatalf("session not split: %d cookies", len(cookies))
+	}
+	for _, c := range cookies {
+		if len(c.Value) > oidcCookieChunk {
+			t.Fatalf("chunk %s is %d bytes", c.Name, len(c.Value))
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://app.example/", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	req.AddCookie(&http.Cookie{Name: "theme", Value: "dark"})
+	var got oidcSession
+	if !p.readCookie(req, "agw_session", &got) || got.AccessToken != big.AccessToken {
+		t.Fatal("chunked session not read back")
+	}
+
+	// a smaller session expires the chunks it no longer needs
+	rec = httptest.NewRecorder()
+	if err := p.setCookie(rec, req, "agw_session", &oidcSession{AccessToken: "at"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	expired := 0
+	for _, c := range rec.Result().Cookies() {
+		if c.Name != "agw_session" && c.MaxAge < 0 {
+			expired++
+		}
+	}
+	if expired != len(cookies)-1 {
+		t.Fatalf("expired %d stale chunks, want %d", expired, len(cookies)-1)
+	}
+
+	stripCookies(req, "agw_session")
+	if h := req.Header.Get("Cookie"); h != "theme=dark" {
+		t.Fatalf("chunks leaked upstream: %q", h)
+	}
+}
+
+func TestOIDCDiscoveryBackoff(t *testing.T) {
+	var hits atomic.Int32
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer idp.Close()
+	p := &OIDCPlugin{}
+	if err := p.Init(map[string]any{"issuer": idp.URL, "client_id": "web", "cookie_secret": "0123456789abcdef0123456789abcdef"}); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, rec, _ := runWithCookies(p, "http://app.example/", nil); rec.Code != http.StatusBadGateway {
+			t.Fatalf("provider down: %d", rec.Code)
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("discovery fetched %d times during backoff", n)
+	}
+}
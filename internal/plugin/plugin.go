@@ -2,10 +2,15 @@ package plugin
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"net/http"
+	"strings"
 
 	"github.com/kenelite/go-agw/internal/config"
+	"github.com/kenelite/go-agw/internal/consumer"
 	"github.com/kenelite/go-agw/internal/observability"
+	"github.com/kenelite/go-agw/internal/tlsutil"
 )
 
 // RequestContext provides per-request context passed to plugins.
@@ -13,6 +18,9 @@ type RequestContext struct {
 	Context context.Context
 	Writer  http.ResponseWriter
 	Request *http.Request
+	// Original is the request as received, before any plugin modified it; only kept for
+	// routes whose chain replays requests (cache)
+	Original *http.Request
 	// Plugin shared storage could be added later
 	Response *Response
     Logger   *observability.Logger
@@ -20,6 +28,14 @@ type RequestContext struct {
     // Resolved upstream info
     UpstreamName   string
     UpstreamTarget string
+    // Verified client certificate identity (mTLS); nil when none was presented
+    ClientCert *tlsutil.Identity
+    // Real client IP, resolved through trusted proxies
+    ClientIP string
+    // Verified token claims set by authentication plugins (e.g. jwt)
+    Claims map[string]any
+    // Authenticated consumer set by authentication plugins (e.g. key-auth)
+    Consumer *consumer.Consumer
 }
 
 // Plugin defines request lifecycle hooks.
@@ -38,39 +54,186 @@ type Response struct {
 	Header     http.Header
 	Body       []byte
 	Trailer    http.Header
+	// Streaming responses are relayed as they arrive: Body is nil and only the
+	// status and headers can still be changed.
+	Streaming bool
+}
+
+// ConsumerAware plugins receive the shared consumer registry before Init.
+type ConsumerAware interface {
+	UseConsumers(*consumer.Registry)
+}
+
+// DispatcherAware plugins receive the gateway's request handler, to issue requests of
+// their own through the full route (e.g. background cache revalidation).
+type DispatcherAware interface {
+	UseDispatcher(http.Handler)
+}
+
+// UpstreamErrorHandler plugins may answer a request whose upstream call failed, writing
+// the response themselves and returning true (e.g. serving a stale cache entry).
+type UpstreamErrorHandler interface {
+	UpstreamError(*RequestContext, error) (handled bool)
 }
 
 // Manager wires configured plugins into the request flow.
 type Manager struct {
-	plugins []Plugin
-	logger  *observability.Logger
+	plugins    []Plugin
+	routes     [][]Plugin // per-route chains; nil entries use the global chain
+	logger     *observability.Logger
+	consumers  *consumer.Registry
+	dispatcher http.Handler
 }
 
 func NewManager(logger *observability.Logger) *Manager { return &Manager{logger: logger} }
 
+// SetConsumers provides the consumer registry to plugins initialised afterwards.
+func (m *Manager) SetConsumers(reg *consumer.Registry) { m.consumers = reg }
+
+// SetDispatcher provides h to DispatcherAware plugins, current and future.
+func (m *Manager) SetDispatcher(h http.Handler) {
+	m.dispatcher = h
+	m.each(func(p Plugin) {
+		if da, ok := p.(DispatcherAware); ok {
+			da.UseDispatcher(h)
+		}
+	})
+}
+
 func (m *Manager) Init(cfg config.PluginsConfig) error {
 	m.plugins = []Plugin{}
 	for _, pref := range cfg.Available {
-		ctor := getConstructor(pref.Name)
-		if ctor == nil {
-			if m.logger != nil {
-				m.logger.Warnw("unknown plugin", "name", pref.Name)
-			}
+		p, err := m.build(pref)
+		if err != nil {
+			return err
+		}
+		if p != nil {
+			m.plugins = append(m.plugins, p)
+		}
+	}
+	return nil
+}
+
+// InitRoutes builds the chains of routes that declare their own plugins: the global chain
+// followed by the route's plugins. A route plugin with the same name as a global one
+// replaces it in place, so a route can re-configure e.g. ip-restriction.
+func (m *Manager) InitRoutes(routes []config.RouteConfig) error {
+	m.routes = make([][]Plugin, len(routes))
+	for i, rt := range routes {
+		if len(rt.Plugins) == 0 {
 			continue
 		}
-		p := ctor()
-		if err := p.Init(pref.Config); err != nil {
-			if m.logger != nil {
-				m.logger.Errorw("plugin init failed", "name", pref.Name, "err", err)
+		chain := append([]Plugin(nil), m.plugins...)
+		for _, pref := range rt.Plugins {
+			p, err := m.build(pref)
+			if err != nil {
+				return fmt.Errorf("route %s: %w", rt.Path, err)
+			}
+			if p == nil {
+				continue
+			}
+			replaced := false
+			for j, g := range chain {
+				if g.Name() == p.Name() {
+					chain[j], replaced = p, true
+					break
+				}
+			}
+			if !replaced {
+				chain = append(chain, p)
 			}
-			continue
 		}
-		m.plugins = append(m.plugins, p)
+		m.routes[i] = chain
+	}
+	return nil
+}
+
+// build instantiates and initialises one plugin. Unknown plugins are logged and skipped;
+// a plugin that fails to initialise is an error, so the gateway never starts without it.
+func (m *Manager) build(pref config.PluginRef) (Plugin, error) {
+	ctor := getConstructor(pref.Name)
+	if ctor == nil {
 		if m.logger != nil {
-			m.logger.Infow("plugin loaded", "name", p.Name())
+			m.logger.Warnw("unknown plugin", "name", pref.Name)
 		}
+		return nil, nil
 	}
-	return nil
+	p := ctor()
+	if ca, ok := p.(ConsumerAware); ok && m.consumers != nil {
+		ca.UseConsumers(m.consumers)
+	}
+	if da, ok := p.(DispatcherAware); ok && m.dispatcher != nil {
+		da.UseDispatcher(m.dispatcher)
+	}
+	if err := p.Init(pref.Config); err != nil {
+		return nil, fmt.Errorf("plugin %s: %w", pref.Name, err)
+	}
+	if m.logger != nil {
+		m.logger.Infow("plugin loaded", "name", p.Name())
+	}
+	return p, nil
 }
 
 func (m *Manager) Chain() []Plugin { return m.plugins }
+
+// ChainFor returns the chain for the route at index i.
+func (m *Manager) ChainFor(i int) []Plugin {
+	if i >= 0 && i < len(m.routes) && m.routes[i] != nil {
+		return m.routes[i]
+	}
+	return m.plugins
+}
+
+// each calls fn once for every plugin instance, global or route-level.
+func (m *Manager) each(fn func(Plugin)) {
+	seen := map[Plugin]bool{}
+	visit := func(chain []Plugin) {
+		for _, p := range chain {
+			if !seen[p] {
+				seen[p] = true
+				fn(p)
+			}
+		}
+	}
+	visit(m.plugins)
+	for _, chain := range m.routes {
+		visit(chain)
+	}
+}
+
+// Caches returns every cache plugin instance, for purging and metrics.
+func (m *Manager) Caches() []*CachePlugin {
+	var out []*CachePlugin
+	m.each(func(p Plugin) {
+		if c, ok := p.(*CachePlugin); ok {
+			out = append(out, c)
+		}
+	})
+	return out
+}
+
+// WriteMetrics reports the caches' results, entries and sizes.
+func (m *Manager) WriteMetrics(w io.Writer) {
+	caches := m.Caches()
+	if len(caches) == 0 {
+		return
+	}
+	stats := make([]CacheStats, len(caches))
+	for i, c := range caches {
+		stats[i] = c.Stats()
+	}
+	fmt.Fprintf(w, "# HELP go_agw_cache_requests_total Cacheable requests by outcome\n# TYPE go_agw_cache_requests_total counter\n")
+	for _, s := range stats {
+		for _, r := range cacheResultNames {
+			fmt.Fprintf(w, "go_agw_cache_requests_total{zone=%q,result=%q} %d\n", s.Zone, strings.ToLower(r), s.Results[r])
+		}
+	}
+	fmt.Fprintf(w, "# HELP go_agw_cache_entries Entries stored\n# TYPE go_agw_cache_entries gauge\n")
+	for _, s := range stats {
+		fmt.Fprintf(w, "go_agw_cache_entries{zone=%q} %d\n", s.Zone, s.Entries)
+	}
+	fmt.Fprintf(w, "# HELP go_agw_cache_bytes Bytes stored\n# TYPE go_agw_cache_bytes gauge\n")
+	for _, s := range stats {
+		fmt.Fprintf(w, "go_agw_cache_bytes{zone=%q} %d\n", s.Zone, s.Bytes)
+	}
+}
@@ -73,6 +73,7 @@ func (p *TransformPlugin) AfterDispatch(ctx *RequestContext) {
         }
     }
     // Body transforms
+    if ctx.Response.Streaming { return }
     ct := strings.ToLower(ctx.Response.Header.Get("Content-Type"))
     body := ctx.Response.Body
     // Optional gzip decompress first
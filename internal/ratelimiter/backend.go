@@ -0,0 +1,221 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/kenelite/go-agw/internal/config"
+	"github.com/kenelite/go-agw/internal/observability"
+)
+
+// Backend counts a request identified by key against lim. Implementations must be safe
+// for concurrent use.
+type Backend interface {
+	Allow(ctx context.Context, key string, lim Limit) (Decision, error)
+}
+
+// Refunder is implemented by backends that can give back a request they allowed. A
+// request checked against several limits is refunded to the ones that allowed it when a
+// later limit rejects it, so a throttled request does not use up longer quotas.
+type Refunder interface {
+	Refund(ctx context.Context, key string, lim Limit) error
+}
+
+// Memory keeps limiter state in process; every gateway replica limits on its own. Opened
+// with OpenMemory it sweeps idle keys periodically and, with a persist file, saves its state
+// periodically and on Close and restores it on start, so long quotas survive restarts.
+type Memory struct {
+	l      *Limiter
+	path   string
+	stop   chan struct{}
+	done   chan struct{}
+	logger *observability.Logger
+}
+
+// MemoryOptions configures OpenMemory. Zero values select defaults.
+type MemoryOptions struct {
+	MaxKeys         int           // default DefaultMaxKeys
+	SweepInterval   time.Duration // default 1m
+	PersistFile     string
+	PersistInterval time.Duration // default 10s
+}
+
+// NewMemory returns an in-process backend without background sweeping or persistence.
+func NewMemory() *Memory { return &Memory{l: New()} }
+
+// OpenMemory restores persisted state, if any, and starts background maintenance.
+func OpenMemory(opts MemoryOptions, logger *observability.Logger) (*Memory, error) {
+	m := &Memory{l: NewSharded(64, opts.MaxKeys), path: opts.PersistFile, stop: make(chan struct{}), done: make(chan struct{}), logger: logger}
+	if m.path != "" {
+		if err := m.l.Load(m.path); err != nil {
+			return nil, err
+		}
+	}
+	if opts.SweepInterval <= 0 {
+		opts.SweepInterval = time.Minute
+	}
+	if opts.PersistInterval <= 0 {
+		opts.PersistInterval = 10 * time.Second
+	}
+	go m.maintain(opts.SweepInterval, opts.PersistInterval)
+	return m, nil
+}
+
+func (m *Memory) Allow(_ context.Context, key string, lim Limit) (Decision, error) {
+	return m.l.Take(key, lim), nil
+}
+
+func (m *Memory) Refund(_ context.Context, key string, lim Limit) error {
+	m.l.Refund(key, lim)
+	return nil
+}
+
+func (m *Memory) maintain(sweepEvery, saveEvery time.Duration) {
+	defer close(m.done)
+	sweep := time.NewTicker(sweepEvery)
+	defer sweep.Stop()
+	var saveC <-chan time.Time
+	if m.path != "" {
+		save := time.NewTicker(saveEvery)
+		defer save.Stop()
+		saveC = save.C
+	}
+	for {
+		select {
+		case <-sweep.C:
+			m.l.Sweep()
+		case <-saveC:
+			if err := m.l.Save(m.path); err != nil && m.logger != nil {
+				m.logger.Warnw("saving rate limit state failed", "path", m.path, "err", err)
+			}
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// Close stops background work and writes a final snapshot when persisting.
+func (m *Memory) Close() error {
+	if m.stop == nil {
+		return nil
+	}
+	close(m.stop)
+	<-m.done
+	m.stop = nil
+	if m.path == "" {
+		return nil
+	}
+	return m.l.Save(m.path)
+}
+
+// WriteMetrics reports tracked keys and evictions.
+func (m *Memory) WriteMetrics(w io.Writer) { m.l.writeMetrics(w, "memory") }
+
+// NewBackend builds the backend selected by the rate_limit_store config. Shared stores are
+// wrapped in a Fallback so that requests are still limited, per replica, while the store
+// is unreachable.
+func NewBackend(sc config.RateLimitStoreConfig, logger *observability.Logger) (Backend, error) {
+	switch sc.Type {
+	case "", "memory":
+		return OpenMemory(MemoryOptions{
+			MaxKeys:         sc.MaxKeys,
+			SweepInterval:   time.Duration(sc.SweepInterval) * time.Millisecond,
+			PersistFile:     sc.PersistFile,
+			PersistInterval: time.Duration(sc.PersistInterval) * time.Millisecond,
+		}, logger)
+	case "redis":
+		if sc.Addr == "" {
+			return nil, errors.New("rate_limit_store: redis needs addr")
+		}
+		r := NewRedis(RedisOptions{
+			Addr:      sc.Addr,
+			Password:  sc.Password,
+			DB:        sc.DB,
+			Timeout:   time.Duration(sc.Timeout) * time.Millisecond,
+			KeyPrefix: sc.KeyPrefix,
+			PoolSize:  sc.PoolSize,
+		})
+		f := NewFallback(r, time.Duration(sc.RetryInterval)*time.Millisecond, logger)
+		f.local = NewSharded(64, sc.MaxKeys)
+		return f, nil
+	default:
+		return nil, fmt.Errorf("rate_limit_store: unknown type %q", sc.Type)
+	}
+}
+
+// Fallback sends decisions to a shared store and switches to an in-process limiter when
+// the store fails. While degraded it retries the store at most once per retry interval,
+// so an outage does not add the store timeout to every request.
+type Fallback struct {
+	primary Backend
+	local   *Limiter
+	retry   time.Duration
+	logger  *observability.Logger
+
+	retryAt  atomic.Int64 // unix nanos before which the store is skipped; 0 when healthy
+	errors   atomic.Int64
+	degraded atomic.Bool
+}
+
+// NewFallback wraps primary. retry defaults to one second.
+func NewFallback(primary Backend, retry time.Duration, logger *observability.Logger) *Fallback {
+	if retry <= 0 {
+		retry = time.Second
+	}
+	return &Fallback{primary: primary, local: New(), retry: retry, logger: logger}
+}
+
+func (f *Fallback) Allow(ctx context.Context, key string, lim Limit) (Decision, error) {
+	if at := f.retryAt.Load(); at != 0 && time.Now().UnixNano() < at {
+		return f.local.Take(key, lim), nil
+	}
+	d, err := f.primary.Allow(ctx, key, lim)
+	if err == nil {
+		if f.degraded.CompareAndSwap(true, false) && f.logger != nil {
+			f.logger.Infow("rate limit store recovered")
+		}
+		f.retryAt.Store(0)
+		return d, nil
+	}
+	f.errors.Add(1)
+	f.retryAt.Store(time.Now().Add(f.retry).UnixNano())
+	if !f.degraded.Swap(true) && f.logger != nil {
+		f.logger.Warnw("rate limit store unavailable, limiting locally", "err", err)
+	}
+	return f.local.Take(key, lim), nil
+}
+
+// Refund gives the request back to where Allow most likely counted it: the local limiter
+// while degraded, otherwise the store.
+func (f *Fallback) Refund(ctx context.Context, key string, lim Limit) error {
+	if at := f.retryAt.Load(); at != 0 && time.Now().UnixNano() < at {
+		f.local.Refund(key, lim)
+		return nil
+	}
+	if r, ok := f.primary.(Refunder); ok {
+		return r.Refund(ctx, key, lim)
+	}
+	return nil
+}
+
+// Degraded reports whether decisions are currently made locally.
+func (f *Fallback) Degraded() bool { return f.degraded.Load() }
+
+// WriteMetrics reports store failures and whether the fallback is active.
+func (f *Fallback) WriteMetrics(w io.Writer) {
+	degraded := 0
+	if f.Degraded() {
+		degraded = 1
+	}
+	fmt.Fprintf(w, "# HELP go_agw_ratelimit_store_errors_total Failed rate limit store calls\n"+
+		"# TYPE go_agw_ratelimit_store_errors_total counter\n"+
+		"go_agw_ratelimit_store_errors_total %d\n"+
+		"# HELP go_agw_ratelimit_store_degraded 1 while rate limits are enforced per replica\n"+
+		"# TYPE go_agw_ratelimit_store_degraded gauge\n"+
+		"go_agw_ratelimit_store_degraded %d\n", f.errors.Load(), degraded)
+	f.local.writeMetrics(w, "fallback")
+}
@@ -1,11 +1,54 @@
 package ratelimiter
 
 import (
+    "fmt"
+    "io"
+    "math"
     "net"
     "sync"
+    "sync/atomic"
     "time"
 )
 
+// Algorithms a Limit can use.
+const (
+    TokenBucketAlgorithm   = "token_bucket"   // smooth refill with bursts (default)
+    FixedWindowAlgorithm   = "fixed_window"   // counter reset at UTC-aligned window boundaries
+    SlidingWindowAlgorithm = "sliding_window" // current counter plus a weighted share of the previous window
+    SlidingLogAlgorithm    = "sliding_log"    // exact: one timestamp per request within the window
+)
+
+// Limit allows Requests per Window. Token buckets additionally allow bursts of up to Burst requests.
+type Limit struct {
+    Requests  int
+    Window    time.Duration
+    Burst     int
+    Algorithm string // default TokenBucketAlgorithm
+    // Monthly makes fixed windows calendar months (UTC) instead of multiples of Window.
+    Monthly bool
+}
+
+// rate is the refill rate in tokens per second.
+func (lim Limit) rate() float64 { return float64(lim.Requests) / lim.Window.Seconds() }
+
+// Decision is the outcome of taking one request from a limit.
+type Decision struct {
+    Allowed    bool
+    Limit      int           // quota of the window (bucket capacity for token buckets)
+    Remaining  int           // requests left after this one
+    Reset      time.Duration // until the quota is fully available again
+    RetryAfter time.Duration // when denied: until a retry can succeed
+}
+
+// bucket is the per-key state of one algorithm.
+type bucket interface {
+    take(now time.Time, lim Limit) Decision
+    // refund gives back one request that take allowed.
+    refund(now time.Time, lim Limit)
+    // expired reports whether the state no longer affects decisions and can be dropped.
+    expired(now time.Time) bool
+}
+
 // Simple token bucket per key (e.g., client IP or route key)
 type TokenBucket struct {
     capacity int
@@ -14,35 +57,327 @@ type TokenBucket struct {
     last     time.Time
 }
 
+// DefaultMaxKeys bounds the keys a Limiter tracks unless configured otherwise.
+const DefaultMaxKeys = 1 << 20
+
+// Limiter tracks per-key state in shards, each with its own lock and LRU list. Keys whose
+// state no longer matters (a full bucket, a finished window) are dropped as they reach the
+// cold end of the list or when Sweep runs; beyond the key cap the least recently used key
+// is evicted even if its state still matters.
 type Limiter struct {
-    mu    sync.Mutex
-    store map[string]*TokenBucket
+    shards    []shard
+    mask      uint32
+    evictLRU  atomic.Int64
+    evictIdle atomic.Int64
 }
 
-func New() *Limiter { return &Limiter{store: map[string]*TokenBucket{}} }
+type shard struct {
+    mu      sync.Mutex
+    m       map[string]*entry
+    head    entry // sentinel: head.next is the most recently used entry
+    maxKeys int
+}
+
+type entry struct {
+    key        string
+    b          bucket
+    prev, next *entry
+}
+
+func New() *Limiter { return NewSharded(64, DefaultMaxKeys) }
+
+// NewSharded returns a Limiter with shards rounded up to a power of two, tracking at most
+// maxKeys keys in total.
+func NewSharded(shards, maxKeys int) *Limiter {
+    n := 1
+    for n < shards { n <<= 1 }
+    if maxKeys <= 0 { maxKeys = DefaultMaxKeys }
+    l := &Limiter{shards: make([]shard, n), mask: uint32(n - 1)}
+    for i := range l.shards {
+        sh := &l.shards[i]
+        sh.m = map[string]*entry{}
+        sh.head.prev, sh.head.next = &sh.head, &sh.head
+        sh.maxKeys = max(1, (maxKeys+n-1)/n)
+    }
+    return l
+}
 
 func (l *Limiter) Allow(key string, rps, burst int) bool {
-    if rps <= 0 { return true }
+    return l.Take(key, Limit{Requests: rps, Window: time.Second, Burst: burst}).Allowed
+}
+
+// Take counts one request for key against lim.
+func (l *Limiter) Take(key string, lim Limit) Decision {
+    if lim.Requests <= 0 || lim.Window <= 0 { return Decision{Allowed: true} }
+    now := time.Now()
+    sh := l.shard(key)
+    sh.mu.Lock()
+    defer sh.mu.Unlock()
+    e, ok := sh.m[key]
+    if ok && sameKind(e.b, lim) {
+        sh.moveToFront(e)
+    } else {
+        if ok { sh.remove(e) }
+        e = &entry{key: key, b: newBucket(now, lim)}
+        sh.pushFront(e)
+        l.trim(sh, now)
+    }
+    return e.b.take(now, lim)
+}
+
+// Refund gives back one request allowed by Take, e.g. when another limit rejected the
+// request after all.
+func (l *Limiter) Refund(key string, lim Limit) {
+    if lim.Requests <= 0 || lim.Window <= 0 { return }
+    sh := l.shard(key)
+    sh.mu.Lock()
+    defer sh.mu.Unlock()
+    if e, ok := sh.m[key]; ok && sameKind(e.b, lim) {
+        e.b.refund(time.Now(), lim)
+    }
+}
+
+// trim drops idle keys from the cold end and enforces the shard's key cap.
+func (l *Limiter) trim(sh *shard, now time.Time) {
+    // a couple of idle entries per insert keeps pace with the arrival of new keys
+    for i := 0; i < 2; i++ {
+        tail := sh.head.prev
+        if tail == &sh.head || tail == sh.head.next || !tail.b.expired(now) { break }
+        sh.remove(tail)
+        l.evictIdle.Add(1)
+    }
+    for len(sh.m) > sh.maxKeys {
+        sh.remove(sh.head.prev)
+        l.evictLRU.Add(1)
+    }
+}
+
+// Sweep drops every key whose state no longer affects decisions.
+func (l *Limiter) Sweep() {
     now := time.Now()
-    l.mu.Lock()
-    defer l.mu.Unlock()
-    b, ok := l.store[key]
-    if !ok {
-        b = &TokenBucket{capacity: max(1, burst), tokens: float64(burst), rate: float64(rps), last: now}
-        l.store[key] = b
+    for i := range l.shards {
+        sh := &l.shards[i]
+        sh.mu.Lock()
+        for e := sh.head.next; e != &sh.head; {
+            next := e.next
+            if e.b.expired(now) {
+                sh.remove(e)
+                l.evictIdle.Add(1)
+            }
+            e = next
+        }
+        sh.mu.Unlock()
     }
+}
+
+// Len returns the number of tracked keys.
+func (l *Limiter) Len() int {
+    n := 0
+    for i := range l.shards {
+        sh := &l.shards[i]
+        sh.mu.Lock()
+        n += len(sh.m)
+        sh.mu.Unlock()
+    }
+    return n
+}
+
+// writeMetrics reports tracked keys and evictions, labelled with the store they belong to.
+func (l *Limiter) writeMetrics(w io.Writer, store string) {
+    fmt.Fprintf(w, "# HELP go_agw_ratelimit_keys Rate limit keys tracked in process\n"+
+        "# TYPE go_agw_ratelimit_keys gauge\n"+
+        "go_agw_ratelimit_keys{store=%q} %d\n"+
+        "# HELP go_agw_ratelimit_evictions_total Rate limit keys dropped from memory\n"+
+        "# TYPE go_agw_ratelimit_evictions_total counter\n"+
+        "go_agw_ratelimit_evictions_total{store=%q,reason=\"idle\"} %d\n"+
+        "go_agw_ratelimit_evictions_total{store=%q,reason=\"lru\"} %d\n",
+        store, l.Len(), store, l.evictIdle.Load(), store, l.evictLRU.Load())
+}
+
+func (l *Limiter) shard(key string) *shard {
+    // FNV-1a
+    h := uint32(2166136261)
+    for i := 0; i < len(key); i++ {
+        h ^= uint32(key[i])
+        h *= 16777619
+    }
+    return &l.shards[h&l.mask]
+}
+
+func (sh *shard) pushFront(e *entry) {
+    e.prev, e.next = &sh.head, sh.head.next
+    sh.head.next.prev = e
+    sh.head.next = e
+    sh.m[e.key] = e
+}
+
+func (sh *shard) moveToFront(e *entry) {
+    if sh.head.next == e { return }
+    e.prev.next, e.next.prev = e.next, e.prev
+    e.prev, e.next = &sh.head, sh.head.next
+    sh.head.next.prev = e
+    sh.head.next = e
+}
+
+func (sh *shard) remove(e *entry) {
+    e.prev.next, e.next.prev = e.next, e.prev
+    e.prev, e.next = nil, nil
+    delete(sh.m, e.key)
+}
+
+func newBucket(now time.Time, lim Limit) bucket {
+    switch lim.Algorithm {
+    case FixedWindowAlgorithm, SlidingWindowAlgorithm:
+        return &windowCounter{sliding: lim.Algorithm == SlidingWindowAlgorithm}
+    case SlidingLogAlgorithm:
+        return &slidingLog{window: lim.Window}
+    }
+    capacity := max(1, lim.Burst)
+    return &TokenBucket{capacity: capacity, tokens: float64(capacity), rate: lim.rate(), last: now}
+}
+
+// sameKind reports whether b was created for lim's algorithm (the config may have changed).
+func sameKind(b bucket, lim Limit) bool {
+    switch b := b.(type) {
+    case *windowCounter:
+        return b.sliding == (lim.Algorithm == SlidingWindowAlgorithm) && (lim.Algorithm == FixedWindowAlgorithm || lim.Algorithm == SlidingWindowAlgorithm)
+    case *slidingLog:
+        return lim.Algorithm == SlidingLogAlgorithm
+    default:
+        return lim.Algorithm == "" || lim.Algorithm == TokenBucketAlgorithm
+    }
+}
+
+func (b *TokenBucket) take(now time.Time, lim Limit) Decision {
     // refill
     elapsed := now.Sub(b.last).Seconds()
-    b.tokens += elapsed * b.rate
+    if elapsed > 0 { b.tokens += elapsed * b.rate }
     if b.tokens > float64(b.capacity) { b.tokens = float64(b.capacity) }
     b.last = now
+    d := Decision{Limit: b.capacity}
     if b.tokens >= 1 {
         b.tokens -= 1
-        return true
+        d.Allowed = true
+    } else {
+        d.RetryAfter = seconds((1 - b.tokens) / b.rate)
     }
-    return false
+    d.Remaining = int(b.tokens)
+    d.Reset = seconds((float64(b.capacity) - b.tokens) / b.rate)
+    return d
+}
+
+func (b *TokenBucket) refund(_ time.Time, _ Limit) {
+    b.tokens = math.Min(float64(b.capacity), b.tokens+1)
+}
+
+func (b *TokenBucket) expired(now time.Time) bool {
+    return b.tokens+now.Sub(b.last).Seconds()*b.rate >= float64(b.capacity)
+}
+
+// windowCounter counts requests in fixed windows. Sliding counters also weigh the previous
+// window by how much of it still overlaps the sliding window.
+type windowCounter struct {
+    sliding    bool
+    start, end time.Time
+    curr, prev int
+}
+
+func (w *windowCounter) take(now time.Time, lim Limit) Decision {
+    start, end := WindowBounds(now, lim)
+    if !start.Equal(w.start) {
+        if start.Equal(w.end) { w.prev = w.curr } else { w.prev = 0 }
+        w.start, w.end, w.curr = start, end, 0
+    }
+    weight := 0.0
+    if w.sliding { weight = PrevWeight(now, start, end) }
+    d := windowDecision(lim.Requests, w.curr, w.prev, weight, now, start, end)
+    if d.Allowed { w.curr++ }
+    return d
+}
+
+func (w *windowCounter) refund(now time.Time, lim Limit) {
+    // a request counted in a window that has since ended no longer matters
+    if start, _ := WindowBounds(now, lim); start.Equal(w.start) && w.curr > 0 { w.curr-- }
 }
 
+func (w *windowCounter) expired(now time.Time) bool {
+    return !now.Before(w.end.Add(w.end.Sub(w.start)))
+}
+
+// WindowBounds returns the fixed window containing now: a calendar month for Monthly
+// limits, otherwise a multiple of lim.Window counted from the Unix epoch (so day windows
+// start at UTC midnight).
+func WindowBounds(now time.Time, lim Limit) (time.Time, time.Time) {
+    if lim.Monthly {
+        u := now.UTC()
+        start := time.Date(u.Year(), u.Month(), 1, 0, 0, 0, 0, time.UTC)
+        return start, start.AddDate(0, 1, 0)
+    }
+    w := int64(lim.Window)
+    ns := now.UnixNano()
+    start := ns - ns%w
+    return time.Unix(0, start), time.Unix(0, start+w)
+}
+
+// PrevWeight is the share of the previous window still inside a sliding window ending now.
+func PrevWeight(now, start, end time.Time) float64 {
+    return 1 - float64(now.Sub(start))/float64(end.Sub(start))
+}
+
+// windowDecision decides one request given the current and previous window counts. Shared
+// by the in-memory counters and the Redis scripts, which only return the counts.
+func windowDecision(limit, curr, prev int, weight float64, now, start, end time.Time) Decision {
+    used := float64(prev)*weight + float64(curr)
+    d := Decision{Limit: limit, Allowed: used+1 <= float64(limit)}
+    if d.Allowed { used++ }
+    d.Remaining = max(0, limit-int(math.Ceil(used)))
+    d.Reset = end.Sub(now)
+    if !d.Allowed {
+        d.RetryAfter = d.Reset
+        if prev > 0 && curr < limit {
+            // the previous window's share decays until one more request fits
+            need := 1 - float64(limit-1-curr)/float64(prev)
+            d.RetryAfter = time.Duration(need*float64(end.Sub(start))) - now.Sub(start)
+        }
+    }
+    return d
+}
+
+// slidingLog remembers the time of every allowed request within the window.
+type slidingLog struct {
+    window time.Duration
+    times  []int64 // unix nanos, ascending
+}
+
+func (s *slidingLog) take(now time.Time, lim Limit) Decision {
+    s.window = lim.Window
+    cutoff := now.Add(-lim.Window).UnixNano()
+    i := 0
+    for i < len(s.times) && s.times[i] <= cutoff { i++ }
+    s.times = s.times[i:]
+    d := Decision{Limit: lim.Requests}
+    if len(s.times) < lim.Requests {
+        s.times = append(s.times, now.UnixNano())
+        d.Allowed = true
+    } else {
+        // the entry whose expiry frees a slot
+        d.RetryAfter = time.Duration(s.times[len(s.times)-lim.Requests] - cutoff)
+    }
+    d.Remaining = max(0, lim.Requests-len(s.times))
+    d.Reset = time.Duration(s.times[len(s.times)-1] - cutoff)
+    return d
+}
+
+func (s *slidingLog) refund(_ time.Time, _ Limit) {
+    if len(s.times) > 0 { s.times = s.times[:len(s.times)-1] }
+}
+
+func (s *slidingLog) expired(now time.Time) bool {
+    return len(s.times) == 0 || s.times[len(s.times)-1] <= now.Add(-s.window).UnixNano()
+}
+
+func seconds(s float64) time.Duration { return time.Duration(s * float64(time.Second)) }
+
 func ClientIP(hostport string) string {
     host, _, err := net.SplitHostPort(hostport)
     if err != nil { return hostport }
@@ -51,3 +386,4 @@ func ClientIP(hostport string) string {
 
 func max(a, b int) int { if a > b { return a }; return b }
 
+func max64(a, b int64) int64 { if a > b { return a }; return b }
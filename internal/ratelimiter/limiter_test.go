@@ -1,6 +1,12 @@
 package ratelimiter
 
 import (
+    "context"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
     "testing"
     "time"
 )
@@ -19,3 +25,204 @@ func TestLimiterAllow(t *testing.T) {
     }
 }
 
+
+func TestWindowAlgorithms(t *testing.T) {
+    start := time.Date(2024, 2, 15, 10, 0, 0, 0, time.UTC)
+
+    fixed := Limit{Requests: 2, Window: time.Hour, Algorithm: FixedWindowAlgorithm}
+    b := newBucket(start, fixed)
+    now := start.Add(30 * time.Minute)
+    b.take(now, fixed)
+    if d := b.take(now, fixed); !d.Allowed || d.Remaining != 0 {
+        t.Fatalf("fixed: second request %+v", d)
+    }
+    if d := b.take(now, fixed); d.Allowed || d.RetryAfter != 30*time.Minute || d.Reset != 30*time.Minute {
+        t.Fatalf("fixed: third request %+v", d)
+    }
+    if d := b.take(start.Add(time.Hour), fixed); !d.Allowed {
+        t.Fatalf("fixed: next window should start empty: %+v", d)
+    }
+
+    sliding := Limit{Requests: 10, Window: time.Minute, Algorithm: SlidingWindowAlgorithm}
+    b = newBucket(start, sliding)
+    for i := 0; i < 10; i++ {
+        b.take(start.Add(59*time.Second), sliding)
+    }
+    // halfway through the next minute half of the previous window still counts
+    now = start.Add(90 * time.Second)
+    for i := 0; i < 5; i++ {
+        if d := b.take(now, sliding); !d.Allowed {
+            t.Fatalf("sliding: request %d denied: %+v", i, d)
+        }
+    }
+    if d := b.take(now, sliding); d.Allowed || d.RetryAfter != 6*time.Second {
+        t.Fatalf("sliding: expected denial with 6s retry, got %+v", d)
+    }
+
+    log := Limit{Requests: 2, Window: 10 * time.Second, Algorithm: SlidingLogAlgorithm}
+    b = newBucket(start, log)
+    b.take(start, log)
+    b.take(start.Add(time.Second), log)
+    if d := b.take(start.Add(2*time.Second), log); d.Allowed || d.RetryAfter != 8*time.Second {
+        t.Fatalf("log: expected denial with 8s retry, got %+v", d)
+    }
+    if d := b.take(start.Add(10*time.Second+time.Millisecond), log); !d.Allowed || d.Remaining != 0 {
+        t.Fatalf("log: oldest request should have expired: %+v", d)
+    }
+}
+
+func TestLimiterRefund(t *testing.T) {
+    l := New()
+    for _, algo := range []string{TokenBucketAlgorithm, FixedWindowAlgorithm, SlidingWindowAlgorithm, SlidingLogAlgorithm} {
+        lim := Limit{Requests: 1, Window: time.Hour, Burst: 1, Algorithm: algo}
+        if !l.Take(algo, lim).Allowed {
+            t.Fatalf("%s: first request denied", algo)
+        }
+        l.Refund(algo, lim)
+        if d := l.Take(algo, lim); !d.Allowed {
+            t.Fatalf("%s: refunded request should be available again: %+v", algo, d)
+        }
+        if l.Take(algo, lim).Allowed {
+            t.Fatalf("%s: refund gave back more than one request", algo)
+        }
+    }
+}
+
+func TestMonthlyWindowBounds(t *testing.T) {
+    s, e := WindowBounds(time.Date(2024, 2, 15, 10, 0, 0, 0, time.UTC), Limit{Monthly: true})
+    if !s.Equal(time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)) || !e.Equal(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)) {
+        t.Fatalf("month bounds: %v - %v", s, e)
+    }
+    s, _ = WindowBounds(time.Date(2024, 2, 15, 10, 0, 0, 0, time.UTC), Limit{Window: 24 * time.Hour})
+    if !s.Equal(time.Date(2024, 2, 15, 0, 0, 0, 0, time.UTC)) {
+        t.Fatalf("day windows should start at UTC midnight: %v", s)
+    }
+}
+
+func TestLimiterPersistence(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "ratelimit.json")
+    quota := Limit{Requests: 2, Window: 24 * time.Hour, Algorithm: SlidingWindowAlgorithm}
+    m, err := OpenMemory(MemoryOptions{PersistFile: path, PersistInterval: time.Hour}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ctx := context.Background()
+    m.Allow(ctx, "plan", quota)
+    m.Allow(ctx, "plan", quota)
+    m.Allow(ctx, "bucket", Limit{Requests: 1, Window: time.Hour, Burst: 1})
+    if err := m.Close(); err != nil {
+        t.Fatalf("close: %v", err)
+    }
+
+    restarted, err := OpenMemory(MemoryOptions{PersistFile: path, PersistInterval: time.Hour}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer restarted.Close()
+    if d, _ := restarted.Allow(ctx, "plan", quota); d.Allowed {
+        t.Fatalf("quota should survive a restart: %+v", d)
+    }
+    if d, _ := restarted.Allow(ctx, "bucket", Limit{Requests: 1, Window: time.Hour, Burst: 1}); d.Allowed {
+        t.Fatalf("token bucket should survive a restart: %+v", d)
+    }
+}
+
+func TestLimiterEvictsLeastRecentlyUsed(t *testing.T) {
+    l := NewSharded(1, 3)
+    lim := Limit{Requests: 1, Window: time.Hour, Burst: 1}
+    for _, k := range []string{"a", "b", "c"} { l.Take(k, lim) }
+    l.Take("a", lim) // a becomes most recently used
+    l.Take("d", lim)
+    if l.Len() != 3 || l.evictLRU.Load() != 1 {
+        t.Fatalf("len=%d lru evictions=%d", l.Len(), l.evictLRU.Load())
+    }
+    if _, ok := l.shards[0].m["b"]; ok {
+        t.Fatal("b was least recently used and should be evicted")
+    }
+    if d := l.Take("a", lim); d.Allowed {
+        t.Fatal("a should keep its exhausted bucket")
+    }
+}
+
+func TestLimiterDropsIdleKeys(t *testing.T) {
+    l := NewSharded(1, 100)
+    fast := Limit{Requests: 1000, Window: time.Second, Burst: 1} // refills in 1ms
+    slow := Limit{Requests: 1, Window: time.Hour, Burst: 1}
+    l.Take("idle", fast)
+    l.Take("busy", slow)
+    time.Sleep(5 * time.Millisecond)
+    l.Sweep()
+    if l.Len() != 1 || l.evictIdle.Load() != 1 {
+        t.Fatalf("sweep: len=%d idle evictions=%d", l.Len(), l.evictIdle.Load())
+    }
+    m := &Memory{l: l}
+    var sb strings.Builder
+    m.WriteMetrics(&sb)
+    for _, want := range []string{`go_agw_ratelimit_keys{store="memory"} 1`, `go_agw_ratelimit_evictions_total{store="memory",reason="idle"} 1`} {
+        if !strings.Contains(sb.String(), want) {
+            t.Fatalf("metrics missing %q:\n%s", want, sb.String())
+        }
+    }
+}
+
+func TestLimiterDropsIdleKeysOnInsert(t *testing.T) {
+    l := NewSharded(1, 100)
+    l.Take("idle", Limit{Requests: 1000, Window: time.Second, Burst: 1})
+    time.Sleep(5 * time.Millisecond)
+    l.Take("new", Limit{Requests: 1, Window: time.Hour, Burst: 1})
+    if _, ok := l.shards[0].m["idle"]; ok || l.Len() != 1 {
+        t.Fatal("an idle key at the cold end should be dropped when a new key arrives")
+    }
+}
+
+func TestLimiterConcurrentKeysStayBounded(t *testing.T) {
+    l := NewSharded(8, 1000)
+    lim := Limit{Requests: 1, Window: time.Hour, Burst: 1}
+    var wg sync.WaitGroup
+    for g := 0; g < 8; g++ {
+        wg.Add(1)
+        go func(g int) {
+            defer wg.Done()
+            for i := 0; i < 2000; i++ { l.Take(strconv.Itoa(g)+":"+strconv.Itoa(i), lim) }
+        }(g)
+    }
+    wg.Wait()
+    if n := l.Len(); n > 1000 {
+        t.Fatalf("tracked %d keys, cap is 1000", n)
+    }
+}
+
+func benchmarkTake(b *testing.B, l *Limiter, keys int) {
+    names := make([]string, keys)
+    for i := range names { names[i] = "client-" + strconv.Itoa(i) + "|/api" }
+    lim := Limit{Requests: 1000, Window: time.Second, Burst: 1000}
+    var next atomic.Int64
+    b.ReportAllocs()
+    b.ResetTimer()
+    b.RunParallel(func(pb *testing.PB) {
+        i := int(next.Add(1)) * 7919
+        for pb.Next() {
+            l.Take(names[i%keys], lim)
+            i++
+        }
+    })
+}
+
+// go test -race -bench Limiter -cpu 1,4,16 ./internal/ratelimiter compares a sharded limiter
+// against a single lock as concurrency grows.
+func BenchmarkLimiterSharded(b *testing.B) {
+    for _, keys := range []int{1, 1000, 100000} {
+        b.Run("keys="+strconv.Itoa(keys), func(b *testing.B) { benchmarkTake(b, NewSharded(64, DefaultMaxKeys), keys) })
+    }
+}
+
+func BenchmarkLimiterSingleLock(b *testing.B) {
+    for _, keys := range []int{1, 1000, 100000} {
+        b.Run("keys="+strconv.Itoa(keys), func(b *testing.B) { benchmarkTake(b, NewSharded(1, DefaultMaxKeys), keys) })
+    }
+}
+
+func BenchmarkLimiterEviction(b *testing.B) {
+    // far more keys than the cap: every take inserts and evicts
+    benchmarkTake(b, NewSharded(64, 10000), 1000000)
+}
@@ -0,0 +1,119 @@
+package ratelimiter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshotEntry is the on-disk form of one key's state.
+type snapshotEntry struct {
+	Key  string `json:"key"`
+	Kind string `json:"kind"` // token_bucket, window, sliding_window, sliding_log
+
+	Capacity int       `json:"capacity,omitempty"`
+	Tokens   float64   `json:"tokens,omitempty"`
+	Rate     float64   `json:"rate,omitempty"`
+	Last     time.Time `json:"last,omitempty"`
+
+	Start time.Time `json:"start,omitempty"`
+	End   time.Time `json:"end,omitempty"`
+	Curr  int       `json:"curr,omitempty"`
+	Prev  int       `json:"prev,omitempty"`
+
+	Window time.Duration `json:"window,omitempty"`
+	Times  []int64       `json:"times,omitempty"`
+}
+
+// Save writes every key whose state still matters to path, atomically replacing the file.
+func (l *Limiter) Save(path string) error {
+	now := time.Now()
+	var entries []snapshotEntry
+	for i := range l.shards {
+		sh := &l.shards[i]
+		sh.mu.Lock()
+		// oldest first, so that Load rebuilds the same LRU order
+		for e := sh.head.prev; e != &sh.head; e = e.prev {
+			if !e.b.expired(now) {
+				entries = append(entries, snapshot(e.key, e.b))
+			}
+		}
+		sh.mu.Unlock()
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load restores state written by Save. A missing file is not an error.
+func (l *Limiter) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []snapshotEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	now := time.Now()
+	for _, e := range entries {
+		var b bucket
+		switch e.Kind {
+		case "token_bucket":
+			b = &TokenBucket{capacity: e.Capacity, tokens: e.Tokens, rate: e.Rate, last: e.Last}
+		case "window", "sliding_window":
+			b = &windowCounter{sliding: e.Kind == "sliding_window", start: e.Start, end: e.End, curr: e.Curr, prev: e.Prev}
+		case "sliding_log":
+			b = &slidingLog{window: e.Window, times: e.Times}
+		default:
+			continue
+		}
+		sh := l.shard(e.Key)
+		sh.mu.Lock()
+		if old, ok := sh.m[e.Key]; ok {
+			sh.remove(old)
+		}
+		sh.pushFront(&entry{key: e.Key, b: b})
+		l.trim(sh, now)
+		sh.mu.Unlock()
+	}
+	return nil
+}
+
+func snapshot(key string, b bucket) snapshotEntry {
+	e := snapshotEntry{Key: key}
+	switch b := b.(type) {
+	case *TokenBucket:
+		e.Kind, e.Capacity, e.Tokens, e.Rate, e.Last = "token_bucket", b.capacity, b.tokens, b.rate, b.last
+	case *windowCounter:
+		e.Kind = "window"
+		if b.sliding {
+			e.Kind = "sliding_window"
+		}
+		e.Start, e.End, e.Curr, e.Prev = b.start, b.end, b.curr, b.prev
+	case *slidingLog:
+		e.Kind, e.Window, e.Times = "sliding_log", b.window, append([]int64(nil), b.times...)
+	}
+	return e
+}
@@ -0,0 +1,432 @@
+package ratelimiter
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scripts run atomically on the server. Token buckets and sliding logs read the server
+// clock so replicas with skewed clocks agree; window counters use keys named after the
+// window, computed by the caller.
+
+// tokenBucketScript: KEYS[1] bucket; ARGV requests, window ms, burst.
+// Returns {allowed, remaining, reset ms, retry ms}.
+const tokenBucketScript = `
+local rate = tonumber(ARGV[1]) / tonumber(ARGV[2]) -- tokens per ms
+local burst = tonumber(ARGV[3])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(b[1]) or burst
+local ts = tonumber(b[2]) or now
+if now > ts then
+  tokens = math.min(burst, tokens + (now - ts) * rate / 1000)
+end
+local allowed, retry = 0, 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  retry = math.ceil((1 - tokens) / rate)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate) + 1000)
+return {allowed, math.floor(tokens), math.ceil((burst - tokens) / rate), retry}
+`
+
+// windowScript counts fixed and sliding windows: KEYS[1] current window, KEYS[2] previous
+// window; ARGV limit, weight of the previous window (0 for fixed windows), ttl ms.
+// Returns {allowed, current count, previous count}.
+const windowScript = `
+local limit = tonumber(ARGV[1])
+local weight = tonumber(ARGV[2])
+local curr = tonumber(redis.call('GET', KEYS[1]) or '0')
+local prev = 0
+if weight > 0 then
+  prev = tonumber(redis.call('GET', KEYS[2]) or '0')
+end
+if prev * weight + curr + 1 > limit then
+  return {0, curr, prev}
+end
+curr = redis.call('INCR', KEYS[1])
+if curr == 1 then
+  redis.call('PEXPIRE', KEYS[1], ARGV[3])
+end
+return {1, curr, prev}
+`
+
+// slidingLogScript: KEYS[1] sorted set of request times; ARGV limit, window ms, unique member.
+// Returns {allowed, count, reset ms, retry ms}.
+const slidingLogScript = `
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local n = redis.call('ZCARD', KEYS[1])
+local allowed, retry = 0, 0
+if n < limit then
+  redis.call('ZADD', KEYS[1], now, ARGV[3])
+  n = n + 1
+  allowed = 1
+else
+  local freeing = redis.call('ZRANGE', KEYS[1], n - limit, n - limit, 'WITHSCORES')
+  retry = tonumber(freeing[2]) + window - now
+end
+redis.call('PEXPIRE', KEYS[1], window)
+local newest = redis.call('ZRANGE', KEYS[1], -1, -1, 'WITHSCORES')
+return {allowed, n, tonumber(newest[2]) + window - now, retry}
+`
+
+// refundScript gives back one allowed request: KEYS[1] bucket, current window counter or
+// log; ARGV kind ("bucket", "window" or "log"), burst. Logs drop their newest entry.
+const refundScript = `
+local kind = ARGV[1]
+if kind == 'bucket' then
+  local tokens = tonumber(redis.call('HGET', KEYS[1], 'tokens'))
+  if tokens then
+    redis.call('HSET', KEYS[1], 'tokens', tostring(math.min(tonumber(ARGV[2]), tokens + 1)))
+  end
+elseif kind == 'window' then
+  if tonumber(redis.call('GET', KEYS[1]) or '0') > 0 then
+    redis.call('DECR', KEYS[1])
+  end
+else
+  redis.call('ZPOPMAX', KEYS[1])
+end
+return 1
+`
+
+var (
+	tokenBucketSHA = scriptSHA(tokenBucketScript)
+	refundSHA      = scriptSHA(refundScript)
+	windowSHA      = scriptSHA(windowScript)
+	slidingLogSHA  = scriptSHA(slidingLogScript)
+)
+
+func scriptSHA(script string) string {
+	sum := sha1.Sum([]byte(script))
+	return hex.EncodeToString(sum[:])
+}
+
+// RedisOptions configures a Redis backend.
+type RedisOptions struct {
+	Addr      string
+	Password  string
+	DB        int
+	Timeout   time.Duration // dial and per-command deadline, default 100ms
+	KeyPrefix string        // default "agw:rl:"
+	PoolSize  int           // idle connections kept, default 16
+}
+
+// Redis keeps token buckets in a Redis-compatible server, so every gateway replica
+// draws from the same buckets. It speaks RESP directly and runs the bucket logic as a
+// Lua script (EVALSHA, falling back to EVAL when the script is not cached).
+type Redis struct {
+	opts RedisOptions
+	idle chan *redisConn
+}
+
+func NewRedis(opts RedisOptions) *Redis {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 100 * time.Millisecond
+	}
+	if opts.KeyPrefix == "" {
+		opts.KeyPrefix = "agw:rl:"
+	}
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = 16
+	}
+	return &Redis{opts: opts, idle: make(chan *redisConn, opts.PoolSize)}
+}
+
+func (r *Redis) Allow(ctx context.Context, key string, lim Limit) (Decision, error) {
+	if lim.Requests <= 0 || lim.Window <= 0 {
+		return Decision{Allowed: true}, nil
+	}
+	window := max64(1, lim.Window.Milliseconds())
+	switch lim.Algorithm {
+	case FixedWindowAlgorithm, SlidingWindowAlgorithm:
+		return r.window(ctx, key, lim)
+	case SlidingLogAlgorithm:
+		member := make([]byte, 8)
+		_, _ = rand.Read(member)
+		v, err := r.eval(ctx, slidingLogScript, slidingLogSHA, []string{r.opts.KeyPrefix + key},
+			[]string{strconv.Itoa(lim.Requests), strconv.FormatInt(window, 10), hex.EncodeToString(member)})
+		n, err := intsReply(v, err, 4)
+		if err != nil {
+			return Decision{}, err
+		}
+		return Decision{Allowed: n[0] == 1, Limit: lim.Requests, Remaining: max(0, lim.Requests-int(n[1])),
+			Reset: time.Duration(n[2]) * time.Millisecond, RetryAfter: time.Duration(n[3]) * time.Millisecond}, nil
+	}
+	burst := max(1, lim.Burst)
+	v, err := r.eval(ctx, tokenBucketScript, tokenBucketSHA, []string{r.opts.KeyPrefix + key},
+		[]string{strconv.Itoa(lim.Requests), strconv.FormatInt(window, 10), strconv.Itoa(burst)})
+	n, err := intsReply(v, err, 4)
+	if err != nil {
+		return Decision{}, err
+	}
+	return Decision{Allowed: n[0] == 1, Limit: burst, Remaining: int(n[1]),
+		Reset: time.Duration(n[2]) * time.Millisecond, RetryAfter: time.Duration(n[3]) * time.Millisecond}, nil
+}
+
+func (r *Redis) Refund(ctx context.Context, key string, lim Limit) error {
+	if lim.Requests <= 0 || lim.Window <= 0 {
+		return nil
+	}
+	kind, k := "bucket", r.opts.KeyPrefix+key
+	switch lim.Algorithm {
+	case FixedWindowAlgorithm, SlidingWindowAlgorithm:
+		start, _ := WindowBounds(time.Now(), lim)
+		kind, k = "window", r.windowKey(key, start)
+	case SlidingLogAlgorithm:
+		kind = "log"
+	}
+	_, err := r.eval(ctx, refundScript, refundSHA, []string{k}, []string{kind, strconv.Itoa(max(1, lim.Burst))})
+	return err
+}
+
+// windowKey names the counter of the window starting at start.
+func (r *Redis) windowKey(key string, start time.Time) string {
+	return r.opts.KeyPrefix + "{" + key + "}:" + strconv.FormatInt(start.UnixMilli(), 10)
+}
+
+// window runs fixed and sliding window counters. Window keys share a hash tag so that both
+// land on the same Redis Cluster slot.
+func (r *Redis) window(ctx context.Context, key string, lim Limit) (Decision, error) {
+	now := time.Now()
+	start, end := WindowBounds(now, lim)
+	prevStart, _ := WindowBounds(start.Add(-time.Nanosecond), lim)
+	weight := "0"
+	if lim.Algorithm == SlidingWindowAlgorithm {
+		weight = strconv.FormatFloat(PrevWeight(now, start, end), 'f', 6, 64)
+	}
+	keys := []string{r.windowKey(key, start), r.windowKey(key, prevStart)}
+	// keep the counter while it can still weigh on the next window
+	ttl := 2*end.Sub(now) + time.Second
+	v, err := r.eval(ctx, windowScript, windowSHA, keys,
+		[]string{strconv.Itoa(lim.Requests), weight, strconv.FormatInt(ttl.Milliseconds(), 10)})
+	n, err := intsReply(v, err, 3)
+	if err != nil {
+		return Decision{}, err
+	}
+	curr := int(n[1])
+	if n[0] == 1 {
+		curr-- // windowDecision expects the count before this request
+	}
+	// decide with the same rounded weight the script used
+	w, _ := strconv.ParseFloat(weight, 64)
+	return windowDecision(lim.Requests, curr, int(n[2]), w, now, start, end), nil
+}
+
+// intsReply checks that a script returned an array of at least n integers.
+func intsReply(v any, err error, n int) ([]int64, error) {
+	if err != nil {
+		return nil, err
+	}
+	arr, ok := v.([]any)
+	if !ok || len(arr) < n {
+		return nil, fmt.Errorf("redis: unexpected script reply %v", v)
+	}
+	out := make([]int64, len(arr))
+	for i, x := range arr {
+		if out[i], ok = x.(int64); !ok {
+			return nil, fmt.Errorf("redis: unexpected script reply %v", v)
+		}
+	}
+	return out, nil
+}
+
+// eval runs a script by digest and loads it with EVAL when the server does not know it.
+func (r *Redis) eval(ctx context.Context, script, sha string, keys, args []string) (any, error) {
+	cmd := append([]string{"EVALSHA", sha, strconv.Itoa(len(keys))}, keys...)
+	cmd = append(cmd, args...)
+	v, err := r.do(ctx, cmd...)
+	var rerr redisError
+	if errors.As(err, &rerr) && strings.HasPrefix(string(rerr), "NOSCRIPT") {
+		cmd[0], cmd[1] = "EVAL", script
+		v, err = r.do(ctx, cmd...)
+	}
+	return v, err
+}
+
+// Close drops idle connections.
+func (r *Redis) Close() error {
+	for {
+		select {
+		case c := <-r.idle:
+			_ = c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// do sends one command. Connections that saw a network or protocol error are discarded;
+// server error replies leave the connection usable.
+// An idle connection the server already closed is retried once on a fresh one.
+func (r *Redis) do(ctx context.Context, args ...string) (any, error) {
+	c, reused, err := r.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v, err := c.do(ctx, r.opts.Timeout, args...)
+	if reused && errors.Is(err, io.EOF) {
+		_ = c.conn.Close()
+		if c, err = r.dial(ctx); err != nil {
+			return nil, err
+		}
+		v, err = c.do(ctx, r.opts.Timeout, args...)
+	}
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		_ = c.conn.Close()
+		return nil, err
+	}
+	r.put(c)
+	return v, err
+}
+
+func (r *Redis) get(ctx context.Context) (*redisConn, bool, error) {
+	select {
+	case c := <-r.idle:
+		return c, true, nil
+	default:
+	}
+	c, err := r.dial(ctx)
+	return c, false, err
+}
+
+func (r *Redis) dial(ctx context.Context) (*redisConn, error) {
+	d := net.Dialer{Timeout: r.opts.Timeout}
+	conn, err := d.DialContext(ctx, "tcp", r.opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, br: bufio.NewReader(conn)}
+	if r.opts.Password != "" {
+		if _, err := c.do(ctx, r.opts.Timeout, "AUTH", r.opts.Password); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("redis auth: %w", err)
+		}
+	}
+	if r.opts.DB != 0 {
+		if _, err := c.do(ctx, r.opts.Timeout, "SELECT", strconv.Itoa(r.opts.DB)); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("redis select: %w", err)
+		}
+	}
+	return c, nil
+}
+
+func (r *Redis) put(c *redisConn) {
+	select {
+	case r.idle <- c:
+	default:
+		_ = c.conn.Close()
+	}
+}
+
+// redisError is an error reply sent by the server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+type redisConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func (c *redisConn) do(ctx context.Context, timeout time.Duration, args ...string) (any, error) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = c.conn.SetDeadline(deadline)
+	if _, err := c.conn.Write(appendCommand(nil, args)); err != nil {
+		return nil, err
+	}
+	return readReply(c.br)
+}
+
+// appendCommand encodes args as a RESP array of bulk strings.
+func appendCommand(b []byte, args []string) []byte {
+	b = append(b, '*')
+	b = strconv.AppendInt(b, int64(len(args)), 10)
+	b = append(b, '\r', '\n')
+	for _, a := range args {
+		b = append(b, '$')
+		b = strconv.AppendInt(b, int64(len(a)), 10)
+		b = append(b, '\r', '\n')
+		b = append(b, a...)
+		b = append(b, '\r', '\n')
+	}
+	return b
+}
+
+// readReply decodes one RESP2 value: string, redisError, int64, []byte (nil for a null
+// bulk string) or []any.
+func readReply(br *bufio.Reader) (any, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed reply")
+	}
+	body := line[1 : len(line)-2]
+	switch line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < -1 || n > 512<<20 {
+			return nil, errors.New("redis: malformed bulk length")
+		}
+		if n == -1 {
+			return []byte(nil), nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < -1 || n > 1<<20 {
+			return nil, errors.New("redis: malformed array length")
+		}
+		if n == -1 {
+			return []any(nil), nil
+		}
+		out := make([]any, 0, n)
+		for i := 0; i < n; i++ {
+			v, err := readReply(br)
+			var rerr redisError
+			if err != nil && !errors.As(err, &rerr) {
+				return nil, err
+			}
+			if err != nil {
+				v = rerr
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", line[0])
+}
@@ -0,0 +1,354 @@
+package ratelimiter
+
+import (
+	"bufio"
+	"context"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-process stand-in for a Redis server. It speaks enough RESP for the
+// backend and runs known Lua scripts, identified by SHA1, as Go equivalents under a single
+// lock, which gives the same atomicity as a real server.
+type fakeRedis struct {
+	t        *testing.T
+	ln       net.Listener
+	password string
+
+	mu       sync.Mutex
+	loaded   map[string]bool
+	hashes   map[string]map[string]string
+	counters map[string]int64
+	zsets    map[string][]int64
+	evals    int
+	evalSHA  int
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{t: t, ln: ln, password: password, loaded: map[string]bool{}, hashes: map[string]map[string]string{},
+		counters: map[string]int64{}, zsets: map[string][]int64{}}
+	go f.serve()
+	t.Cleanup(func() { _ = ln.Close() })
+	return f
+}
+
+func (f *fakeRedis) addr() string { return f.ln.Addr().String() }
+
+func (f *fakeRedis) serve() {
+	for {
+		c, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(c)
+	}
+}
+
+func (f *fakeRedis) handle(c net.Conn) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	authed := f.password == ""
+	for {
+		v, err := readReply(br)
+		if err != nil {
+			return
+		}
+		items, _ := v.([]any)
+		args := make([]string, len(items))
+		for i, it := range items {
+			b, _ := it.([]byte)
+			args[i] = string(b)
+		}
+		if len(args) == 0 {
+			return
+		}
+		cmd := strings.ToUpper(args[0])
+		var reply string
+		switch {
+		case cmd == "AUTH":
+			if len(args) == 2 && args[1] == f.password {
+				authed = true
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case cmd == "PING":
+			reply = "+PONG\r\n"
+		case cmd == "SELECT":
+			reply = "+OK\r\n"
+		case cmd == "EVAL" || cmd == "EVALSHA":
+			reply = f.eval(cmd, args[1:])
+		default:
+			reply = "-ERR unknown command '" + args[0] + "'\r\n"
+		}
+		if _, err := c.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeRedis) eval(cmd string, args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sha := args[0]
+	if cmd == "EVAL" {
+		f.evals++
+		sha = scriptSHA(args[0])
+		f.loaded[sha] = true
+	} else {
+		f.evalSHA++
+		if !f.loaded[sha] {
+			return "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+		}
+	}
+	n, _ := strconv.Atoi(args[1])
+	keys, argv := args[2:2+n], args[2+n:]
+	switch sha {
+	case tokenBucketSHA:
+		return intsArray(f.tokenBucket(keys[0], argv)...)
+	case windowSHA:
+		return intsArray(f.window(keys, argv)...)
+	case slidingLogSHA:
+		return intsArray(f.slidingLog(keys[0], argv)...)
+	case refundSHA:
+		f.refund(keys[0], argv)
+		return ":1\r\n"
+	}
+	return "-ERR unknown script\r\n"
+}
+
+func intsArray(vals ...int64) string {
+	out := "*" + strconv.Itoa(len(vals)) + "\r\n"
+	for _, v := range vals {
+		out += ":" + strconv.FormatInt(v, 10) + "\r\n"
+	}
+	return out
+}
+
+// tokenBucket mirrors tokenBucketScript.
+func (f *fakeRedis) tokenBucket(key string, argv []string) []int64 {
+	requests, _ := strconv.ParseFloat(argv[0], 64)
+	window, _ := strconv.ParseFloat(argv[1], 64)
+	rate := requests / window
+	burst, _ := strconv.ParseFloat(argv[2], 64)
+	now := float64(time.Now().UnixMicro())
+	h := f.hashes[key]
+	if h == nil {
+		h = map[string]string{}
+		f.hashes[key] = h
+	}
+	tokens, err := strconv.ParseFloat(h["tokens"], 64)
+	if err != nil {
+		tokens = burst
+	}
+	ts, err := strconv.ParseFloat(h["ts"], 64)
+	if err != nil {
+		ts = now
+	}
+	if now > ts {
+		tokens = math.Min(burst, tokens+(now-ts)*rate/1000)
+	}
+	var allowed, retry int64
+	if tokens >= 1 {
+		tokens--
+		allowed = 1
+	} else {
+		retry = int64(math.Ceil((1 - tokens) / rate))
+	}
+	h["tokens"] = strconv.FormatFloat(tokens, 'f', -1, 64)
+	h["ts"] = strconv.FormatFloat(now, 'f', -1, 64)
+	return []int64{allowed, int64(tokens), int64(math.Ceil((burst - tokens) / rate)), retry}
+}
+
+// window mirrors windowScript.
+func (f *fakeRedis) window(keys, argv []string) []int64 {
+	limit, _ := strconv.ParseFloat(argv[0], 64)
+	weight, _ := strconv.ParseFloat(argv[1], 64)
+	curr, prev := f.counters[keys[0]], int64(0)
+	if weight > 0 {
+		prev = f.counters[keys[1]]
+	}
+	if float64(prev)*weight+float64(curr)+1 > limit {
+		return []int64{0, curr, prev}
+	}
+	f.counters[keys[0]]++
+	return []int64{1, curr + 1, prev}
+}
+
+// slidingLog mirrors slidingLogScript.
+func (f *fakeRedis) slidingLog(key string, argv []string) []int64 {
+	limit, _ := strconv.Atoi(argv[0])
+	window, _ := strconv.ParseInt(argv[1], 10, 64)
+	now := time.Now().UnixMilli()
+	var times []int64
+	for _, t := range f.zsets[key] {
+		if t > now-window {
+			times = append(times, t)
+		}
+	}
+	var allowed, retry int64
+	if len(times) < limit {
+		times = append(times, now)
+		allowed = 1
+	} else {
+		retry = times[len(times)-limit] + window - now
+	}
+	f.zsets[key] = times
+	return []int64{allowed, int64(len(times)), times[len(times)-1] + window - now, retry}
+}
+
+// refund mirrors refundScript.
+func (f *fakeRedis) refund(key string, argv []string) {
+	switch argv[0] {
+	case "bucket":
+		if tokens, err := strconv.ParseFloat(f.hashes[key]["tokens"], 64); err == nil {
+			burst, _ := strconv.ParseFloat(argv[1], 64)
+			f.hashes[key]["tokens"] = strconv.FormatFloat(math.Min(burst, tokens+1), 'f', -1, 64)
+		}
+	case "window":
+		if f.counters[key] > 0 {
+			f.counters[key]--
+		}
+	default:
+		if times := f.zsets[key]; len(times) > 0 {
+			f.zsets[key] = times[:len(times)-1]
+		}
+	}
+}
+
+var perSecond = Limit{Requests: 1, Window: time.Second, Burst: 1}
+
+func TestRedisSharedAcrossReplicas(t *testing.T) {
+	srv := newFakeRedis(t, "s3cret")
+	a := NewRedis(RedisOptions{Addr: srv.addr(), Password: "s3cret", DB: 2})
+	b := NewRedis(RedisOptions{Addr: srv.addr(), Password: "s3cret", DB: 2})
+	defer a.Close()
+	defer b.Close()
+	ctx := context.Background()
+	allowed := 0
+	for i := 0; i < 4; i++ {
+		for _, r := range []*Redis{a, b} {
+			d, err := r.Allow(ctx, "ip|/x", Limit{Requests: 1, Window: time.Second, Burst: 3})
+			if err != nil {
+				t.Fatalf("allow: %v", err)
+			}
+			if d.Allowed {
+				allowed++
+			}
+		}
+	}
+	if allowed != 3 {
+		t.Fatalf("two replicas allowed %d requests, want the shared burst of 3", allowed)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.evals != 1 {
+		t.Fatalf("script loaded %d times, want once after NOSCRIPT", srv.evals)
+	}
+	if _, ok := srv.hashes["agw:rl:ip|/x"]; !ok {
+		t.Fatalf("bucket not stored under the key prefix: %v", srv.hashes)
+	}
+}
+
+func TestRedisAuthFailure(t *testing.T) {
+	srv := newFakeRedis(t, "s3cret")
+	r := NewRedis(RedisOptions{Addr: srv.addr(), Password: "wrong"})
+	if _, err := r.Allow(context.Background(), "k", perSecond); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Fatalf("expected auth error, got %v", err)
+	}
+}
+
+func TestFallbackWhenStoreUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	f := NewFallback(NewRedis(RedisOptions{Addr: addr, Timeout: 50 * time.Millisecond}), time.Hour, nil)
+	ctx := context.Background()
+	d, err := f.Allow(ctx, "k", perSecond)
+	if err != nil || !d.Allowed {
+		t.Fatalf("first request should pass locally: %+v err=%v", d, err)
+	}
+	if !f.Degraded() {
+		t.Fatal("fallback should report degraded")
+	}
+	if d, _ := f.Allow(ctx, "k", perSecond); d.Allowed {
+		t.Fatal("local fallback should still enforce the limit")
+	}
+	var sb strings.Builder
+	f.WriteMetrics(&sb)
+	if !strings.Contains(sb.String(), "go_agw_ratelimit_store_errors_total 1\n") || !strings.Contains(sb.String(), "go_agw_ratelimit_store_degraded 1\n") {
+		t.Fatalf("metrics: %s", sb.String())
+	}
+}
+
+func TestFallbackRecovers(t *testing.T) {
+	srv := newFakeRedis(t, "")
+	f := NewFallback(NewRedis(RedisOptions{Addr: srv.addr()}), time.Millisecond, nil)
+	f.degraded.Store(true)
+	f.retryAt.Store(time.Now().Add(-time.Second).UnixNano())
+	if d, err := f.Allow(context.Background(), "k", perSecond); err != nil || !d.Allowed {
+		t.Fatalf("%+v err=%v", d, err)
+	}
+	if f.Degraded() {
+		t.Fatal("fallback should return to the store once it answers")
+	}
+}
+
+func TestRedisQuotaAlgorithms(t *testing.T) {
+	srv := newFakeRedis(t, "")
+	r := NewRedis(RedisOptions{Addr: srv.addr()})
+	ctx := context.Background()
+	for _, algo := range []string{FixedWindowAlgorithm, SlidingWindowAlgorithm, SlidingLogAlgorithm} {
+		lim := Limit{Requests: 3, Window: 24 * time.Hour, Algorithm: algo}
+		for i := 0; i < 3; i++ {
+			d, err := r.Allow(ctx, algo, lim)
+			if err != nil || !d.Allowed || d.Remaining != 2-i || d.Limit != 3 {
+				t.Fatalf("%s request %d: %+v err=%v", algo, i, d, err)
+			}
+		}
+		d, err := r.Allow(ctx, algo, lim)
+		if err != nil || d.Allowed || d.Remaining != 0 {
+			t.Fatalf("%s: fourth request should be denied: %+v err=%v", algo, d, err)
+		}
+		if d.RetryAfter <= 0 || d.RetryAfter > 24*time.Hour || d.Reset <= 0 {
+			t.Fatalf("%s: retry/reset out of range: %+v", algo, d)
+		}
+	}
+}
+
+func TestRedisRefund(t *testing.T) {
+	srv := newFakeRedis(t, "")
+	r := NewRedis(RedisOptions{Addr: srv.addr()})
+	ctx := context.Background()
+	for _, algo := range []string{TokenBucketAlgorithm, FixedWindowAlgorithm, SlidingWindowAlgorithm, SlidingLogAlgorithm} {
+		lim := Limit{Requests: 1, Window: time.Hour, Burst: 1, Algorithm: algo}
+		if d, err := r.Allow(ctx, algo, lim); err != nil || !d.Allowed {
+			t.Fatalf("%s: first request: %+v err=%v", algo, d, err)
+		}
+		if err := r.Refund(ctx, algo, lim); err != nil {
+			t.Fatalf("%s: refund: %v", algo, err)
+		}
+		if d, err := r.Allow(ctx, algo, lim); err != nil || !d.Allowed {
+			t.Fatalf("%s: refunded request should be available again: %+v err=%v", algo, d, err)
+		}
+		if d, _ := r.Allow(ctx, algo, lim); d.Allowed {
+			t.Fatalf("%s: refund gave back more than one request", algo)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kenelite/go-agw/internal/admission"
+	"github.com/kenelite/go-agw/internal/config"
+	"github.com/kenelite/go-agw/internal/consumer"
+)
+
+// admissionSlot is a concurrency limiter with the Retry-After sent when it sheds.
+type admissionSlot struct {
+	l          *admission.Limiter
+	retryAfter string
+}
+
+func newAdmissionSlot(c config.ConcurrencyConfig) (*admissionSlot, error) {
+	l, err := admission.FromConfig(c)
+	if err != nil || l == nil {
+		return nil, err
+	}
+	retry := time.Duration(c.RetryAfter) * time.Millisecond
+	if retry <= 0 {
+		retry = time.Second
+	}
+	return &admissionSlot{l: l, retryAfter: ceilSeconds(retry)}, nil
+}
+
+// routePriority is a route's compiled priority config.
+type routePriority struct {
+	header string
+	class  admission.Class
+}
+
+func buildRouteAdmission(routes []config.RouteConfig, group *admission.Group) ([]*admissionSlot, []routePriority, error) {
+	slots := make([]*admissionSlot, len(routes))
+	prios := make([]routePriority, len(routes))
+	for i, rt := range routes {
+		s, err := newAdmissionSlot(rt.Concurrency)
+		if err != nil {
+			return nil, nil, fmt.Errorf("route %s: %w", rt.Path, err)
+		}
+		if s != nil {
+			slots[i] = s
+			group.Add("route", rt.Path, s.l)
+		}
+		prios[i] = routePriority{header: rt.Priority.Header, class: admission.Normal}
+		if rt.Priority.Class != "" {
+			c, ok := admission.ParseClass(rt.Priority.Class)
+			if !ok {
+				return nil, nil, fmt.Errorf("route %s: unknown priority class %q", rt.Path, rt.Priority.Class)
+			}
+			prios[i].class = c
+		}
+	}
+	return slots, prios, nil
+}
+
+// priorityClass resolves the class of req: the consumer's "priority" metadata, then the
+// route's priority header, then the route's class. Unknown names are ignored.
+func (r *Router) priorityClass(req *http.Request, idx int) admission.Class {
+	p := r.priorities[idx]
+	if c, ok := consumer.FromContext(req.Context()); ok {
+		if class, ok := admission.ParseClass(c.Metadata["priority"]); ok {
+			return class
+		}
+	}
+	if p.header != "" {
+		if class, ok := admission.ParseClass(strings.ToLower(req.Header.Get(p.header))); ok {
+			return class
+		}
+	}
+	return p.class
+}
+
+// UseUpstreams applies upstream-wide settings that the router enforces: concurrency limits
+// shared by every route using the upstream.
+func (r *Router) UseUpstreams(upstreams []config.UpstreamConfig) error {
+	slots := map[string]*admissionSlot{}
+	for _, u := range upstreams {
+		s, err := newAdmissionSlot(u.Concurrency)
+		if err != nil {
+			return fmt.Errorf("upstream %s: %w", u.Name, err)
+		}
+		if s != nil {
+			slots[u.Name] = s
+			r.admission.Add("upstream", u.Name, s.l)
+		}
+	}
+	r.upstreamAdmission = slots
+	return nil
+}
+
+// admitted holds the concurrency tickets of a request; its methods accept a nil receiver.
+type admitted struct {
+	tickets []*admission.Ticket
+}
+
+// admit takes a slot on the route and then on the upstream, queueing by priority class as
+// configured. When either sheds the request it writes 503 with Retry-After and returns false.
+func (r *Router) admit(w http.ResponseWriter, req *http.Request, idx int, upstreamName string) (*admitted, bool) {
+	var a *admitted
+	var class admission.Class
+	for _, s := range []*admissionSlot{r.routeAdmission[idx], r.upstreamAdmission[upstreamName]} {
+		if s == nil {
+			continue
+		}
+		if a == nil {
+			class = r.priorityClass(req, idx)
+		}
+		t, err := s.l.Acquire(req.Context(), class)
+		if err != nil {
+			a.release()
+			w.Header().Set("Retry-After", s.retryAfter)
+			http.Error(w, "service overloaded", http.StatusServiceUnavailable)
+			return nil, false
+		}
+		if a == nil {
+			a = &admitted{}
+		}
+		a.tickets = append(a.tickets, t)
+	}
+	return a, true
+}
+
+// sample reports the upstream latency to adaptive limits once response headers arrived.
+func (a *admitted) sample(dropped bool) {
+	if a == nil {
+		return
+	}
+	for _, t := range a.tickets {
+		t.Sample(dropped)
+	}
+}
+
+func (a *admitted) release() {
+	if a == nil {
+		return
+	}
+	for _, t := range a.tickets {
+		t.Release()
+	}
+}
+
+// overloaded reports whether an upstream outcome signals congestion to adaptive limits.
+func overloaded(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		// a client that went away or sent too much says nothing about the upstream
+		var mbe *http.MaxBytesError
+		return req.Context().Err() == nil && !errors.As(err, &mbe)
+	}
+	return resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusGatewayTimeout
+}
@@ -0,0 +1,91 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kenelite/go-agw/internal/admission"
+	"github.com/kenelite/go-agw/internal/config"
+	"github.com/kenelite/go-agw/internal/consumer"
+	"github.com/kenelite/go-agw/internal/observability"
+	"github.com/kenelite/go-agw/internal/plugin"
+	"github.com/kenelite/go-agw/internal/scheduler"
+)
+
+func TestRouterConcurrencyShedsWith503(t *testing.T) {
+	release := make(chan struct{})
+	entered := make(chan struct{}, 1)
+	r := newTestRouter(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		entered <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	slot, err := newAdmissionSlot(config.ConcurrencyConfig{MaxInflight: 1, RetryAfter: 2500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.routeAdmission[0] = slot
+
+	done := make(chan int, 1)
+	go func() {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://agw/slow", nil))
+		done <- rec.Code
+	}()
+	<-entered
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://agw/slow", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "3" {
+		t.Fatalf("shed request: code=%d Retry-After=%q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("admitted request: %d", code)
+	}
+	if s := slot.l.Stats(); s.Inflight != 0 || s.QueueFull != 1 {
+		t.Fatalf("stats: %+v", s)
+	}
+}
+
+func TestUpstreamConcurrencyRejectsUnknownAlgorithm(t *testing.T) {
+	r := newTestRouter(t, http.NotFoundHandler())
+	err := r.UseUpstreams([]config.UpstreamConfig{{Name: "echo", Concurrency: config.ConcurrencyConfig{MaxInflight: 4, Adaptive: config.AdaptiveConcurrencyConfig{Algorithm: "vegas"}}}})
+	if err == nil {
+		t.Fatal("unknown adaptive algorithm should be rejected")
+	}
+}
+
+func TestRouterPriorityClass(t *testing.T) {
+	r := newTestRouter(t, http.NotFoundHandler())
+	r.priorities[0] = routePriority{header: "X-Priority", class: admission.Low}
+	for _, tc := range []struct {
+		header   string
+		consumer string
+		want     admission.Class
+	}{
+		{"", "", admission.Low},
+		{"High", "", admission.High},
+		{"urgent", "", admission.Low},
+		{"low", "critical", admission.Critical},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://agw/", nil)
+		if tc.header != "" {
+			req.Header.Set("X-Priority", tc.header)
+		}
+		if tc.consumer != "" {
+			c := &consumer.Consumer{Name: "probe", Metadata: map[string]string{"priority": tc.consumer}}
+			req = req.WithContext(consumer.NewContext(req.Context(), c))
+		}
+		if got := r.priorityClass(req, 0); got != tc.want {
+			t.Fatalf("header=%q consumer=%q: got %v want %v", tc.header, tc.consumer, got, tc.want)
+		}
+	}
+
+	logger := observability.NewLogger(nil)
+	routes := []config.RouteConfig{{Path: "/", Priority: config.PriorityConfig{Class: "batch"}}}
+	if _, err := NewRouter(routes, nil, scheduler.NewRoundRobin(), plugin.NewManager(logger), observability.NewMetrics(), logger); err == nil {
+		t.Fatal("unknown priority class should be rejected")
+	}
+}
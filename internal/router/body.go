@@ -0,0 +1,148 @@
+package router
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/kenelite/go-agw/internal/config"
+)
+
+const defaultBufferMemory = 1 << 20
+
+// bodyPolicy is a route's request body limit and buffering settings.
+type bodyPolicy struct {
+	max         int64
+	buffer      bool
+	memory      int64
+	tempDir     string
+	readTimeout time.Duration
+}
+
+func newBodyPolicy(rt config.RouteConfig) bodyPolicy {
+	rb := rt.RequestBuffering
+	p := bodyPolicy{max: rt.MaxRequestBodyBytes, buffer: rb.Enabled, memory: rb.MemoryBytes, tempDir: rb.TempDir,
+		readTimeout: time.Duration(rb.ReadTimeout) * time.Millisecond}
+	if p.memory <= 0 {
+		p.memory = defaultBufferMemory
+	}
+	return p
+}
+
+// prepareBody enforces the route's body limit and, when buffering is on, receives the
+// whole body before anything else happens; req.GetBody then replays it. It writes the
+// error response and returns false when the request cannot proceed. The returned func
+// releases any temp file and must be called once the request is done.
+func (r *Router) prepareBody(w http.ResponseWriter, req *http.Request, idx int) (func(), bool) {
+	p := r.bodies[idx]
+	noop := func() {}
+	if req.Body == nil || req.Body == http.NoBody {
+		return noop, true
+	}
+	if p.max > 0 {
+		if req.ContentLength > p.max {
+			tooLarge(w, p.max)
+			return noop, false
+		}
+		req.Body = http.MaxBytesReader(w, req.Body, p.max)
+	}
+	if !p.buffer {
+		return noop, true
+	}
+	rc := http.NewResponseController(w)
+	if p.readTimeout > 0 {
+		_ = rc.SetReadDeadline(time.Now().Add(p.readTimeout))
+	}
+	sb, err := spoolBody(req.Body, p.memory, p.tempDir)
+	if p.readTimeout > 0 {
+		_ = rc.SetReadDeadline(time.Time{})
+	}
+	_ = req.Body.Close()
+	if err != nil {
+		var mbe *http.MaxBytesError
+		var ne net.Error
+		switch {
+		case errors.As(err, &mbe):
+			tooLarge(w, mbe.Limit)
+		case errors.As(err, &ne) && ne.Timeout():
+			http.Error(w, "request body not received in time", http.StatusRequestTimeout)
+		default:
+			r.logger.Warnw("request buffering failed", "err", err)
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+		}
+		return noop, false
+	}
+	req.Body = sb.reader()
+	req.GetBody = func() (io.ReadCloser, error) { return sb.reader(), nil }
+	req.ContentLength = sb.size
+	req.TransferEncoding = nil
+	return sb.remove, true
+}
+
+func tooLarge(w http.ResponseWriter, limit int64) {
+	http.Error(w, fmt.Sprintf("request body exceeds %d bytes", limit), http.StatusRequestEntityTooLarge)
+}
+
+// spooledBody is a fully received request body, in memory or, past the memory limit, in
+// a temp file.
+type spooledBody struct {
+	mem  []byte
+	file *os.File
+	size int64
+}
+
+// spoolBody reads src to the end, keeping up to memory bytes in memory.
+func spoolBody(src io.Reader, memory int64, dir string) (*spooledBody, error) {
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(src, memory+1))
+	if err != nil {
+		return nil, err
+	}
+	if n <= memory {
+		return &spooledBody{mem: buf.Bytes(), size: n}, nil
+	}
+	f, err := os.CreateTemp(dir, "go-agw-body-*")
+	if err != nil {
+		return nil, err
+	}
+	sb := &spooledBody{file: f}
+	written, err := io.Copy(f, io.MultiReader(&buf, src))
+	if err != nil {
+		sb.remove()
+		return nil, err
+	}
+	sb.size = written
+	return sb, nil
+}
+
+// reader returns an independent reader over the body.
+func (sb *spooledBody) reader() io.ReadCloser {
+	if sb.file == nil {
+		return io.NopCloser(bytes.NewReader(sb.mem))
+	}
+	return io.NopCloser(io.NewSectionReader(sb.file, 0, sb.size))
+}
+
+func (sb *spooledBody) remove() {
+	if sb.file != nil {
+		_ = sb.file.Close()
+		_ = os.Remove(sb.file.Name())
+	}
+}
+
+// bodyTooLarge reports whether an upstream call failed because the streamed request body
+// went over max_request_body_bytes, and answers 413 if so.
+func bodyTooLarge(w http.ResponseWriter, err error) bool {
+	var mbe *http.MaxBytesError
+	if !errors.As(err, &mbe) {
+		return false
+	}
+	w.Header().Set("Connection", "close")
+	tooLarge(w, mbe.Limit)
+	return true
+}
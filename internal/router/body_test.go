@@ -0,0 +1,89 @@
+package router
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kenelite/go-agw/internal/config"
+)
+
+// chunked hides the length of r so the request is sent without Content-Length.
+type chunked struct{ io.Reader }
+
+func TestRouterRequestBodyLimit(t *testing.T) {
+	var calls atomic.Int32
+	r := newTestRouter(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls.Add(1)
+		_, _ = io.Copy(io.Discard, req.Body)
+	}))
+	r.routes[0].Methods = nil
+	r.bodies[0] = newBodyPolicy(config.RouteConfig{MaxRequestBodyBytes: 16})
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "http://agw/upload", strings.NewReader(strings.Repeat("x", 17))))
+	if rec.Code != http.StatusRequestEntityTooLarge || calls.Load() != 0 {
+		t.Fatalf("declared length over the limit: code=%d calls=%d", rec.Code, calls.Load())
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://agw/upload", chunked{strings.NewReader(strings.Repeat("x", 4096))})
+	req.ContentLength = -1
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("streamed body over the limit: %d %s", rec.Code, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "http://agw/upload", strings.NewReader("small")))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("body within the limit: %d", rec.Code)
+	}
+}
+
+func TestRouterRequestBuffering(t *testing.T) {
+	type seen struct {
+		length int64
+		te     []string
+		body   string
+	}
+	got := make(chan seen, 1)
+	r := newTestRouter(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := io.ReadAll(req.Body)
+		got <- seen{req.ContentLength, req.TransferEncoding, string(b)}
+	}))
+	r.routes[0].Methods = nil
+	dir := t.TempDir()
+	r.bodies[0] = newBodyPolicy(config.RouteConfig{MaxRequestBodyBytes: 1 << 20,
+		RequestBuffering: config.RequestBufferingConfig{Enabled: true, MemoryBytes: 10, TempDir: dir}})
+
+	payload := strings.Repeat("abcdefgh", 100)
+	req := httptest.NewRequest(http.MethodPost, "http://agw/upload", chunked{strings.NewReader(payload)})
+	req.ContentLength = -1
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("buffered upload: %d %s", rec.Code, rec.Body)
+	}
+	s := <-got
+	if s.length != int64(len(payload)) || len(s.te) != 0 || s.body != payload {
+		t.Fatalf("upstream should receive the whole body with Content-Length: len=%d te=%v body=%d bytes", s.length, s.te, len(s.body))
+	}
+	if left, _ := os.ReadDir(dir); len(left) != 0 {
+		t.Fatalf("spilled body not removed: %v", left)
+	}
+
+	sb, err := spoolBody(strings.NewReader("in memory"), 64, dir)
+	if err != nil || sb.file != nil {
+		t.Fatalf("small body should stay in memory: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if b, _ := io.ReadAll(sb.reader()); string(b) != "in memory" {
+			t.Fatalf("replay %d: %q", i, b)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kenelite/go-agw/internal/config"
+	"github.com/kenelite/go-agw/internal/consumer"
+	"github.com/kenelite/go-agw/internal/observability"
+	"github.com/kenelite/go-agw/internal/plugin"
+	"github.com/kenelite/go-agw/internal/scheduler"
+	"github.com/kenelite/go-agw/internal/upstream"
+)
+
+func TestRouterCacheServesStaleOnUpstreamFailure(t *testing.T) {
+	var calls atomic.Int32
+	be := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Cache-Control", "max-age=0, stale-if-error=60")
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("cached"))
+	}))
+	logger := observability.NewLogger(nil)
+	upm, err := upstream.NewManager([]config.UpstreamConfig{{Name: "echo", Targets: []string{be.URL}, Timeout: 2000}}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm := plugin.NewManager(logger)
+	_ = pm.Init(config.PluginsConfig{Available: []config.PluginRef{{Name: "cache"}}})
+	r, err := NewRouter([]config.RouteConfig{{Path: "/", UpstreamRef: "echo"}}, upm, scheduler.NewRoundRobin(), pm, observability.NewMetrics(), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://agw/page", nil))
+		return rec
+	}
+	if rec := send(); rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("first request: %d %v", rec.Code, rec.Header())
+	}
+	be.Close()
+	rec := send()
+	if rec.Code != http.StatusOK || rec.Body.String() != "cached" || rec.Header().Get("X-Cache") != "STALE" {
+		t.Fatalf("unreachable upstream should be covered by stale-if-error: %d %v %q", rec.Code, rec.Header(), rec.Body)
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("upstream calls: %d", calls.Load())
+	}
+}
+
+func TestRouterCacheWithKeyAuth(t *testing.T) {
+	var calls atomic.Int32
+	be := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls.Add(1)
+		if req.URL.Path == "/shared" {
+			w.Header().Set("Cache-Control", "public, max-age=0, stale-while-revalidate=60")
+			w.Header().Set("ETag", `"v1"`)
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		_, _ = w.Write([]byte(req.Header.Get("X-Consumer-Name")))
+	}))
+	defer be.Close()
+	logger := observability.NewLogger(nil)
+	upm, err := upstream.NewManager([]config.UpstreamConfig{{Name: "echo", Targets: []string{be.URL}, Timeout: 2000}}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg, _ := consumer.NewRegistry([]config.ConsumerConfig{{Name: "alice", APIKeys: []string{"k-alice"}}})
+	pm := plugin.NewManager(logger)
+	pm.SetConsumers(reg)
+	if err := pm.Init(config.PluginsConfig{Available: []config.PluginRef{{Name: "key-auth"}, {Name: "cache"}}}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRouter([]config.RouteConfig{{Path: "/", UpstreamRef: "echo"}}, upm, scheduler.NewRoundRobin(), pm, observability.NewMetrics(), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://agw"+path, nil)
+		req.Header.Set("X-API-Key", "k-alice")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// a consumer's response is not shared unless the upstream marks it public
+	send("/private")
+	if rec := send("/private"); rec.Header().Get("X-Cache") != "MISS" || calls.Load() != 2 {
+		t.Fatalf("per-consumer response was cached: %v calls=%d", rec.Header(), calls.Load())
+	}
+
+	// background revalidation replays the request with its API key
+	send("/shared")
+	if rec := send("/shared"); rec.Header().Get("X-Cache") != "STALE" {
+		t.Fatalf("expected stale response: %v", rec.Header())
+	}
+	deadline := time.Now().Add(time.Second)
+	for calls.Load() < 4 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if calls.Load() != 4 {
+		t.Fatalf("background refresh did not reach the upstream: calls=%d", calls.Load())
+	}
+}
@@ -0,0 +1,205 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kenelite/go-agw/internal/config"
+	"github.com/kenelite/go-agw/internal/plugin"
+)
+
+const defaultCoalesceKey = "method+host+path+query+header:Authorization+header:Cookie"
+
+// errNotShared tells followers that the leader's outcome cannot be shared (a streamed
+// response, a rejected request), so they call the upstream themselves.
+var errNotShared = errors.New("response not shared")
+
+// coalescer collapses concurrent identical requests of one route into one upstream call.
+type coalescer struct {
+	route   string
+	parts   []keyPart
+	timeout time.Duration
+	methods []string
+
+	mu      sync.Mutex
+	flights map[string]*flight
+
+	shared, timeouts, fallbacks atomic.Int64
+}
+
+// flight is one upstream call that followers wait on.
+type flight struct {
+	c    *coalescer
+	key  string
+	done chan struct{}
+	once sync.Once
+	resp *plugin.Response
+	err  error
+}
+
+func newCoalescer(rt config.RouteConfig) (*coalescer, error) {
+	cc := rt.Coalesce
+	if !cc.Enabled {
+		return nil, nil
+	}
+	expr := cc.Key
+	if expr == "" {
+		expr = defaultCoalesceKey
+	}
+	parts, err := parseKeyExpr(expr)
+	if err != nil {
+		return nil, fmt.Errorf("coalesce: %w", err)
+	}
+	c := &coalescer{route: rt.Path, parts: parts, timeout: time.Duration(cc.Timeout) * time.Millisecond,
+		methods: upperAll(cc.Methods), flights: map[string]*flight{}}
+	if c.timeout <= 0 {
+		c.timeout = time.Second
+	}
+	if len(c.methods) == 0 {
+		c.methods = []string{http.MethodGet, http.MethodHead}
+	}
+	return c, nil
+}
+
+// eligible reports whether req may share a flight: an allowed method and no request
+// body, since the key does not cover it. identified is set when a plugin authenticated the
+// caller as a consumer or by token claims; such requests are never shared, as the
+// credentials the key relies on may have been removed by the plugin.
+func (c *coalescer) eligible(req *http.Request, identified bool) bool {
+	if identified || upgradeType(req) != "" || req.ContentLength != 0 || req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	for _, m := range c.methods {
+		if req.Method == m {
+			return true
+		}
+	}
+	return false
+}
+
+// join returns the flight for req's key and whether the caller leads it.
+func (c *coalescer) join(req *http.Request) (*flight, bool) {
+	var b strings.Builder
+	writeKey(&b, c.parts, req)
+	key := b.String()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f, ok := c.flights[key]; ok {
+		return f, false
+	}
+	f := &flight{c: c, key: key, done: make(chan struct{})}
+	c.flights[key] = f
+	return f, true
+}
+
+// publish hands the leader's outcome to the followers; only the first call counts. The
+// response is copied, so the leader's plugins may modify theirs. Responses meant for the
+// leader's client alone are not shared.
+func (f *flight) publish(resp *plugin.Response, err error) {
+	if f == nil {
+		return
+	}
+	if resp != nil && private(resp.Header) {
+		resp, err = nil, errNotShared
+	}
+	f.once.Do(func() {
+		f.c.mu.Lock()
+		delete(f.c.flights, f.key)
+		f.c.mu.Unlock()
+		if resp != nil {
+			resp = cloneResponse(resp)
+		}
+		f.resp, f.err = resp, err
+		close(f.done)
+	})
+}
+
+// fail publishes an upstream error. When it came from the leader's client leaving or from
+// a timeout, which may be the leader's own shorter deadline, the followers try again
+// instead.
+func (f *flight) fail(req *http.Request, err error) {
+	if req.Context().Err() != nil || errors.Is(err, errUpstreamTimeout) {
+		err = errNotShared
+	}
+	f.publish(nil, err)
+}
+
+// private reports whether a response belongs to one client: it sets cookies or forbids
+// shared caching.
+func private(h http.Header) bool {
+	if len(h.Values("Set-Cookie")) > 0 {
+		return true
+	}
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			d, _, _ = strings.Cut(strings.TrimSpace(d), "=")
+			if strings.EqualFold(d, "private") || strings.EqualFold(d, "no-store") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wait returns a copy of the leader's response or its upstream error. It fails with
+// errNotShared when the follower should call the upstream itself.
+func (f *flight) wait(ctx context.Context) (*plugin.Response, error) {
+	t := time.NewTimer(f.c.timeout)
+	defer t.Stop()
+	select {
+	case <-f.done:
+	case <-t.C:
+		f.c.timeouts.Add(1)
+		return nil, errNotShared
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if f.err == errNotShared {
+		f.c.fallbacks.Add(1)
+		return nil, f.err
+	}
+	f.c.shared.Add(1)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return cloneResponse(f.resp), nil
+}
+
+func cloneResponse(r *plugin.Response) *plugin.Response {
+	return &plugin.Response{
+		StatusCode: r.StatusCode,
+		Header:     r.Header.Clone(),
+		Body:       append([]byte(nil), r.Body...),
+		Trailer:    r.Trailer.Clone(),
+	}
+}
+
+// coalesceMetrics reports how followers of every coalescing route fared.
+type coalesceMetrics []*coalescer
+
+func (cm coalesceMetrics) WriteMetrics(w io.Writer) {
+	if len(cm) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# HELP go_agw_coalesced_requests_total Requests that waited on an identical in-flight request\n# TYPE go_agw_coalesced_requests_total counter\n")
+	for _, c := range cm {
+		fmt.Fprintf(w, "go_agw_coalesced_requests_total{route=%q,result=\"shared\"} %d\n", c.route, c.shared.Load())
+		fmt.Fprintf(w, "go_agw_coalesced_requests_total{route=%q,result=\"timeout\"} %d\n", c.route, c.timeouts.Load())
+		fmt.Fprintf(w, "go_agw_coalesced_requests_total{route=%q,result=\"fallback\"} %d\n", c.route, c.fallbacks.Load())
+	}
+}
+
+func upperAll(in []string) []string {
+	out := make([]string, len(in))
+	for i, s := range in {
+		out[i] = strings.ToUpper(s)
+	}
+	return out
+}
@@ -0,0 +1,210 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kenelite/go-agw/internal/config"
+	"github.com/kenelite/go-agw/internal/consumer"
+)
+
+func TestRouterCoalescesIdenticalRequests(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	r := newTestRouter(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+		<-release
+		w.Header().Set("X-Origin", "backend")
+		_, _ = w.Write([]byte("hot"))
+	}))
+	co, err := newCoalescer(config.RouteConfig{Path: "/", Coalesce: config.CoalesceConfig{Enabled: true, Timeout: 5000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.coalescers[0] = co
+
+	const n = 5
+	var wg sync.WaitGroup
+	recs := make([]*httptest.ResponseRecorder, n)
+	for i := 0; i < n; i++ {
+		recs[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(rec *httptest.ResponseRecorder) {
+			defer wg.Done()
+			r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://agw/hot?x=1", nil))
+		}(recs[i])
+		if i == 0 {
+			for calls.Load() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	time.Sleep(50 * time.Millisecond) // let the followers join
+	close(release)
+	wg.Wait()
+	for i, rec := range recs {
+		if rec.Code != http.StatusOK || rec.Body.String() != "hot" || rec.Header().Get("X-Origin") != "backend" {
+			t.Fatalf("request %d: %d %v %q", i, rec.Code, rec.Header(), rec.Body)
+		}
+	}
+	if calls.Load() != 1 || co.shared.Load() != n-1 {
+		t.Fatalf("upstream calls %d, shared %d", calls.Load(), co.shared.Load())
+	}
+	// the flight is gone once answered
+	if _, leader := co.join(httptest.NewRequest(http.MethodGet, "http://agw/hot?x=1", nil)); !leader {
+		t.Fatal("a finished flight should not be joined")
+	}
+}
+
+func TestCoalesceFollowerTimeout(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	r := newTestRouter(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if calls.Add(1) == 1 {
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	co, _ := newCoalescer(config.RouteConfig{Path: "/", Coalesce: config.CoalesceConfig{Enabled: true, Timeout: 20}})
+	r.coalescers[0] = co
+	done := make(chan struct{})
+	go func() {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://agw/slow", nil))
+		close(done)
+	}()
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://agw/slow", nil))
+	if rec.Code != http.StatusOK || calls.Load() != 2 || co.timeouts.Load() != 1 {
+		t.Fatalf("follower should give up on the slow leader: code=%d calls=%d timeouts=%d", rec.Code, calls.Load(), co.timeouts.Load())
+	}
+	close(release)
+	<-done
+}
+
+func TestCoalesceKey(t *testing.T) {
+	co, err := newCoalescer(config.RouteConfig{Path: "/", Coalesce: config.CoalesceConfig{Enabled: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := func(method, url, auth string) *http.Request {
+		r := httptest.NewRequest(method, url, nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		return r
+	}
+	f, _ := co.join(req(http.MethodGet, "http://agw/a?x=1&y=2", "Bearer a"))
+	if _, leader := co.join(req(http.MethodGet, "http://agw/a?y=2&x=1", "Bearer a")); leader {
+		t.Fatal("same request with reordered query should join")
+	}
+	if _, leader := co.join(req(http.MethodGet, "http://agw/a?x=1&y=2", "Bearer b")); !leader {
+		t.Fatal("different credentials must not share a response")
+	}
+	f.publish(nil, errNotShared)
+	if co.eligible(req(http.MethodPost, "http://agw/a", ""), false) {
+		t.Fatal("POST is not coalesced by default")
+	}
+	if _, err := newCoalescer(config.RouteConfig{Coalesce: config.CoalesceConfig{Enabled: true, Key: "body"}}); err == nil {
+		t.Fatal("unknown key term should be rejected")
+	}
+}
+
+func TestCoalesceNotSharedPrivate(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	r := newTestRouter(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		n := calls.Add(1)
+		if n == 1 {
+			<-release
+		}
+		w.Header().Set("Set-Cookie", fmt.Sprintf("session=%d", n))
+	}))
+	co, _ := newCoalescer(config.RouteConfig{Path: "/", Coalesce: config.CoalesceConfig{Enabled: true, Timeout: 5000}})
+	r.coalescers[0] = co
+	done := make(chan struct{})
+	go func() {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://agw/me", nil))
+		close(done)
+	}()
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond) // let the follower join
+		close(release)
+	}()
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://agw/me", nil))
+	<-done
+	if rec.Header().Get("Set-Cookie") != "session=2" || co.fallbacks.Load() != 1 {
+		t.Fatalf("leader's cookie shared: %q fallbacks=%d", rec.Header().Get("Set-Cookie"), co.fallbacks.Load())
+	}
+
+	// a chunked body is not covered by the key
+	req := httptest.NewRequest(http.MethodGet, "http://agw/me", strings.NewReader("x"))
+	req.ContentLength = -1
+	if co.eligible(req, false) {
+		t.Fatal("request with a body should not be coalesced")
+	}
+}
+
+// useKeyAuth adds key-auth to the test route, with consumers alice (k-alice) and bob (k-bob).
+func useKeyAuth(t *testing.T, r *Router) {
+	t.Helper()
+	reg, err := consumer.NewRegistry([]config.ConsumerConfig{
+		{Name: "alice", APIKeys: []string{"k-alice"}},
+		{Name: "bob", APIKeys: []string{"k-bob"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.plugins.SetConsumers(reg)
+	if err := r.plugins.InitRoutes([]config.RouteConfig{{Plugins: []config.PluginRef{{Name: "key-auth"}}}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCoalesceNotSharedBetweenConsumers(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	r := newTestRouter(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if calls.Add(1) == 1 {
+			<-release
+		}
+		_, _ = w.Write([]byte(req.Header.Get("X-Consumer-Name")))
+	}))
+	useKeyAuth(t, r)
+	co, _ := newCoalescer(config.RouteConfig{Path: "/", Coalesce: config.CoalesceConfig{Enabled: true, Timeout: 5000}})
+	r.coalescers[0] = co
+
+	send := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://agw/me", nil)
+		req.Header.Set("X-API-Key", key)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- send("k-alice") }()
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond) // bob would have joined alice's flight by now
+		close(release)
+	}()
+	bob := send("k-bob")
+	alice := <-done
+	if alice.Body.String() != "alice" || bob.Body.String() != "bob" || calls.Load() != 2 {
+		t.Fatalf("alice got %q, bob got %q, upstream calls %d", alice.Body, bob.Body, calls.Load())
+	}
+}
@@ -0,0 +1,64 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kenelite/go-agw/internal/config"
+)
+
+func TestRouterCORSPreflight(t *testing.T) {
+	var hits atomic.Int32
+	r := newTestRouter(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Access-Control-Allow-Origin", "https://stale.example")
+		_, _ = w.Write([]byte("ok"))
+	}))
+	_ = r.plugins.InitRoutes([]config.RouteConfig{{Plugins: []config.PluginRef{
+		{Name: "cors", Config: map[string]any{"allow_origins": []any{"https://app.example.com"}}},
+	}}})
+
+	// the route only allows GET, but the preflight for a GET must still reach the cors plugin
+	req := httptest.NewRequest(http.MethodOptions, "http://agw/orders", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" || hits.Load() != 0 {
+		t.Fatalf("preflight: code=%d acao=%q upstream hits=%d", rec.Code, rec.Header().Get("Access-Control-Allow-Origin"), hits.Load())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://agw/orders", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if vv := rec.Header().Values("Access-Control-Allow-Origin"); rec.Code != http.StatusOK || len(vv) != 1 || vv[0] != "https://app.example.com" {
+		t.Fatalf("simple request: code=%d acao=%v", rec.Code, vv)
+	}
+
+	// plain OPTIONS without CORS headers still does not match a GET-only route
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodOptions, "http://agw/orders", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("plain OPTIONS: %d", rec.Code)
+	}
+}
+
+func TestRouterPreflightWithoutCORS(t *testing.T) {
+	var hits atomic.Int32
+	r := newTestRouter(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		hits.Add(1)
+	}))
+
+	// without a cors plugin the route's methods apply to the OPTIONS request as sent
+	req := httptest.NewRequest(http.MethodOptions, "http://agw/orders", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound || hits.Load() != 0 {
+		t.Fatalf("preflight on a route without cors: code=%d upstream hits=%d", rec.Code, hits.Load())
+	}
+}
@@ -0,0 +1,92 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/kenelite/go-agw/internal/clientip"
+	"github.com/kenelite/go-agw/internal/config"
+)
+
+const (
+	forwardAppend   = "append"
+	forwardReplace  = "replace"
+	forwardPreserve = "preserve"
+)
+
+type forwardedPolicy struct {
+	mode    string
+	rfc7239 bool
+}
+
+func newForwardedPolicy(c config.ForwardedHeadersConfig) (forwardedPolicy, error) {
+	p := forwardedPolicy{mode: strings.ToLower(c.Policy), rfc7239: c.RFC7239}
+	switch p.mode {
+	case "":
+		p.mode = forwardAppend
+	case forwardAppend, forwardReplace, forwardPreserve:
+	default:
+		return p, fmt.Errorf("unknown forwarded_headers policy %q", c.Policy)
+	}
+	return p, nil
+}
+
+// apply sets X-Forwarded-* (and optionally Forwarded) on the upstream headers h.
+// Headers from untrusted peers are discarded so clients cannot spoof their address.
+func (p forwardedPolicy) apply(h http.Header, req *http.Request, clientIP string, peerTrusted bool) {
+	if p.mode == forwardPreserve {
+		return
+	}
+	peer := clientip.Host(req.RemoteAddr)
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	if p.mode == forwardReplace || !peerTrusted {
+		for _, k := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded"} {
+			h.Del(k)
+		}
+		peer = clientIP
+	}
+	appendListHeader(h, "X-Forwarded-For", peer)
+	if h.Get("X-Forwarded-Proto") == "" {
+		h.Set("X-Forwarded-Proto", proto)
+	}
+	if h.Get("X-Forwarded-Host") == "" {
+		h.Set("X-Forwarded-Host", req.Host)
+	}
+	if p.rfc7239 {
+		appendListHeader(h, "Forwarded", forwardedElement(peer, proto, req.Host))
+	}
+}
+
+// forwardedElement renders one RFC 7239 forwarded-element.
+func forwardedElement(forIP, proto, host string) string {
+	node := forIP
+	if ip := net.ParseIP(forIP); ip != nil && ip.To4() == nil {
+		node = `"[` + forIP + `]"`
+	}
+	parts := []string{"for=" + node}
+	if host != "" {
+		parts = append(parts, "host="+quoteIfNeeded(host))
+	}
+	parts = append(parts, "proto="+proto)
+	return strings.Join(parts, ";")
+}
+
+func quoteIfNeeded(v string) string {
+	if strings.ContainsAny(v, ":[]\" ,;=") {
+		return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+	}
+	return v
+}
+
+func appendListHeader(h http.Header, key, value string) {
+	if prev := strings.Join(h.Values(key), ", "); prev != "" {
+		h.Set(key, prev+", "+value)
+		return
+	}
+	h.Set(key, value)
+}
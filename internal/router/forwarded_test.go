@@ -0,0 +1,79 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kenelite/go-agw/internal/config"
+)
+
+func TestRouterForwardedHeaders(t *testing.T) {
+	var got http.Header
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	})
+	r := newTestRouter(t, backend)
+	if err := r.UseServerConfig(config.ServerConfig{
+		TrustedProxies:   []string{"10.0.0.0/8"},
+		ForwardedHeaders: config.ForwardedHeadersConfig{RFC7239: true},
+	}); err != nil {
+		t.Fatalf("server config: %v", err)
+	}
+
+	// via a trusted load balancer: chain is extended
+	req := httptest.NewRequest(http.MethodGet, "http://api.example.com/", nil)
+	req.RemoteAddr = "10.0.0.5:4000"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	if v := got.Get("X-Forwarded-For"); v != "203.0.113.7, 10.0.0.5" {
+		t.Fatalf("unexpected X-Forwarded-For: %q", v)
+	}
+	if got.Get("X-Forwarded-Proto") != "https" || got.Get("X-Forwarded-Host") != "api.example.com" {
+		t.Fatalf("unexpected proto/host: %v", got)
+	}
+	if v := got.Get("Forwarded"); v != "for=10.0.0.5;host=api.example.com;proto=http" {
+		t.Fatalf("unexpected Forwarded: %q", v)
+	}
+
+	// directly from an untrusted client: spoofed headers are dropped
+	req = httptest.NewRequest(http.MethodGet, "http://api.example.com/", nil)
+	req.RemoteAddr = "198.51.100.9:4000"
+	req.Header.Set("X-Forwarded-For", "1.1.1.1")
+	req.Header.Set("X-Forwarded-Host", "evil.example")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	if v := got.Get("X-Forwarded-For"); v != "198.51.100.9" {
+		t.Fatalf("unexpected X-Forwarded-For: %q", v)
+	}
+	if v := got.Get("X-Forwarded-Host"); v != "api.example.com" {
+		t.Fatalf("unexpected X-Forwarded-Host: %q", v)
+	}
+}
+
+func TestRouterRateLimitUsesRealClientIP(t *testing.T) {
+	r := newTestRouter(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) }))
+	if err := r.UseServerConfig(config.ServerConfig{TrustedProxies: []string{"10.0.0.5"}}); err != nil {
+		t.Fatalf("server config: %v", err)
+	}
+	r.routes[0].RateLimit = config.RateLimitConfig{RequestsPerSecond: 1, Burst: 1}
+
+	send := func(client string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://agw/", nil)
+		req.RemoteAddr = "10.0.0.5:4000"
+		req.Header.Set("X-Forwarded-For", client)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := send("203.0.113.1"); code != http.StatusOK {
+		t.Fatalf("first client: %d", code)
+	}
+	if code := send("203.0.113.2"); code != http.StatusOK {
+		t.Fatalf("second client behind the same proxy should have its own bucket: %d", code)
+	}
+	if code := send("203.0.113.1"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 for repeated client, got %d", code)
+	}
+}
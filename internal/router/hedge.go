@@ -0,0 +1,225 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kenelite/go-agw/internal/config"
+)
+
+const (
+	defaultHedgeDelay  = 50 * time.Millisecond
+	defaultHedgeBudget = 10 // percent of requests
+	// hedgeBudgetBurst is how many unused hedges a quiet route can save up.
+	hedgeBudgetBurst = 10
+	hedgeSamples     = 256
+	hedgeMinSamples  = 20
+)
+
+// hedger sends a second copy of a slow request to another target, within a budget.
+type hedger struct {
+	route      string
+	delay      time.Duration
+	percentile float64
+	ratio      float64
+	methods    []string
+
+	mu      sync.Mutex
+	tokens  float64
+	samples []time.Duration // ring of recent latencies
+	next    int
+
+	sent, won, exhausted atomic.Int64
+}
+
+func newHedger(rt config.RouteConfig) (*hedger, error) {
+	hc := rt.Hedge
+	if !hc.Enabled {
+		return nil, nil
+	}
+	if hc.Percentile < 0 || hc.Percentile > 100 {
+		return nil, fmt.Errorf("hedge: percentile %v out of range", hc.Percentile)
+	}
+	if hc.BudgetPercent < 0 || hc.BudgetPercent > 100 {
+		return nil, fmt.Errorf("hedge: budget_percent %v out of range", hc.BudgetPercent)
+	}
+	h := &hedger{route: rt.Path, delay: time.Duration(hc.Delay) * time.Millisecond, percentile: hc.Percentile,
+		ratio: hc.BudgetPercent / 100, methods: upperAll(hc.Methods)}
+	if h.delay <= 0 {
+		h.delay = defaultHedgeDelay
+	}
+	if h.ratio == 0 {
+		h.ratio = defaultHedgeBudget / 100.0
+	}
+	if len(h.methods) == 0 {
+		h.methods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+	}
+	return h, nil
+}
+
+// eligible reports whether req may be hedged: an allowed method, more than one target and
+// a body that can be sent twice (none, or buffered by request_buffering).
+func (h *hedger) eligible(req *http.Request, targets int) bool {
+	if targets < 2 || upgradeType(req) != "" {
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	for _, m := range h.methods {
+		if req.Method == m {
+			return true
+		}
+	}
+	return false
+}
+
+// wait returns the current hedge delay: the configured percentile of recent latencies
+// once there are enough of them, delay_ms before that.
+func (h *hedger) wait() time.Duration {
+	h.mu.Lock()
+	if h.percentile == 0 || len(h.samples) < hedgeMinSamples {
+		h.mu.Unlock()
+		return h.delay
+	}
+	s := append([]time.Duration(nil), h.samples...)
+	h.mu.Unlock()
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	i := int(math.Ceil(h.percentile/100*float64(len(s)))) - 1
+	return s[max(i, 0)]
+}
+
+func (h *hedger) observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.samples) < hedgeSamples {
+		h.samples = append(h.samples, d)
+		return
+	}
+	h.samples[h.next] = d
+	h.next = (h.next + 1) % hedgeSamples
+}
+
+// earn credits the budget with one request's share.
+func (h *hedger) earn() {
+	h.mu.Lock()
+	h.tokens = min(h.tokens+h.ratio, hedgeBudgetBurst)
+	h.mu.Unlock()
+}
+
+// spend takes one hedge from the budget.
+func (h *hedger) spend() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.tokens < 1 {
+		h.exhausted.Add(1)
+		return false
+	}
+	h.tokens--
+	return true
+}
+
+type attemptResult struct {
+	resp   *http.Response
+	err    error
+	target int
+}
+
+// do sends the request to target first and, if it has not answered within the hedge
+// delay, a copy to the target returned by pick. The first response wins and the other
+// attempt is cancelled; a failed attempt still waits for the other one. It returns the
+// winning target.
+func (h *hedger) do(ctx context.Context, send func(context.Context, int) (*http.Response, error), first int, pick func() int) (*http.Response, int, error) {
+	start := time.Now()
+	results := make(chan attemptResult, 2)
+	cancels := map[int]context.CancelFunc{}
+	launch := func(target int) {
+		actx, cancel := context.WithCancel(ctx)
+		cancels[target] = cancel
+		go func() {
+			resp, err := send(actx, target)
+			results <- attemptResult{resp, err, target}
+		}()
+	}
+	h.earn()
+	launch(first)
+	timer := time.NewTimer(h.wait())
+	defer timer.Stop()
+	pending := 1
+	var res attemptResult
+wait:
+	for {
+		select {
+		case <-timer.C:
+			if h.spend() {
+				h.sent.Add(1)
+				launch(pick())
+				pending++
+			}
+		case res = <-results:
+			pending--
+			if res.err == nil || pending == 0 {
+				break wait
+			}
+		}
+	}
+	for t, cancel := range cancels {
+		if res.err != nil || t != res.target {
+			cancel()
+		}
+	}
+	if pending > 0 {
+		go func() {
+			if lost := <-results; lost.resp != nil {
+				lost.resp.Body.Close()
+			}
+		}()
+	}
+	if res.err != nil {
+		return nil, res.target, res.err
+	}
+	if res.target != first {
+		h.won.Add(1)
+	}
+	h.observe(time.Since(start))
+	res.resp.Body = &cancelOnClose{ReadCloser: res.resp.Body, cancel: cancels[res.target]}
+	return res.resp, res.target, nil
+}
+
+// cancelOnClose releases the winning attempt's context once its body is done.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// hedgeMetrics reports hedging on every route that has it enabled.
+type hedgeMetrics []*hedger
+
+func (hm hedgeMetrics) WriteMetrics(w io.Writer) {
+	if len(hm) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# HELP go_agw_hedged_requests_total Hedged requests: sent, won (answered first) and not sent for lack of budget\n# TYPE go_agw_hedged_requests_total counter\n")
+	for _, h := range hm {
+		fmt.Fprintf(w, "go_agw_hedged_requests_total{route=%q,result=\"sent\"} %d\n", h.route, h.sent.Load())
+		fmt.Fprintf(w, "go_agw_hedged_requests_total{route=%q,result=\"won\"} %d\n", h.route, h.won.Load())
+		fmt.Fprintf(w, "go_agw_hedged_requests_total{route=%q,result=\"budget_exhausted\"} %d\n", h.route, h.exhausted.Load())
+	}
+	fmt.Fprintf(w, "# HELP go_agw_hedge_delay_seconds Current delay before a request is hedged\n# TYPE go_agw_hedge_delay_seconds gauge\n")
+	for _, h := range hm {
+		fmt.Fprintf(w, "go_agw_hedge_delay_seconds{route=%q} %g\n", h.route, h.wait().Seconds())
+	}
+}
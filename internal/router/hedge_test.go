@@ -0,0 +1,138 @@
+package router
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kenelite/go-agw/internal/config"
+	"github.com/kenelite/go-agw/internal/observability"
+	"github.com/kenelite/go-agw/internal/plugin"
+	"github.com/kenelite/go-agw/internal/scheduler"
+	"github.com/kenelite/go-agw/internal/upstream"
+)
+
+// newHedgeRouter proxies "/" to two targets; the first request either of them receives
+// stalls until cancelled (or for slow, if set), every later one answers at once.
+func newHedgeRouter(t *testing.T, hc config.HedgeConfig, slow time.Duration) (*Router, *atomic.Int32) {
+	t.Helper()
+	var calls, cancelled atomic.Int32
+	handler := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			if calls.Add(1) == 1 {
+				wait := time.Second
+				if slow > 0 {
+					wait = slow
+				}
+				select {
+				case <-time.After(wait):
+				case <-req.Context().Done():
+					cancelled.Add(1)
+					return
+				}
+			}
+			_, _ = io.WriteString(w, name)
+		}
+	}
+	var targets []string
+	for _, name := range []string{"a", "b"} {
+		be := httptest.NewServer(handler(name))
+		t.Cleanup(be.Close)
+		targets = append(targets, be.URL)
+	}
+	logger := observability.NewLogger(nil)
+	upm, err := upstream.NewManager([]config.UpstreamConfig{{Name: "echo", Targets: targets, Timeout: 2000}}, logger)
+	if err != nil {
+		t.Fatalf("upstream manager: %v", err)
+	}
+	routes := []config.RouteConfig{{Path: "/", UpstreamRef: "echo", Hedge: hc}}
+	r, err := NewRouter(routes, upm, scheduler.NewRoundRobin(), plugin.NewManager(logger), observability.NewMetrics(), logger)
+	if err != nil {
+		t.Fatalf("router: %v", err)
+	}
+	return r, &cancelled
+}
+
+func TestRouterHedgeFirstResponseWins(t *testing.T) {
+	r, cancelled := newHedgeRouter(t, config.HedgeConfig{Enabled: true, Delay: 20, BudgetPercent: 100}, 0)
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://agw/", nil))
+	if rec.Code != http.StatusOK || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("hedge should answer quickly: %d after %v", rec.Code, time.Since(start))
+	}
+	h := r.hedgers[0]
+	if h.sent.Load() != 1 || h.won.Load() != 1 {
+		t.Fatalf("sent=%d won=%d", h.sent.Load(), h.won.Load())
+	}
+	deadline := time.Now().Add(time.Second)
+	for cancelled.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if cancelled.Load() != 1 {
+		t.Fatal("losing request was not cancelled")
+	}
+
+	var b strings.Builder
+	hedgeMetrics(r.hedgers).WriteMetrics(&b)
+	if !strings.Contains(b.String(), `go_agw_hedged_requests_total{route="/",result="won"} 1`) {
+		t.Fatalf("metrics:\n%s", b.String())
+	}
+}
+
+func TestRouterHedgeBudget(t *testing.T) {
+	r, _ := newHedgeRouter(t, config.HedgeConfig{Enabled: true, Delay: 10, BudgetPercent: 10}, 100*time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://agw/", nil))
+	h := r.hedgers[0]
+	if rec.Code != http.StatusOK || h.sent.Load() != 0 || h.exhausted.Load() != 1 {
+		t.Fatalf("one request does not earn a hedge: code=%d sent=%d exhausted=%d", rec.Code, h.sent.Load(), h.exhausted.Load())
+	}
+}
+
+func TestHedgeEligibility(t *testing.T) {
+	h, _ := newHedger(config.RouteConfig{Hedge: config.HedgeConfig{Enabled: true}})
+	get := httptest.NewRequest(http.MethodGet, "http://agw/", nil)
+	if !h.eligible(get, 2) || h.eligible(get, 1) {
+		t.Fatal("GET needs a second target to be hedged")
+	}
+	post := httptest.NewRequest(http.MethodPost, "http://agw/", strings.NewReader("x"))
+	post.GetBody = nil
+	if h.eligible(post, 2) {
+		t.Fatal("POST is not idempotent by default")
+	}
+	h.methods = []string{http.MethodPost}
+	if h.eligible(post, 2) {
+		t.Fatal("a body that cannot be replayed must not be hedged")
+	}
+	post.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader("x")), nil }
+	if !h.eligible(post, 2) {
+		t.Fatal("a buffered body can be hedged")
+	}
+	if _, err := newHedger(config.RouteConfig{Hedge: config.HedgeConfig{Enabled: true, Percentile: 150}}); err == nil {
+		t.Fatal("percentile over 100 should be rejected")
+	}
+}
+
+func TestHedgeDelayPercentile(t *testing.T) {
+	h, _ := newHedger(config.RouteConfig{Hedge: config.HedgeConfig{Enabled: true, Delay: 30, Percentile: 95}})
+	for i := 1; i < hedgeMinSamples; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+	if d := h.wait(); d != 30*time.Millisecond {
+		t.Fatalf("too few samples should use delay_ms, got %v", d)
+	}
+	h.samples = nil
+	for i := 1; i <= 100; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+	if d := h.wait(); d != 95*time.Millisecond {
+		t.Fatalf("p95 = %v", d)
+	}
+}
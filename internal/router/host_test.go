@@ -0,0 +1,98 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kenelite/go-agw/internal/config"
+	"github.com/kenelite/go-agw/internal/observability"
+	"github.com/kenelite/go-agw/internal/plugin"
+	"github.com/kenelite/go-agw/internal/scheduler"
+	"github.com/kenelite/go-agw/internal/upstream"
+)
+
+func TestRouterHostRewrite(t *testing.T) {
+	be := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Host + "|" + r.TLS.ServerName))
+	}))
+	be.StartTLS()
+	defer be.Close()
+	targetHost := strings.TrimPrefix(be.URL, "https://")
+
+	logger := observability.NewLogger(nil)
+	upm, err := upstream.NewManager([]config.UpstreamConfig{{
+		Name: "saas", Targets: []string{be.URL}, Timeout: 2000,
+		TLS:         config.UpstreamTLSConfig{InsecureSkipVerify: true},
+		HostRewrite: config.HostRewriteConfig{Policy: "target"},
+	}}, logger)
+	if err != nil {
+		t.Fatalf("upstream manager: %v", err)
+	}
+	routes := []config.RouteConfig{
+		{Path: "/fixed", UpstreamRef: "saas", HostRewrite: config.HostRewriteConfig{Policy: "fixed", Value: "api.vendor.example"}},
+		{Path: "/tmpl", UpstreamRef: "saas", HostRewrite: config.HostRewriteConfig{Policy: "template", Value: "${upstream}.${hostname}"}},
+		{Path: "/keep", UpstreamRef: "saas", HostRewrite: config.HostRewriteConfig{Policy: "preserve"}},
+		{Path: "/", UpstreamRef: "saas"},
+	}
+	r, err := NewRouter(routes, upm, scheduler.NewRoundRobin(), plugin.NewManager(logger), observability.NewMetrics(), logger)
+	if err != nil {
+		t.Fatalf("router: %v", err)
+	}
+
+	cases := map[string]string{
+		"/fixed": "api.vendor.example|api.vendor.example",
+		"/tmpl":  "saas.shop.example|saas.shop.example",
+		"/keep":  "shop.example:8443|shop.example",
+		"/other": targetHost + "|",
+	}
+	for path, want := range cases {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://shop.example:8443"+path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d: %s", path, rec.Code, rec.Body.String())
+		}
+		if got := rec.Body.String(); got != want {
+			t.Errorf("%s: got host|sni %q want %q", path, got, want)
+		}
+	}
+
+	if _, err := NewRouter([]config.RouteConfig{{HostRewrite: config.HostRewriteConfig{Policy: "fixed"}}}, upm, nil, nil, nil, logger); err == nil {
+		t.Fatal("expected error for fixed host_rewrite without value")
+	}
+}
+
+// setHostPlugin stands in for a plugin that routes by rewriting the Host.
+type setHostPlugin struct{ host string }
+
+func (p *setHostPlugin) Name() string { return "test-set-host" }
+func (p *setHostPlugin) Init(cfg map[string]any) error {
+	p.host, _ = cfg["host"].(string)
+	return nil
+}
+func (p *setHostPlugin) BeforeDispatch(ctx *plugin.RequestContext) (bool, error) {
+	// like plugins that attach context values, hand on a new request
+	ctx.Request = ctx.Request.WithContext(ctx.Request.Context())
+	ctx.Request.Host = p.host
+	return false, nil
+}
+func (p *setHostPlugin) AfterDispatch(*plugin.RequestContext) {}
+
+func TestRouterPluginHost(t *testing.T) {
+	plugin.Register("test-set-host", func() plugin.Plugin { return &setHostPlugin{} })
+	got := make(chan http.Header, 1)
+	r := newTestRouter(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h := req.Header.Clone()
+		h.Set("Host", req.Host)
+		got <- h
+	}))
+	_ = r.plugins.InitRoutes([]config.RouteConfig{{Plugins: []config.PluginRef{{Name: "test-set-host", Config: map[string]any{"host": "tenant.internal"}}}}})
+	r.hostRewrite[0], _ = upstream.NewHostRewrite("preserve", "")
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://shop.example/", nil))
+	h := <-got
+	if h.Get("Host") != "tenant.internal" || h.Get("X-Forwarded-Host") != "tenant.internal" {
+		t.Fatalf("host set by a plugin was dropped: host=%q x-forwarded-host=%q", h.Get("Host"), h.Get("X-Forwarded-Host"))
+	}
+}
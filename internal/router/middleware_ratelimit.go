@@ -1,21 +1,79 @@
 package router
 
 import (
+    "math"
     "net/http"
+    "strconv"
+    "time"
 
     "github.com/kenelite/go-agw/internal/ratelimiter"
 )
 
-type rateLimitMiddleware struct { limiter *ratelimiter.Limiter }
+type rateLimitMiddleware struct { backend ratelimiter.Backend }
 
-func newRateLimitMiddleware() *rateLimitMiddleware { return &rateLimitMiddleware{limiter: ratelimiter.New()} }
+func newRateLimitMiddleware() *rateLimitMiddleware { return &rateLimitMiddleware{backend: ratelimiter.NewMemory()} }
 
-func (m *rateLimitMiddleware) allow(w http.ResponseWriter, r *http.Request, rps, burst int) bool {
-    key := ratelimiter.ClientIP(r.RemoteAddr) + "|" + r.URL.Path
-    if !m.limiter.Allow(key, rps, burst) {
-        http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
-        return false
+// rateLimitPass carries one request's rate limit outcome from the checks made before the
+// plugin chain to those made after it.
+type rateLimitPass struct {
+    tightest *ratelimiter.Decision
+    taken    []takenLimit
+}
+
+// takenLimit is a bucket that counted the request; the key is kept because plugins may
+// change what it is computed from.
+type takenLimit struct {
+    key   string
+    limit ratelimiter.Limit
+}
+
+// allow enforces the rules of one phase (see rateLimitRule.afterAuth); the request is
+// rejected by the first limit it exceeds, and the limits that had already counted it, in
+// either phase, get the request back, so being throttled by a short limit does not use up
+// a daily or monthly quota. Unless hidden, RateLimit-* headers describe the limit closest
+// to exhaustion (or the one exceeded).
+func (m *rateLimitMiddleware) allow(w http.ResponseWriter, r *http.Request, rules []rateLimitRule, afterAuth, hideHeaders bool, pass *rateLimitPass) bool {
+    for i := range rules {
+        if rules[i].afterAuth != afterAuth { continue }
+        key := rules[i].key(r)
+        d, err := m.backend.Allow(r.Context(), key, rules[i].limit)
+        if err != nil {
+            // backend errors fail open; shared stores are wrapped in a local fallback anyway
+            continue
+        }
+        if !d.Allowed {
+            m.refund(r, pass.taken)
+            if !hideHeaders { setRateLimitHeaders(w.Header(), d) }
+            w.Header().Set("Retry-After", ceilSeconds(d.RetryAfter))
+            http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+            return false
+        }
+        pass.taken = append(pass.taken, takenLimit{key: key, limit: rules[i].limit})
+        if pass.tightest == nil || d.Remaining < pass.tightest.Remaining {
+            pass.tightest = &d
+        }
     }
+    if pass.tightest != nil && !hideHeaders { setRateLimitHeaders(w.Header(), *pass.tightest) }
     return true
 }
 
+// refund gives the request back to the buckets that counted it.
+func (m *rateLimitMiddleware) refund(r *http.Request, taken []takenLimit) {
+    rf, ok := m.backend.(ratelimiter.Refunder)
+    if !ok { return }
+    for _, t := range taken {
+        _ = rf.Refund(r.Context(), t.key, t.limit)
+    }
+}
+
+func setRateLimitHeaders(h http.Header, d ratelimiter.Decision) {
+    h.Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+    h.Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+    h.Set("RateLimit-Reset", ceilSeconds(d.Reset))
+}
+
+// ceilSeconds renders d as whole seconds, rounding up so clients never retry early.
+func ceilSeconds(d time.Duration) string {
+    if d < 0 { d = 0 }
+    return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
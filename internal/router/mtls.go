@@ -0,0 +1,70 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/kenelite/go-agw/internal/config"
+	"github.com/kenelite/go-agw/internal/tlsutil"
+)
+
+func buildClientAuth(routes []config.RouteConfig) ([]*tlsutil.ClientAuth, error) {
+	out := make([]*tlsutil.ClientAuth, len(routes))
+	for i, rt := range routes {
+		ca, err := tlsutil.NewClientAuth(rt.ClientAuth)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = ca
+	}
+	return out, nil
+}
+
+// clientAuthFor returns the route's client certificate policy, falling back to the listener's.
+func (r *Router) clientAuthFor(idx int) *tlsutil.ClientAuth {
+	if idx < len(r.clientAuth) && r.clientAuth[idx] != nil {
+		return r.clientAuth[idx]
+	}
+	return r.listenerAuth
+}
+
+// authenticateClient verifies the client certificate for the matched route and returns its identity.
+// On failure it writes the response and returns ok=false.
+func (r *Router) authenticateClient(w http.ResponseWriter, req *http.Request, idx int) (*tlsutil.Identity, bool) {
+	ca := r.clientAuthFor(idx)
+	if !ca.Enabled() {
+		// no policy: only expose identities crypto/tls already verified
+		if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+			return tlsutil.IdentityFromCert(req.TLS.VerifiedChains[0][0]), true
+		}
+		return nil, true
+	}
+	id, err := ca.Verify(req.TLS)
+	if err != nil {
+		r.logger.Warnw("client certificate rejected", "path", req.URL.Path, "err", err)
+		if errors.Is(err, tlsutil.ErrNoClientCert) {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		} else {
+			http.Error(w, "client certificate rejected", http.StatusForbidden)
+		}
+		return nil, false
+	}
+	return id, true
+}
+
+// applyClientCertHeader sets X-Forwarded-Client-Cert on the upstream request per policy.
+// Incoming values are always dropped unless the policy is append.
+func applyClientCertHeader(h http.Header, policy string, id *tlsutil.Identity) {
+	if policy != tlsutil.ForwardAppend {
+		h.Del(tlsutil.XFCCHeader)
+	}
+	if id == nil || policy == tlsutil.ForwardSanitize {
+		return
+	}
+	if prev := strings.Join(h.Values(tlsutil.XFCCHeader), ","); prev != "" {
+		h.Set(tlsutil.XFCCHeader, prev+","+id.XFCC())
+		return
+	}
+	h.Set(tlsutil.XFCCHeader, id.XFCC())
+}
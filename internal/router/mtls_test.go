@@ -0,0 +1,89 @@
+package router
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kenelite/go-agw/internal/config"
+)
+
+func selfSignedClientCert(t *testing.T, spiffe string) *x509.Certificate {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	u, _ := url.Parse(spiffe)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		URIs:         []*url.URL{u},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create cert: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func TestRouterClientCertForwarding(t *testing.T) {
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("X-Forwarded-Client-Cert")))
+	})
+	r := newTestRouter(t, backend)
+	r.routes[0].ClientAuth = config.ClientAuthConfig{
+		Mode:              "require",
+		AllowedSPIFFEIDs:  []string{"spiffe://example.org/web"},
+		ForwardClientCert: "set",
+	}
+	ca, err := buildClientAuth(r.routes)
+	if err != nil {
+		t.Fatalf("client auth: %v", err)
+	}
+	r.clientAuth = ca
+
+	// no certificate
+	req := httptest.NewRequest(http.MethodGet, "http://agw/", nil)
+	req.Header.Set("X-Forwarded-Client-Cert", "Hash=spoofed")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without certificate, got %d", rec.Code)
+	}
+
+	// certificate verified by the listener, SPIFFE ID allowed
+	cert := selfSignedClientCert(t, "spiffe://example.org/web")
+	req = httptest.NewRequest(http.MethodGet, "http://agw/", nil)
+	req.Header.Set("X-Forwarded-Client-Cert", "Hash=spoofed")
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", rec.Code)
+	}
+	if got := rec.Body.String(); strings.Contains(got, "spoofed") || !strings.Contains(got, "URI=spiffe://example.org/web") {
+		t.Fatalf("unexpected forwarded client cert: %q", got)
+	}
+
+	// SPIFFE ID not allowed
+	cert = selfSignedClientCert(t, "spiffe://example.org/batch")
+	req = httptest.NewRequest(http.MethodGet, "http://agw/", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for disallowed SPIFFE ID, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,243 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kenelite/go-agw/internal/clientip"
+	"github.com/kenelite/go-agw/internal/config"
+	"github.com/kenelite/go-agw/internal/consumer"
+	"github.com/kenelite/go-agw/internal/plugin"
+	"github.com/kenelite/go-agw/internal/ratelimiter"
+)
+
+// rateLimitRule is one compiled limit of a route.
+type rateLimitRule struct {
+	id    string // route and rule, prefixed to every bucket key
+	parts []keyPart
+	limit ratelimiter.Limit
+	// afterAuth rules key on the consumer or its claims and run once authentication
+	// plugins have identified the caller; the others run before any plugin.
+	afterAuth bool
+}
+
+// keyPart is one term of a key expression such as "consumer+header:X-Tenant".
+type keyPart struct {
+	kind string // ip, consumer, client, header, claim, route, path, template, method, host, query
+	arg  string
+	segs []string // template segments
+}
+
+// compileRateLimits turns a route's rate_limit config into rules. The legacy rps/burst
+// pair becomes a per-second limit keyed by client and path; it always runs before the
+// plugins, so the client is the IP, as it was before consumers existed.
+func compileRateLimits(idx int, rl config.RateLimitConfig) ([]rateLimitRule, error) {
+	var rules []rateLimitRule
+	if rl.RequestsPerSecond > 0 {
+		parts, _ := parseKeyExpr("client+path")
+		rules = append(rules, rateLimitRule{
+			id:    fmt.Sprintf("r%d:rps", idx),
+			parts: parts,
+			limit: ratelimiter.Limit{Requests: rl.RequestsPerSecond, Window: time.Second, Burst: rl.Burst},
+		})
+	}
+	for i, l := range rl.Limits {
+		name := l.Name
+		if name == "" {
+			name = strconv.Itoa(i)
+		}
+		if l.Requests <= 0 {
+			return nil, fmt.Errorf("rate_limit %q: requests must be positive", name)
+		}
+		expr := l.Key
+		if expr == "" {
+			expr = "client"
+		}
+		parts, err := parseKeyExpr(expr)
+		if err != nil {
+			return nil, fmt.Errorf("rate_limit %q: %w", name, err)
+		}
+		lim := ratelimiter.Limit{Requests: l.Requests, Window: time.Duration(l.Window) * time.Millisecond, Burst: l.Burst, Algorithm: l.Algorithm}
+		switch l.Algorithm {
+		case "", ratelimiter.TokenBucketAlgorithm, ratelimiter.FixedWindowAlgorithm, ratelimiter.SlidingWindowAlgorithm, ratelimiter.SlidingLogAlgorithm:
+		default:
+			return nil, fmt.Errorf("rate_limit %q: unknown algorithm %q", name, l.Algorithm)
+		}
+		if l.Period != "" {
+			period, ok := ratePeriods[l.Period]
+			if !ok {
+				return nil, fmt.Errorf("rate_limit %q: unknown period %q", name, l.Period)
+			}
+			lim.Window = period
+			lim.Monthly = l.Period == "month" && l.Algorithm == ratelimiter.FixedWindowAlgorithm
+		}
+		if lim.Window <= 0 {
+			lim.Window = time.Second
+		}
+		if lim.Burst <= 0 {
+			lim.Burst = l.Requests
+		}
+		rules = append(rules, rateLimitRule{
+			id:        fmt.Sprintf("r%d:%s", idx, name),
+			parts:     parts,
+			limit:     lim,
+			afterAuth: identityKeyed(parts),
+		})
+	}
+	return rules, nil
+}
+
+// identityKeyed reports whether a key needs what authentication plugins find out: the
+// consumer or its claims. A client key does not; counted before the plugins it is the IP,
+// so a flood of bad credentials is throttled before it reaches them.
+func identityKeyed(parts []keyPart) bool {
+	for _, p := range parts {
+		switch p.kind {
+		case "consumer", "claim":
+			return true
+		}
+	}
+	return false
+}
+
+var ratePeriods = map[string]time.Duration{
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+	"week":   7 * 24 * time.Hour,
+	"month":  30 * 24 * time.Hour,
+}
+
+func parseKeyExpr(expr string) ([]keyPart, error) {
+	var parts []keyPart
+	for _, term := range strings.Split(expr, "+") {
+		term = strings.TrimSpace(term)
+		kind, arg, _ := strings.Cut(term, ":")
+		p := keyPart{kind: kind, arg: arg}
+		switch kind {
+		case "ip", "consumer", "client", "route", "path", "method", "host", "query":
+			if arg != "" {
+				return nil, fmt.Errorf("key %q takes no argument", kind)
+			}
+		case "header":
+			if arg == "" {
+				return nil, fmt.Errorf("key %q needs a header name", term)
+			}
+			p.arg = http.CanonicalHeaderKey(arg)
+		case "claim":
+			if arg == "" {
+				return nil, fmt.Errorf("key %q needs a claim name", term)
+			}
+		case "template":
+			if !strings.HasPrefix(arg, "/") {
+				return nil, fmt.Errorf("key %q needs a path template such as /users/{id}", term)
+			}
+			p.segs = strings.Split(strings.Trim(arg, "/"), "/")
+		default:
+			return nil, fmt.Errorf("unknown key %q", term)
+		}
+		parts = append(parts, p)
+	}
+	return parts, nil
+}
+
+// key builds the bucket key for req. Missing values (no consumer, header or claim) yield
+// an empty term, so such requests share one bucket rather than escaping the limit.
+func (rule *rateLimitRule) key(r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(rule.id)
+	writeKey(&b, rule.parts, r)
+	return b.String()
+}
+
+// writeKey appends the value of each key part to b, each preceded by '|'.
+func writeKey(b *strings.Builder, parts []keyPart, r *http.Request) {
+	for _, p := range parts {
+		b.WriteByte('|')
+		switch p.kind {
+		case "ip":
+			b.WriteString(requestClientIP(r))
+		case "consumer":
+			if c, ok := consumer.FromContext(r.Context()); ok {
+				b.WriteString(c.Name)
+			}
+		case "client":
+			// authenticated consumers get their own bucket regardless of the IP they call from
+			if c, ok := consumer.FromContext(r.Context()); ok {
+				b.WriteString("consumer:" + c.Name)
+			} else {
+				b.WriteString(requestClientIP(r))
+			}
+		case "header":
+			b.WriteString(r.Header.Get(p.arg))
+		case "claim":
+			if claims, ok := plugin.ClaimsFrom(r.Context()); ok {
+				b.WriteString(claimValue(claims[p.arg]))
+			}
+		case "route":
+			// the rule id already scopes the bucket to the route
+		case "path":
+			b.WriteString(r.URL.Path)
+		case "template":
+			if matchTemplate(p.segs, r.URL.Path) {
+				b.WriteString(p.arg)
+			} else {
+				b.WriteString(r.URL.Path)
+			}
+		case "method":
+			b.WriteString(r.Method)
+		case "host":
+			b.WriteString(strings.ToLower(r.Host))
+		case "query":
+			b.WriteString(r.URL.Query().Encode()) // sorted by name
+		}
+	}
+}
+
+func requestClientIP(r *http.Request) string {
+	if ip, ok := clientip.FromContext(r.Context()); ok {
+		return ip
+	}
+	return ratelimiter.ClientIP(r.RemoteAddr)
+}
+
+// matchTemplate reports whether path fits segs, where "{name}" matches one segment and a
+// final "*" matches the rest of the path.
+func matchTemplate(segs []string, path string) bool {
+	got := strings.Split(strings.Trim(path, "/"), "/")
+	for i, s := range segs {
+		if s == "*" && i == len(segs)-1 {
+			return len(got) >= i
+		}
+		if i >= len(got) {
+			return false
+		}
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			if got[i] == "" {
+				return false
+			}
+			continue
+		}
+		if s != got[i] {
+			return false
+		}
+	}
+	return len(got) == len(segs)
+}
+
+func claimValue(v any) string {
+	switch c := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return c
+	case float64:
+		return strconv.FormatFloat(c, 'f', -1, 64)
+	default:
+		return fmt.Sprint(c)
+	}
+}
@@ -0,0 +1,240 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/kenelite/go-agw/internal/config"
+	"github.com/kenelite/go-agw/internal/observability"
+	"github.com/kenelite/go-agw/internal/plugin"
+	"github.com/kenelite/go-agw/internal/scheduler"
+)
+
+func TestRouterMultipleRateLimits(t *testing.T) {
+	r := newTestRouter(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) }))
+	r.routes[0].RateLimit = config.RateLimitConfig{Limits: []config.RateLimitRule{
+		{Name: "per-user", Key: "header:X-User", Requests: 2, Window: 60000},
+		{Name: "per-route", Key: "route", Requests: 3, Window: 60000},
+	}}
+	send := func(user, path string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://agw"+path, nil)
+		req.Header.Set("X-User", user)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	steps := []struct {
+		user, path string
+		want       int
+	}{
+		{"alice", "/a", http.StatusOK},
+		{"alice", "/b", http.StatusOK},
+		{"alice", "/c", http.StatusTooManyRequests}, // per-user, regardless of path
+		{"bob", "/a", http.StatusOK},
+		{"carol", "/a", http.StatusTooManyRequests}, // per-route budget spent
+	}
+	for i, s := range steps {
+		if got := send(s.user, s.path); got != s.want {
+			t.Fatalf("step %d (%s %s): got %d want %d", i, s.user, s.path, got, s.want)
+		}
+	}
+}
+
+func TestRouterRateLimitRefundsQuota(t *testing.T) {
+	r := newTestRouter(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) }))
+	r.routes[0].RateLimit = config.RateLimitConfig{Limits: []config.RateLimitRule{
+		{Name: "quota", Key: "header:X-User", Requests: 2, Period: "day", Algorithm: "fixed_window"},
+		{Name: "throttle", Key: "header:X-Session", Requests: 1, Window: 60000},
+	}}
+	send := func(session string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://agw/", nil)
+		req.Header.Set("X-User", "alice")
+		req.Header.Set("X-Session", session)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	for i, s := range []struct {
+		session string
+		want    int
+	}{
+		{"s1", http.StatusOK},
+		{"s1", http.StatusTooManyRequests}, // throttled: must not count against the quota
+		{"s1", http.StatusTooManyRequests},
+		{"s2", http.StatusOK},
+		{"s3", http.StatusTooManyRequests}, // quota spent
+	} {
+		if got := send(s.session); got != s.want {
+			t.Fatalf("step %d (%s): got %d want %d", i, s.session, got, s.want)
+		}
+	}
+}
+
+func TestRouterRateLimitBeforePlugins(t *testing.T) {
+	r := newTestRouter(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) }))
+	_ = r.plugins.InitRoutes([]config.RouteConfig{{Plugins: []config.PluginRef{
+		{Name: "cors", Config: map[string]any{"allow_origins": []any{"https://app.example.com"}}},
+	}}})
+	r.routes[0].RateLimit = config.RateLimitConfig{Limits: []config.RateLimitRule{
+		{Name: "per-ip", Key: "ip", Requests: 1, Window: 60000},
+	}}
+	preflight := func() int {
+		req := httptest.NewRequest(http.MethodOptions, "http://agw/orders", nil)
+		req.Header.Set("Origin", "https://app.example.com")
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	// requests answered by a plugin still count against IP-keyed limits
+	if code := preflight(); code != http.StatusNoContent {
+		t.Fatalf("first preflight: %d", code)
+	}
+	if code := preflight(); code != http.StatusTooManyRequests {
+		t.Fatalf("second preflight should be throttled: %d", code)
+	}
+
+	for _, expr := range []string{"ip+route", "client", "client+path"} {
+		if parts, _ := parseKeyExpr(expr); identityKeyed(parts) {
+			t.Fatalf("%s does not need authentication plugins", expr)
+		}
+	}
+	for _, expr := range []string{"consumer", "claim:sub+ip"} {
+		if parts, _ := parseKeyExpr(expr); !identityKeyed(parts) {
+			t.Fatalf("%s should run after authentication", expr)
+		}
+	}
+}
+
+func TestRouterLegacyRateLimitBeforeAuth(t *testing.T) {
+	r := newTestRouter(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) }))
+	useKeyAuth(t, r)
+	r.routes[0].RateLimit = config.RateLimitConfig{RequestsPerSecond: 1, Burst: 1}
+	send := func() int {
+		req := httptest.NewRequest(http.MethodGet, "http://agw/orders", nil)
+		req.Header.Set("X-API-Key", "k-wrong")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	// guessing API keys is throttled by IP before key-auth sees the request
+	if code := send(); code != http.StatusUnauthorized {
+		t.Fatalf("first request: %d", code)
+	}
+	if code := send(); code != http.StatusTooManyRequests {
+		t.Fatalf("second unauthenticated request should be throttled: %d", code)
+	}
+}
+
+func TestRouterRateLimitDefaultKeyBeforeAuth(t *testing.T) {
+	r := newTestRouter(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) }))
+	useKeyAuth(t, r)
+	r.routes[0].RateLimit = config.RateLimitConfig{Limits: []config.RateLimitRule{{Requests: 1, Window: 60000}}}
+	send := func(key string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://agw/orders", nil)
+		req.Header.Set("X-API-Key", key)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := send("k-wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("first request: %d", code)
+	}
+	if code := send("k-alice"); code != http.StatusTooManyRequests {
+		t.Fatalf("the default client key should count bad credentials by IP: %d", code)
+	}
+}
+
+func TestRouterRateLimitPathTemplate(t *testing.T) {
+	r := newTestRouter(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) }))
+	r.routes[0].RateLimit = config.RateLimitConfig{Limits: []config.RateLimitRule{
+		{Key: "ip+template:/users/{id}", Requests: 1, Window: 60000},
+	}}
+	send := func(path string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://agw"+path, nil)
+		req.RemoteAddr = "192.0.2.1:1000"
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := send("/users/1"); code != http.StatusOK {
+		t.Fatalf("first user: %d", code)
+	}
+	if code := send("/users/2"); code != http.StatusTooManyRequests {
+		t.Fatalf("/users/2 should share the /users/{id} bucket: %d", code)
+	}
+	if code := send("/users/1/orders"); code != http.StatusOK {
+		t.Fatalf("paths outside the template keep their own bucket: %d", code)
+	}
+}
+
+func TestRateLimitKeyExpressions(t *testing.T) {
+	for _, tc := range []struct {
+		segs string
+		path string
+		want bool
+	}{
+		{"/users/{id}", "/users/42", true},
+		{"/users/{id}", "/users/", false},
+		{"/users/{id}", "/users/42/orders", false},
+		{"/files/*", "/files/a/b/c", true},
+		{"/files/*", "/files", true},
+		{"/users/{id}", "/teams/42", false},
+	} {
+		parts, err := parseKeyExpr("template:" + tc.segs)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.segs, err)
+		}
+		if got := matchTemplate(parts[0].segs, tc.path); got != tc.want {
+			t.Fatalf("matchTemplate(%s, %s) = %v", tc.segs, tc.path, got)
+		}
+	}
+	for _, bad := range []string{"cookie:x", "header:", "ip:1", "template:users"} {
+		if _, err := parseKeyExpr(bad); err == nil {
+			t.Fatalf("%q should be rejected", bad)
+		}
+	}
+	logger := observability.NewLogger(nil)
+	routes := []config.RouteConfig{{Path: "/", RateLimit: config.RateLimitConfig{Limits: []config.RateLimitRule{{Key: "nope", Requests: 1}}}}}
+	_, err := NewRouter(routes, nil, scheduler.NewRoundRobin(), plugin.NewManager(logger), observability.NewMetrics(), logger)
+	if err == nil || !strings.Contains(err.Error(), `unknown key "nope"`) {
+		t.Fatalf("NewRouter should reject bad key expressions, got %v", err)
+	}
+}
+
+func TestRouterRateLimitHeaders(t *testing.T) {
+	r := newTestRouter(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) }))
+	r.routes[0].RateLimit = config.RateLimitConfig{Limits: []config.RateLimitRule{
+		{Name: "burst", Key: "ip", Requests: 100, Window: 1000},
+		{Name: "daily", Key: "ip", Requests: 2, Period: "day", Algorithm: "sliding_window"},
+	}}
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://agw/", nil)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+	rec := send()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("first request: %d", rec.Code)
+	}
+	// the daily quota is the tightest limit
+	if rec.Header().Get("RateLimit-Limit") != "2" || rec.Header().Get("RateLimit-Remaining") != "1" || rec.Header().Get("RateLimit-Reset") == "" {
+		t.Fatalf("headers: %v", rec.Header())
+	}
+	send()
+	rec = send()
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("quota exhausted: %d", rec.Code)
+	}
+	retry, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	if err != nil || retry <= 0 || retry > 86400 {
+		t.Fatalf("Retry-After: %q", rec.Header().Get("Retry-After"))
+	}
+	if rec.Header().Get("RateLimit-Remaining") != "0" {
+		t.Fatalf("remaining on 429: %v", rec.Header())
+	}
+}
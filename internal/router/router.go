@@ -1,15 +1,23 @@
 package router
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/kenelite/go-agw/internal/admission"
+	"github.com/kenelite/go-agw/internal/clientip"
 	"github.com/kenelite/go-agw/internal/config"
 	"github.com/kenelite/go-agw/internal/observability"
 	"github.com/kenelite/go-agw/internal/plugin"
 	"github.com/kenelite/go-agw/internal/scheduler"
+	"github.com/kenelite/go-agw/internal/tlsutil"
 	"github.com/kenelite/go-agw/internal/upstream"
 )
 
@@ -21,24 +29,141 @@ type Router struct {
 	metrics  *observability.Metrics
 	logger   *observability.Logger
 	_rlmw    *rateLimitMiddleware
+	// client certificate policies: per route (nil when unset) and listener-wide
+	clientAuth   []*tlsutil.ClientAuth
+	listenerAuth *tlsutil.ClientAuth
+	// real client IP resolution and upstream forwarding headers
+	realIP    *clientip.Resolver
+	forwarded forwardedPolicy
+	// per-route host_rewrite overrides (nil when unset)
+	hostRewrite []*upstream.HostRewrite
+	// open upgraded connections per route
+	tunnels []atomic.Int64
+	// compiled rate limits per route
+	rateLimits []routeRateLimits
+	// concurrency limits per route (nil when unset) and per upstream name
+	routeAdmission    []*admissionSlot
+	upstreamAdmission map[string]*admissionSlot
+	priorities        []routePriority
+	admission         *admission.Group
+	// request coalescing per route (nil when disabled)
+	coalescers []*coalescer
+	// request body limits and buffering per route
+	bodies []bodyPolicy
+	// request, per-try and idle timeouts per route
+	timeouts []timeoutPolicy
+	// hedged requests per route (nil when disabled)
+	hedgers []*hedger
+}
+
+type routeRateLimits struct {
+	once  sync.Once
+	rules []rateLimitRule
 }
 
 func NewRouter(routes []config.RouteConfig, up *upstream.Manager, sch scheduler.Scheduler, pl *plugin.Manager, m *observability.Metrics, l *observability.Logger) (*Router, error) {
-	return &Router{routes: routes, upstream: up, sched: sch, plugins: pl, metrics: m, logger: l}, nil
+	ca, err := buildClientAuth(routes)
+	if err != nil {
+		return nil, err
+	}
+	hr := make([]*upstream.HostRewrite, len(routes))
+	co := make([]*coalescer, len(routes))
+	var cm coalesceMetrics
+	bodies := make([]bodyPolicy, len(routes))
+	timeouts := make([]timeoutPolicy, len(routes))
+	hedgers := make([]*hedger, len(routes))
+	var hm hedgeMetrics
+	for i, rt := range routes {
+		bodies[i] = newBodyPolicy(rt)
+		timeouts[i] = newTimeoutPolicy(rt.Timeouts)
+		if hr[i], err = upstream.NewHostRewrite(rt.HostRewrite.Policy, rt.HostRewrite.Value); err != nil {
+			return nil, err
+		}
+		if _, err := compileRateLimits(i, rt.RateLimit); err != nil {
+			return nil, fmt.Errorf("route %s: %w", rt.Path, err)
+		}
+		if co[i], err = newCoalescer(rt); err != nil {
+			return nil, fmt.Errorf("route %s: %w", rt.Path, err)
+		}
+		if co[i] != nil {
+			cm = append(cm, co[i])
+		}
+		if hedgers[i], err = newHedger(rt); err != nil {
+			return nil, fmt.Errorf("route %s: %w", rt.Path, err)
+		}
+		if hedgers[i] != nil {
+			hm = append(hm, hedgers[i])
+		}
+	}
+	group := &admission.Group{}
+	ra, prios, err := buildRouteAdmission(routes, group)
+	if err != nil {
+		return nil, err
+	}
+	if m != nil {
+		m.Register(group)
+		m.Register(cm)
+		m.Register(hm)
+	}
+	r := &Router{routes: routes, upstream: up, sched: sch, plugins: pl, metrics: m, logger: l, clientAuth: ca,
+		forwarded: forwardedPolicy{mode: forwardAppend}, hostRewrite: hr, tunnels: make([]atomic.Int64, len(routes)),
+		rateLimits: make([]routeRateLimits, len(routes)), routeAdmission: ra, priorities: prios, admission: group, coalescers: co, bodies: bodies, timeouts: timeouts, hedgers: hedgers}
+	// plugins such as cache issue background requests through the full route
+	pl.SetDispatcher(r)
+	return r, nil
+}
+
+// UseServerConfig applies listener-wide settings: the TLS client certificate policy,
+// trusted proxies and the forwarding header policy.
+func (r *Router) UseServerConfig(sc config.ServerConfig) error {
+	ca, err := tlsutil.NewClientAuth(sc.TLS.ClientAuth)
+	if err != nil {
+		return err
+	}
+	res, err := clientip.NewResolver(sc.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	fp, err := newForwardedPolicy(sc.ForwardedHeaders)
+	if err != nil {
+		return err
+	}
+	r.listenerAuth, r.realIP, r.forwarded = ca, res, fp
+	return nil
 }
 
 func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	r.metrics.IncRequests()
 	for i, rt := range r.routes {
-		if !matchRoute(rt, req) {
+		if !r.matchRoute(i, req) {
 			continue
 		}
-		if !r.preflight(w, req, i) {
+		// the request deadline runs from arrival and may be shortened by the client
+		deadline := r.timeouts[i].deadline(req, time.Now())
+		clientIP := r.realIP.Resolve(req)
+		req = req.WithContext(clientip.NewContext(req.Context(), clientIP))
+		var limits rateLimitPass
+		if !r.preflight(w, req, i, &limits) {
+			return
+		}
+		clientID, ok := r.authenticateClient(w, req, i)
+		if !ok {
+			return
+		}
+		// body limits apply before plugins, which may read the body themselves
+		releaseBody, ok := r.prepareBody(w, req, i)
+		if !ok {
 			return
 		}
+		defer releaseBody()
 		// plugins: before (plugins may mutate request and choose upstream)
-		prc := &plugin.RequestContext{Context: req.Context(), Writer: w, Request: req}
-		for _, p := range r.plugins.Chain() {
+		prc := &plugin.RequestContext{Context: req.Context(), Writer: w, Request: req, Logger: r.logger, Metrics: r.metrics, ClientCert: clientID, ClientIP: clientIP}
+		if r.hasPlugin(i, "cache") {
+			// background revalidation replays the request through the chain as received
+			prc.Original = req.Clone(req.Context())
+		}
+		chain := r.plugins.ChainFor(i)
+		for _, p := range chain {
 			handled, err := p.BeforeDispatch(prc)
 			if err != nil {
 				r.logger.Errorw("plugin before error", "plugin", p.Name(), "err", err)
@@ -47,6 +172,10 @@ func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 				return
 			}
 		}
+		// limits keyed on the consumer run once authentication plugins have identified it
+		if !r.postflight(w, prc.Request, i, &limits) {
+			return
+		}
 		// choose upstream after plugins
 		upstreamName := rt.UpstreamRef
 		if name, ok := plugin.UpstreamOverrideFrom(prc.Request.Context()); ok && name != "" {
@@ -57,6 +186,33 @@ func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			http.Error(w, "upstream not found", http.StatusBadGateway)
 			return
 		}
+		prc.UpstreamName = upstreamName
+		// identical concurrent requests share one upstream call; followers do not take
+		// concurrency slots while they wait
+		var fl *flight
+		if co := r.coalescers[i]; co != nil && co.eligible(prc.Request, prc.Consumer != nil || prc.Claims != nil) {
+			f, leader := co.join(prc.Request)
+			if leader {
+				fl = f
+				defer fl.publish(nil, errNotShared)
+			} else if res, err := f.wait(prc.Request.Context()); err != errNotShared {
+				if err != nil {
+					r.upstreamFailed(w, prc, chain, err)
+					return
+				}
+				prc.Response = res
+				r.respond(w, prc, chain)
+				return
+			}
+		}
+		// concurrency limits; upgraded tunnels are bounded by upgrade.max_connections instead
+		var adm *admitted
+		if upgradeType(prc.Request) == "" {
+			if adm, ok = r.admit(w, prc.Request, i, upstreamName); !ok {
+				return
+			}
+			defer adm.release()
+		}
 
 		// pick target
 		idx := r.sched.Next(len(ups.Targets))
@@ -66,80 +222,214 @@ func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 		target := ups.Targets[idx]
 		// enrich plugin context for observability
-		prc.Logger = r.logger
-		prc.Metrics = r.metrics
-		prc.UpstreamName = upstreamName
 		prc.UpstreamTarget = target.URL.String()
 
-		// proxy minimal
-		outReq := prc.Request.Clone(prc.Request.Context())
-		outReq.URL.Scheme = target.URL.Scheme
-		outReq.URL.Host = target.URL.Host
-		outReq.URL.Path = singleJoiningSlash(target.URL.Path, prc.Request.URL.Path)
-		outReq.RequestURI = ""
-		// sanitize and adjust headers
-		outReq.Header = cloneHeader(prc.Request.Header)
-		removeHopByHopHeaders(outReq.Header)
-		if isGRPC(prc.Request) {
-			// gRPC requires TE: trailers on HTTP/2; set to be safe for upstreams that expect it
-			outReq.Header.Set("TE", "trailers")
-		}
-
-		// Ensure HTTP/2 when proxying gRPC if possible; http.Client will negotiate automatically over TLS.
-		// For h2c upstreams, users should provide http:// targets; std client will still use HTTP/1.1.
-		resp, err := ups.Client.Do(outReq)
-		if err != nil {
-			r.metrics.IncFailures()
-			http.Error(w, err.Error(), http.StatusBadGateway)
-			return
+		// proxy minimal; hedging builds a second request for another target
+		outbound := func(target upstream.Target) (*http.Request, string) {
+			outReq := prc.Request.Clone(prc.Request.Context())
+			outReq.URL.Scheme = target.URL.Scheme
+			outReq.URL.Host = target.URL.Host
+			outReq.URL.Path = singleJoiningSlash(target.URL.Path, prc.Request.URL.Path)
+			outReq.RequestURI = ""
+			hostRewrite := ups.HostRewrite
+			if i < len(r.hostRewrite) && r.hostRewrite[i] != nil {
+				hostRewrite = r.hostRewrite[i]
+			}
+			host, sni := hostRewrite.Resolve(prc.Request, target.URL, upstreamName)
+			outReq.Host = host
+			// sanitize and adjust headers
+			outReq.Header = cloneHeader(prc.Request.Header)
+			removeHopByHopHeaders(outReq.Header)
+			applyClientCertHeader(outReq.Header, r.clientAuthFor(i).ForwardPolicy(), clientID)
+			r.forwarded.apply(outReq.Header, prc.Request, clientIP, r.realIP.Trusted(clientip.Host(req.RemoteAddr)))
+			if isGRPC(prc.Request) {
+				// gRPC requires TE: trailers on HTTP/2; set to be safe for upstreams that expect it
+				outReq.Header.Set("TE", "trailers")
+			}
+			return outReq, sni
+		}
+		outReq, sni := outbound(target)
+
+		var resp *http.Response
+		var dl *upstreamDeadline
+		if proto := upgradeType(prc.Request); proto != "" {
+			var done bool
+			if resp, done = r.proxyUpgrade(w, prc, outReq, proto, ups, target, sni, i); done {
+				return
+			}
+		} else {
+			// Ensure HTTP/2 when proxying gRPC if possible; http.Client will negotiate automatically over TLS.
+			// For h2c upstreams, users should provide http:// targets; std client will still use HTTP/1.1.
+			// the upstream timeout is enforced through the request context so that it can turn
+			// into an idle timeout once the response proves to be a stream
+			tp := r.timeouts[i]
+			attempt, ok := tp.attempt(deadline, ups.Client.Timeout, time.Now())
+			if !ok {
+				fl.publish(nil, errNotShared)
+				r.upstreamFailed(w, prc, chain, errUpstreamTimeout)
+				return
+			}
+			tp.propagate(outReq, isGRPC(prc.Request), attempt)
+			attemptEnd := time.Now().Add(attempt)
+			var ctx context.Context
+			ctx, dl = startDeadline(outReq.Context(), attempt)
+			defer dl.stop()
+			send := func(ctx context.Context, out *http.Request, sni string) (*http.Response, error) {
+				client := *ups.ClientFor(sni)
+				client.Timeout = 0
+				return client.Do(out.WithContext(ctx))
+			}
+			var err error
+			if h := r.hedgers[i]; h != nil && h.eligible(prc.Request, len(ups.Targets)) {
+				// a slow attempt is raced by a copy sent to another target
+				var won int
+				resp, won, err = h.do(ctx, func(ctx context.Context, j int) (*http.Response, error) {
+					if j == idx {
+						return send(ctx, outReq, sni)
+					}
+					hedgeReq, hedgeSNI := outbound(ups.Targets[j])
+					if prc.Request.GetBody != nil {
+						body, err := prc.Request.GetBody()
+						if err != nil {
+							return nil, err
+						}
+						hedgeReq.Body = body
+					}
+					if attempt > 0 {
+						tp.propagate(hedgeReq, isGRPC(prc.Request), time.Until(attemptEnd))
+					}
+					return send(ctx, hedgeReq, hedgeSNI)
+				}, idx, func() int {
+					j := r.sched.Next(len(ups.Targets))
+					if j < 0 || j == idx {
+						j = (idx + 1) % len(ups.Targets)
+					}
+					return j
+				})
+				prc.UpstreamTarget = ups.Targets[won].URL.String()
+			} else {
+				resp, err = send(ctx, outReq, sni)
+			}
+			adm.sample(overloaded(req, resp, err))
+			if err != nil {
+				if dl.timedOut() {
+					err = errUpstreamTimeout
+				}
+				fl.fail(req, err)
+				r.upstreamFailed(w, prc, chain, err)
+				return
+			}
+			if rt.Streaming || isStreamingResponse(resp) {
+				fl.publish(nil, errNotShared)
+				defer resp.Body.Close()
+				idle := tp.idle
+				if idle == 0 {
+					idle = time.Duration(rt.IdleTimeout) * time.Millisecond
+				}
+				if idle == 0 {
+					idle = ups.Client.Timeout
+				}
+				r.streamResponse(w, prc, chain, resp, dl, idle)
+				return
+			}
+			dl.watchIdle(tp.idle)
 		}
 		defer resp.Body.Close()
 		// buffer upstream response for plugin transformations
-		body, _ := ioutil.ReadAll(resp.Body)
+		body, err := readBody(resp.Body, dl)
+		if err != nil {
+			if dl.timedOut() {
+				err = errUpstreamTimeout
+			}
+			fl.fail(req, err)
+			r.upstreamFailed(w, prc, chain, err)
+			return
+		}
 		prc.Response = &plugin.Response{
 			StatusCode: resp.StatusCode,
 			Header:     cloneHeader(resp.Header),
 			Body:       body,
 			Trailer:    cloneHeader(resp.Trailer),
 		}
+		fl.publish(prc.Response, nil)
+		r.respond(w, prc, chain)
+		return
+	}
+	http.NotFound(w, req)
+}
 
-		// plugins: after (allow transformations)
-		for _, p := range r.plugins.Chain() {
-			p.AfterDispatch(prc)
+// upstreamFailed answers a request whose upstream call failed, unless a plugin such as
+// cache can answer it instead.
+func (r *Router) upstreamFailed(w http.ResponseWriter, prc *plugin.RequestContext, chain []plugin.Plugin, err error) {
+	if bodyTooLarge(w, err) {
+		return
+	}
+	r.metrics.IncFailures()
+	for _, p := range chain {
+		if h, ok := p.(plugin.UpstreamErrorHandler); ok && h.UpstreamError(prc, err) {
+			return
 		}
+	}
+	if errors.Is(err, errUpstreamTimeout) {
+		gatewayTimeout(w, prc.Request)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
 
-		// sanitize hop-by-hop headers and write response
-		removeHopByHopHeaders(prc.Response.Header)
-		// announce trailers first
-		if len(prc.Response.Trailer) > 0 {
-			for k := range prc.Response.Trailer {
-				w.Header().Add("Trailer", k)
-			}
+// respond runs the after-dispatch plugins over the buffered prc.Response and writes it.
+func (r *Router) respond(w http.ResponseWriter, prc *plugin.RequestContext, chain []plugin.Plugin) {
+	// plugins: after (allow transformations)
+	for _, p := range chain {
+		p.AfterDispatch(prc)
+	}
+
+	// sanitize hop-by-hop headers and write response
+	removeHopByHopHeaders(prc.Response.Header)
+	// announce trailers first
+	if len(prc.Response.Trailer) > 0 {
+		for k := range prc.Response.Trailer {
+			w.Header().Add("Trailer", k)
 		}
-		copyHeaderExcept(w.Header(), prc.Response.Header, map[string]struct{}{"Trailer": {}, "Content-Length": {}})
-		// Avoid stale Content-Length after modifications
-		w.Header().Del("Content-Length")
-		w.WriteHeader(prc.Response.StatusCode)
-		_, _ = io.Copy(w, strings.NewReader(string(prc.Response.Body)))
-		// write trailers
-		for k, vv := range prc.Response.Trailer {
-			for _, v := range vv {
-				w.Header().Add(k, v)
-			}
+	}
+	copyHeaderExcept(w.Header(), prc.Response.Header, map[string]struct{}{"Trailer": {}, "Content-Length": {}})
+	// Avoid stale Content-Length after modifications
+	w.Header().Del("Content-Length")
+	w.WriteHeader(prc.Response.StatusCode)
+	_, _ = io.Copy(w, strings.NewReader(string(prc.Response.Body)))
+	// write trailers
+	for k, vv := range prc.Response.Trailer {
+		for _, v := range vv {
+			w.Header().Add(k, v)
 		}
-		return
 	}
-	http.NotFound(w, req)
 }
 
-func matchRoute(rt config.RouteConfig, req *http.Request) bool {
+// hasPlugin reports whether the route's chain includes the named plugin.
+func (r *Router) hasPlugin(i int, name string) bool {
+	for _, p := range r.plugins.ChainFor(i) {
+		if p.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRoute reports whether req belongs to route i. On routes with the cors plugin a
+// CORS preflight is matched by the method it asks about, so the plugin can answer it.
+func (r *Router) matchRoute(i int, req *http.Request) bool {
+	rt := r.routes[i]
 	if rt.Path != "" && !strings.HasPrefix(req.URL.Path, rt.Path) {
 		return false
 	}
 	if len(rt.Methods) > 0 {
+		method := req.Method
+		if plugin.IsPreflight(req) && r.hasPlugin(i, "cors") {
+			method = req.Header.Get("Access-Control-Request-Method")
+		}
 		ok := false
 		for _, m := range rt.Methods {
-			if strings.EqualFold(m, req.Method) {
+			if strings.EqualFold(m, method) || strings.EqualFold(m, req.Method) {
 				ok = true
 				break
 			}
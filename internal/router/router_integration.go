@@ -2,24 +2,46 @@ package router
 
 import (
     "net/http"
+
+    "github.com/kenelite/go-agw/internal/ratelimiter"
 )
 
 // integrate rate limit checks into routing
-func (r *Router) maybeAllow(w http.ResponseWriter, req *http.Request, rtIdx int) bool {
-    rl := r.routes[rtIdx].RateLimit
-    if rl.RequestsPerSecond == 0 { return true }
+func (r *Router) maybeAllow(w http.ResponseWriter, req *http.Request, rtIdx int, afterAuth bool, pass *rateLimitPass) bool {
+    rules := r.rateLimitRules(rtIdx)
+    if len(rules) == 0 { return true }
     if r._rlmw == nil { r._rlmw = newRateLimitMiddleware() }
-    return r._rlmw.allow(w, req, rl.RequestsPerSecond, rl.Burst)
+    return r._rlmw.allow(w, req, rules, afterAuth, r.routes[rtIdx].RateLimit.HideHeaders, pass)
+}
+
+// rateLimitRules compiles a route's limits on first use; NewRouter has already validated them.
+func (r *Router) rateLimitRules(idx int) []rateLimitRule {
+    rl := &r.rateLimits[idx]
+    rl.once.Do(func() { rl.rules, _ = compileRateLimits(idx, r.routes[idx].RateLimit) })
+    return rl.rules
+}
+
+// UseRateLimitBackend shares rate limit buckets through b (e.g. a Redis store) instead of
+// keeping them in process.
+func (r *Router) UseRateLimitBackend(b ratelimiter.Backend) {
+    r._rlmw = &rateLimitMiddleware{backend: b}
 }
 
 // internal state
-func (r *Router) ensureRateLimit(w http.ResponseWriter, req *http.Request, idx int) bool {
-    return r.maybeAllow(w, req, idx)
+func (r *Router) ensureRateLimit(w http.ResponseWriter, req *http.Request, idx int, afterAuth bool, pass *rateLimitPass) bool {
+    return r.maybeAllow(w, req, idx, afterAuth, pass)
+}
+
+// call at match point: limits keyed on the IP, route or request run before any plugin, so
+// cached, preflight and rejected requests are throttled too and a flood never reaches
+// authentication callouts
+func (r *Router) preflight(w http.ResponseWriter, req *http.Request, idx int, pass *rateLimitPass) bool {
+    return r.ensureRateLimit(w, req, idx, false, pass)
 }
 
-// call at match point
-func (r *Router) preflight(w http.ResponseWriter, req *http.Request, idx int) bool {
-    return r.ensureRateLimit(w, req, idx)
+// call after the plugin chain: limits keyed on the consumer or its claims
+func (r *Router) postflight(w http.ResponseWriter, req *http.Request, idx int, pass *rateLimitPass) bool {
+    return r.ensureRateLimit(w, req, idx, true, pass)
 }
 
 // augment Router with field for middleware
@@ -0,0 +1,174 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kenelite/go-agw/internal/plugin"
+)
+
+// streamingContentTypes are relayed as they arrive on every route.
+var streamingContentTypes = map[string]struct{}{
+	"text/event-stream":    {},
+	"application/x-ndjson": {},
+}
+
+func isStreamingResponse(resp *http.Response) bool {
+	mt, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	_, ok := streamingContentTypes[mt]
+	return ok
+}
+
+// upstreamDeadline enforces the upstream timeout with a timer instead of http.Client.Timeout,
+// so a response that turns out to be a stream can switch to an idle timeout. Reads of a
+// buffered body may add an idle timer on top of the attempt timer.
+type upstreamDeadline struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	idleT   *time.Timer
+	idleFor time.Duration
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+}
+
+func startDeadline(ctx context.Context, total time.Duration) (context.Context, *upstreamDeadline) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	d := &upstreamDeadline{ctx: ctx, cancel: cancel}
+	if total > 0 {
+		d.timer = time.AfterFunc(total, d.expire)
+	}
+	return ctx, d
+}
+
+func (d *upstreamDeadline) expire() { d.cancel(errUpstreamTimeout) }
+
+// idle drops the attempt timer and arms an idle timeout instead; call touch on every bit
+// of progress.
+func (d *upstreamDeadline) idle(timeout time.Duration) {
+	d.mu.Lock()
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	d.mu.Unlock()
+	d.watchIdle(timeout)
+}
+
+// watchIdle arms an idle timeout next to the attempt timer.
+func (d *upstreamDeadline) watchIdle(timeout time.Duration) {
+	if d == nil || timeout <= 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.idleT != nil {
+		d.idleT.Stop()
+	}
+	d.idleFor = timeout
+	d.idleT = time.AfterFunc(timeout, d.expire)
+}
+
+func (d *upstreamDeadline) touch() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.idleT != nil {
+		d.idleT.Reset(d.idleFor)
+	}
+}
+
+// timedOut reports whether one of the timers cancelled the attempt.
+func (d *upstreamDeadline) timedOut() bool {
+	return d != nil && context.Cause(d.ctx) == errUpstreamTimeout
+}
+
+func (d *upstreamDeadline) stop() {
+	d.mu.Lock()
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	if d.idleT != nil {
+		d.idleT.Stop()
+	}
+	d.mu.Unlock()
+	d.cancel(nil)
+}
+
+// readBody reads a buffered response body, re-arming the idle timer as data arrives.
+func readBody(body io.Reader, dl *upstreamDeadline) ([]byte, error) {
+	var buf bytes.Buffer
+	chunk := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(chunk)
+		if n > 0 {
+			dl.touch()
+			buf.Write(chunk[:n])
+		}
+		if err == io.EOF {
+			return buf.Bytes(), nil
+		}
+		if err != nil {
+			return buf.Bytes(), err
+		}
+	}
+}
+
+// streamResponse relays resp to the client chunk by chunk, flushing after every read.
+// Plugins see the status and headers (Response.Streaming) before anything is written.
+func (r *Router) streamResponse(w http.ResponseWriter, prc *plugin.RequestContext, chain []plugin.Plugin, resp *http.Response, dl *upstreamDeadline, idle time.Duration) {
+	dl.idle(idle)
+	prc.Response = &plugin.Response{
+		StatusCode: resp.StatusCode,
+		Header:     cloneHeader(resp.Header),
+		Trailer:    cloneHeader(resp.Trailer),
+		Streaming:  true,
+	}
+	for _, p := range chain {
+		p.AfterDispatch(prc)
+	}
+
+	rc := http.NewResponseController(w)
+	// streams may legitimately stay open longer than any server write timeout
+	_ = rc.SetWriteDeadline(time.Time{})
+	removeHopByHopHeaders(prc.Response.Header)
+	for k := range resp.Trailer {
+		w.Header().Add("Trailer", k)
+	}
+	copyHeaderExcept(w.Header(), prc.Response.Header, map[string]struct{}{"Trailer": {}, "Content-Length": {}})
+	w.Header().Del("Content-Length")
+	w.WriteHeader(prc.Response.StatusCode)
+	_ = rc.Flush()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			dl.touch()
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			if ferr := rc.Flush(); ferr != nil {
+				return
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	// trailers are only known once the body is fully read
+	for k, vv := range resp.Trailer {
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package router
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kenelite/go-agw/internal/config"
+	"github.com/kenelite/go-agw/internal/observability"
+	"github.com/kenelite/go-agw/internal/plugin"
+	"github.com/kenelite/go-agw/internal/scheduler"
+	"github.com/kenelite/go-agw/internal/upstream"
+)
+
+func newStreamingRouter(t *testing.T, backend http.Handler, timeoutMS int, routes []config.RouteConfig) *httptest.Server {
+	t.Helper()
+	be := httptest.NewServer(backend)
+	t.Cleanup(be.Close)
+	logger := observability.NewLogger(nil)
+	upm, err := upstream.NewManager([]config.UpstreamConfig{{Name: "echo", Targets: []string{be.URL}, Timeout: timeoutMS}}, logger)
+	if err != nil {
+		t.Fatalf("upstream manager: %v", err)
+	}
+	r, err := NewRouter(routes, upm, scheduler.NewRoundRobin(), plugin.NewManager(logger), observability.NewMetrics(), logger)
+	if err != nil {
+		t.Fatalf("router: %v", err)
+	}
+	gw := httptest.NewServer(r)
+	t.Cleanup(gw.Close)
+	return gw
+}
+
+func TestRouterStreamsEventStream(t *testing.T) {
+	release := make(chan struct{})
+	backend := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = io.WriteString(w, "data: second\n\n")
+	})
+	gw := newStreamingRouter(t, backend, 2000, []config.RouteConfig{{Path: "/", UpstreamRef: "echo"}})
+	defer close(release)
+
+	resp, err := http.Get(gw.URL + "/events")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	defer resp.Body.Close()
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != "data: first\n" {
+		t.Fatalf("expected first event before the stream ends, got %q %v", line, err)
+	}
+}
+
+func TestRouterStreamingIdleTimeout(t *testing.T) {
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// long poll: ticks for 600ms, well past the 200ms upstream timeout
+		for i := 0; i < 6; i++ {
+			_, _ = fmt.Fprintf(w, "tick %d\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+		if r.URL.Path == "/stall" {
+			time.Sleep(time.Second)
+			_, _ = io.WriteString(w, "late\n")
+		}
+	})
+	routes := []config.RouteConfig{{Path: "/", UpstreamRef: "echo", Streaming: true, IdleTimeout: 300}}
+	gw := newStreamingRouter(t, backend, 200, routes)
+
+	resp, err := http.Get(gw.URL + "/poll")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "tick 5") {
+		t.Fatalf("active stream cut by upstream timeout: %q", body)
+	}
+
+	resp, err = http.Get(gw.URL + "/stall")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.Contains(string(body), "late") {
+		t.Fatalf("expected idle stream to be cut, got %q", body)
+	}
+}
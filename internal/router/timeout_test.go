@@ -0,0 +1,172 @@
+package router
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kenelite/go-agw/internal/config"
+)
+
+func TestRouterPerTryTimeout(t *testing.T) {
+	r := newTestRouter(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			select {
+			case <-time.After(time.Second):
+			case <-req.Context().Done():
+			}
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	r.timeouts[0] = newTimeoutPolicy(config.TimeoutConfig{PerTry: 50})
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://agw/slow", nil))
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("slow upstream: %d %s", rec.Code, rec.Body)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("per-try timeout not applied, took %v", d)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://agw/fast", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("fast upstream: %d", rec.Code)
+	}
+}
+
+func TestRouterDeadlinePropagation(t *testing.T) {
+	got := make(chan http.Header, 1)
+	r := newTestRouter(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got <- req.Header.Clone()
+	}))
+	r.routes[0].Methods = nil
+	r.timeouts[0] = newTimeoutPolicy(config.TimeoutConfig{Request: 5000, DeadlineHeader: "x-request-timeout-ms"})
+
+	// the client's shorter deadline wins and the remaining time is forwarded
+	req := httptest.NewRequest(http.MethodGet, "http://agw/", nil)
+	req.Header.Set("X-Request-Timeout-Ms", "800")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	h := <-got
+	if d, ok := (timeoutPolicy{header: "X-Request-Timeout-Ms"}).clientTimeout(&http.Request{Header: h}); !ok || d > 800*time.Millisecond || d < 700*time.Millisecond {
+		t.Fatalf("forwarded deadline header = %q", h.Get("X-Request-Timeout-Ms"))
+	}
+
+	// without one, the route's request timeout is forwarded
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://agw/", nil))
+	if v := (<-got).Get("X-Request-Timeout-Ms"); v == "" || len(v) != 4 {
+		t.Fatalf("route deadline not forwarded: %q", v)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "http://agw/pkg.Svc/Call", strings.NewReader(""))
+	req.ProtoMajor, req.ProtoMinor = 2, 0
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Grpc-Timeout", "300m")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	d, ok := parseGRPCTimeout((<-got).Get("Grpc-Timeout"))
+	if !ok || d > 300*time.Millisecond || d < 200*time.Millisecond {
+		t.Fatalf("forwarded grpc-timeout = %v %v", d, ok)
+	}
+}
+
+func TestRouterGRPCDeadlineExceeded(t *testing.T) {
+	r := newTestRouter(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.Copy(io.Discard, req.Body)
+		<-req.Context().Done()
+	}))
+	r.routes[0].Methods = nil
+
+	req := httptest.NewRequest(http.MethodPost, "http://agw/pkg.Svc/Call", strings.NewReader(""))
+	req.ProtoMajor, req.ProtoMinor = 2, 0
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Grpc-Timeout", "50m")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Grpc-Status") != "4" {
+		t.Fatalf("want DEADLINE_EXCEEDED, got %d grpc-status=%q", rec.Code, rec.Header().Get("Grpc-Status"))
+	}
+
+	// an already expired deadline never reaches the upstream
+	req = httptest.NewRequest(http.MethodGet, "http://agw/", nil)
+	r.timeouts[0] = newTimeoutPolicy(config.TimeoutConfig{Request: 1})
+	if _, ok := r.timeouts[0].attempt(r.timeouts[0].deadline(req, time.Now().Add(-time.Second)), 0, time.Now()); ok {
+		t.Fatal("expired deadline should not allow an attempt")
+	}
+}
+
+func TestRouterIdleTimeoutBufferedBody(t *testing.T) {
+	r := newTestRouter(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		_, _ = w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-time.After(time.Second):
+		case <-req.Context().Done():
+		}
+	}))
+	r.timeouts[0] = newTimeoutPolicy(config.TimeoutConfig{Idle: 50})
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://agw/", nil))
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("stalled body: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestGRPCTimeoutFormat(t *testing.T) {
+	for _, d := range []time.Duration{time.Nanosecond, 1500 * time.Microsecond, 3 * time.Second, 200 * time.Hour} {
+		got, ok := parseGRPCTimeout(formatGRPCTimeout(d))
+		if !ok || got > d || d-got > d/1000+time.Nanosecond && d < time.Hour {
+			t.Fatalf("%v round-trips to %v (%s)", d, got, formatGRPCTimeout(d))
+		}
+	}
+	for _, v := range []string{"", "5", "10x", "123456789m", "-1S"} {
+		if _, ok := parseGRPCTimeout(v); ok {
+			t.Fatalf("%q should be rejected", v)
+		}
+	}
+}
+
+func TestRouterDeadlineNotSharedWithFollowers(t *testing.T) {
+	var calls atomic.Int32
+	r := newTestRouter(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if calls.Add(1) == 1 {
+			select {
+			case <-time.After(time.Second):
+			case <-req.Context().Done():
+			}
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	r.timeouts[0] = newTimeoutPolicy(config.TimeoutConfig{DeadlineHeader: "x-request-timeout-ms"})
+	co, _ := newCoalescer(config.RouteConfig{Path: "/", Coalesce: config.CoalesceConfig{Enabled: true, Timeout: 5000}})
+	r.coalescers[0] = co
+
+	// the leader's client only waits 100ms; the follower has no deadline of its own
+	leader := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		req := httptest.NewRequest(http.MethodGet, "http://agw/hot", nil)
+		req.Header.Set("X-Request-Timeout-Ms", "100")
+		r.ServeHTTP(leader, req)
+		close(done)
+	}()
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://agw/hot", nil))
+	<-done
+	if leader.Code != http.StatusGatewayTimeout {
+		t.Fatalf("leader: %d", leader.Code)
+	}
+	if rec.Code != http.StatusOK || calls.Load() != 2 || co.fallbacks.Load() != 1 {
+		t.Fatalf("follower got the leader's timeout: code=%d calls=%d fallbacks=%d", rec.Code, calls.Load(), co.fallbacks.Load())
+	}
+}
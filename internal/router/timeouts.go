@@ -0,0 +1,135 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kenelite/go-agw/internal/config"
+)
+
+// errUpstreamTimeout replaces the transport error when an upstream attempt ran out of time.
+var errUpstreamTimeout = errors.New("upstream timeout")
+
+// timeoutPolicy is a route's compiled timeouts.
+type timeoutPolicy struct {
+	request, perTry, idle time.Duration
+	header                string
+}
+
+func newTimeoutPolicy(tc config.TimeoutConfig) timeoutPolicy {
+	ms := func(n int) time.Duration { return time.Duration(n) * time.Millisecond }
+	return timeoutPolicy{request: ms(tc.Request), perTry: ms(tc.PerTry), idle: ms(tc.Idle), header: http.CanonicalHeaderKey(tc.DeadlineHeader)}
+}
+
+// deadline returns when the request must be answered: arrival plus request_ms, or the
+// client's own deadline if that comes first. The zero time means no deadline.
+func (tp timeoutPolicy) deadline(req *http.Request, arrival time.Time) time.Time {
+	var dl time.Time
+	if tp.request > 0 {
+		dl = arrival.Add(tp.request)
+	}
+	if d, ok := tp.clientTimeout(req); ok {
+		if cd := arrival.Add(d); dl.IsZero() || cd.Before(dl) {
+			dl = cd
+		}
+	}
+	return dl
+}
+
+// clientTimeout reads the time the client is willing to wait: grpc-timeout on gRPC calls,
+// the deadline header (milliseconds) on HTTP requests.
+func (tp timeoutPolicy) clientTimeout(req *http.Request) (time.Duration, bool) {
+	if isGRPC(req) {
+		return parseGRPCTimeout(req.Header.Get("Grpc-Timeout"))
+	}
+	if tp.header == "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(req.Header.Get(tp.header), 10, 64)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Millisecond, true
+}
+
+// attempt returns how long the next upstream attempt may take: per_try_ms (or the
+// upstream's timeout_ms) capped by the time left before the deadline. It returns false
+// when the deadline has already passed; zero means unbounded.
+func (tp timeoutPolicy) attempt(deadline time.Time, upstreamTimeout time.Duration, now time.Time) (time.Duration, bool) {
+	t := tp.perTry
+	if t <= 0 {
+		t = upstreamTimeout
+	}
+	if !deadline.IsZero() {
+		left := deadline.Sub(now)
+		if left <= 0 {
+			return 0, false
+		}
+		if t <= 0 || left < t {
+			t = left
+		}
+	}
+	return t, true
+}
+
+// propagate tells the upstream how long it has, replacing whatever the client sent.
+func (tp timeoutPolicy) propagate(out *http.Request, grpc bool, left time.Duration) {
+	if left <= 0 {
+		return
+	}
+	if grpc {
+		out.Header.Set("Grpc-Timeout", formatGRPCTimeout(left))
+	} else if tp.header != "" {
+		out.Header.Set(tp.header, strconv.FormatInt(max(left.Milliseconds(), 1), 10))
+	}
+}
+
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour, 'M': time.Minute, 'S': time.Second,
+	'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond,
+}
+
+// parseGRPCTimeout parses a grpc-timeout value: up to 8 digits and a unit.
+func parseGRPCTimeout(v string) (time.Duration, bool) {
+	if len(v) < 2 || len(v) > 9 {
+		return 0, false
+	}
+	unit, ok := grpcTimeoutUnits[v[len(v)-1]]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// formatGRPCTimeout encodes d with the finest unit that fits in 8 digits.
+func formatGRPCTimeout(d time.Duration) string {
+	for _, u := range []struct {
+		unit byte
+		d    time.Duration
+	}{{'n', time.Nanosecond}, {'u', time.Microsecond}, {'m', time.Millisecond}, {'S', time.Second}, {'M', time.Minute}} {
+		if n := d / u.d; n < 1e8 {
+			return strconv.FormatInt(int64(max(n, 1)), 10) + string(u.unit)
+		}
+	}
+	return strconv.FormatInt(int64(min(d/time.Hour, 1e8-1)), 10) + "H"
+}
+
+// gatewayTimeout answers a request whose upstream did not respond in time: 504, or for
+// gRPC a trailers-only response with DEADLINE_EXCEEDED.
+func gatewayTimeout(w http.ResponseWriter, req *http.Request) {
+	if isGRPC(req) {
+		h := w.Header()
+		h.Set("Content-Type", "application/grpc")
+		h.Set("Grpc-Status", "4") // DEADLINE_EXCEEDED
+		h.Set("Grpc-Message", "upstream deadline exceeded")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	http.Error(w, "upstream timeout", http.StatusGatewayTimeout)
+}
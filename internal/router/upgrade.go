@@ -0,0 +1,206 @@
+package router
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kenelite/go-agw/internal/plugin"
+	"github.com/kenelite/go-agw/internal/upstream"
+)
+
+// upgradeType returns the requested protocol when req asks for an HTTP/1.1 Upgrade.
+func upgradeType(req *http.Request) string {
+	if req.ProtoMajor != 1 || !headerHasToken(req.Header, "Connection", "upgrade") {
+		return ""
+	}
+	return req.Header.Get("Upgrade")
+}
+
+func headerHasToken(h http.Header, key, token string) bool {
+	for _, v := range h.Values(key) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// proxyUpgrade dials the target, forwards the upgrade request and, on 101 Switching Protocols,
+// hijacks the client connection and pipes bytes both ways until either side closes.
+// It returns the upstream response when the upstream declined the upgrade, so the caller can
+// relay it like any other response; done reports that the request was fully handled.
+func (r *Router) proxyUpgrade(w http.ResponseWriter, prc *plugin.RequestContext, outReq *http.Request, proto string, ups *upstream.Upstream, target upstream.Target, sni string, idx int) (resp *http.Response, done bool) {
+	cfg := r.routes[idx].Upgrade
+	if cfg.Disabled {
+		http.Error(w, "upgrade not allowed", http.StatusForbidden)
+		return nil, true
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "upgrade not supported", http.StatusInternalServerError)
+		return nil, true
+	}
+	open := &r.tunnels[idx]
+	if n := open.Add(1); cfg.MaxConnections > 0 && n > int64(cfg.MaxConnections) {
+		open.Add(-1)
+		http.Error(w, "too many connections", http.StatusServiceUnavailable)
+		return nil, true
+	}
+	defer open.Add(-1)
+
+	upConn, err := ups.Dial(outReq.Context(), target, sni)
+	if err != nil {
+		r.metrics.IncFailures()
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return nil, true
+	}
+	// the handshake is bounded like any upstream attempt; once switched, the tunnel runs on
+	// its idle timeout instead. A refused upgrade keeps the deadline while its body is relayed.
+	handshake, _ := r.timeouts[idx].attempt(time.Time{}, ups.Client.Timeout, time.Now())
+	if handshake <= 0 {
+		handshake = defaultUpgradeHandshakeTimeout
+	}
+	_ = upConn.SetDeadline(time.Now().Add(handshake))
+	outReq.Header.Set("Connection", "Upgrade")
+	outReq.Header.Set("Upgrade", proto)
+	if err := outReq.Write(upConn); err != nil {
+		upConn.Close()
+		r.metrics.IncFailures()
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return nil, true
+	}
+	upReader := bufio.NewReader(upConn)
+	resp, err = http.ReadResponse(upReader, outReq)
+	if err != nil {
+		upConn.Close()
+		r.metrics.IncFailures()
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			gatewayTimeout(w, prc.Request)
+			return nil, true
+		}
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return nil, true
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body = readCloser{Reader: resp.Body, Closer: upConn}
+		return resp, false
+	}
+
+	_ = upConn.SetDeadline(time.Time{})
+
+	clientConn, clientBuf, err := hj.Hijack()
+	if err != nil {
+		upConn.Close()
+		r.logger.Errorw("hijack failed", "err", err)
+		return nil, true
+	}
+	defer clientConn.Close()
+	defer upConn.Close()
+
+	// relay the 101 response; only Connection/Upgrade survive among hop-by-hop headers
+	respHeader := cloneHeader(resp.Header)
+	removeHopByHopHeaders(respHeader)
+	respHeader.Set("Connection", "Upgrade")
+	respHeader.Set("Upgrade", resp.Header.Get("Upgrade"))
+	if _, err := fmt.Fprintf(clientBuf, "HTTP/1.1 101 %s\r\n", http.StatusText(http.StatusSwitchingProtocols)); err != nil {
+		return nil, true
+	}
+	_ = respHeader.Write(clientBuf)
+	_, _ = clientBuf.WriteString("\r\n")
+	if err := clientBuf.Flush(); err != nil {
+		return nil, true
+	}
+
+	r.metrics.TunnelOpened()
+	defer r.metrics.TunnelClosed()
+	pipeTunnel(clientConn, clientBuf.Reader, upConn, upReader, time.Duration(cfg.IdleTimeout)*time.Millisecond)
+
+	prc.Response = &plugin.Response{StatusCode: resp.StatusCode, Header: respHeader}
+	for _, p := range r.plugins.ChainFor(idx) {
+		p.AfterDispatch(prc)
+	}
+	return nil, true
+}
+
+const tunnelDrainTimeout = 5 * time.Second
+
+// defaultUpgradeHandshakeTimeout bounds the upgrade handshake when neither the route nor
+// the upstream sets a timeout.
+const defaultUpgradeHandshakeTimeout = 30 * time.Second
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// pipeTunnel copies in both directions, reading from the buffered readers so bytes already
+// read past the HTTP headers are not lost. An idle timeout closes both sides when no data
+// moved in either direction for that long.
+func pipeTunnel(client net.Conn, clientR io.Reader, up net.Conn, upR io.Reader, idle time.Duration) {
+	var last atomic.Int64
+	last.Store(time.Now().UnixNano())
+	touch := func() { last.Store(time.Now().UnixNano()) }
+
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			client.Close()
+			up.Close()
+		})
+	}
+	done := make(chan struct{}, 2)
+	go func() { _, _ = io.Copy(up, activityReader{clientR, touch}); closeWrite(up); done <- struct{}{} }()
+	go func() { _, _ = io.Copy(client, activityReader{upR, touch}); closeWrite(client); done <- struct{}{} }()
+
+	var tick <-chan time.Time
+	if idle > 0 {
+		t := time.NewTicker(idle / 4)
+		defer t.Stop()
+		tick = t.C
+	}
+	// once one side finished, give the other a moment to drain before tearing down
+	var drain <-chan time.Time
+	for remaining := 2; remaining > 0; {
+		select {
+		case <-done:
+			remaining--
+			drain = time.After(tunnelDrainTimeout)
+		case <-drain:
+			closeBoth()
+		case <-tick:
+			if time.Since(time.Unix(0, last.Load())) > idle {
+				closeBoth()
+			}
+		}
+	}
+	closeBoth()
+}
+
+type activityReader struct {
+	r     io.Reader
+	touch func()
+}
+
+func (a activityReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 {
+		a.touch()
+	}
+	return n, err
+}
+
+// closeWrite half-closes TCP connections so the peer sees EOF while the other direction drains.
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+}
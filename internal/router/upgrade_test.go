@@ -0,0 +1,138 @@
+package router
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kenelite/go-agw/internal/config"
+)
+
+// echoUpgradeBackend accepts any Upgrade and echoes bytes back.
+func echoUpgradeBackend(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("backend hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		_ = brw.Flush()
+		_, _ = io.Copy(conn, brw)
+	})
+}
+
+func dialUpgrade(t *testing.T, gwURL string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(gwURL, "http://"))
+	if err != nil {
+		t.Fatalf("dial gateway: %v", err)
+	}
+	_, _ = io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: agw\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read upgrade response: %v", err)
+	}
+	return conn, br, resp
+}
+
+func TestRouterUpgradeTunnel(t *testing.T) {
+	r := newTestRouter(t, echoUpgradeBackend(t))
+	r.routes[0].Upgrade.MaxConnections = 1
+	gw := httptest.NewServer(r)
+	defer gw.Close()
+
+	conn, br, resp := dialUpgrade(t, gw.URL)
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+	_, _ = io.WriteString(conn, "ping")
+	buf := make([]byte, 4)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo through tunnel: %q %v", buf, err)
+	}
+	if n := r.metrics.OpenTunnels(); n != 1 {
+		t.Fatalf("expected 1 open tunnel, got %d", n)
+	}
+
+	// route allows a single tunnel
+	conn2, _, resp2 := dialUpgrade(t, gw.URL)
+	conn2.Close()
+	if resp2.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 over max_connections, got %d", resp2.StatusCode)
+	}
+
+	conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for r.metrics.OpenTunnels() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := r.metrics.OpenTunnels(); n != 0 {
+		t.Fatalf("tunnel not closed, open=%d", n)
+	}
+}
+
+func TestRouterUpgradeIdleTimeout(t *testing.T) {
+	r := newTestRouter(t, echoUpgradeBackend(t))
+	r.routes[0].Upgrade.IdleTimeout = 100
+	gw := httptest.NewServer(r)
+	defer gw.Close()
+
+	conn, br, resp := dialUpgrade(t, gw.URL)
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("expected idle tunnel to be closed, got %v", err)
+	}
+}
+
+func TestRouterUpgradeHandshakeTimeout(t *testing.T) {
+	// an upstream that accepts the connection but never answers the upgrade
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	r := newTestRouter(t, echoUpgradeBackend(t))
+	r.routes[0].Upgrade.MaxConnections = 1
+	r.timeouts[0] = newTimeoutPolicy(config.TimeoutConfig{PerTry: 100})
+	ups, _ := r.upstream.Get("echo")
+	ups.Targets[0].URL.Host = ln.Addr().String()
+	gw := httptest.NewServer(r)
+	defer gw.Close()
+
+	start := time.Now()
+	conn, _, resp := dialUpgrade(t, gw.URL)
+	conn.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout || time.Since(start) > time.Second {
+		t.Fatalf("stalled handshake: %d after %v", resp.StatusCode, time.Since(start))
+	}
+	if n := r.tunnels[0].Load(); n != 0 {
+		t.Fatalf("connection slot not released: %d", n)
+	}
+}
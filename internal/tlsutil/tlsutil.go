@@ -0,0 +1,376 @@
+package tlsutil
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kenelite/go-agw/internal/config"
+)
+
+var (
+	ErrNoClientCert      = errors.New("client certificate required")
+	ErrClientCertRevoked = errors.New("client certificate revoked")
+	ErrSPIFFEIDDenied    = errors.New("client SPIFFE ID not allowed")
+)
+
+// Forward policies for the X-Forwarded-Client-Cert header.
+const (
+	ForwardSanitize = "sanitize"
+	ForwardSet      = "set"
+	ForwardAppend   = "append"
+)
+
+// XFCCHeader carries client certificate details to upstreams.
+const XFCCHeader = "X-Forwarded-Client-Cert"
+
+// LoadCertPool reads PEM-encoded certificates from files into a pool.
+func LoadCertPool(files []string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("read ca file: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", f)
+		}
+	}
+	return pool, nil
+}
+
+// LoadCRLs reads PEM or DER encoded certificate revocation lists.
+func LoadCRLs(files []string) ([]*x509.RevocationList, error) {
+	var out []*x509.RevocationList
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("read crl file: %w", err)
+		}
+		ders := [][]byte{}
+		for rest := data; ; {
+			var blk *pem.Block
+			blk, rest = pem.Decode(rest)
+			if blk == nil {
+				break
+			}
+			if blk.Type == "X509 CRL" {
+				ders = append(ders, blk.Bytes)
+			}
+		}
+		if len(ders) == 0 {
+			ders = append(ders, data)
+		}
+		for _, der := range ders {
+			crl, err := x509.ParseRevocationList(der)
+			if err != nil {
+				return nil, fmt.Errorf("parse crl %s: %w", f, err)
+			}
+			out = append(out, crl)
+		}
+	}
+	return out, nil
+}
+
+// Identity describes a verified client certificate.
+type Identity struct {
+	Subject     string   `json:"subject"`
+	DNSNames    []string `json:"dns_names,omitempty"`
+	URIs        []string `json:"uris,omitempty"`
+	Emails      []string `json:"emails,omitempty"`
+	IPs         []string `json:"ips,omitempty"`
+	SPIFFEID    string   `json:"spiffe_id,omitempty"`
+	Fingerprint string   `json:"fingerprint"` // hex SHA-256 of the DER certificate
+}
+
+func IdentityFromCert(c *x509.Certificate) *Identity {
+	sum := sha256.Sum256(c.Raw)
+	id := &Identity{
+		Subject:     c.Subject.String(),
+		DNSNames:    append([]string(nil), c.DNSNames...),
+		Emails:      append([]string(nil), c.EmailAddresses...),
+		Fingerprint: hex.EncodeToString(sum[:]),
+	}
+	for _, u := range c.URIs {
+		id.URIs = append(id.URIs, u.String())
+		if u.Scheme == "spiffe" && id.SPIFFEID == "" {
+			id.SPIFFEID = u.String()
+		}
+	}
+	for _, ip := range c.IPAddresses {
+		id.IPs = append(id.IPs, ip.String())
+	}
+	return id
+}
+
+// XFCC renders the identity as an X-Forwarded-Client-Cert element (Envoy format).
+func (id *Identity) XFCC() string {
+	parts := []string{"Hash=" + id.Fingerprint, "Subject=" + quoteXFCC(id.Subject, true)}
+	for _, u := range id.URIs {
+		parts = append(parts, "URI="+quoteXFCC(u, false))
+	}
+	for _, d := range id.DNSNames {
+		parts = append(parts, "DNS="+quoteXFCC(d, false))
+	}
+	return strings.Join(parts, ";")
+}
+
+func quoteXFCC(v string, always bool) string {
+	if !always && !strings.ContainsAny(v, ",;=\"") {
+		return v
+	}
+	return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+}
+
+// ClientAuth verifies client certificates against configured CAs, CRLs and SPIFFE rules.
+type ClientAuth struct {
+	mode    string
+	roots   *x509.CertPool
+	crls    []*x509.RevocationList
+	allowed []string
+	forward string
+}
+
+// NewClientAuth returns nil when the config does not enable client authentication.
+func NewClientAuth(cfg config.ClientAuthConfig) (*ClientAuth, error) {
+	mode := strings.ToLower(cfg.Mode)
+	switch mode {
+	case "", "none":
+		if cfg.ForwardClientCert == "" {
+			return nil, nil
+		}
+		mode = "none"
+	case "optional", "require":
+	default:
+		return nil, fmt.Errorf("unknown client_auth mode %q", cfg.Mode)
+	}
+	a := &ClientAuth{mode: mode, allowed: cfg.AllowedSPIFFEIDs, forward: strings.ToLower(cfg.ForwardClientCert)}
+	switch a.forward {
+	case "":
+		a.forward = ForwardSanitize
+	case ForwardSanitize, ForwardSet, ForwardAppend:
+	default:
+		return nil, fmt.Errorf("unknown forward_client_cert policy %q", cfg.ForwardClientCert)
+	}
+	if len(cfg.CAFiles) > 0 {
+		pool, err := LoadCertPool(cfg.CAFiles)
+		if err != nil {
+			return nil, err
+		}
+		a.roots = pool
+	}
+	crls, err := LoadCRLs(cfg.CRLFiles)
+	if err != nil {
+		return nil, err
+	}
+	a.crls = crls
+	return a, nil
+}
+
+// Enabled reports whether client certificates are checked at all.
+func (a *ClientAuth) Enabled() bool { return a != nil && a.mode != "none" }
+
+func (a *ClientAuth) Required() bool { return a != nil && a.mode == "require" }
+
+// ForwardPolicy returns the X-Forwarded-Client-Cert policy.
+func (a *ClientAuth) ForwardPolicy() string {
+	if a == nil {
+		return ForwardSanitize
+	}
+	return a.forward
+}
+
+// Verify checks the peer certificates of a connection and returns the client identity.
+// It returns (nil, nil) when no certificate was presented and one is not required.
+// When no CA bundle is configured, the chains verified during the handshake are used.
+func (a *ClientAuth) Verify(state *tls.ConnectionState) (*Identity, error) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		if a.Required() {
+			return nil, ErrNoClientCert
+		}
+		return nil, nil
+	}
+	leaf := state.PeerCertificates[0]
+	chains := state.VerifiedChains
+	if a.roots != nil {
+		inter := x509.NewCertPool()
+		for _, c := range state.PeerCertificates[1:] {
+			inter.AddCert(c)
+		}
+		var err error
+		chains, err = leaf.Verify(x509.VerifyOptions{
+			Roots:         a.roots,
+			Intermediates: inter,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("verify client certificate: %w", err)
+		}
+	}
+	if len(chains) == 0 {
+		return nil, errors.New("client certificate not verified")
+	}
+	return a.check(leaf, chains)
+}
+
+// VerifyPeerCertificate is suitable for tls.Config.VerifyPeerCertificate; it adds
+// CRL and SPIFFE checks on top of the chain verification done by crypto/tls.
+func (a *ClientAuth) VerifyPeerCertificate(_ [][]byte, chains [][]*x509.Certificate) error {
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return nil
+	}
+	_, err := a.check(chains[0][0], chains)
+	return err
+}
+
+func (a *ClientAuth) check(leaf *x509.Certificate, chains [][]*x509.Certificate) (*Identity, error) {
+	if err := a.checkRevocation(chains); err != nil {
+		return nil, err
+	}
+	id := IdentityFromCert(leaf)
+	if len(a.allowed) > 0 && !MatchSPIFFEID(a.allowed, id.SPIFFEID) {
+		return nil, ErrSPIFFEIDDenied
+	}
+	return id, nil
+}
+
+func (a *ClientAuth) checkRevocation(chains [][]*x509.Certificate) error {
+	if len(a.crls) == 0 {
+		return nil
+	}
+	for _, chain := range chains {
+		for i := 0; i+1 < len(chain); i++ {
+			cert, issuer := chain[i], chain[i+1]
+			for _, crl := range a.crls {
+				if crl.CheckSignatureFrom(issuer) != nil {
+					continue
+				}
+				for _, e := range crl.RevokedCertificateEntries {
+					if e.SerialNumber != nil && e.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+						return ErrClientCertRevoked
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// MatchSPIFFEID reports whether id matches any pattern; a trailing "*" matches a prefix.
+func MatchSPIFFEID(patterns []string, id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "*") {
+			if strings.HasPrefix(id, strings.TrimSuffix(p, "*")) {
+				return true
+			}
+			continue
+		}
+		if p == id {
+			return true
+		}
+	}
+	return false
+}
+
+// ServerConfig builds the data-plane tls.Config. When requestClientCert is set and the
+// listener itself does not verify client certificates, certificates are still requested
+// so that routes can verify them.
+func ServerConfig(cfg config.TLSConfig, requestClientCert bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load server certificate: %w", err)
+	}
+	tc := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	ca, err := NewClientAuth(cfg.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case ca.Enabled() && ca.roots != nil:
+		tc.ClientCAs = ca.roots
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+		if ca.Required() {
+			tc.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		tc.VerifyPeerCertificate = ca.VerifyPeerCertificate
+	case ca.Enabled():
+		return nil, errors.New("server.tls.client_auth requires ca_files")
+	case requestClientCert:
+		tc.ClientAuth = tls.RequestClientCert
+	}
+	return tc, nil
+}
+
+// ErrPinMismatch is returned when no upstream certificate matches a configured pin.
+var ErrPinMismatch = errors.New("upstream certificate does not match pinned keys")
+
+// ClientConfig builds the tls.Config used to connect to an upstream. It returns nil
+// when nothing is configured so the transport keeps its defaults.
+func ClientConfig(cfg config.UpstreamTLSConfig) (*tls.Config, error) {
+	if cfg.CAFile == "" && cfg.CertFile == "" && cfg.KeyFile == "" && cfg.ServerName == "" &&
+		!cfg.InsecureSkipVerify && cfg.MinVersion == "" && len(cfg.PinnedSHA256) == 0 {
+		return nil, nil
+	}
+	tc := &tls.Config{ServerName: cfg.ServerName, InsecureSkipVerify: cfg.InsecureSkipVerify}
+	v, err := ParseVersion(cfg.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	tc.MinVersion = v
+	if cfg.CAFile != "" {
+		pool, err := LoadCertPool([]string{cfg.CAFile})
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = pool
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	if len(cfg.PinnedSHA256) > 0 {
+		pins := map[string]struct{}{}
+		for _, p := range cfg.PinnedSHA256 {
+			pins[strings.TrimPrefix(p, "sha256//")] = struct{}{}
+		}
+		// runs after normal chain verification (or instead of it with insecure_skip_verify)
+		tc.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, c := range cs.PeerCertificates {
+				sum := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+				if _, ok := pins[base64.StdEncoding.EncodeToString(sum[:])]; ok {
+					return nil
+				}
+			}
+			return ErrPinMismatch
+		}
+	}
+	return tc, nil
+}
+
+// ParseVersion maps "1.0".."1.3" to a TLS version constant; empty means TLS 1.2.
+func ParseVersion(s string) (uint16, error) {
+	switch s {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown tls version %q", s)
+}
@@ -0,0 +1,148 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kenelite/go-agw/internal/config"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create ca: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) issue(t *testing.T, serial int64, spiffe string) *x509.Certificate {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "client", Organization: []string{"acme"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"client.local"},
+	}
+	if spiffe != "" {
+		u, _ := url.Parse(spiffe)
+		tmpl.URIs = []*url.URL{u}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("issue cert: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func writePEM(t *testing.T, typ string, der []byte) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), strings.ReplaceAll(strings.ToLower(typ), " ", "_")+".pem")
+	if err := os.WriteFile(p, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o644); err != nil {
+		t.Fatalf("write pem: %v", err)
+	}
+	return p
+}
+
+func TestClientAuthVerify(t *testing.T) {
+	ca := newTestCA(t)
+	caFile := writePEM(t, "CERTIFICATE", ca.cert.Raw)
+	a, err := NewClientAuth(config.ClientAuthConfig{
+		Mode:             "require",
+		CAFiles:          []string{caFile},
+		AllowedSPIFFEIDs: []string{"spiffe://example.org/ns/prod/*"},
+	})
+	if err != nil {
+		t.Fatalf("new client auth: %v", err)
+	}
+
+	if _, err := a.Verify(&tls.ConnectionState{}); !errors.Is(err, ErrNoClientCert) {
+		t.Fatalf("expected ErrNoClientCert, got %v", err)
+	}
+
+	good := ca.issue(t, 10, "spiffe://example.org/ns/prod/sa/web")
+	id, err := a.Verify(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{good}})
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if id.SPIFFEID != "spiffe://example.org/ns/prod/sa/web" || len(id.Fingerprint) != 64 {
+		t.Fatalf("unexpected identity: %+v", id)
+	}
+	if xfcc := id.XFCC(); !strings.Contains(xfcc, "URI=spiffe://example.org/ns/prod/sa/web") || !strings.HasPrefix(xfcc, "Hash=") {
+		t.Fatalf("unexpected xfcc: %s", xfcc)
+	}
+
+	denied := ca.issue(t, 11, "spiffe://example.org/ns/dev/sa/web")
+	if _, err := a.Verify(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{denied}}); !errors.Is(err, ErrSPIFFEIDDenied) {
+		t.Fatalf("expected ErrSPIFFEIDDenied, got %v", err)
+	}
+
+	other := newTestCA(t).issue(t, 12, "spiffe://example.org/ns/prod/sa/web")
+	if _, err := a.Verify(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{other}}); err == nil {
+		t.Fatal("expected certificate from unknown CA to be rejected")
+	}
+}
+
+func TestClientAuthCRL(t *testing.T) {
+	ca := newTestCA(t)
+	revoked := ca.issue(t, 20, "")
+	crlDER, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                time.Now().Add(-time.Minute),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{{SerialNumber: revoked.SerialNumber, RevocationTime: time.Now()}},
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatalf("create crl: %v", err)
+	}
+	a, err := NewClientAuth(config.ClientAuthConfig{
+		Mode:     "optional",
+		CAFiles:  []string{writePEM(t, "CERTIFICATE", ca.cert.Raw)},
+		CRLFiles: []string{writePEM(t, "X509 CRL", crlDER)},
+	})
+	if err != nil {
+		t.Fatalf("new client auth: %v", err)
+	}
+	if _, err := a.Verify(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{revoked}}); !errors.Is(err, ErrClientCertRevoked) {
+		t.Fatalf("expected ErrClientCertRevoked, got %v", err)
+	}
+	if _, err := a.Verify(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{ca.issue(t, 21, "")}}); err != nil {
+		t.Fatalf("unrevoked certificate rejected: %v", err)
+	}
+	if id, err := a.Verify(&tls.ConnectionState{}); id != nil || err != nil {
+		t.Fatalf("optional mode without certificate: id=%v err=%v", id, err)
+	}
+}
@@ -0,0 +1,132 @@
+package upstream
+
+import (
+    "context"
+    "crypto/tls"
+    "fmt"
+    "net"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+)
+
+// Host rewrite policies.
+const (
+    HostPreserve = "preserve"
+    HostTarget   = "target"
+    HostFixed    = "fixed"
+    HostTemplate = "template"
+)
+
+// maxSNIClients bounds the per-upstream clients kept for distinct SNI values; the
+// preserve policy takes its SNI from the client's Host header.
+const maxSNIClients = 64
+
+// HostRewrite decides the Host header and TLS SNI sent to an upstream.
+type HostRewrite struct {
+    policy string
+    value  string
+}
+
+// NewHostRewrite returns nil when no policy is configured.
+func NewHostRewrite(policy, value string) (*HostRewrite, error) {
+    switch strings.ToLower(policy) {
+    case "":
+        return nil, nil
+    case HostPreserve, HostTarget:
+    case HostFixed, HostTemplate:
+        if value == "" { return nil, fmt.Errorf("host_rewrite %s requires a value", policy) }
+    default:
+        return nil, fmt.Errorf("unknown host_rewrite policy %q", policy)
+    }
+    return &HostRewrite{policy: strings.ToLower(policy), value: value}, nil
+}
+
+// Resolve returns the Host header for the upstream request and the SNI to use.
+// An empty SNI means the default (the target host, or tls.server_name).
+func (h *HostRewrite) Resolve(req *http.Request, target *url.URL, upstreamName string) (host, sni string) {
+    if h == nil { return req.Host, "" }
+    switch h.policy {
+    case HostTarget:
+        return target.Host, ""
+    case HostFixed:
+        host = h.value
+    case HostTemplate:
+        host = strings.NewReplacer(
+            "${host}", req.Host,
+            "${hostname}", hostname(req.Host),
+            "${target_host}", target.Host,
+            "${upstream}", upstreamName,
+        ).Replace(h.value)
+    default:
+        host = req.Host
+    }
+    return host, hostname(host)
+}
+
+func hostname(hostport string) string {
+    if h, _, err := net.SplitHostPort(hostport); err == nil { return h }
+    return hostport
+}
+
+// ClientFor returns a client whose TLS handshakes send the given SNI. Clients are cached
+// per name and share the upstream's pool statistics; an explicit tls.server_name always wins.
+func (u *Upstream) ClientFor(sni string) *http.Client {
+    if sni == "" || u.tlsCfg != nil && u.tlsCfg.ServerName != "" { return u.Client }
+    u.sniMu.Lock()
+    defer u.sniMu.Unlock()
+    if c, ok := u.sniClients[sni]; ok { return c }
+    if len(u.sniClients) >= maxSNIClients { return u.Client }
+    tc := &tls.Config{}
+    if u.tlsCfg != nil { tc = u.tlsCfg.Clone() }
+    tc.ServerName = sni
+    tr, err := newTransport(u.cfg.Transport, tc, u.Stats)
+    if err != nil { return u.Client }
+    c := &http.Client{Timeout: u.Client.Timeout, Transport: tr}
+    if u.sniClients == nil { u.sniClients = map[string]*http.Client{} }
+    u.sniClients[sni] = c
+    return c
+}
+
+func (u *Upstream) closeIdleConnections() {
+    u.Client.CloseIdleConnections()
+    u.sniMu.Lock()
+    defer u.sniMu.Unlock()
+    for _, c := range u.sniClients { c.CloseIdleConnections() }
+}
+
+// Dial opens a raw connection to target for protocols that leave HTTP behind (e.g. WebSocket).
+// https and wss targets are dialed with the upstream's TLS settings.
+func (u *Upstream) Dial(ctx context.Context, target Target, sni string) (net.Conn, error) {
+    addr := target.URL.Host
+    secure := target.URL.Scheme == "https" || target.URL.Scheme == "wss"
+    if target.URL.Port() == "" {
+        port := "80"
+        if secure { port = "443" }
+        addr = net.JoinHostPort(target.URL.Hostname(), port)
+    }
+    d := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+    if u.cfg.Transport.ConnectTimeout > 0 { d.Timeout = ms(u.cfg.Transport.ConnectTimeout) }
+    u.Stats.dials.Add(1)
+    conn, err := d.DialContext(ctx, "tcp", addr)
+    if err != nil {
+        u.Stats.dialFailures.Add(1)
+        return nil, err
+    }
+    if !secure { return conn, nil }
+    tc := &tls.Config{}
+    if u.tlsCfg != nil { tc = u.tlsCfg.Clone() }
+    if tc.ServerName == "" {
+        tc.ServerName = sni
+        if sni == "" { tc.ServerName = target.URL.Hostname() }
+    }
+    // upgrades are HTTP/1.1 only
+    tc.NextProtos = []string{"http/1.1"}
+    tconn := tls.Client(conn, tc)
+    if err := tconn.HandshakeContext(ctx); err != nil {
+        conn.Close()
+        return nil, err
+    }
+    return tconn, nil
+}
@@ -1,14 +1,19 @@
 package upstream
 
 import (
+    "crypto/tls"
     "errors"
+    "fmt"
+    "io"
     "net/http"
     "net/url"
+    "sort"
     "sync"
     "time"
 
     "github.com/kenelite/go-agw/internal/config"
     "github.com/kenelite/go-agw/internal/observability"
+    "github.com/kenelite/go-agw/internal/tlsutil"
 )
 
 type Target struct {
@@ -16,32 +21,83 @@ type Target struct {
 }
 
 type Upstream struct {
-    Name    string
-    Targets []Target
-    Client  *http.Client
+    Name        string
+    Targets     []Target
+    Client      *http.Client
+    Stats       *PoolStats
+    HostRewrite *HostRewrite
+
+    cfg        config.UpstreamConfig
+    tlsCfg     *tls.Config
+    sniMu      sync.Mutex
+    sniClients map[string]*http.Client
 }
 
 type Manager struct {
     mu        sync.RWMutex
     upstreams map[string]*Upstream
+    // pool stats survive reloads so counters stay monotonic
+    stats     map[string]*PoolStats
     logger    *observability.Logger
 }
 
 func NewManager(cfgs []config.UpstreamConfig, logger *observability.Logger) (*Manager, error) {
-    m := &Manager{upstreams: make(map[string]*Upstream), logger: logger}
+    m := &Manager{logger: logger, stats: map[string]*PoolStats{}}
+    ups, err := m.buildUpstreams(cfgs)
+    if err != nil { return nil, err }
+    m.upstreams = ups
+    return m, nil
+}
+
+// Reload rebuilds all upstreams (including TLS material read from disk) and swaps them in atomically.
+// In-flight requests keep using the previous clients; their idle connections are closed.
+func (m *Manager) Reload(cfgs []config.UpstreamConfig) error {
+    ups, err := m.buildUpstreams(cfgs)
+    if err != nil { return err }
+    m.mu.Lock()
+    old := m.upstreams
+    m.upstreams = ups
+    m.mu.Unlock()
+    for _, u := range old { u.closeIdleConnections() }
+    if m.logger != nil { m.logger.Infow("upstreams reloaded", "count", len(ups)) }
+    return nil
+}
+
+func (m *Manager) buildUpstreams(cfgs []config.UpstreamConfig) (map[string]*Upstream, error) {
+    out := make(map[string]*Upstream, len(cfgs))
+    m.mu.Lock()
+    defer m.mu.Unlock()
     for _, uc := range cfgs {
-        if uc.Name == "" || len(uc.Targets) == 0 {
-            return nil, errors.New("upstream name and targets required")
+        st, ok := m.stats[uc.Name]
+        if !ok {
+            st = &PoolStats{}
+            m.stats[uc.Name] = st
         }
-        ups := &Upstream{Name: uc.Name, Client: &http.Client{Timeout: time.Duration(uc.Timeout) * time.Millisecond}}
-        for _, t := range uc.Targets {
-            u, err := url.Parse(t)
-            if err != nil { return nil, err }
-            ups.Targets = append(ups.Targets, Target{URL: u})
-        }
-        m.upstreams[uc.Name] = ups
+        ups, err := newUpstream(uc, st)
+        if err != nil { return nil, err }
+        out[uc.Name] = ups
     }
-    return m, nil
+    return out, nil
+}
+
+func newUpstream(uc config.UpstreamConfig, stats *PoolStats) (*Upstream, error) {
+    if uc.Name == "" || len(uc.Targets) == 0 {
+        return nil, errors.New("upstream name and targets required")
+    }
+    tc, err := tlsutil.ClientConfig(uc.TLS)
+    if err != nil { return nil, fmt.Errorf("upstream %s tls: %w", uc.Name, err) }
+    tr, err := newTransport(uc.Transport, tc, stats)
+    if err != nil { return nil, fmt.Errorf("upstream %s transport: %w", uc.Name, err) }
+    hr, err := NewHostRewrite(uc.HostRewrite.Policy, uc.HostRewrite.Value)
+    if err != nil { return nil, fmt.Errorf("upstream %s: %w", uc.Name, err) }
+    ups := &Upstream{Name: uc.Name, Stats: stats, HostRewrite: hr, cfg: uc, tlsCfg: tc,
+        Client: &http.Client{Timeout: time.Duration(uc.Timeout) * time.Millisecond, Transport: tr}}
+    for _, t := range uc.Targets {
+        u, err := url.Parse(t)
+        if err != nil { return nil, err }
+        ups.Targets = append(ups.Targets, Target{URL: u})
+    }
+    return ups, nil
 }
 
 func (m *Manager) Get(name string) (*Upstream, bool) {
@@ -50,3 +106,28 @@ func (m *Manager) Get(name string) (*Upstream, bool) {
     return u, ok
 }
 
+// WriteMetrics appends per-upstream pool statistics in Prometheus text format.
+func (m *Manager) WriteMetrics(w io.Writer) {
+    m.mu.RLock()
+    names := make([]string, 0, len(m.upstreams))
+    for name := range m.upstreams { names = append(names, name) }
+    m.mu.RUnlock()
+    sort.Strings(names)
+    series := []struct {
+        name, typ, help string
+        val             func(*PoolStats) int64
+    }{
+        {"go_agw_upstream_connections_active", "gauge", "Upstream connections serving a request", (*PoolStats).Active},
+        {"go_agw_upstream_connections_idle", "gauge", "Idle pooled upstream connections", (*PoolStats).Idle},
+        {"go_agw_upstream_dials_total", "counter", "Upstream connection attempts", (*PoolStats).Dials},
+        {"go_agw_upstream_dial_failures_total", "counter", "Failed upstream connection attempts", (*PoolStats).DialFailures},
+    }
+    for _, s := range series {
+        fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", s.name, s.help, s.name, s.typ)
+        for _, name := range names {
+            u, ok := m.Get(name)
+            if !ok { continue }
+            fmt.Fprintf(w, "%s{upstream=%q} %d\n", s.name, name, s.val(u.Stats))
+        }
+    }
+}
@@ -1,6 +1,16 @@
 package upstream
 
 import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/pem"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
     "testing"
 
     "github.com/kenelite/go-agw/internal/config"
@@ -20,3 +30,70 @@ func TestManagerBasic(t *testing.T) {
     }
 }
 
+
+func TestManagerUpstreamTLS(t *testing.T) {
+    srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { _, _ = w.Write([]byte("ok")) }))
+    defer srv.Close()
+    caFile := filepath.Join(t.TempDir(), "ca.pem")
+    if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o644); err != nil {
+        t.Fatalf("write ca: %v", err)
+    }
+    get := func(m *Manager) error {
+        u, _ := m.Get("u")
+        resp, err := u.Client.Get(srv.URL)
+        if err != nil { return err }
+        resp.Body.Close()
+        return nil
+    }
+
+    m, err := NewManager([]config.UpstreamConfig{{Name: "u", Targets: []string{srv.URL}, Timeout: 1000}}, nil)
+    if err != nil { t.Fatalf("unexpected error: %v", err) }
+    if get(m) == nil { t.Fatal("expected untrusted upstream certificate to fail") }
+
+    // trust the private CA via hot reload; example.com is one of the test certificate SANs
+    tlsCfg := config.UpstreamTLSConfig{CAFile: caFile, ServerName: "example.com", MinVersion: "1.2"}
+    if err := m.Reload([]config.UpstreamConfig{{Name: "u", Targets: []string{srv.URL}, Timeout: 1000, TLS: tlsCfg}}); err != nil {
+        t.Fatalf("reload: %v", err)
+    }
+    if err := get(m); err != nil { t.Fatalf("expected trusted upstream, got %v", err) }
+
+    sum := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+    tlsCfg.PinnedSHA256 = []string{base64.StdEncoding.EncodeToString(sum[:])}
+    _ = m.Reload([]config.UpstreamConfig{{Name: "u", Targets: []string{srv.URL}, TLS: tlsCfg}})
+    if err := get(m); err != nil { t.Fatalf("expected pinned key to match, got %v", err) }
+
+    tlsCfg.PinnedSHA256 = []string{base64.StdEncoding.EncodeToString(make([]byte, 32))}
+    _ = m.Reload([]config.UpstreamConfig{{Name: "u", Targets: []string{srv.URL}, TLS: tlsCfg}})
+    if get(m) == nil { t.Fatal("expected pin mismatch to fail") }
+}
+
+func TestManagerPoolStats(t *testing.T) {
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { _, _ = w.Write([]byte("ok")) }))
+    defer srv.Close()
+    tc := config.TransportConfig{ConnectTimeout: 500, MaxIdleConnsPerHost: 4, MaxConnsPerHost: 8, IdleConnTimeout: 1000, HTTP2ReadIdleTimeout: 1000, HTTP2PingTimeout: 500}
+    m, err := NewManager([]config.UpstreamConfig{
+        {Name: "u", Targets: []string{srv.URL}, Timeout: 1000, Transport: tc},
+        {Name: "down", Targets: []string{"http://127.0.0.1:1"}, Timeout: 1000, Transport: tc},
+    }, nil)
+    if err != nil { t.Fatalf("unexpected error: %v", err) }
+
+    u, _ := m.Get("u")
+    for i := 0; i < 3; i++ {
+        resp, err := u.Client.Get(srv.URL)
+        if err != nil { t.Fatalf("request: %v", err) }
+        _, _ = io.Copy(io.Discard, resp.Body)
+        resp.Body.Close()
+    }
+    if u.Stats.Dials() != 1 || u.Stats.Active() != 0 || u.Stats.Idle() != 1 {
+        t.Fatalf("unexpected pool stats: dials=%d active=%d idle=%d", u.Stats.Dials(), u.Stats.Active(), u.Stats.Idle())
+    }
+    d, _ := m.Get("down")
+    if _, err := d.Client.Get("http://127.0.0.1:1"); err == nil { t.Fatal("expected dial failure") }
+    if d.Stats.DialFailures() != 1 { t.Fatalf("expected one dial failure, got %d", d.Stats.DialFailures()) }
+
+    var buf bytes.Buffer
+    m.WriteMetrics(&buf)
+    for _, want := range []string{`go_agw_upstream_connections_idle{upstream="u"} 1`, `go_agw_upstream_dial_failures_total{upstream="down"} 1`} {
+        if !strings.Contains(buf.String(), want) { t.Fatalf("metrics missing %q:\n%s", want, buf.String()) }
+    }
+}
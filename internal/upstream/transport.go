@@ -0,0 +1,124 @@
+package upstream
+
+import (
+    "context"
+    "crypto/tls"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "golang.org/x/net/http2"
+
+    "github.com/kenelite/go-agw/internal/config"
+)
+
+// PoolStats tracks connection pool usage for one upstream. Active counts in-flight
+// requests (one connection each over HTTP/1.1); idle is derived from open minus active.
+type PoolStats struct {
+    open         atomic.Int64
+    active       atomic.Int64
+    dials        atomic.Int64
+    dialFailures atomic.Int64
+}
+
+func (s *PoolStats) Open() int64         { return s.open.Load() }
+func (s *PoolStats) Active() int64       { return s.active.Load() }
+func (s *PoolStats) Dials() int64        { return s.dials.Load() }
+func (s *PoolStats) DialFailures() int64 { return s.dialFailures.Load() }
+
+func (s *PoolStats) Idle() int64 {
+    if v := s.open.Load() - s.active.Load(); v > 0 { return v }
+    return 0
+}
+
+func ms(v int) time.Duration { return time.Duration(v) * time.Millisecond }
+
+// newTransport builds the http.Transport for an upstream, mirroring http.DefaultTransport
+// for anything left unset in the config.
+func newTransport(tc config.TransportConfig, tlsCfg *tls.Config, stats *PoolStats) (http.RoundTripper, error) {
+    dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+    if tc.ConnectTimeout > 0 { dialer.Timeout = ms(tc.ConnectTimeout) }
+    if tc.KeepAlive != 0 { dialer.KeepAlive = ms(tc.KeepAlive) }
+    tr := &http.Transport{
+        Proxy:                 http.ProxyFromEnvironment,
+        DialContext:           countingDialer(dialer, stats),
+        ForceAttemptHTTP2:     true,
+        MaxIdleConns:          100,
+        IdleConnTimeout:       90 * time.Second,
+        TLSHandshakeTimeout:   10 * time.Second,
+        ExpectContinueTimeout: 1 * time.Second,
+        TLSClientConfig:       tlsCfg,
+        DisableKeepAlives:     tc.DisableKeepAlives,
+        MaxConnsPerHost:       tc.MaxConnsPerHost,
+        MaxIdleConnsPerHost:   tc.MaxIdleConnsPerHost,
+        ResponseHeaderTimeout: ms(tc.ResponseHeaderTimeout),
+    }
+    if tc.TLSHandshakeTimeout > 0 { tr.TLSHandshakeTimeout = ms(tc.TLSHandshakeTimeout) }
+    if tc.IdleConnTimeout > 0 { tr.IdleConnTimeout = ms(tc.IdleConnTimeout) }
+    if tc.MaxIdleConns > 0 { tr.MaxIdleConns = tc.MaxIdleConns }
+    if tc.HTTP2ReadIdleTimeout > 0 {
+        h2, err := http2.ConfigureTransports(tr)
+        if err != nil { return nil, fmt.Errorf("configure http2: %w", err) }
+        h2.ReadIdleTimeout = ms(tc.HTTP2ReadIdleTimeout)
+        h2.PingTimeout = ms(tc.HTTP2PingTimeout)
+    }
+    return &statsRoundTripper{base: tr, stats: stats}, nil
+}
+
+func countingDialer(d *net.Dialer, stats *PoolStats) func(ctx context.Context, network, addr string) (net.Conn, error) {
+    return func(ctx context.Context, network, addr string) (net.Conn, error) {
+        stats.dials.Add(1)
+        c, err := d.DialContext(ctx, network, addr)
+        if err != nil {
+            stats.dialFailures.Add(1)
+            return nil, err
+        }
+        stats.open.Add(1)
+        return &countedConn{Conn: c, stats: stats}, nil
+    }
+}
+
+type countedConn struct {
+    net.Conn
+    stats *PoolStats
+    once  sync.Once
+}
+
+func (c *countedConn) Close() error {
+    c.once.Do(func() { c.stats.open.Add(-1) })
+    return c.Conn.Close()
+}
+
+// statsRoundTripper counts a request as active until its response body is closed.
+type statsRoundTripper struct {
+    base  *http.Transport
+    stats *PoolStats
+}
+
+func (t *statsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+    t.stats.active.Add(1)
+    resp, err := t.base.RoundTrip(req)
+    if err != nil {
+        t.stats.active.Add(-1)
+        return nil, err
+    }
+    resp.Body = &activeBody{ReadCloser: resp.Body, stats: t.stats}
+    return resp, nil
+}
+
+func (t *statsRoundTripper) CloseIdleConnections() { t.base.CloseIdleConnections() }
+
+type activeBody struct {
+    io.ReadCloser
+    stats *PoolStats
+    once  sync.Once
+}
+
+func (b *activeBody) Close() error {
+    b.once.Do(func() { b.stats.active.Add(-1) })
+    return b.ReadCloser.Close()
+}